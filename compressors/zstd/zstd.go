@@ -0,0 +1,110 @@
+package zstd
+
+import (
+	"io"
+
+	"github.com/itchio/wharf/pwr"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// FrameSize is the maximum amount of uncompressed data stored in a single
+// zstd frame. Frames are independent from each other, which is what lets
+// the decompressor resume from a checkpoint without starting over.
+const FrameSize = 1024 * 1024 // 1MiB
+
+type zstdCompressor struct{}
+
+func (zc *zstdCompressor) Apply(writer io.Writer, quality int32) (io.Writer, error) {
+	encoder, err := zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(int(quality))),
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithZeroFrames(true),
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	fw := &frameWriter{
+		writer:  writer,
+		encoder: encoder,
+		buf:     make([]byte, 0, FrameSize),
+	}
+	return fw, nil
+}
+
+// frameWriter buffers up to FrameSize bytes, then writes them
+// out as a single, self-contained zstd frame.
+type frameWriter struct {
+	writer  io.Writer
+	encoder *zstd.Encoder
+
+	buf        []byte
+	frame      []byte
+	wroteFrame bool
+	closed     bool
+}
+
+var _ io.WriteCloser = (*frameWriter)(nil)
+
+func (fw *frameWriter) Write(p []byte) (int, error) {
+	if fw.closed {
+		return 0, errors.New("zstd: write to closed writer")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := FrameSize - len(fw.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		fw.buf = append(fw.buf, p[:n]...)
+		p = p[n:]
+		written += n
+
+		if len(fw.buf) == FrameSize {
+			err := fw.flushFrame()
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+func (fw *frameWriter) flushFrame() error {
+	fw.frame = fw.encoder.EncodeAll(fw.buf, fw.frame[:0])
+	fw.buf = fw.buf[:0]
+	fw.wroteFrame = true
+
+	_, err := fw.writer.Write(fw.frame)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// Close writes out any buffered data as a last frame. It does not
+// close the underlying writer.
+func (fw *frameWriter) Close() error {
+	if fw.closed {
+		return nil
+	}
+	fw.closed = true
+
+	// always emit at least one frame, so that empty streams
+	// are still valid zstd streams
+	if len(fw.buf) > 0 || !fw.wroteFrame {
+		err := fw.flushFrame()
+		if err != nil {
+			return err
+		}
+	}
+
+	return fw.encoder.Close()
+}
+
+func init() {
+	pwr.RegisterCompressor(pwr.CompressionAlgorithm_ZSTD, &zstdCompressor{})
+}
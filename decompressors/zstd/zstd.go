@@ -0,0 +1,16 @@
+package zstd
+
+import (
+	"github.com/itchio/savior"
+	"github.com/itchio/wharf/pwr"
+)
+
+type zstdDecompressor struct{}
+
+func (zd *zstdDecompressor) Apply(source savior.Source) (savior.Source, error) {
+	return NewSource(source), nil
+}
+
+func init() {
+	pwr.RegisterDecompressor(pwr.CompressionAlgorithm_ZSTD, &zstdDecompressor{})
+}
@@ -0,0 +1,184 @@
+package zstd_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/randsource/fullyrandom"
+	"github.com/itchio/savior"
+	"github.com/itchio/savior/checker"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/savior/semirandom"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/wire"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	zstdcompressor "github.com/itchio/wharf/compressors/zstd"
+	zstdsource "github.com/itchio/wharf/decompressors/zstd"
+)
+
+func Test_Uninitialized(t *testing.T) {
+	ss := seeksource.FromBytes(nil)
+	_, err := ss.Resume(nil)
+	assert.NoError(t, err)
+
+	zs := zstdsource.NewSource(ss)
+	_, err = zs.Read([]byte{})
+	assert.Error(t, err)
+	assert.True(t, errors.Cause(err) == savior.ErrUninitializedSource)
+
+	_, err = zs.ReadByte()
+	assert.Error(t, err)
+	assert.True(t, errors.Cause(err) == savior.ErrUninitializedSource)
+}
+
+const dataSize = 16 * 1024 * 1024
+
+func Test_Checkpoints(t *testing.T) {
+	samples := map[string][]byte{
+		"zero":        make([]byte, dataSize),
+		"semirandom":  semirandom.Bytes(dataSize),
+		"fullyrandom": fullyrandom.Bytes(dataSize),
+	}
+
+	for name, reference := range samples {
+		for _, quality := range []int32{1, 3, 9} {
+			t.Run(fmt.Sprintf("%s-q%d", name, quality), func(t *testing.T) {
+				buf := new(bytes.Buffer)
+				wc, err := pwr.CompressWire(wire.NewWriteContext(buf), &pwr.CompressionSettings{
+					Algorithm: pwr.CompressionAlgorithm_ZSTD,
+					Quality:   quality,
+				})
+				assert.NoError(t, err)
+
+				_, err = wc.Writer().Write(reference)
+				assert.NoError(t, err)
+				assert.NoError(t, wc.Close())
+
+				zs := zstdsource.NewSource(seeksource.FromBytes(buf.Bytes()))
+				checker.RunSourceTest(t, zs, reference)
+			})
+		}
+	}
+}
+
+func Test_SingleFrame(t *testing.T) {
+	reference := semirandom.Bytes(dataSize)
+
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderCRC(true))
+	assert.NoError(t, err)
+	compressed := encoder.EncodeAll(reference, nil)
+	assert.NoError(t, encoder.Close())
+
+	// streams from other encoders may only have one frame:
+	// they can be read back, but not resumed partway through
+	zs := zstdsource.NewSource(seeksource.FromBytes(compressed))
+	_, err = zs.Resume(nil)
+	assert.NoError(t, err)
+
+	data, err := io.ReadAll(zs)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(reference, data))
+}
+
+func Test_Empty(t *testing.T) {
+	buf := new(bytes.Buffer)
+	wc, err := pwr.CompressWire(wire.NewWriteContext(buf), &pwr.CompressionSettings{
+		Algorithm: pwr.CompressionAlgorithm_ZSTD,
+		Quality:   3,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, wc.Close())
+	assert.NotEqual(t, 0, buf.Len())
+
+	zs := zstdsource.NewSource(seeksource.FromBytes(buf.Bytes()))
+	_, err = zs.Resume(nil)
+	assert.NoError(t, err)
+
+	data, err := io.ReadAll(zs)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+}
+
+func Test_PatchTOC(t *testing.T) {
+	fileSizes := []int64{zstdcompressor.FrameSize * 3 / 2, 100, zstdcompressor.FrameSize * 2, 10}
+
+	sourceContainer := &tlc.Container{}
+	for i, size := range fileSizes {
+		sourceContainer.Files = append(sourceContainer.Files, &tlc.File{
+			Path: fmt.Sprintf("file-%d", i),
+			Size: size,
+		})
+	}
+
+	buf := new(bytes.Buffer)
+	rawWire := wire.NewWriteContext(buf)
+	assert.NoError(t, rawWire.WriteMagic(pwr.PatchMagic))
+
+	compression := &pwr.CompressionSettings{
+		Algorithm: pwr.CompressionAlgorithm_ZSTD,
+		Quality:   1,
+	}
+	assert.NoError(t, rawWire.WriteMessage(&pwr.PatchHeader{Compression: compression}))
+
+	wc, err := pwr.CompressWire(rawWire, compression)
+	assert.NoError(t, err)
+	assert.NoError(t, wc.WriteMessage(&tlc.Container{}))
+	assert.NoError(t, wc.WriteMessage(sourceContainer))
+
+	for i, size := range fileSizes {
+		assert.NoError(t, wc.WriteMessage(&pwr.SyncHeader{FileIndex: int64(i)}))
+		data := semirandom.Bytes(size)
+		for len(data) > 0 {
+			n := min(len(data), 64*1024)
+			assert.NoError(t, wc.WriteMessage(&pwr.SyncOp{Type: pwr.SyncOp_DATA, Data: data[:n]}))
+			data = data[n:]
+		}
+		assert.NoError(t, wc.WriteMessage(&pwr.SyncOp{Type: pwr.SyncOp_HEY_YOU_DID_IT}))
+	}
+	assert.NoError(t, wc.Close())
+
+	assert.NoError(t, pwr.WritePatchTOC(seeksource.FromBytes(buf.Bytes()), buf))
+	patch := buf.Bytes()
+
+	toc, err := pwr.ReadPatchTOC(seeksource.FromBytes(patch))
+	assert.NoError(t, err)
+	assert.Len(t, toc.Entries, len(fileSizes))
+
+	// later files start partway through frames, which don't start
+	// at the beginning of the compressed stream
+	lastEntry := toc.Entries[len(toc.Entries)-1]
+	assert.True(t, lastEntry.RestartDecompressedOffset > 0)
+	assert.True(t, lastEntry.RestartDecompressedOffset < lastEntry.DecompressedOffset)
+	assert.True(t, lastEntry.RestartOffset > toc.Entries[0].RestartOffset)
+
+	for i := len(fileSizes) - 1; i >= 0; i-- {
+		rctx, err := toc.OpenFile(seeksource.FromBytes(patch), int64(i))
+		assert.NoError(t, err)
+
+		sh := &pwr.SyncHeader{}
+		assert.NoError(t, rctx.ReadMessage(sh))
+		assert.EqualValues(t, i, sh.FileIndex)
+
+		var size int64
+		op := &pwr.SyncOp{}
+		for {
+			assert.NoError(t, rctx.ReadMessage(op))
+			if op.Type == pwr.SyncOp_HEY_YOU_DID_IT {
+				break
+			}
+			size += int64(len(op.Data))
+		}
+		assert.Equal(t, fileSizes[i], size)
+	}
+
+	// regular readers stop before the table of contents
+	pi, err := pwr.InspectPatch(seeksource.FromBytes(patch))
+	assert.NoError(t, err)
+	assert.Equal(t, fileSizes[0], pi.Files[0].FreshBytes)
+}
@@ -0,0 +1,375 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"github.com/itchio/savior"
+	"github.com/itchio/wharf/pwr"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	frameMagic         uint32 = 0xFD2FB528
+	skippableMagicMask uint32 = 0xFFFFFFF0
+	skippableMagic     uint32 = 0x184D2A50
+)
+
+type zstdSource struct {
+	// input
+	source savior.Source
+
+	// internal
+	decoder     *zstd.Decoder
+	initialized bool
+	inputOffset int64
+	offset      int64
+
+	// where the frame in out starts
+	frameInputOffset int64
+	frameOffset      int64
+
+	header  []byte
+	frame   []byte
+	out     []byte
+	outPos  int
+	bytebuf []byte
+
+	ssc              savior.SourceSaveConsumer
+	sourceCheckpoint *savior.SourceCheckpoint
+}
+
+// ZstdSourceCheckpoint is saved on frame boundaries: InputOffset is where
+// the next frame starts in the compressed stream, OutputOffset is how many
+// bytes were decompressed before it.
+type ZstdSourceCheckpoint struct {
+	SourceCheckpoint *savior.SourceCheckpoint
+	InputOffset      int64
+	OutputOffset     int64
+}
+
+var _ pwr.RestartableSource = (*zstdSource)(nil)
+
+// NewSource returns a savior.Source that decompresses a zstd stream. It can
+// save and resume on frame boundaries, so it works best with streams made
+// of many frames, like the ones written by compressors/zstd.
+func NewSource(source savior.Source) savior.Source {
+	return &zstdSource{
+		source:  source,
+		header:  make([]byte, 18),
+		bytebuf: []byte{0x00},
+	}
+}
+
+func (zs *zstdSource) Features() savior.SourceFeatures {
+	return savior.SourceFeatures{
+		Name:          "zstd",
+		ResumeSupport: savior.ResumeSupportBlock,
+	}
+}
+
+func (zs *zstdSource) SetSourceSaveConsumer(ssc savior.SourceSaveConsumer) {
+	savior.Debugf("zstdsource: set source save consumer!")
+	zs.ssc = ssc
+	zs.source.SetSourceSaveConsumer(&savior.CallbackSourceSaveConsumer{
+		OnSave: func(checkpoint *savior.SourceCheckpoint) error {
+			savior.Debugf("zstdsource: underlying source gave us checkpoint!")
+			zs.sourceCheckpoint = checkpoint
+			return nil
+		},
+	})
+}
+
+func (zs *zstdSource) WantSave() {
+	savior.Debugf("zstdsource: want save!")
+	zs.source.WantSave()
+}
+
+func (zs *zstdSource) Resume(checkpoint *savior.SourceCheckpoint) (int64, error) {
+	savior.Debugf(`zstdsource: asked to resume`)
+
+	if zs.decoder == nil {
+		decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		zs.decoder = decoder
+	}
+
+	zs.sourceCheckpoint = nil
+	zs.out = zs.out[:0]
+	zs.outPos = 0
+
+	if checkpoint != nil {
+		if ourCheckpoint, ok := checkpoint.Data.(*ZstdSourceCheckpoint); ok {
+			sourceOffset, err := zs.source.Resume(ourCheckpoint.SourceCheckpoint)
+			if err != nil {
+				return 0, errors.WithStack(err)
+			}
+
+			if sourceOffset < ourCheckpoint.InputOffset {
+				delta := ourCheckpoint.InputOffset - sourceOffset
+				savior.Debugf(`zstdsource: discarding %d bytes to align source with decompressor`, delta)
+				err = savior.DiscardByRead(zs.source, delta)
+				if err != nil {
+					return 0, errors.WithStack(err)
+				}
+				sourceOffset += delta
+			}
+
+			if sourceOffset == ourCheckpoint.InputOffset {
+				zs.inputOffset = ourCheckpoint.InputOffset
+				zs.offset = ourCheckpoint.OutputOffset
+				zs.initialized = true
+				return zs.offset, nil
+			}
+
+			savior.Debugf(`zstdsource: expected source to resume at %d but got %d`, ourCheckpoint.InputOffset, sourceOffset)
+		}
+	}
+
+	// start from beginning
+	sourceOffset, err := zs.source.Resume(nil)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	if sourceOffset != 0 {
+		msg := fmt.Sprintf("zstdsource: expected source to resume at start but got %d", sourceOffset)
+		return 0, errors.New(msg)
+	}
+
+	zs.inputOffset = 0
+	zs.offset = 0
+	zs.initialized = true
+
+	return 0, nil
+}
+
+func (zs *zstdSource) Read(buf []byte) (int, error) {
+	if !zs.initialized {
+		return 0, errors.WithStack(savior.ErrUninitializedSource)
+	}
+
+	for zs.outPos == len(zs.out) {
+		// we're on a frame boundary, the only place we can save at
+		if zs.sourceCheckpoint != nil && zs.ssc != nil {
+			checkpoint := &savior.SourceCheckpoint{
+				Offset: zs.offset,
+				Data: &ZstdSourceCheckpoint{
+					SourceCheckpoint: zs.sourceCheckpoint,
+					InputOffset:      zs.inputOffset,
+					OutputOffset:     zs.offset,
+				},
+			}
+			zs.sourceCheckpoint = nil
+
+			savior.Debugf("zstdsource: saving, InputOffset = %d, OutputOffset = %d", zs.inputOffset, zs.offset)
+			err := zs.ssc.Save(checkpoint)
+			return 0, err
+		}
+
+		err := zs.nextFrame()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(buf, zs.out[zs.outPos:])
+	zs.outPos += n
+	zs.offset += int64(n)
+	return n, nil
+}
+
+// RestartPoint returns where the frame being read starts, or where the next
+// one does if the current frame has been read entirely. Frames are
+// independent, so a new source can start from there.
+func (zs *zstdSource) RestartPoint() (int64, int64) {
+	if zs.outPos == len(zs.out) {
+		return zs.inputOffset, zs.offset
+	}
+	return zs.frameInputOffset, zs.frameOffset
+}
+
+// nextFrame reads a whole frame from the underlying source and decompresses
+// it. It returns io.EOF if the source ends cleanly on a frame boundary.
+func (zs *zstdSource) nextFrame() error {
+	zs.frameInputOffset = zs.inputOffset
+	zs.frameOffset = zs.offset
+
+	magicBuf := zs.header[:4]
+	n, err := io.ReadFull(zs.source, magicBuf)
+	if err != nil {
+		if n == 0 && errors.Cause(err) == io.EOF {
+			return io.EOF
+		}
+		return errors.WithStack(asUnexpectedEOF(err))
+	}
+	zs.inputOffset += int64(n)
+	magic := binary.LittleEndian.Uint32(magicBuf)
+
+	if magic&skippableMagicMask == skippableMagic {
+		sizeBuf := zs.header[4:8]
+		err = zs.readFull(sizeBuf)
+		if err != nil {
+			return err
+		}
+		size := int64(binary.LittleEndian.Uint32(sizeBuf))
+		err = savior.DiscardByRead(zs.source, size)
+		if err != nil {
+			return errors.WithStack(asUnexpectedEOF(err))
+		}
+		zs.inputOffset += size
+		zs.out = zs.out[:0]
+		zs.outPos = 0
+		return nil
+	}
+
+	if magic != frameMagic {
+		return errors.Errorf("zstdsource: invalid frame magic %x at input offset %d", magic, zs.inputOffset-4)
+	}
+
+	zs.frame = append(zs.frame[:0], magicBuf...)
+
+	// frame header descriptor
+	err = zs.readFrameBytes(1)
+	if err != nil {
+		return err
+	}
+	fhd := zs.frame[4]
+	if fhd&0x08 != 0 {
+		return errors.Errorf("zstdsource: reserved bit set in frame header at input offset %d", zs.inputOffset-1)
+	}
+
+	fcsFlag := fhd >> 6
+	singleSegment := (fhd>>5)&1 == 1
+	hasChecksum := (fhd>>2)&1 == 1
+	dictIDFlag := fhd & 0x3
+
+	headerSize := 0
+	if !singleSegment {
+		// window descriptor
+		headerSize++
+	}
+	headerSize += []int{0, 1, 2, 4}[dictIDFlag]
+	switch fcsFlag {
+	case 0:
+		if singleSegment {
+			headerSize++
+		}
+	case 1:
+		headerSize += 2
+	case 2:
+		headerSize += 4
+	case 3:
+		headerSize += 8
+	}
+
+	err = zs.readFrameBytes(headerSize)
+	if err != nil {
+		return err
+	}
+
+	// blocks, until the last one
+	for {
+		err = zs.readFrameBytes(3)
+		if err != nil {
+			return err
+		}
+		bh := zs.frame[len(zs.frame)-3:]
+		blockHeader := uint32(bh[0]) | uint32(bh[1])<<8 | uint32(bh[2])<<16
+		lastBlock := blockHeader&1 == 1
+		blockType := (blockHeader >> 1) & 0x3
+		blockSize := int(blockHeader >> 3)
+
+		switch blockType {
+		case 0, 2:
+			// raw & compressed blocks
+			err = zs.readFrameBytes(blockSize)
+		case 1:
+			// RLE blocks store a single byte
+			err = zs.readFrameBytes(1)
+		default:
+			err = errors.Errorf("zstdsource: reserved block type at input offset %d", zs.inputOffset-3)
+		}
+		if err != nil {
+			return err
+		}
+
+		if lastBlock {
+			break
+		}
+	}
+
+	if hasChecksum {
+		err = zs.readFrameBytes(4)
+		if err != nil {
+			return err
+		}
+	}
+
+	zs.out, err = zs.decoder.DecodeAll(zs.frame, zs.out[:0])
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	zs.outPos = 0
+
+	return nil
+}
+
+func (zs *zstdSource) readFrameBytes(n int) error {
+	start := len(zs.frame)
+	if cap(zs.frame) < start+n {
+		frame := make([]byte, start, (start+n)*2)
+		copy(frame, zs.frame)
+		zs.frame = frame
+	}
+	zs.frame = zs.frame[:start+n]
+	return zs.readFull(zs.frame[start:])
+}
+
+func (zs *zstdSource) readFull(buf []byte) error {
+	n, err := io.ReadFull(zs.source, buf)
+	zs.inputOffset += int64(n)
+	if err != nil {
+		return errors.WithStack(asUnexpectedEOF(err))
+	}
+	return nil
+}
+
+func asUnexpectedEOF(err error) error {
+	if errors.Cause(err) == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (zs *zstdSource) ReadByte() (byte, error) {
+	if !zs.initialized {
+		return 0, errors.WithStack(savior.ErrUninitializedSource)
+	}
+
+	n, err := zs.Read(zs.bytebuf)
+	if n == 0 && err == nil {
+		/* this happens when Read needs to save, but it swallows the error */
+		/* we're not meant to surface them, but there's no way to handle a */
+		/* short read from ReadByte, so we just read again */
+		_, err = zs.Read(zs.bytebuf)
+	}
+
+	return zs.bytebuf[0], err
+}
+
+func (zs *zstdSource) Progress() float64 {
+	// We can't tell how large the uncompressed stream is until we finish
+	// decompressing it. The underlying's source progress is a good enough
+	// approximation.
+	return zs.source.Progress()
+}
+
+func init() {
+	gob.Register(&ZstdSourceCheckpoint{})
+}
@@ -10,13 +10,17 @@ require (
 	github.com/itchio/go-brotli v0.0.0-20190702114328-3f28d645a45c
 	github.com/itchio/headway v0.0.0-20251229214354-da882c8b5dd4
 	github.com/itchio/httpkit v0.0.0-20251231162950-9fb57e6ac916
+	github.com/itchio/kompress v0.0.0-20200301155538-5c2eecce9e51
 	github.com/itchio/lake v0.0.0-20200305150023-cc4284ec2b2a
 	github.com/itchio/randsource v0.0.0-20190703104731-3f6d22f91927
 	github.com/itchio/savior v0.0.0-20200618124148-6034e878d75b
 	github.com/itchio/screw v0.0.0-20200301160148-75fc2d65fb38
 	github.com/jgallagher/gosaca v0.0.0-20130226042358-754749770f08
+	github.com/klauspost/compress v1.18.3
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.11.1
+	github.com/zeebo/blake3 v0.2.4
+	github.com/zeebo/xxh3 v1.1.0
 	google.golang.org/protobuf v1.36.11
 )
 
@@ -41,9 +45,8 @@ require (
 	github.com/go-stack/stack v1.8.1 // indirect
 	github.com/gogs/chardet v0.0.0-20211120154057-b7413eaefb8f // indirect
 	github.com/itchio/dskompress v0.0.0-20190702113811-5e6f499be697 // indirect
-	github.com/itchio/kompress v0.0.0-20200301155538-5c2eecce9e51 // indirect
 	github.com/itchio/ox v0.0.0-20200826161350-12c6ca18d236 // indirect
-	github.com/klauspost/compress v1.18.3 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.10 // indirect
 	github.com/mitchellh/copystructure v1.2.0 // indirect
 	github.com/mitchellh/reflectwalk v1.0.2 // indirect
 	github.com/oxtoacart/bpool v0.0.0-20190530202638-03653db5a59c // indirect
@@ -2,10 +2,8 @@ package pwr
 
 import (
 	"context"
-	"fmt"
 	"io"
 	"os"
-	"path/filepath"
 	"sync"
 
 	"github.com/itchio/headway/counter"
@@ -36,6 +34,14 @@ type ArchiveHealer struct {
 	// an eos path for the archive
 	ArchivePath string
 
+	// an optional eos path for a zip index (.pzi) of the archive. If set,
+	// the archive's central directory is never read.
+	ArchiveIndexPath string
+
+	// VerifyIndex (optional) checks the zip index at ArchiveIndexPath
+	// before it's read
+	VerifyIndex SourceVerifier
+
 	archiveFile    eos.File
 	archiveFileErr error
 	archiveLock    sync.Mutex
@@ -45,12 +51,11 @@ type ArchiveHealer struct {
 	Consumer *state.Consumer
 
 	// internal
-	progressMutex  sync.Mutex
-	totalCorrupted int64
-	totalHealing   int64
-	totalHealed    int64
-	totalHealthy   int64
-	hasWounds      bool
+	woundsTally
+	progressMutex sync.Mutex
+	totalHealing  int64
+	totalHealed   int64
+	totalHealthy  int64
 
 	container *tlc.Container
 
@@ -63,18 +68,10 @@ type chunkHealedFunc func(chunkHealed int64)
 
 // Do starts receiving from the wounds channel and healing
 func (ah *ArchiveHealer) Do(parentCtx context.Context, container *tlc.Container, wounds chan *Wound) error {
-	ctx, cancel := context.WithCancel(parentCtx)
-	defer cancel()
-
 	ah.container = container
 
-	files := make(map[int64]bool)
-	fileIndices := make(chan int64, len(container.Files))
-
 	targetPool := fspool.New(container, ah.Target)
 
-	errs := make(chan error, 1)
-
 	onChunkHealed := func(healedChunk int64) {
 		ah.progressMutex.Lock()
 		ah.totalHealed += healedChunk
@@ -88,80 +85,16 @@ func (ah *ArchiveHealer) Do(parentCtx context.Context, container *tlc.Container,
 		}
 	}()
 
-	go func() {
-		errs <- ah.heal(ctx, container, targetPool, fileIndices, onChunkHealed)
-	}()
-
-	processWound := func(wound *Wound) error {
-		if !wound.Healthy() {
-			ah.totalCorrupted += wound.Size()
-			ah.hasWounds = true
-		}
-
-		switch wound.Kind {
-		case WoundKind_DIR:
-			dirEntry := container.Dirs[wound.Index]
-			path := filepath.Join(ah.Target, filepath.FromSlash(dirEntry.Path))
-
-			stats, err := os.Lstat(path)
-			if err == nil {
-				if stats.IsDir() {
-					ah.Consumer.Debugf("For dir wound, found existing dir (%s), all good", path)
-					return nil
-				} else {
-					ah.Consumer.Debugf("For dir wound, found file/symlink (%s), removing", path)
-					err = os.Remove(path)
-					if err != nil {
-						return errors.WithStack(err)
-					}
-				}
-			}
-
-			ah.Consumer.Debugf("For dir wound, doing MkdirAll (%s)", path)
-			err = os.MkdirAll(path, 0o755)
-			if err != nil {
-				return errors.WithStack(err)
-			}
-
-		case WoundKind_SYMLINK:
-			symlinkEntry := container.Symlinks[wound.Index]
-			path := filepath.Join(ah.Target, filepath.FromSlash(symlinkEntry.Path))
-
-			dir := filepath.Dir(path)
-			err := os.MkdirAll(dir, 0o755)
-			if err != nil {
-				return errors.WithStack(err)
-			}
-
-			stats, err := os.Lstat(path)
-			if err == nil {
-				if stats.IsDir() {
-					ah.Consumer.Debugf("For symlink wound, found dir (%s), doing RemoveAll", path)
-					err = os.RemoveAll(path)
-					if err != nil {
-						return errors.WithStack(err)
-					}
-				} else {
-					ah.Consumer.Debugf("For symlink wound, found file/symlink (%s), doing Remove", path)
-					err = os.Remove(path)
-					if err != nil {
-						return errors.WithStack(err)
-					}
-				}
-			}
-
-			ah.Consumer.Debugf("For symlink wound, doing Symlink (%s) => (%s)", path, symlinkEntry.Dest)
-			err = os.Symlink(symlinkEntry.Dest, path)
-			if err != nil {
-				return errors.WithStack(err)
-			}
-
-		case WoundKind_FILE:
-			if files[wound.Index] {
-				// already queued
-				return nil
-			}
-
+	wl := &woundsLoop{
+		consumer:   ah.Consumer,
+		target:     ah.Target,
+		container:  container,
+		tally:      &ah.woundsTally,
+		wholeFiles: true,
+		healFiles: func(ctx context.Context, fileWounds chan *Wound) error {
+			return ah.heal(ctx, container, targetPool, fileWounds, onChunkHealed)
+		},
+		onFileWound: func(wound *Wound) {
 			file := container.Files[wound.Index]
 			ah.Consumer.ProgressLabel(file.Path)
 
@@ -169,60 +102,15 @@ func (ah *ArchiveHealer) Do(parentCtx context.Context, container *tlc.Container,
 			ah.totalHealing += file.Size
 			ah.progressMutex.Unlock()
 			ah.updateProgress()
-			files[wound.Index] = true
-
-			select {
-			case err := <-errs:
-				return errors.WithStack(err)
-			case fileIndices <- wound.Index:
-				// queued for work!
-			}
-
-		case WoundKind_CLOSED_FILE:
-			if files[wound.Index] {
-				// already healing whole file
-			} else {
-				fileSize := container.Files[wound.Index].Size
-
-				// whole file was healthy
-				if wound.End == fileSize {
-					ah.progressMutex.Lock()
-					ah.totalHealthy += fileSize
-					ah.progressMutex.Unlock()
-					ah.updateProgress()
-				}
-			}
-
-		default:
-			return fmt.Errorf("Unknown wound kind: %d", wound.Kind)
-		}
-
-		return nil
-	}
-
-	for wound := range wounds {
-		select {
-		case <-ctx.Done():
-			return werrors.ErrCancelled
-		default:
-			// keep going!
-		}
-
-		err := processWound(wound)
-		if err != nil {
-			return err
-		}
-	}
-
-	// queued everything
-	close(fileIndices)
-
-	err := <-errs
-	if err != nil {
-		return errors.WithStack(err)
+		},
+		onHealthyFile: func(size int64) {
+			ah.progressMutex.Lock()
+			ah.totalHealthy += size
+			ah.progressMutex.Unlock()
+			ah.updateProgress()
+		},
 	}
-
-	return nil
+	return wl.run(parentCtx, wounds)
 }
 
 func (ah *ArchiveHealer) openArchive() (eos.File, error) {
@@ -237,8 +125,18 @@ func (ah *ArchiveHealer) openArchive() (eos.File, error) {
 	return ah.archiveFile, ah.archiveFileErr
 }
 
+func (ah *ArchiveHealer) openArchiveIndex() (*ZipIndex, error) {
+	source, file, err := openWharfFile(ah.ArchiveIndexPath, ah.VerifyIndex, ah.Consumer)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+
+	return ReadZipIndex(source)
+}
+
 func (ah *ArchiveHealer) heal(ctx context.Context, container *tlc.Container, targetPool lake.WritablePool,
-	fileIndices chan int64, chunkHealed chunkHealedFunc) error {
+	fileWounds chan *Wound, chunkHealed chunkHealedFunc) error {
 
 	var sourcePool lake.Pool
 	var err error
@@ -248,11 +146,12 @@ func (ah *ArchiveHealer) heal(ctx context.Context, container *tlc.Container, tar
 		case <-ctx.Done():
 			// something else stopped the healing
 			return nil
-		case fileIndex, ok := <-fileIndices:
+		case wound, ok := <-fileWounds:
 			if !ok {
 				// no more files to heal
 				return nil
 			}
+			fileIndex := wound.Index
 
 			// lazily open file
 			if sourcePool == nil {
@@ -266,12 +165,25 @@ func (ah *ArchiveHealer) heal(ctx context.Context, container *tlc.Container, tar
 					return err
 				}
 
-				zipReader, err := zip.NewReader(file, stat.Size())
-				if err != nil {
-					return errors.WithStack(err)
-				}
+				if ah.ArchiveIndexPath != "" {
+					index, err := ah.openArchiveIndex()
+					if err != nil {
+						return errors.WithStack(err)
+					}
 
-				sourcePool = zippool.New(container, zipReader)
+					if index.ArchiveSize != stat.Size() {
+						return errors.Errorf("zip index is for a %d-byte archive, but %s is %d bytes", index.ArchiveSize, ah.ArchivePath, stat.Size())
+					}
+
+					sourcePool = NewZipIndexPool(container, index, file)
+				} else {
+					zipReader, err := zip.NewReader(file, stat.Size())
+					if err != nil {
+						return errors.WithStack(err)
+					}
+
+					sourcePool = zippool.New(container, zipReader)
+				}
 				// sic: we're inside a for, not a function, so this correctly happens
 				// when we actually return
 				defer sourcePool.Close()
@@ -339,19 +251,6 @@ func (ah *ArchiveHealer) healOne(ctx context.Context, sourcePool lake.Pool, targ
 	return err
 }
 
-// HasWounds returns true if the healer ever received wounds
-func (ah *ArchiveHealer) HasWounds() bool {
-	return ah.hasWounds
-}
-
-// TotalCorrupted returns the total amount of corrupted data
-// contained in the wounds this healer has received. Dirs
-// and symlink wounds have 0-size, use HasWounds to know
-// if there were any wounds at all.
-func (ah *ArchiveHealer) TotalCorrupted() int64 {
-	return ah.totalCorrupted
-}
-
 // TotalHealed returns the total amount of data written to disk
 // to repair the wounds. This might be more than TotalCorrupted,
 // since ArchiveHealer always redownloads whole files, even if
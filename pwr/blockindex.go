@@ -0,0 +1,37 @@
+package pwr
+
+import (
+	"context"
+
+	"github.com/itchio/savior"
+	"github.com/itchio/wharf/wsync"
+	"github.com/pkg/errors"
+)
+
+// WriteBlockIndex reads a wharf signature file and writes its block hashes
+// to an on-disk index at indexPath, without keeping them in memory. The index
+// can be opened with wsync.OpenBlockLibrary and used as a DiffContext's
+// TargetLibrary. The signature's block size and strong hash are recorded in
+// the index. The returned SignatureInfo has no Hashes.
+func WriteBlockIndex(ctx context.Context, signatureReader savior.SeekSource, indexPath string) (*SignatureInfo, error) {
+	biw, err := wsync.NewBlockIndexWriter(indexPath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	sigInfo, err := readSignature(ctx, signatureReader, biw.Write)
+	if err != nil {
+		biw.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	biw.BlockSize = sigInfo.EffectiveBlockSize()
+	biw.StrongHash = int32(sigInfo.StrongHash)
+
+	err = biw.Close()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return sigInfo, nil
+}
@@ -30,4 +30,21 @@ func Test_BlockMath(t *testing.T) {
 	assert.Equal(t, BlockSize, ComputeBlockSize(BlockSize*2+1, 0))
 	assert.Equal(t, BlockSize, ComputeBlockSize(BlockSize*2+1, 1))
 	assert.Equal(t, int64(1), ComputeBlockSize(BlockSize*2+1, 2))
+
+	// non-default block sizes
+	const small = int64(8 * 1024)
+	assert.Equal(t, int64(0), ComputeNumBlocksWithBlockSize(0, small))
+	assert.Equal(t, int64(1), ComputeNumBlocksWithBlockSize(small, small))
+	assert.Equal(t, int64(8), ComputeNumBlocksWithBlockSize(BlockSize, small))
+	assert.Equal(t, int64(9), ComputeNumBlocksWithBlockSize(BlockSize+1, small))
+	assert.Equal(t, small, ComputeBlockSizeWithBlockSize(BlockSize+1, 7, small))
+	assert.Equal(t, int64(1), ComputeBlockSizeWithBlockSize(BlockSize+1, 8, small))
+
+	// header values
+	assert.Equal(t, BlockSize, EffectiveBlockSize(0))
+	assert.Equal(t, small, EffectiveBlockSize(small))
+	assert.NoError(t, ValidateBlockSize(0))
+	assert.NoError(t, ValidateBlockSize(small))
+	assert.Error(t, ValidateBlockSize(-1))
+	assert.Error(t, ValidateBlockSize(MaxBlockSize+1))
 }
@@ -10,6 +10,8 @@ import (
 type blockValidator struct {
 	hashInfo *HashInfo
 	sctx     *wsync.Context
+	// set if hashInfo's strong hash isn't supported
+	err error
 }
 
 type BlockValidator interface {
@@ -19,23 +21,36 @@ type BlockValidator interface {
 }
 
 func NewBlockValidator(hashInfo *HashInfo) BlockValidator {
+	sctx, err := mksync(hashInfo.BlockSize, hashInfo.StrongHash)
 	return &blockValidator{
 		hashInfo: hashInfo,
-		sctx:     wsync.NewContext(int(BlockSize)),
+		sctx:     sctx,
+		err:      err,
 	}
 }
 
 func (bv *blockValidator) BlockSize(fileIndex int64, blockIndex int64) int64 {
 	fileSize := bv.hashInfo.Container.Files[fileIndex].Size
-	return ComputeBlockSize(fileSize, blockIndex)
+	return ComputeBlockSizeWithBlockSize(fileSize, blockIndex, EffectiveBlockSize(bv.hashInfo.BlockSize))
 }
 
 func (bv *blockValidator) ValidateAsWound(fileIndex int64, blockIndex int64, data []byte) Wound {
-	weakHash, strongHash := bv.sctx.HashBlock(data)
 	hashGroup := bv.hashInfo.Groups[fileIndex]
-	start := blockIndex * BlockSize
+	start := blockIndex * EffectiveBlockSize(bv.hashInfo.BlockSize)
 	size := bv.BlockSize(fileIndex, blockIndex)
 
+	if bv.err != nil {
+		// can't check anything, so nothing is known to be good
+		return Wound{
+			Kind:  WoundKind_FILE,
+			Index: fileIndex,
+			Start: start,
+			End:   start + size,
+		}
+	}
+
+	weakHash, strongHash := bv.sctx.HashBlock(data)
+
 	if blockIndex >= int64(len(hashGroup)) {
 		return Wound{
 			Kind:  WoundKind_FILE,
@@ -74,6 +89,10 @@ func (bv *blockValidator) ValidateAsWound(fileIndex int64, blockIndex int64, dat
 }
 
 func (bv *blockValidator) ValidateAsError(fileIndex int64, blockIndex int64, data []byte) error {
+	if bv.err != nil {
+		return bv.err
+	}
+
 	weakHash, strongHash := bv.sctx.HashBlock(data)
 	hashGroup := bv.hashInfo.Groups[fileIndex]
 	file := bv.hashInfo.Container.Files[fileIndex]
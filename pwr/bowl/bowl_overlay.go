@@ -1,6 +1,7 @@
 package bowl
 
 import (
+	"context"
 	"encoding/gob"
 	"fmt"
 	"io"
@@ -9,8 +10,10 @@ import (
 	"sort"
 
 	"github.com/itchio/headway/state"
+	"github.com/itchio/savior"
 	"github.com/itchio/savior/filesource"
 	"github.com/itchio/screw"
+	"github.com/itchio/wharf/pwr"
 	"github.com/itchio/wharf/pwr/overlay"
 
 	"github.com/itchio/lake"
@@ -36,6 +39,12 @@ type overlayBowl struct {
 	OutputFolder string
 	StageFolder  string
 
+	ReversePatchWriter io.Writer
+	ReverseCompression *pwr.CompressionSettings
+	PatchReader        savior.SeekSource
+	OnReverseProgress  state.ProgressCallback
+	Context            context.Context
+
 	Consumer *state.Consumer
 
 	stagePool         *fspool.FsPool
@@ -64,6 +73,23 @@ type OverlayBowlParams struct {
 	OutputFolder string
 	StageFolder  string
 
+	// ReversePatchWriter (optional) receives a patch that goes from the new
+	// build back to the old one. It's written during Commit, while the old
+	// build is still around.
+	ReversePatchWriter io.Writer
+	// ReverseCompression (optional) defaults to no compression
+	ReverseCompression *pwr.CompressionSettings
+	// PatchReader is the patch being applied, which the reverse patch is
+	// derived from. It's required when ReversePatchWriter is set, and is read
+	// again from the start during Commit, so it can be the patcher's.
+	PatchReader savior.SeekSource
+	// OnReverseProgress (optional) is called with the progress of writing
+	// the reverse patch
+	OnReverseProgress state.ProgressCallback
+	// Context (optional) lets callers cancel writing the reverse patch,
+	// defaults to context.Background()
+	Context context.Context
+
 	Consumer *state.Consumer
 }
 
@@ -99,6 +125,10 @@ func NewOverlayBowl(params OverlayBowlParams) (Bowl, error) {
 		return nil, errors.New("overlaybowl: StageFolder must not be nil")
 	}
 
+	if params.ReversePatchWriter != nil && params.PatchReader == nil {
+		return nil, errors.New("overlaybowl: PatchReader must not be nil when ReversePatchWriter is set")
+	}
+
 	var err error
 
 	err = screw.MkdirAll(params.StageFolder, 0755)
@@ -122,6 +152,12 @@ func NewOverlayBowl(params OverlayBowlParams) (Bowl, error) {
 		OutputFolder: params.OutputFolder,
 		StageFolder:  params.StageFolder,
 
+		ReversePatchWriter: params.ReversePatchWriter,
+		ReverseCompression: params.ReverseCompression,
+		PatchReader:        params.PatchReader,
+		OnReverseProgress:  params.OnReverseProgress,
+		Context:            params.Context,
+
 		Consumer: params.Consumer,
 
 		stagePool:         stagePool,
@@ -240,6 +276,14 @@ func (b *overlayBowl) Commit() error {
 		return errors.WithStack(err)
 	}
 
+	// - write the reverse patch while we still have the old build
+	if b.ReversePatchWriter != nil {
+		err = b.writeReversePatch()
+		if err != nil {
+			return err
+		}
+	}
+
 	if screw.IsCaseInsensitiveFS() {
 		// fix casing on-disk, reflect that on renames/etc.
 		err = b.fixExistingCase()
@@ -0,0 +1,47 @@
+package bowl
+
+import (
+	"context"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/wharf/pwr/genie"
+	"github.com/pkg/errors"
+)
+
+// writeReversePatch derives a patch that goes from the new build back to the
+// old one from the patch being applied, reading what it can't copy back from
+// the old build (still untouched in the output folder). It must be called
+// before any of the commit steps that modify the output folder.
+func (b *overlayBowl) writeReversePatch() error {
+	ctx := b.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	b.Consumer.Infof("Computing reverse patch")
+
+	// messages go to the bowl's consumer, but progress is the reverse
+	// patch's own, it'd otherwise start over from 0 after patching.
+	consumer := &state.Consumer{
+		OnProgress: b.OnReverseProgress,
+	}
+	if b.Consumer != nil {
+		consumer.OnMessage = b.Consumer.OnMessage
+	}
+
+	_, err := b.PatchReader.Resume(nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	oldPool := fspool.New(b.TargetContainer, b.OutputFolder)
+	defer oldPool.Close()
+
+	err = genie.WriteReversePatch(ctx, b.PatchReader, oldPool, b.ReversePatchWriter, b.ReverseCompression, consumer)
+	if err != nil {
+		return errors.WithMessage(err, "while writing reverse patch")
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package pwr
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// A SignatureChangelog lists the differences between the files of two
+// builds, as found by CompareSignatures.
+type SignatureChangelog struct {
+	// Changed lists paths present in both builds, with different contents
+	Changed []string
+	// Added lists paths only in the new build, whose contents aren't
+	// in the old build
+	Added []string
+	// Removed lists paths only in the old build, that weren't renamed
+	Removed []string
+	// Renamed lists files that moved to another path
+	Renamed []FileMove
+	// Duplicated lists files of the new build that have the same contents
+	// as an old file that's still around (or was renamed to another path)
+	Duplicated []FileMove
+}
+
+// A FileMove relates a file of the new build to a file of the old build
+// with identical contents
+type FileMove struct {
+	OldPath string
+	NewPath string
+}
+
+// IsEmpty returns true if both builds have the same files, with the same contents
+func (sc *SignatureChangelog) IsEmpty() bool {
+	return len(sc.Changed) == 0 && len(sc.Added) == 0 && len(sc.Removed) == 0 &&
+		len(sc.Renamed) == 0 && len(sc.Duplicated) == 0
+}
+
+// CompareSignatures lists the files that differ from the old build a to
+// the new build b, by looking at their hashes only. Files are considered
+// identical when they have the same size and block hashes, so both
+// signatures must have the same block size and strong hash algorithm.
+// Empty files are never considered renamed or duplicated.
+func CompareSignatures(a *SignatureInfo, b *SignatureInfo) (*SignatureChangelog, error) {
+	if a.EffectiveBlockSize() != b.EffectiveBlockSize() {
+		return nil, errors.Errorf("can't compare signatures with %d-byte and %d-byte blocks", a.EffectiveBlockSize(), b.EffectiveBlockSize())
+	}
+	if a.StrongHash != b.StrongHash {
+		return nil, errors.Errorf("can't compare signatures with %s and %s strong hashes", a.StrongHash, b.StrongHash)
+	}
+
+	aKeys, err := fileKeys(a)
+	if err != nil {
+		return nil, errors.Wrap(err, "in old signature")
+	}
+	bKeys, err := fileKeys(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "in new signature")
+	}
+
+	aPaths := make(map[string]int)
+	// old files by contents, in container order
+	aByKey := make(map[string][]int)
+	for i, f := range a.Container.Files {
+		aPaths[f.Path] = i
+		if f.Size > 0 {
+			aByKey[aKeys[i]] = append(aByKey[aKeys[i]], i)
+		}
+	}
+
+	bPaths := make(map[string]bool)
+	for _, f := range b.Container.Files {
+		bPaths[f.Path] = true
+	}
+
+	changelog := &SignatureChangelog{}
+	renamed := make(map[int]bool)
+
+	for j, f := range b.Container.Files {
+		if i, ok := aPaths[f.Path]; ok {
+			if aKeys[i] != bKeys[j] {
+				changelog.Changed = append(changelog.Changed, f.Path)
+			}
+			continue
+		}
+
+		var candidates []int
+		if f.Size > 0 {
+			candidates = aByKey[bKeys[j]]
+		}
+		if len(candidates) == 0 {
+			changelog.Added = append(changelog.Added, f.Path)
+			continue
+		}
+
+		// the first old file that's gone and hasn't been claimed yet
+		// is renamed, other matches are copies
+		moved := false
+		for _, i := range candidates {
+			oldPath := a.Container.Files[i].Path
+			if !bPaths[oldPath] && !renamed[i] {
+				renamed[i] = true
+				changelog.Renamed = append(changelog.Renamed, FileMove{OldPath: oldPath, NewPath: f.Path})
+				moved = true
+				break
+			}
+		}
+
+		if !moved {
+			changelog.Duplicated = append(changelog.Duplicated, FileMove{
+				OldPath: a.Container.Files[candidates[0]].Path,
+				NewPath: f.Path,
+			})
+		}
+	}
+
+	for i, f := range a.Container.Files {
+		if !bPaths[f.Path] && !renamed[i] {
+			changelog.Removed = append(changelog.Removed, f.Path)
+		}
+	}
+
+	return changelog, nil
+}
+
+// fileKeys returns a string for each file of a signature, which is the same
+// for two files if and only if they have the same size and block hashes
+func fileKeys(sigInfo *SignatureInfo) ([]string, error) {
+	hashInfo, err := ComputeHashInfo(sigInfo)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	keys := make([]string, len(sigInfo.Container.Files))
+	var buf []byte
+	for fileIndex, f := range sigInfo.Container.Files {
+		buf = binary.AppendVarint(buf[:0], f.Size)
+		for _, bh := range hashInfo.Groups[int64(fileIndex)] {
+			buf = binary.LittleEndian.AppendUint32(buf, bh.WeakHash)
+			buf = append(buf, bh.StrongHash...)
+		}
+		keys[fileIndex] = string(buf)
+	}
+	return keys, nil
+}
@@ -0,0 +1,71 @@
+package pwr
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CompareSignatures(t *testing.T) {
+	dir, err := os.MkdirTemp("", "comparesigs")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	v1 := filepath.Join(dir, "v1")
+	wtest.MakeTestDir(t, v1, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "keep", Seed: 0x1, Size: BlockSize*2 + 3},
+			{Path: "changed", Seed: 0x2, Size: BlockSize + 5},
+			{Path: "gone", Seed: 0x3, Size: 128},
+			{Path: "moved-from", Seed: 0x4, Size: BlockSize * 2},
+			{Path: "copied-src", Seed: 0x5, Size: 256},
+			{Path: "empty-old", Data: []byte{}},
+		},
+	})
+
+	v2 := filepath.Join(dir, "v2")
+	wtest.MakeTestDir(t, v2, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "keep", Seed: 0x1, Size: BlockSize*2 + 3},
+			{Path: "changed", Seed: 0x9, Size: BlockSize + 5},
+			{Path: "subdir/moved-to", Seed: 0x4, Size: BlockSize * 2},
+			{Path: "copied-src", Seed: 0x5, Size: 256},
+			{Path: "copy", Seed: 0x5, Size: 256},
+			{Path: "new", Seed: 0x6, Size: 512},
+			{Path: "empty-new", Data: []byte{}},
+		},
+	})
+
+	sig := func(dir string) *SignatureInfo {
+		container, err := tlc.WalkAny(dir, tlc.WalkOpts{})
+		wtest.Must(t, err)
+		hashes, err := ComputeSignature(context.Background(), container, fspool.New(container, dir), &state.Consumer{})
+		wtest.Must(t, err)
+		return &SignatureInfo{Container: container, Hashes: hashes}
+	}
+	a, b := sig(v1), sig(v2)
+
+	changelog, err := CompareSignatures(a, b)
+	wtest.Must(t, err)
+	assert.Equal(t, []string{"changed"}, changelog.Changed)
+	assert.Equal(t, []string{"empty-new", "new"}, changelog.Added)
+	assert.Equal(t, []string{"empty-old", "gone"}, changelog.Removed)
+	assert.Equal(t, []FileMove{{OldPath: "moved-from", NewPath: "subdir/moved-to"}}, changelog.Renamed)
+	assert.Equal(t, []FileMove{{OldPath: "copied-src", NewPath: "copy"}}, changelog.Duplicated)
+	assert.False(t, changelog.IsEmpty())
+
+	changelog, err = CompareSignatures(a, a)
+	wtest.Must(t, err)
+	assert.True(t, changelog.IsEmpty())
+
+	b.BlockSize = 8 * 1024
+	_, err = CompareSignatures(a, b)
+	assert.Error(t, err)
+}
@@ -20,6 +20,16 @@ type Decompressor interface {
 	Apply(source savior.Source) (savior.Source, error)
 }
 
+// A RestartableSource is a decompressing source made of independent parts,
+// so decompression can start over at the beginning of any of them
+type RestartableSource interface {
+	savior.Source
+
+	// RestartPoint returns where decompression can start over to get to the
+	// current offset, both in the compressed and the decompressed stream
+	RestartPoint() (compressedOffset int64, decompressedOffset int64)
+}
+
 var compressors map[CompressionAlgorithm]Compressor
 var decompressors map[CompressionAlgorithm]Decompressor
 
@@ -57,6 +67,7 @@ func CompressWire(ctx *wire.WriteContext, compression *CompressionSettings) (*wi
 	}
 
 	if compression.Algorithm == CompressionAlgorithm_NONE {
+		ctx.SetChecksums(compression.Checksums)
 		return ctx, nil
 	}
 
@@ -70,40 +81,64 @@ func CompressWire(ctx *wire.WriteContext, compression *CompressionSettings) (*wi
 		return nil, errors.WithStack(err)
 	}
 
-	return wire.NewWriteContext(compressedWriter), nil
+	wctx := wire.NewWriteContext(compressedWriter)
+	wctx.SetChecksums(compression.Checksums)
+	return wctx, nil
 }
 
 // DecompressWire wraps a wire.ReadContext into a decompressor, according to the given settings,
 // so that any messages read through the returned ReadContext will first be decompressed.
 func DecompressWire(ctx *wire.ReadContext, compression *CompressionSettings) (*wire.ReadContext, error) {
+	rctx, _, err := DecompressWireSection(ctx, compression)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return rctx, nil
+}
+
+// DecompressWireSection is DecompressWire, but also returns the (compressed)
+// section of ctx's source the decompressor reads from, so callers can tell
+// how much of it has been read. The section starts at ctx's current offset.
+func DecompressWireSection(ctx *wire.ReadContext, compression *CompressionSettings) (*wire.ReadContext, savior.SeekSource, error) {
 	if compression == nil {
-		return nil, errors.Errorf("no compression specified")
+		return nil, nil, errors.Errorf("no compression specified")
 	}
 
 	originalSource, ok := ctx.GetSource().(savior.SeekSource)
 	if !ok {
-		return nil, errors.Errorf("can only DecompressWire when source is a savior.SeekSource")
+		return nil, nil, errors.Errorf("can only DecompressWire when source is a savior.SeekSource")
 	}
 
 	offset := originalSource.Tell()
 	size := originalSource.Size()
 	sectionSource, err := originalSource.Section(offset, size-offset)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, nil, errors.WithStack(err)
 	}
 
-	var finalSource savior.Source
+	finalSource, err := decompressSource(sectionSource, compression)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
 
-	if compression.Algorithm == CompressionAlgorithm_NONE {
-		finalSource = sectionSource
-	} else {
+	rctx := wire.NewReadContext(finalSource)
+	rctx.SetChecksums(compression.Checksums)
+	return rctx, sectionSource, nil
+}
+
+// decompressSource returns a source that decompresses source (which must
+// be at its start) according to the given settings, resumed from the start.
+func decompressSource(source savior.Source, compression *CompressionSettings) (savior.Source, error) {
+	finalSource := source
+
+	if compression.Algorithm != CompressionAlgorithm_NONE {
 		decompressor := decompressors[compression.Algorithm]
 		if decompressor == nil {
 			return nil, errors.Errorf("no decompressor registered for %s", compression.Algorithm.String())
 		}
 
 		var err error
-		finalSource, err = decompressor.Apply(sectionSource)
+		finalSource, err = decompressor.Apply(source)
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
@@ -118,5 +153,5 @@ func DecompressWire(ctx *wire.ReadContext, compression *CompressionSettings) (*w
 		return nil, errors.Errorf("expected source to resume at 0, got %d", finalOffset)
 	}
 
-	return wire.NewReadContext(finalSource), nil
+	return finalSource, nil
 }
@@ -3,7 +3,7 @@ package pwr
 import (
 	"encoding/binary"
 
-	"github.com/itchio/wharf/wsync"
+	"github.com/pkg/errors"
 )
 
 // Endianness defines the byte order of all fixed-size integers written or read by wharf
@@ -24,14 +24,41 @@ const (
 
 	// ZipIndexMagic is the magic number for wharf zip index files (.pzi)
 	ZipIndexMagic
+
+	// MultiBasePatchMagic is the magic number for wharf multi-base patch files (.pwrm)
+	MultiBasePatchMagic
+
+	// PatchTOCMagic is the magic number for tables of contents appended to patch files
+	PatchTOCMagic
+
+	// SealMagic is the magic number for seals, appended to wharf files or detached (.sig)
+	SealMagic
 )
 
 // ModeMask is or'd with files being applied/created
 const ModeMask = 0644
 
-// BlockSize is the standard block size files are broken into when ran through wharf's diff
+// BlockSize is the default block size files are broken into when ran through wharf's diff.
+// Patches and signatures that don't specify a block size use it.
 const BlockSize int64 = 64 * 1024 // 64k
 
-func mksync() *wsync.Context {
-	return wsync.NewContext(int(BlockSize))
+// MaxBlockSize is the largest block size patches and signatures may specify
+const MaxBlockSize int64 = 16 * 1024 * 1024 // 16M
+
+// EffectiveBlockSize returns the block size to use for a given header
+// value, where 0 stands for the default BlockSize.
+func EffectiveBlockSize(blockSize int64) int64 {
+	if blockSize == 0 {
+		return BlockSize
+	}
+	return blockSize
+}
+
+// ValidateBlockSize returns an error if blockSize can't be used
+// in a patch or a signature. 0 is valid and stands for BlockSize.
+func ValidateBlockSize(blockSize int64) error {
+	if blockSize < 0 || blockSize > MaxBlockSize {
+		return errors.Errorf("invalid block size %d (must be between 1 and %d)", blockSize, MaxBlockSize)
+	}
+	return nil
 }
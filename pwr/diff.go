@@ -28,6 +28,34 @@ type DiffContext struct {
 
 	TargetContainer *tlc.Container
 	TargetSignature []wsync.BlockHash
+	// TargetSignatureInfo (optional) describes how TargetSignature (or
+	// TargetChunks) was computed. When set, WritePatch refuses targets hashed
+	// with another block size, strong hash or chunking algorithm.
+	TargetSignatureInfo *SignatureInfo
+	// TargetLibrary (optional) is used instead of TargetSignature when set,
+	// see WriteBlockIndex. It's not closed by WritePatch.
+	TargetLibrary *wsync.BlockLibrary
+
+	// BlockSize (optional) defaults to BlockSize. TargetSignature must have
+	// been computed with the same block size.
+	BlockSize int64
+	// StrongHash (optional) defaults to MD5. TargetSignature must have
+	// been computed with the same algorithm.
+	StrongHash StrongHashAlgorithm
+
+	// Chunking (optional) defaults to FIXED_BLOCKS. When FASTCDC, the target
+	// is looked up in TargetChunks instead of TargetSignature, and the
+	// signature written also contains the source's chunk hashes.
+	Chunking     ChunkingAlgorithm
+	TargetChunks []wsync.ChunkHash
+
+	// Concurrency (optional) specifies the number of files to diff at once.
+	// A 0 value (default) diffs them sequentially. A negative value is added
+	// to the number of cores. Patches are identical either way.
+	Concurrency int
+	// PoolFactory returns a new pool for SourceContainer. Pools aren't safe
+	// for concurrent use, so it's required when Concurrency is non-zero.
+	PoolFactory func() (lake.Pool, error)
 
 	ReusedBytes int64
 	FreshBytes  int64
@@ -42,15 +70,37 @@ func (dctx *DiffContext) WritePatch(ctx context.Context, patchWriter io.Writer,
 		return errors.WithStack(fmt.Errorf("No compression settings specified, bailing out"))
 	}
 
+	err := ValidateBlockSize(dctx.BlockSize)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if dctx.Concurrency != 0 && dctx.PoolFactory == nil {
+		return errors.New("diff: PoolFactory is required when Concurrency is non-zero")
+	}
+
+	err = dctx.checkTarget()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	fd, err := dctx.newFileDiffer(nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
 	// signature header
 	rawSigWire := wire.NewWriteContext(signatureWriter)
-	err := rawSigWire.WriteMagic(SignatureMagic)
+	err = rawSigWire.WriteMagic(SignatureMagic)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
 	err = rawSigWire.WriteMessage(&SignatureHeader{
 		Compression: dctx.Compression,
+		BlockSize:   dctx.BlockSize,
+		StrongHash:  dctx.StrongHash,
+		Chunking:    dctx.Chunking,
 	})
 	if err != nil {
 		return errors.WithStack(err)
@@ -75,6 +125,7 @@ func (dctx *DiffContext) WritePatch(ctx context.Context, patchWriter io.Writer,
 
 	header := &PatchHeader{
 		Compression: dctx.Compression,
+		BlockSize:   dctx.BlockSize,
 	}
 
 	err = rawPatchWire.WriteMessage(header)
@@ -97,6 +148,89 @@ func (dctx *DiffContext) WritePatch(ctx context.Context, patchWriter io.Writer,
 		return errors.WithStack(err)
 	}
 
+	sigWriter := makeSigWriter(sigWire)
+
+	// chunk hashes go after all block hashes in the signature
+	var sourceChunks []wsync.ChunkHash
+	chunkWriter := func(ch wsync.ChunkHash) error {
+		sourceChunks = append(sourceChunks, ch)
+		return nil
+	}
+
+	if dctx.Concurrency != 0 {
+		err = dctx.writeFilesParallel(ctx, fd, patchWire, sigWriter, chunkWriter)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	} else {
+		err = dctx.writeFiles(ctx, fd, patchWire, sigWriter, chunkWriter)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	err = patchWire.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	chunkHash := &ChunkHash{}
+	for _, ch := range sourceChunks {
+		chunkHash.Reset()
+		chunkHash.Size = ch.Size
+		chunkHash.StrongHash = ch.StrongHash
+		err = sigWire.WriteMessage(chunkHash)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	err = sigWire.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// checkTarget returns an error if the target's hashes weren't computed with
+// the settings the source is about to be hashed with, since none of them
+// would ever match.
+func (dctx *DiffContext) checkTarget() error {
+	blockSize := EffectiveBlockSize(dctx.BlockSize)
+
+	if dctx.TargetLibrary != nil && dctx.Chunking == ChunkingAlgorithm_FIXED_BLOCKS {
+		lib := dctx.TargetLibrary
+		if lib.BlockSize() == 0 {
+			// in-memory library, nothing recorded to check against
+			return nil
+		}
+		if lib.BlockSize() != blockSize || lib.StrongHash() != int32(dctx.StrongHash) {
+			return errors.Errorf("diff: target library has block size %d and strong hash %s, but diffing with block size %d and strong hash %s",
+				lib.BlockSize(), StrongHashAlgorithm(lib.StrongHash()), blockSize, dctx.StrongHash)
+		}
+		return nil
+	}
+
+	sig := dctx.TargetSignatureInfo
+	if sig == nil {
+		return nil
+	}
+
+	if sig.EffectiveBlockSize() != blockSize || sig.StrongHash != dctx.StrongHash {
+		return errors.Errorf("diff: target signature has block size %d and strong hash %s, but diffing with block size %d and strong hash %s",
+			sig.EffectiveBlockSize(), sig.StrongHash, blockSize, dctx.StrongHash)
+	}
+
+	if dctx.Chunking == ChunkingAlgorithm_FASTCDC && sig.Chunking != ChunkingAlgorithm_FASTCDC {
+		return errors.Errorf("diff: target signature has no chunk hashes (chunking %s), but diffing with chunking %s", sig.Chunking, dctx.Chunking)
+	}
+
+	return nil
+}
+
+// writeFiles diffs all source files one after the other
+func (dctx *DiffContext) writeFiles(ctx context.Context, fd *fileDiffer, patchWire *wire.WriteContext, sigWriter wsync.SignatureWriter, chunkWriter wsync.ChunkSignatureWriter) (err error) {
 	sourceBytes := dctx.SourceContainer.Size
 	fileOffset := int64(0)
 
@@ -104,18 +238,8 @@ func (dctx *DiffContext) WritePatch(ctx context.Context, patchWriter io.Writer,
 		dctx.Consumer.Progress(float64(fileOffset+count) / float64(sourceBytes))
 	}
 
-	sigWriter := makeSigWriter(sigWire)
 	opsWriter := makeOpsWriter(patchWire, dctx)
 
-	diffContext := mksync()
-	signContext := mksync()
-	blockLibrary := wsync.NewBlockLibrary(dctx.TargetSignature)
-
-	targetContainerPathToIndex := make(map[string]int64)
-	for index, f := range dctx.TargetContainer.Files {
-		targetContainerPathToIndex[f.Path] = int64(index)
-	}
-
 	// re-used messages
 	syncHeader := &SyncHeader{}
 	syncDelimiter := &SyncOp{
@@ -146,27 +270,7 @@ func (dctx *DiffContext) WritePatch(ctx context.Context, patchWriter io.Writer,
 			return errors.WithStack(err)
 		}
 
-		var preferredFileIndex int64 = -1
-		if oldIndex, ok := targetContainerPathToIndex[f.Path]; ok {
-			preferredFileIndex = oldIndex
-		}
-
-		mr := multiread.New(counter.NewReaderCallback(onSourceRead, sourceReader))
-		diffReader := mr.Reader()
-		signReader := mr.Reader()
-
-		err := taskgroup.Do(
-			ctx,
-			func() error {
-				return diffContext.ComputeDiff(diffReader, blockLibrary, opsWriter, preferredFileIndex)
-			},
-			func() error {
-				return signContext.CreateSignature(ctx, int64(fileIndex), signReader, sigWriter)
-			},
-			func() error {
-				return mr.Do(ctx)
-			},
-		)
+		err = fd.diffFile(ctx, int64(fileIndex), counter.NewReaderCallback(onSourceRead, sourceReader), opsWriter, sigWriter, chunkWriter)
 		if err != nil {
 			return errors.WithStack(err)
 		}
@@ -177,15 +281,117 @@ func (dctx *DiffContext) WritePatch(ctx context.Context, patchWriter io.Writer,
 		}
 	}
 
-	err = patchWire.Close()
+	return nil
+}
+
+// A fileDiffer diffs files against the target, one at a time
+type fileDiffer struct {
+	dctx *DiffContext
+
+	diffContext  *wsync.Context
+	signContext  *wsync.Context
+	chunkContext *wsync.Context
+
+	blockLibrary *wsync.BlockLibrary
+	chunkLibrary *wsync.ChunkLibrary
+
+	targetContainerPathToIndex map[string]int64
+}
+
+// newFileDiffer returns a fileDiffer with its own sync contexts. Libraries
+// are read-only, so they're taken from like when it's non-nil.
+func (dctx *DiffContext) newFileDiffer(like *fileDiffer) (*fileDiffer, error) {
+	fd := &fileDiffer{dctx: dctx}
+
+	var err error
+	fd.diffContext, err = mksync(dctx.BlockSize, dctx.StrongHash)
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, errors.WithStack(err)
 	}
-	err = sigWire.Close()
+	fd.signContext, err = mksync(dctx.BlockSize, dctx.StrongHash)
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, errors.WithStack(err)
+	}
+
+	switch dctx.Chunking {
+	case ChunkingAlgorithm_FIXED_BLOCKS:
+		// nothing to set up
+	case ChunkingAlgorithm_FASTCDC:
+		fd.chunkContext, err = mksync(dctx.BlockSize, dctx.StrongHash)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	default:
+		return nil, errors.Errorf("unsupported chunking algorithm %s", dctx.Chunking)
+	}
+
+	if like != nil {
+		fd.blockLibrary = like.blockLibrary
+		fd.chunkLibrary = like.chunkLibrary
+		fd.targetContainerPathToIndex = like.targetContainerPathToIndex
+		return fd, nil
+	}
+
+	if fd.chunkContext != nil {
+		fd.chunkLibrary = wsync.NewChunkLibrary(dctx.TargetChunks)
+	} else if dctx.TargetLibrary != nil {
+		fd.blockLibrary = dctx.TargetLibrary
+	} else {
+		fd.blockLibrary = wsync.NewBlockLibrary(dctx.TargetSignature)
 	}
 
+	fd.targetContainerPathToIndex = make(map[string]int64)
+	for index, f := range dctx.TargetContainer.Files {
+		fd.targetContainerPathToIndex[f.Path] = int64(index)
+	}
+
+	return fd, nil
+}
+
+// diffFile sends the ops needed to rebuild a source file to opsWriter,
+// and its hashes to sigWriter (and chunkWriter, for FASTCDC)
+func (fd *fileDiffer) diffFile(ctx context.Context, fileIndex int64, sourceReader io.Reader, opsWriter wsync.OperationWriter, sigWriter wsync.SignatureWriter, chunkWriter wsync.ChunkSignatureWriter) error {
+	f := fd.dctx.SourceContainer.Files[fileIndex]
+
+	var preferredFileIndex int64 = -1
+	if oldIndex, ok := fd.targetContainerPathToIndex[f.Path]; ok {
+		preferredFileIndex = oldIndex
+	}
+
+	mr := multiread.New(sourceReader)
+	diffReader := mr.Reader()
+	signReader := mr.Reader()
+
+	tasks := []taskgroup.Task{
+		func() error {
+			return fd.signContext.CreateSignature(ctx, fileIndex, signReader, sigWriter)
+		},
+	}
+
+	if fd.chunkContext != nil {
+		chunkReader := mr.Reader()
+		tasks = append(tasks,
+			func() error {
+				return fd.diffContext.ComputeChunkDiff(ctx, diffReader, fd.chunkLibrary, opsWriter, preferredFileIndex)
+			},
+			func() error {
+				return fd.chunkContext.CreateChunkSignature(ctx, fileIndex, chunkReader, chunkWriter)
+			},
+		)
+	} else {
+		tasks = append(tasks, func() error {
+			return fd.diffContext.ComputeDiff(diffReader, fd.blockLibrary, opsWriter, preferredFileIndex)
+		})
+	}
+
+	tasks = append(tasks, func() error {
+		return mr.Do(ctx)
+	})
+
+	err := taskgroup.Do(ctx, tasks...)
+	if err != nil {
+		return errors.WithStack(err)
+	}
 	return nil
 }
 
@@ -201,17 +407,29 @@ func makeSigWriter(wc *wire.WriteContext) wsync.SignatureWriter {
 // ComputeNumBlocks returns the number of small blocks a file is made up of.
 // It returns a correct result even when the file's size is not a multiple of BlockSize
 func ComputeNumBlocks(fileSize int64) int64 {
-	return (fileSize + BlockSize - 1) / BlockSize
+	return ComputeNumBlocksWithBlockSize(fileSize, BlockSize)
+}
+
+// ComputeNumBlocksWithBlockSize is a variant of ComputeNumBlocks for
+// patches and signatures that use a non-default block size
+func ComputeNumBlocksWithBlockSize(fileSize int64, blockSize int64) int64 {
+	return (fileSize + blockSize - 1) / blockSize
 }
 
 // ComputeBlockSize returns the size of one of the file's blocks, given the size of the file
 // and the position of the block in the file. It'll return BlockSize for all blocks except
 // the last one, if the file size is not a multiple of BlockSize
 func ComputeBlockSize(fileSize int64, blockIndex int64) int64 {
-	if BlockSize*(blockIndex+1) > fileSize {
-		return fileSize % BlockSize
+	return ComputeBlockSizeWithBlockSize(fileSize, blockIndex, BlockSize)
+}
+
+// ComputeBlockSizeWithBlockSize is a variant of ComputeBlockSize for
+// patches and signatures that use a non-default block size
+func ComputeBlockSizeWithBlockSize(fileSize int64, blockIndex int64, blockSize int64) int64 {
+	if blockSize*(blockIndex+1) > fileSize {
+		return fileSize % blockSize
 	}
-	return BlockSize
+	return blockSize
 }
 
 func makeOpsWriter(wc *wire.WriteContext, dctx *DiffContext) wsync.OperationWriter {
@@ -219,6 +437,7 @@ func makeOpsWriter(wc *wire.WriteContext, dctx *DiffContext) wsync.OperationWrit
 	wop := &SyncOp{}
 
 	files := dctx.TargetContainer.Files
+	blockSize := EffectiveBlockSize(dctx.BlockSize)
 
 	return func(op wsync.Operation) error {
 		numOps++
@@ -233,8 +452,16 @@ func makeOpsWriter(wc *wire.WriteContext, dctx *DiffContext) wsync.OperationWrit
 
 			fileSize := files[op.FileIndex].Size
 			lastBlockIndex := op.BlockIndex + op.BlockSpan - 1
-			tailSize := ComputeBlockSize(fileSize, lastBlockIndex)
-			dctx.ReusedBytes += BlockSize*(op.BlockSpan-1) + tailSize
+			tailSize := ComputeBlockSizeWithBlockSize(fileSize, lastBlockIndex, blockSize)
+			dctx.ReusedBytes += blockSize*(op.BlockSpan-1) + tailSize
+
+		case wsync.OpByteRange:
+			wop.Type = SyncOp_BYTE_RANGE
+			wop.FileIndex = op.FileIndex
+			wop.Offset = op.Offset
+			wop.Size = op.Size
+
+			dctx.ReusedBytes += op.Size
 
 		case wsync.OpData:
 			wop.Type = SyncOp_DATA
@@ -0,0 +1,305 @@
+package pwr
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/itchio/headway/counter"
+	"github.com/itchio/lake"
+	"github.com/itchio/wharf/werrors"
+	"github.com/itchio/wharf/wire"
+	"github.com/itchio/wharf/wsync"
+	"github.com/pkg/errors"
+)
+
+// A diffResult holds everything a worker found out about a source file,
+// until it can be written to the patch in file order.
+type diffResult struct {
+	fileIndex int64
+
+	// serialized SyncOps, as they'd be written to the patch wire
+	opsFile *os.File
+	hashes  []wsync.BlockHash
+	chunks  []wsync.ChunkHash
+
+	reusedBytes int64
+	freshBytes  int64
+
+	// closed once the worker is done with this file
+	done chan struct{}
+	err  error
+}
+
+func (dr *diffResult) close() error {
+	if dr.opsFile == nil {
+		return nil
+	}
+
+	path := dr.opsFile.Name()
+	err := dr.opsFile.Close()
+	dr.opsFile = nil
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// writeFilesParallel diffs several source files at once, each worker
+// writing ops to a temporary file, then copies them to the patch
+// in file order so the output is the same as writeFiles'.
+func (dctx *DiffContext) writeFilesParallel(parentCtx context.Context, fd *fileDiffer, patchWire *wire.WriteContext, sigWriter wsync.SignatureWriter, chunkWriter wsync.ChunkSignatureWriter) (err error) {
+	if dctx.Pool != nil {
+		defer func() {
+			if fErr := dctx.Pool.Close(); fErr != nil && err == nil {
+				err = errors.WithStack(fErr)
+			}
+		}()
+	}
+
+	numWorkers := dctx.Concurrency
+	if numWorkers < 1 {
+		numWorkers += runtime.NumCPU()
+	}
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+
+	var workers []*diffWorker
+	defer func() {
+		for _, w := range workers {
+			if pErr := w.pool.Close(); pErr != nil && err == nil {
+				err = errors.WithStack(pErr)
+			}
+		}
+	}()
+
+	for i := 0; i < numWorkers; i++ {
+		wfd, err := dctx.newFileDiffer(fd)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		pool, err := dctx.PoolFactory()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		workers = append(workers, &diffWorker{fd: wfd, pool: pool})
+	}
+
+	ctx, cancel := context.WithCancel(parentCtx)
+	defer cancel()
+
+	// results that haven't been written yet, in file order.
+	// this also bounds the number of temporary files.
+	ordered := make(chan *diffResult, numWorkers*2)
+	jobs := make(chan *diffResult, numWorkers*2)
+
+	var doneBytes int64
+	sourceBytes := dctx.SourceContainer.Size
+	onSourceRead := func(count int64) {
+		done := atomic.AddInt64(&doneBytes, count)
+		dctx.Consumer.Progress(float64(done) / float64(sourceBytes))
+	}
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		defer close(ordered)
+
+		for fileIndex := range dctx.SourceContainer.Files {
+			res := &diffResult{
+				fileIndex: int64(fileIndex),
+				done:      make(chan struct{}),
+			}
+
+			select {
+			case ordered <- res:
+			case <-ctx.Done():
+				return
+			}
+
+			select {
+			case jobs <- res:
+			case <-ctx.Done():
+				// no worker will ever see it
+				res.err = werrors.ErrCancelled
+				close(res.done)
+				return
+			}
+		}
+	}()
+
+	for _, w := range workers {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for res := range jobs {
+				res.err = w.diff(ctx, dctx, res, onSourceRead)
+				close(res.done)
+			}
+		}()
+	}
+
+	err = dctx.writeResults(ordered, patchWire, sigWriter, chunkWriter)
+	if err != nil {
+		// stop everyone, and clean up the results we won't write
+		cancel()
+		for res := range ordered {
+			<-res.done
+			res.close()
+		}
+	}
+	wg.Wait()
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// writeResults writes results to the patch and signature as they come
+// in, which must be in file order
+func (dctx *DiffContext) writeResults(ordered chan *diffResult, patchWire *wire.WriteContext, sigWriter wsync.SignatureWriter, chunkWriter wsync.ChunkSignatureWriter) error {
+	// re-used messages
+	syncHeader := &SyncHeader{}
+	syncDelimiter := &SyncOp{
+		Type: SyncOp_HEY_YOU_DID_IT,
+	}
+
+	writeResult := func(res *diffResult) error {
+		<-res.done
+		defer res.close()
+
+		if res.err != nil {
+			return errors.WithStack(res.err)
+		}
+
+		dctx.Consumer.ProgressLabel(dctx.SourceContainer.Files[res.fileIndex].Path)
+
+		syncHeader.Reset()
+		syncHeader.FileIndex = res.fileIndex
+		err := patchWire.WriteMessage(syncHeader)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		_, err = res.opsFile.Seek(0, io.SeekStart)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		// ops were serialized by a wire.WriteContext, so
+		// they can be copied as-is
+		_, err = io.Copy(patchWire.Writer(), res.opsFile)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		err = patchWire.WriteMessage(syncDelimiter)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		for _, bh := range res.hashes {
+			err = sigWriter(bh)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		for _, ch := range res.chunks {
+			err = chunkWriter(ch)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		dctx.ReusedBytes += res.reusedBytes
+		dctx.FreshBytes += res.freshBytes
+		return nil
+	}
+
+	for res := range ordered {
+		err := writeResult(res)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// A diffWorker diffs files with its own contexts and pool
+type diffWorker struct {
+	fd   *fileDiffer
+	pool lake.Pool
+}
+
+// diff diffs a single source file into res. onSourceRead is called with
+// the number of source bytes read since its last call.
+func (w *diffWorker) diff(ctx context.Context, dctx *DiffContext, res *diffResult, onSourceRead func(count int64)) error {
+	var err error
+	res.opsFile, err = os.CreateTemp("", "wharf-diff-ops")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	bw := bufio.NewWriter(res.opsFile)
+
+	// only used for ops and accounting
+	local := &DiffContext{
+		TargetContainer: dctx.TargetContainer,
+		BlockSize:       dctx.BlockSize,
+	}
+	// ops are copied as-is into the patch, so they need the same framing
+	opsWire := wire.NewWriteContext(bw)
+	opsWire.SetChecksums(dctx.Compression.GetChecksums())
+	opsWriter := makeOpsWriter(opsWire, local)
+
+	sigWriter := func(bh wsync.BlockHash) error {
+		res.hashes = append(res.hashes, bh)
+		return nil
+	}
+	chunkWriter := func(ch wsync.ChunkHash) error {
+		res.chunks = append(res.chunks, ch)
+		return nil
+	}
+
+	sourceReader, err := w.pool.GetReader(res.fileIndex)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	lastCount := int64(0)
+	cr := counter.NewReaderCallback(func(count int64) {
+		onSourceRead(count - lastCount)
+		lastCount = count
+	}, sourceReader)
+
+	err = w.fd.diffFile(ctx, res.fileIndex, cr, opsWriter, sigWriter, chunkWriter)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	res.reusedBytes = local.ReusedBytes
+	res.freshBytes = local.FreshBytes
+	return nil
+}
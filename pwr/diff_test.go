@@ -0,0 +1,314 @@
+package pwr
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/wire"
+	"github.com/itchio/wharf/wsync"
+	"github.com/itchio/wharf/wtest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParallelDiff(t *testing.T) {
+	dir, err := os.MkdirTemp("", "paralleldiff")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	v1, v2, targetContainer, sourceContainer := makeDiffTestDirs(t, dir)
+
+	sc := &SignContext{Consumer: &state.Consumer{}}
+	targetSignature, err := sc.ComputeSignature(context.Background(), targetContainer, fspool.New(targetContainer, v1))
+	wtest.Must(t, err)
+	targetChunks, err := sc.ComputeChunkSignature(context.Background(), targetContainer, fspool.New(targetContainer, v1))
+	wtest.Must(t, err)
+
+	diff := func(chunking ChunkingAlgorithm, concurrency int) (*DiffContext, []byte, []byte) {
+		var progressMutex sync.Mutex
+		var maxProgress float64
+		consumer := &state.Consumer{
+			OnProgress: func(progress float64) {
+				progressMutex.Lock()
+				defer progressMutex.Unlock()
+				if progress > maxProgress {
+					maxProgress = progress
+				}
+			},
+		}
+
+		dctx := &DiffContext{
+			Compression: &CompressionSettings{
+				Algorithm: CompressionAlgorithm_NONE,
+			},
+			Consumer: consumer,
+
+			SourceContainer: sourceContainer,
+			Pool:            fspool.New(sourceContainer, v2),
+
+			TargetContainer: targetContainer,
+			TargetSignature: targetSignature,
+
+			Chunking:     chunking,
+			TargetChunks: targetChunks,
+
+			Concurrency: concurrency,
+			PoolFactory: func() (lake.Pool, error) {
+				return fspool.New(sourceContainer, v2), nil
+			},
+		}
+
+		patchBuffer := new(bytes.Buffer)
+		signatureBuffer := new(bytes.Buffer)
+		wtest.Must(t, dctx.WritePatch(context.Background(), patchBuffer, signatureBuffer))
+		assert.True(t, maxProgress > 0, "progress must be reported")
+		assert.True(t, maxProgress <= 1.0, "progress must not go over 1, got %f", maxProgress)
+		return dctx, patchBuffer.Bytes(), signatureBuffer.Bytes()
+	}
+
+	for _, chunking := range []ChunkingAlgorithm{ChunkingAlgorithm_FIXED_BLOCKS, ChunkingAlgorithm_FASTCDC} {
+		refCtx, refPatch, refSig := diff(chunking, 0)
+
+		for _, concurrency := range []int{1, 2, 8, -1} {
+			t.Logf("Diffing with %s, concurrency %d", chunking, concurrency)
+			dctx, patch, sig := diff(chunking, concurrency)
+			assert.Equal(t, refPatch, patch)
+			assert.Equal(t, refSig, sig)
+			assert.Equal(t, refCtx.ReusedBytes, dctx.ReusedBytes)
+			assert.Equal(t, refCtx.FreshBytes, dctx.FreshBytes)
+		}
+	}
+
+	t.Logf("Requiring a pool factory")
+	dctx := &DiffContext{
+		Compression: &CompressionSettings{
+			Algorithm: CompressionAlgorithm_NONE,
+		},
+		Consumer: &state.Consumer{},
+
+		SourceContainer: sourceContainer,
+		Pool:            fspool.New(sourceContainer, v2),
+
+		TargetContainer: targetContainer,
+		TargetSignature: targetSignature,
+
+		Concurrency: 2,
+	}
+	assert.Error(t, dctx.WritePatch(context.Background(), new(bytes.Buffer), new(bytes.Buffer)))
+}
+
+func Test_BlockIndexDiff(t *testing.T) {
+	dir, err := os.MkdirTemp("", "blockindexdiff")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	v1, v2, targetContainer, sourceContainer := makeDiffTestDirs(t, dir)
+
+	compression := &CompressionSettings{
+		Algorithm: CompressionAlgorithm_NONE,
+	}
+
+	// diffing against an empty container gives us v1's signature file
+	targetSigBuffer := new(bytes.Buffer)
+	sigDctx := &DiffContext{
+		Compression: compression,
+		Consumer:    &state.Consumer{},
+
+		SourceContainer: targetContainer,
+		Pool:            fspool.New(targetContainer, v1),
+
+		TargetContainer: &tlc.Container{},
+	}
+	wtest.Must(t, sigDctx.WritePatch(context.Background(), new(bytes.Buffer), targetSigBuffer))
+
+	sigSource := seeksource.FromBytes(targetSigBuffer.Bytes())
+	_, err = sigSource.Resume(nil)
+	wtest.Must(t, err)
+	indexPath := filepath.Join(dir, "v1.idx")
+	sigInfo, err := WriteBlockIndex(context.Background(), sigSource, indexPath)
+	wtest.Must(t, err)
+	assert.Equal(t, len(targetContainer.Files), len(sigInfo.Container.Files))
+	assert.Empty(t, sigInfo.Hashes)
+
+	library, err := wsync.OpenBlockLibrary(indexPath)
+	wtest.Must(t, err)
+	defer library.Close()
+
+	targetSignature, err := ComputeSignature(context.Background(), targetContainer, fspool.New(targetContainer, v1), &state.Consumer{})
+	wtest.Must(t, err)
+
+	diff := func(dctx *DiffContext) []byte {
+		patchBuffer := new(bytes.Buffer)
+		wtest.Must(t, dctx.WritePatch(context.Background(), patchBuffer, new(bytes.Buffer)))
+		return patchBuffer.Bytes()
+	}
+
+	inMemory := diff(&DiffContext{
+		Compression: compression,
+		Consumer:    &state.Consumer{},
+
+		SourceContainer: sourceContainer,
+		Pool:            fspool.New(sourceContainer, v2),
+
+		TargetContainer: targetContainer,
+		TargetSignature: targetSignature,
+	})
+
+	onDisk := diff(&DiffContext{
+		Compression: compression,
+		Consumer:    &state.Consumer{},
+
+		SourceContainer: sourceContainer,
+		Pool:            fspool.New(sourceContainer, v2),
+
+		TargetContainer: sigInfo.Container,
+		TargetLibrary:   library,
+	})
+
+	assert.Equal(t, inMemory, onDisk)
+
+	t.Logf("Refusing targets hashed with other settings")
+	targetSignatureInfo := &SignatureInfo{
+		Container: targetContainer,
+		Hashes:    targetSignature,
+	}
+	mismatched := []*DiffContext{
+		{
+			TargetContainer:     targetContainer,
+			TargetSignature:     targetSignature,
+			TargetSignatureInfo: targetSignatureInfo,
+			BlockSize:           BlockSize * 2,
+		},
+		{
+			TargetContainer:     targetContainer,
+			TargetSignature:     targetSignature,
+			TargetSignatureInfo: targetSignatureInfo,
+			StrongHash:          StrongHashAlgorithm_SHA256,
+		},
+		{
+			TargetContainer:     targetContainer,
+			TargetSignature:     targetSignature,
+			TargetSignatureInfo: targetSignatureInfo,
+			Chunking:            ChunkingAlgorithm_FASTCDC,
+		},
+		{
+			TargetContainer: sigInfo.Container,
+			TargetLibrary:   library,
+			BlockSize:       BlockSize * 2,
+		},
+		{
+			TargetContainer: sigInfo.Container,
+			TargetLibrary:   library,
+			StrongHash:      StrongHashAlgorithm_SHA256,
+		},
+	}
+	for _, dctx := range mismatched {
+		dctx.Compression = compression
+		dctx.Consumer = &state.Consumer{}
+		dctx.SourceContainer = sourceContainer
+		dctx.Pool = fspool.New(sourceContainer, v2)
+		assert.Error(t, dctx.WritePatch(context.Background(), new(bytes.Buffer), new(bytes.Buffer)))
+	}
+}
+
+func makeDiffTestDirs(t *testing.T, dir string) (string, string, *tlc.Container, *tlc.Container) {
+	v1 := filepath.Join(dir, "v1")
+	wtest.MakeTestDir(t, v1, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "big", Seed: 0x1, Size: BlockSize*20 + 14},
+			{Path: "moved-before", Seed: 0x2, Size: BlockSize * 3},
+			{Path: "empty", Data: []byte{}},
+			{Path: "subdir/small", Seed: 0x3, Size: 17},
+		},
+	})
+
+	v2 := filepath.Join(dir, "v2")
+	wtest.MakeTestDir(t, v2, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "big", Seed: 0x1, Size: BlockSize*20 + 14, Bsmods: []wtest.Bsmod{
+				{Interval: BlockSize/7 + 3, Delta: 0x4, Max: 4, Skip: 20},
+			}},
+			{Path: "moved-after", Seed: 0x2, Size: BlockSize * 3},
+			{Path: "empty", Data: []byte{}},
+			{Path: "subdir/small", Seed: 0x4, Size: 19},
+			{Path: "subdir/new", Seed: 0x5, Size: BlockSize*2 + 7},
+		},
+	})
+
+	targetContainer, err := tlc.WalkAny(v1, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	sourceContainer, err := tlc.WalkAny(v2, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	return v1, v2, targetContainer, sourceContainer
+}
+
+func Test_DiffChecksums(t *testing.T) {
+	dir, err := os.MkdirTemp("", "diffchecksums")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	v1, v2, targetContainer, sourceContainer := makeDiffTestDirs(t, dir)
+
+	targetSignature, err := ComputeSignature(context.Background(), targetContainer, fspool.New(targetContainer, v1), &state.Consumer{})
+	wtest.Must(t, err)
+
+	diff := func(concurrency int) ([]byte, []byte) {
+		dctx := &DiffContext{
+			Compression: &CompressionSettings{
+				Algorithm: CompressionAlgorithm_NONE,
+				Checksums: true,
+			},
+			Consumer: &state.Consumer{},
+
+			SourceContainer: sourceContainer,
+			Pool:            fspool.New(sourceContainer, v2),
+
+			TargetContainer: targetContainer,
+			TargetSignature: targetSignature,
+
+			Concurrency: concurrency,
+			PoolFactory: func() (lake.Pool, error) {
+				return fspool.New(sourceContainer, v2), nil
+			},
+		}
+
+		patchBuffer := new(bytes.Buffer)
+		signatureBuffer := new(bytes.Buffer)
+		wtest.Must(t, dctx.WritePatch(context.Background(), patchBuffer, signatureBuffer))
+		return patchBuffer.Bytes(), signatureBuffer.Bytes()
+	}
+
+	patch, sig := diff(0)
+	parallelPatch, _ := diff(2)
+	assert.Equal(t, patch, parallelPatch)
+
+	sigSource := seeksource.FromBytes(sig)
+	_, err = sigSource.Resume(nil)
+	wtest.Must(t, err)
+	sigInfo, err := ReadSignature(context.Background(), sigSource)
+	wtest.Must(t, err)
+	assert.Equal(t, sourceContainer.Stats(), sigInfo.Container.Stats())
+
+	pi, err := InspectPatch(seeksource.FromBytes(patch))
+	wtest.Must(t, err)
+	assert.Len(t, pi.Files, len(sourceContainer.Files))
+
+	corrupted := append([]byte(nil), patch...)
+	corrupted[len(corrupted)/2] ^= 0x10
+
+	_, err = InspectPatch(seeksource.FromBytes(corrupted))
+	assert.Error(t, err)
+	_, ok := errors.Cause(err).(*wire.ErrCorruptedMessage)
+	assert.True(t, ok, "should be a corruption error, got %+v", err)
+}
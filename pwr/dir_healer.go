@@ -0,0 +1,204 @@
+package pwr
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/itchio/headway/counter"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/headway/united"
+
+	"github.com/itchio/wharf/ctxcopy"
+
+	"github.com/itchio/lake"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+
+	"github.com/pkg/errors"
+)
+
+// A DirHealer can repair from a local directory laid out
+// according to the same container, like a pristine copy of the build.
+// Unlike ArchiveHealer, it only copies the wounded byte ranges of files.
+type DirHealer struct {
+	// the directory we should heal
+	Target string
+
+	// the directory we should heal from
+	SourceDir string
+
+	// A consumer to report progress to
+	Consumer *state.Consumer
+
+	// internal
+	woundsTally
+	progressMutex sync.Mutex
+	totalHealed   int64
+	totalHealthy  int64
+
+	container *tlc.Container
+
+	lockMap LockMap
+}
+
+var _ Healer = (*DirHealer)(nil)
+
+// Do starts receiving from the wounds channel and healing
+func (dh *DirHealer) Do(parentCtx context.Context, container *tlc.Container, wounds chan *Wound) error {
+	dh.container = container
+
+	wl := &woundsLoop{
+		consumer:      dh.Consumer,
+		target:        dh.Target,
+		container:     container,
+		tally:         &dh.woundsTally,
+		healFiles:     dh.heal,
+		onHealthyFile: dh.onHealthyFile,
+	}
+	return wl.run(parentCtx, wounds)
+}
+
+func (dh *DirHealer) heal(ctx context.Context, fileWounds chan *Wound) (rErr error) {
+	var currentIndex int64 = -1
+	var currentFile *os.File
+	preparedFiles := make(map[int64]bool)
+
+	sourcePool := fspool.New(dh.container, dh.SourceDir)
+
+	closeCurrent := func() error {
+		if currentFile == nil {
+			return nil
+		}
+
+		err := currentFile.Close()
+		currentFile = nil
+		currentIndex = -1
+		return err
+	}
+
+	defer func() {
+		if err := closeCurrent(); err != nil && rErr == nil {
+			rErr = errors.WithStack(err)
+		}
+
+		if err := sourcePool.Close(); err != nil && rErr == nil {
+			rErr = errors.WithStack(err)
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// something else stopped the healing
+			return nil
+		case wound, ok := <-fileWounds:
+			if !ok {
+				// no more wounds to heal
+				return nil
+			}
+
+			if wound.Index != currentIndex {
+				err := closeCurrent()
+				if err != nil {
+					return errors.WithStack(err)
+				}
+
+				currentFile, err = openWoundedFile(ctx, dh.lockMap, dh.Consumer, dh.Target, dh.container, wound.Index, !preparedFiles[wound.Index])
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				currentIndex = wound.Index
+				preparedFiles[wound.Index] = true
+			}
+
+			err := dh.healWound(ctx, sourcePool, currentFile, wound)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+}
+
+func (dh *DirHealer) healWound(ctx context.Context, sourcePool lake.Pool, file *os.File, wound *Wound) error {
+	f := dh.container.Files[wound.Index]
+
+	start := wound.Start
+	end := wound.End
+	if end > f.Size {
+		end = f.Size
+	}
+	if end <= start {
+		return nil
+	}
+
+	reader, err := sourcePool.GetReadSeeker(wound.Index)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = reader.Seek(start, io.SeekStart)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	lastCount := int64(0)
+	cw := counter.NewWriterCallback(func(count int64) {
+		dh.progressMutex.Lock()
+		dh.totalHealed += count - lastCount
+		dh.progressMutex.Unlock()
+		dh.updateProgress()
+		lastCount = count
+	}, io.NewOffsetWriter(file, start))
+
+	copied, err := ctxcopy.Do(ctx, cw, io.LimitReader(reader, end-start))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if copied != end-start {
+		return errors.Errorf("while healing %s: source file is too short (expected to copy %s at %s, got %s)",
+			f.Path, united.FormatBytes(end-start), united.FormatBytes(start), united.FormatBytes(copied))
+	}
+
+	dh.Consumer.Debugf("Healed %s wound %s into %s",
+		united.FormatBytes(end-start), united.FormatBytes(start), f.Path)
+
+	return nil
+}
+
+func (dh *DirHealer) onHealthyFile(size int64) {
+	dh.progressMutex.Lock()
+	dh.totalHealthy += size
+	dh.progressMutex.Unlock()
+	dh.updateProgress()
+}
+
+// TotalHealed returns the total amount of data written to disk
+// to repair the wounds.
+func (dh *DirHealer) TotalHealed() int64 {
+	dh.progressMutex.Lock()
+	defer dh.progressMutex.Unlock()
+	return dh.totalHealed
+}
+
+// SetConsumer gives this healer a consumer to report progress to
+func (dh *DirHealer) SetConsumer(consumer *state.Consumer) {
+	dh.Consumer = consumer
+}
+
+func (dh *DirHealer) updateProgress() {
+	if dh.Consumer == nil {
+		return
+	}
+
+	dh.progressMutex.Lock()
+	progress := float64(dh.totalHealthy+dh.totalHealed) / float64(dh.container.Size)
+	dh.Consumer.Progress(progress)
+	dh.progressMutex.Unlock()
+}
+
+func (dh *DirHealer) SetLockMap(lockMap LockMap) {
+	dh.lockMap = lockMap
+}
@@ -0,0 +1,515 @@
+package pwr
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/itchio/savior"
+	"github.com/itchio/wharf/wire"
+	"github.com/pkg/errors"
+)
+
+// EncryptionKeySize is the size of keys given to EncryptWire and DecryptWire, in bytes
+const EncryptionKeySize = 32
+
+// EncryptionChunkSize is the amount of data sealed in each chunk by EncryptWire.
+// Chunks are independent from each other, which is what lets DecryptWire
+// resume anywhere without starting over.
+const EncryptionChunkSize = 64 * 1024 // 64KiB
+
+// ErrDecryption is returned when an encrypted stream doesn't authenticate:
+// it was tampered with, truncated, or the key is wrong
+var ErrDecryption = errors.New("encrypted stream doesn't authenticate (wrong key, or corrupted)")
+
+const (
+	encryptionNonceSize  = 12
+	encryptionPrefixSize = 7
+	encryptionSaltSize   = 32
+	encryptionTagSize    = 16
+
+	encryptionKeyInfo = "wharf encrypted wire stream"
+)
+
+// EncryptWire writes an EncryptionHeader to ctx, and returns a WriteContext
+// through which anything written is encrypted with key, then written to ctx.
+//
+// To store compressed messages, encrypt first, then compress: CompressWire
+// takes the returned WriteContext, and DecompressWire the one returned by
+// DecryptWire.
+//
+// The returned WriteContext must be closed once everything is written (after
+// anything stacked on top of it), to write out the last chunk. That doesn't
+// close ctx's writer.
+//
+// Each stream is sealed with its own key, derived from key and a random salt,
+// so key can safely be reused across any number of streams.
+func EncryptWire(ctx *wire.WriteContext, key []byte) (*wire.WriteContext, error) {
+	header := &EncryptionHeader{
+		Algorithm: EncryptionAlgorithm_AES_256_GCM,
+		ChunkSize: EncryptionChunkSize,
+		Nonce:     make([]byte, encryptionPrefixSize),
+		Salt:      make([]byte, encryptionSaltSize),
+	}
+	_, err := rand.Read(header.Nonce)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	_, err = rand.Read(header.Salt)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	aead, additionalData, err := newEncryptionAEAD(header, key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = ctx.WriteMessage(header)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	cw := &chunkWriter{
+		writer:         ctx.Writer(),
+		aead:           aead,
+		additionalData: additionalData,
+		nonce:          encryptionNonce(header.Nonce),
+		buf:            make([]byte, 0, header.ChunkSize),
+	}
+	return wire.NewWriteContext(cw), nil
+}
+
+// DecryptWire reads an EncryptionHeader from ctx, and returns a ReadContext
+// through which the rest of ctx's source is decrypted with key, then read.
+// The encrypted stream must run until the end of ctx's source, which must
+// be a savior.SeekSource.
+//
+// Each chunk is authenticated before any of it is read, and errors wrap
+// ErrDecryption. The returned context's source is a savior.SeekSource
+// itself, and can resume from any offset.
+func DecryptWire(ctx *wire.ReadContext, key []byte) (*wire.ReadContext, error) {
+	header := &EncryptionHeader{}
+	err := ctx.ReadMessage(header)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if header.ChunkSize <= 0 || header.ChunkSize > math.MaxInt32 {
+		return nil, errors.Errorf("corrupted encryption header: invalid chunk size %d", header.ChunkSize)
+	}
+
+	if len(header.Nonce) != encryptionPrefixSize {
+		return nil, errors.Errorf("corrupted encryption header: expected %d-byte nonce, got %d bytes", encryptionPrefixSize, len(header.Nonce))
+	}
+
+	if len(header.Salt) != encryptionSaltSize {
+		return nil, errors.Errorf("corrupted encryption header: expected %d-byte salt, got %d bytes", encryptionSaltSize, len(header.Salt))
+	}
+
+	aead, additionalData, err := newEncryptionAEAD(header, key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	originalSource, ok := ctx.GetSource().(savior.SeekSource)
+	if !ok {
+		return nil, errors.Errorf("can only DecryptWire when source is a savior.SeekSource")
+	}
+
+	offset := originalSource.Tell()
+	encryptedSize := originalSource.Size() - offset
+	sectionSource, err := originalSource.Section(offset, encryptedSize)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// there's always at least one chunk, all of them end with a tag
+	sealedChunkSize := header.ChunkSize + encryptionTagSize
+	numChunks := (encryptedSize + sealedChunkSize - 1) / sealedChunkSize
+	if numChunks == 0 || encryptedSize-(numChunks-1)*sealedChunkSize < encryptionTagSize {
+		return nil, errors.Wrapf(ErrDecryption, "truncated stream (%d bytes)", encryptedSize)
+	}
+
+	ds := &decryptSource{
+		source:          sectionSource,
+		aead:            aead,
+		additionalData:  additionalData,
+		nonce:           encryptionNonce(header.Nonce),
+		chunkSize:       header.ChunkSize,
+		sealedChunkSize: sealedChunkSize,
+		numChunks:       numChunks,
+		encryptedSize:   encryptedSize,
+		sectionSize:     encryptedSize - numChunks*encryptionTagSize,
+		chunkIndex:      -1,
+	}
+
+	_, err = ds.Resume(nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return wire.NewReadContext(ds), nil
+}
+
+// newEncryptionAEAD returns the AEAD chunks of the stream described by header
+// are sealed with, and the additional data to seal them with, which binds
+// them to the header.
+func newEncryptionAEAD(header *EncryptionHeader, key []byte) (cipher.AEAD, []byte, error) {
+	if len(key) != EncryptionKeySize {
+		return nil, nil, errors.Errorf("invalid encryption key size: expected %d bytes, got %d", EncryptionKeySize, len(key))
+	}
+
+	additionalData, err := proto.Marshal(header)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	switch header.Algorithm {
+	case EncryptionAlgorithm_AES_256_GCM:
+		streamKey, err := hkdf.Key(sha256.New, key, header.Salt, encryptionKeyInfo, EncryptionKeySize)
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+
+		block, err := aes.NewCipher(streamKey)
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		return aead, additionalData, nil
+	default:
+		return nil, nil, errors.Errorf("unsupported encryption algorithm %s", header.Algorithm.String())
+	}
+}
+
+// encryptionNonce returns a nonce buffer for a stream, see setChunkNonce
+func encryptionNonce(prefix []byte) []byte {
+	nonce := make([]byte, encryptionNonceSize)
+	copy(nonce, prefix)
+	return nonce
+}
+
+// setChunkNonce makes nonce the one of a given chunk. Numbering chunks keeps
+// them from being reordered, and flagging the last one keeps the stream from
+// being truncated.
+func setChunkNonce(nonce []byte, chunkIndex int64, last bool) {
+	binary.BigEndian.PutUint32(nonce[encryptionPrefixSize:], uint32(chunkIndex))
+	if last {
+		nonce[encryptionNonceSize-1] = 1
+	} else {
+		nonce[encryptionNonceSize-1] = 0
+	}
+}
+
+// chunkWriter buffers up to a chunk's worth of data, then writes
+// it out sealed.
+type chunkWriter struct {
+	writer         io.Writer
+	aead           cipher.AEAD
+	additionalData []byte
+	nonce          []byte
+
+	buf        []byte
+	sealed     []byte
+	chunkIndex int64
+	closed     bool
+}
+
+var _ io.WriteCloser = (*chunkWriter)(nil)
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	if cw.closed {
+		return 0, errors.New("encryption: write to closed writer")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// full chunks are only sealed once there's more data, since
+		// the last one has to be flagged as such
+		if len(cw.buf) == cap(cw.buf) {
+			err := cw.flushChunk(false)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		n := cap(cw.buf) - len(cw.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		cw.buf = append(cw.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+func (cw *chunkWriter) flushChunk(last bool) error {
+	if cw.chunkIndex > math.MaxUint32 {
+		return errors.New("encryption: stream too large")
+	}
+
+	setChunkNonce(cw.nonce, cw.chunkIndex, last)
+	cw.sealed = cw.aead.Seal(cw.sealed[:0], cw.nonce, cw.buf, cw.additionalData)
+	cw.buf = cw.buf[:0]
+	cw.chunkIndex++
+
+	_, err := cw.writer.Write(cw.sealed)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// Close writes out any buffered data as the last chunk, which may be
+// empty. It does not close the underlying writer.
+func (cw *chunkWriter) Close() error {
+	if cw.closed {
+		return nil
+	}
+	cw.closed = true
+
+	return cw.flushChunk(true)
+}
+
+// decryptSource is a savior.SeekSource of the decrypted contents of
+// an encrypted stream, or of a section of them. Since chunks can be
+// decrypted in any order, checkpoints are just offsets.
+type decryptSource struct {
+	source          savior.SeekSource
+	aead            cipher.AEAD
+	additionalData  []byte
+	nonce           []byte
+	chunkSize       int64
+	sealedChunkSize int64
+	numChunks       int64
+	encryptedSize   int64
+
+	sectionStart int64
+	sectionSize  int64
+
+	// offset is relative to sectionStart
+	offset int64
+
+	reader     savior.SeekSource
+	sealed     []byte
+	chunk      []byte
+	chunkIndex int64
+	chunkPos   int
+
+	ssc      savior.SourceSaveConsumer
+	wantSave bool
+}
+
+var _ savior.SeekSource = (*decryptSource)(nil)
+
+func (ds *decryptSource) Features() savior.SourceFeatures {
+	return savior.SourceFeatures{
+		Name:          "decrypt",
+		ResumeSupport: savior.ResumeSupportBlock,
+	}
+}
+
+func (ds *decryptSource) SetSourceSaveConsumer(ssc savior.SourceSaveConsumer) {
+	ds.ssc = ssc
+}
+
+func (ds *decryptSource) WantSave() {
+	ds.wantSave = true
+}
+
+func (ds *decryptSource) Resume(c *savior.SourceCheckpoint) (int64, error) {
+	ds.offset = 0
+	if c != nil {
+		if c.Offset < 0 || c.Offset > ds.sectionSize {
+			return 0, errors.Errorf("decrypt: can't resume at %d, outside of %d-byte section", c.Offset, ds.sectionSize)
+		}
+		ds.offset = c.Offset
+	}
+
+	absoluteOffset := ds.sectionStart + ds.offset
+	chunkIndex := absoluteOffset / ds.chunkSize
+	if chunkIndex >= ds.numChunks {
+		// only happens at the very end of the stream
+		chunkIndex = ds.numChunks - 1
+	}
+
+	encryptedOffset := chunkIndex * ds.sealedChunkSize
+	reader, err := ds.source.Section(encryptedOffset, ds.encryptedSize-encryptedOffset)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	_, err = reader.Resume(nil)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	ds.reader = reader
+
+	ds.chunkIndex = chunkIndex - 1
+	err = ds.nextChunk()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	ds.chunkPos = int(absoluteOffset - chunkIndex*ds.chunkSize)
+	if ds.chunkPos > len(ds.chunk) {
+		return 0, errors.Errorf("decrypt: can't resume at %d, chunk %d is too short", ds.offset, chunkIndex)
+	}
+
+	return ds.offset, nil
+}
+
+// nextChunk reads, authenticates and decrypts the chunk after the current one
+func (ds *decryptSource) nextChunk() error {
+	chunkIndex := ds.chunkIndex + 1
+	if chunkIndex >= ds.numChunks {
+		return errors.WithStack(io.ErrUnexpectedEOF)
+	}
+
+	sealedSize := ds.sealedChunkSize
+	if remaining := ds.encryptedSize - chunkIndex*ds.sealedChunkSize; sealedSize > remaining {
+		sealedSize = remaining
+	}
+
+	if int64(cap(ds.sealed)) < sealedSize {
+		ds.sealed = make([]byte, ds.sealedChunkSize)
+	}
+	sealed := ds.sealed[:sealedSize]
+
+	_, err := io.ReadFull(ds.reader, sealed)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	setChunkNonce(ds.nonce, chunkIndex, chunkIndex == ds.numChunks-1)
+	ds.chunk, err = ds.aead.Open(ds.chunk[:0], ds.nonce, sealed, ds.additionalData)
+	if err != nil {
+		return errors.Wrapf(ErrDecryption, "in chunk %d", chunkIndex)
+	}
+
+	ds.chunkIndex = chunkIndex
+	ds.chunkPos = 0
+	return nil
+}
+
+func (ds *decryptSource) Tell() int64 {
+	return ds.offset
+}
+
+func (ds *decryptSource) Size() int64 {
+	return ds.sectionSize
+}
+
+func (ds *decryptSource) Section(start int64, size int64) (savior.SeekSource, error) {
+	if start < 0 || size < 0 {
+		return nil, errors.WithStack(fmt.Errorf("can't make section with negative start or size"))
+	}
+
+	if start+size > ds.sectionSize {
+		return nil, errors.WithStack(fmt.Errorf("section too large: start+size (%d) > original size (%d)", start+size, ds.sectionSize))
+	}
+
+	section := &decryptSource{
+		source:          ds.source,
+		aead:            ds.aead,
+		additionalData:  ds.additionalData,
+		nonce:           encryptionNonce(ds.nonce[:encryptionPrefixSize]),
+		chunkSize:       ds.chunkSize,
+		sealedChunkSize: ds.sealedChunkSize,
+		numChunks:       ds.numChunks,
+		encryptedSize:   ds.encryptedSize,
+
+		sectionStart: ds.sectionStart + start,
+		sectionSize:  size,
+
+		chunkIndex: -1,
+	}
+	return section, nil
+}
+
+func (ds *decryptSource) Read(buf []byte) (int, error) {
+	if ds.reader == nil {
+		return 0, errors.WithStack(savior.ErrUninitializedSource)
+	}
+
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	remaining := ds.sectionSize - ds.offset
+	if remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(buf)) > remaining {
+		buf = buf[:remaining]
+	}
+
+	ds.handleSave()
+	if ds.chunkPos == len(ds.chunk) {
+		err := ds.nextChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(buf, ds.chunk[ds.chunkPos:])
+	ds.chunkPos += n
+	ds.offset += int64(n)
+	return n, nil
+}
+
+func (ds *decryptSource) ReadByte() (byte, error) {
+	if ds.reader == nil {
+		return 0, errors.WithStack(savior.ErrUninitializedSource)
+	}
+
+	if ds.offset == ds.sectionSize {
+		return 0, io.EOF
+	}
+
+	ds.handleSave()
+	if ds.chunkPos == len(ds.chunk) {
+		err := ds.nextChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	b := ds.chunk[ds.chunkPos]
+	ds.chunkPos++
+	ds.offset++
+	return b, nil
+}
+
+func (ds *decryptSource) handleSave() {
+	if ds.wantSave {
+		ds.wantSave = false
+		if ds.ssc != nil {
+			ds.ssc.Save(&savior.SourceCheckpoint{
+				Offset: ds.offset,
+			})
+		}
+	}
+}
+
+func (ds *decryptSource) Progress() float64 {
+	// avoid NaNs
+	if ds.sectionSize > 0 {
+		return float64(ds.offset) / float64(ds.sectionSize)
+	}
+
+	return 0
+}
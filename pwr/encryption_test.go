@@ -0,0 +1,159 @@
+package pwr
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/wire"
+	"github.com/itchio/wharf/wtest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Encryption(t *testing.T) {
+	rng := rand.New(rand.NewSource(0x5eed))
+
+	key := make([]byte, EncryptionKeySize)
+	rng.Read(key)
+
+	compression := &CompressionSettings{
+		Algorithm: CompressionAlgorithm_NONE,
+		Checksums: true,
+	}
+
+	var ops []*SyncOp
+	for i := 0; i < 300; i++ {
+		data := make([]byte, 1000)
+		rng.Read(data)
+		ops = append(ops, &SyncOp{Type: SyncOp_DATA, Data: data})
+	}
+
+	// returns the stream, where its encryption header starts,
+	// and where its encrypted chunks start
+	encrypt := func() ([]byte, int, int) {
+		buf := new(bytes.Buffer)
+		rawWire := wire.NewWriteContext(buf)
+		wtest.Must(t, rawWire.WriteMagic(PatchMagic))
+		wtest.Must(t, rawWire.WriteMessage(&PatchHeader{Compression: compression}))
+
+		headerStart := buf.Len()
+		encryptedWire, err := EncryptWire(rawWire, key)
+		wtest.Must(t, err)
+		encryptedStart := buf.Len()
+		wctx, err := CompressWire(encryptedWire, compression)
+		wtest.Must(t, err)
+		for _, op := range ops {
+			wtest.Must(t, wctx.WriteMessage(op))
+		}
+		wtest.Must(t, wctx.Close())
+		wtest.Must(t, encryptedWire.Close())
+		return buf.Bytes(), headerStart, encryptedStart
+	}
+
+	stream, headerStart, encryptedStart := encrypt()
+	assert.False(t, bytes.Contains(stream, ops[0].Data[:64]), "data must not be stored in the clear")
+
+	open := func(stream []byte, key []byte) (*wire.ReadContext, error) {
+		source := seeksource.FromBytes(stream)
+		_, err := source.Resume(nil)
+		wtest.Must(t, err)
+
+		rawWire := wire.NewReadContext(source)
+		wtest.Must(t, rawWire.ExpectMagic(PatchMagic))
+		header := &PatchHeader{}
+		wtest.Must(t, rawWire.ReadMessage(header))
+
+		decryptedWire, err := DecryptWire(rawWire, key)
+		if err != nil {
+			return nil, err
+		}
+		return DecompressWire(decryptedWire, header.Compression)
+	}
+
+	readAll := func(rctx *wire.ReadContext, start int) error {
+		op := &SyncOp{}
+		for i := start; i < len(ops); i++ {
+			err := rctx.ReadMessage(op)
+			if err != nil {
+				return err
+			}
+			assert.Equal(t, ops[i].Data, op.Data)
+		}
+		return rctx.ReadMessage(op)
+	}
+
+	rctx, err := open(stream, key)
+	wtest.Must(t, err)
+	err = readAll(rctx, 0)
+	assert.True(t, errors.Cause(err) == io.EOF, "stream must end after the last message")
+
+	// resume from a checkpoint made somewhere in the middle
+	rctx, err = open(stream, key)
+	wtest.Must(t, err)
+
+	var checkpoint *wire.MessageReaderCheckpoint
+	var checkpointIndex int
+	op := &SyncOp{}
+	for i := 0; i < len(ops)/2; i++ {
+		if i == len(ops)/3 {
+			rctx.WantSave()
+		}
+		wtest.Must(t, rctx.ReadMessage(op))
+		if c := rctx.PopCheckpoint(); c != nil {
+			checkpoint = c
+			checkpointIndex = i + 1
+		}
+	}
+	assert.NotNil(t, checkpoint)
+
+	rctx, err = open(stream, key)
+	wtest.Must(t, err)
+	wtest.Must(t, rctx.Resume(checkpoint))
+	err = readAll(rctx, checkpointIndex)
+	assert.True(t, errors.Cause(err) == io.EOF)
+
+	// wrong key
+	otherKey := append([]byte(nil), key...)
+	otherKey[0] ^= 0x1
+	_, err = open(stream, otherKey)
+	assert.True(t, errors.Cause(err) == ErrDecryption)
+
+	// tampered chunk
+	tampered := append([]byte(nil), stream...)
+	tampered[len(tampered)/2] ^= 0x1
+	rctx, err = open(tampered, key)
+	wtest.Must(t, err)
+	err = readAll(rctx, 0)
+	assert.True(t, errors.Cause(err) == ErrDecryption)
+
+	// same data and key, but a different salt, so a different stream
+	otherStream, _, otherEncryptedStart := encrypt()
+	assert.Equal(t, len(stream), len(otherStream))
+	assert.NotEqual(t, stream[encryptedStart:], otherStream[otherEncryptedStart:])
+
+	// chunks are bound to their stream's header
+	swapped := append([]byte(nil), stream[:encryptedStart]...)
+	swapped = append(swapped, otherStream[otherEncryptedStart:]...)
+	_, err = open(swapped, key)
+	assert.True(t, errors.Cause(err) == ErrDecryption)
+
+	// tampered header (the last byte of the salt)
+	tampered = append([]byte(nil), stream...)
+	tampered[encryptedStart-1] ^= 0x1
+	assert.True(t, encryptedStart-1 > headerStart)
+	_, err = open(tampered, key)
+	assert.True(t, errors.Cause(err) == ErrDecryption)
+
+	// truncated at a chunk boundary
+	sealedChunkSize := EncryptionChunkSize + encryptionTagSize
+	numChunks := (len(stream) - encryptedStart + sealedChunkSize - 1) / sealedChunkSize
+	assert.True(t, numChunks > 2)
+	truncated := stream[:encryptedStart+(numChunks-1)*sealedChunkSize]
+	rctx, err = open(truncated, key)
+	wtest.Must(t, err)
+	err = readAll(rctx, 0)
+	assert.True(t, errors.Cause(err) == ErrDecryption)
+}
@@ -1,8 +1,11 @@
 package genie
 
 import (
+	"fmt"
+
 	"github.com/itchio/lake/tlc"
 	"github.com/itchio/savior"
+	"github.com/itchio/wharf/bsdiff"
 	"github.com/itchio/wharf/pwr"
 	"github.com/itchio/wharf/wire"
 	"github.com/pkg/errors"
@@ -15,8 +18,19 @@ type CompositionListener func(comp *Composition)
 type Genie struct {
 	BlockSize int64
 
+	// the block size the patch's rsync operations are expressed in,
+	// read by ParseHeader
+	smallBlockSize int64
+
 	PatchWire *wire.ReadContext
 
+	// Header is read by ParseHeader
+	Header *pwr.PatchHeader
+
+	// the part of the patch file PatchWire decompresses, and where it starts
+	patchSection       savior.SeekSource
+	patchSectionOffset int64
+
 	TargetContainer *tlc.Container
 	SourceContainer *tlc.Container
 }
@@ -37,11 +51,20 @@ func (g *Genie) ParseHeader(patchReader savior.SeekSource) error {
 		return errors.WithStack(err)
 	}
 
-	patchWire, err := pwr.DecompressWire(rawPatchWire, header.Compression)
+	err = pwr.ValidateBlockSize(header.BlockSize)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	g.smallBlockSize = pwr.EffectiveBlockSize(header.BlockSize)
+	g.Header = header
+
+	g.patchSectionOffset = patchReader.Tell()
+	patchWire, patchSection, err := pwr.DecompressWireSection(rawPatchWire, header.Compression)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 	g.PatchWire = patchWire
+	g.patchSection = patchSection
 
 	g.TargetContainer = &tlc.Container{}
 	err = patchWire.ReadMessage(g.TargetContainer)
@@ -58,14 +81,30 @@ func (g *Genie) ParseHeader(patchReader savior.SeekSource) error {
 	return nil
 }
 
-// ParseContents sends a Composition for each block of the source container
+// ParseContents sends a Composition for each block of the source container.
+// Blocks of files patched with bsdiff are made of BsdiffOrigins and
+// FreshOrigins.
 func (g *Genie) ParseContents(onComp CompositionListener) error {
+	return g.parseContents(onComp, nil)
+}
+
+// seriesListener is called with the offsets in the patch file between
+// which a file's series was read. For compressed patches, those are only
+// upper bounds, since decompressors read ahead.
+type seriesListener func(fileIndex int64, start int64, end int64)
+
+func (g *Genie) parseContents(onComp CompositionListener, onSeries seriesListener) error {
 	patchWire := g.PatchWire
 
 	// for each file, the patch contains a SyncHeader followed by a series of
 	// operations, always ending in HEY_YOU_DID_IT
 	sh := &pwr.SyncHeader{}
 	for fileIndex, f := range g.SourceContainer.Files {
+		var start int64
+		if onSeries != nil {
+			start = g.patchOffset()
+		}
+
 		sh.Reset()
 		err := patchWire.ReadMessage(sh)
 		if err != nil {
@@ -76,24 +115,107 @@ func (g *Genie) ParseContents(onComp CompositionListener) error {
 			return errors.Errorf("Malformed patch: expected fileIndex = %d, got fileIndex %d", fileIndex, sh.FileIndex)
 		}
 
-		err = g.analyzeFile(patchWire, int64(fileIndex), f.Size, onComp)
+		c := &composer{
+			bigBlockSize: g.BlockSize,
+			onComp:       onComp,
+			comp: &Composition{
+				FileIndex: int64(fileIndex),
+			},
+		}
+
+		switch sh.Type {
+		case pwr.SyncHeader_RSYNC:
+			err = g.analyzeFile(patchWire, c)
+		case pwr.SyncHeader_BSDIFF:
+			err = g.analyzeBsdiff(patchWire, c)
+		default:
+			err = errors.Errorf("Malformed patch: unknown patch series kind %d", sh.Type)
+		}
 		if err != nil {
 			return errors.WithStack(err)
 		}
+
+		if c.comp.Size > 0 && f.Size > 0 {
+			onComp(c.comp)
+		}
+
+		if onSeries != nil {
+			onSeries(int64(fileIndex), start, g.patchOffset())
+		}
 	}
 
 	return nil
 }
 
-func (g *Genie) analyzeFile(patchWire *wire.ReadContext, fileIndex int64, fileSize int64, onComp CompositionListener) error {
-	rop := &pwr.SyncOp{}
+// patchOffset returns how far into the patch file has been read
+func (g *Genie) patchOffset() int64 {
+	return g.patchSectionOffset + g.patchSection.Tell()
+}
+
+// A composer turns a file's origins, in order, into compositions
+// of bigBlockSize bytes
+type composer struct {
+	bigBlockSize int64
+	onComp       CompositionListener
+
+	// the composition being built
+	comp *Composition
+}
+
+func (c *composer) add(origin Origin) {
+	// As long as the origin would span beyond the end of the big block
+	// we're currently analyzing, split it into {A, B}, where A fits into
+	// the current big block, and B is the rest
+	for c.comp.Size+origin.GetSize() > c.bigBlockSize {
+		truncatedSize := c.bigBlockSize - c.comp.Size
+
+		// truncatedSize may be 0 if `comp.Size == bigBlockSize`, ie. comp already
+		// explains all the contents of the current big block - in this case,
+		// we keep this origin intact for the next iteration of the loop
+		// (during which comp.Size will == 0)
+		if truncatedSize > 0 {
+			var head Origin
+			head, origin = splitOrigin(origin, truncatedSize)
+			c.comp.Append(head)
+		}
 
-	smallBlockSize := int64(pwr.BlockSize)
-	bigBlockSize := g.BlockSize
+		c.onComp(c.comp)
 
-	comp := &Composition{
-		FileIndex: int64(fileIndex),
+		// after sending over the composition, we allocate a new one - same file, next block
+		// (sent comps should not be modified afterwards)
+		c.comp = &Composition{
+			FileIndex:  c.comp.FileIndex,
+			BlockIndex: c.comp.BlockIndex + 1,
+		}
+	}
+
+	// after all the splitting, there might still be some data left over
+	// (that's smaller than bigBlockSize)
+	if origin.GetSize() > 0 {
+		c.comp.Append(origin)
+	}
+}
+
+// splitOrigin returns the first size bytes of origin, and the rest
+func splitOrigin(origin Origin, size int64) (Origin, Origin) {
+	switch o := origin.(type) {
+	case *BlockOrigin:
+		return &BlockOrigin{FileIndex: o.FileIndex, Offset: o.Offset, Size: size},
+			&BlockOrigin{FileIndex: o.FileIndex, Offset: o.Offset + size, Size: o.Size - size}
+	case *BsdiffOrigin:
+		return &BsdiffOrigin{FileIndex: o.FileIndex, Offset: o.Offset, Size: size},
+			&BsdiffOrigin{FileIndex: o.FileIndex, Offset: o.Offset + size, Size: o.Size - size}
+	case *FreshOrigin:
+		return &FreshOrigin{Size: size}, &FreshOrigin{Size: o.Size - size}
+	default:
+		panic(fmt.Sprintf("genie: can't split origin %T", origin))
 	}
+}
+
+func (g *Genie) analyzeFile(patchWire *wire.ReadContext, c *composer) error {
+	rop := &pwr.SyncOp{}
+
+	smallBlockSize := g.smallBlockSize
 
 	// infinite loop, explicitly "break"'d out of
 	for {
@@ -104,89 +226,96 @@ func (g *Genie) analyzeFile(patchWire *wire.ReadContext, fileIndex int64, fileSi
 		}
 
 		switch rop.Type {
-		case pwr.SyncOp_BLOCK_RANGE:
+		case pwr.SyncOp_BLOCK_RANGE, pwr.SyncOp_BYTE_RANGE:
 			// SyncOps operate in terms of small blocks, we want byte offsets
 			bo := &BlockOrigin{
 				FileIndex: rop.FileIndex,
 				Offset:    rop.BlockIndex * smallBlockSize,
 				Size:      rop.BlockSpan * smallBlockSize,
 			}
+			if rop.Type == pwr.SyncOp_BYTE_RANGE {
+				// ...except for these, which are already in bytes
+				bo.Offset = rop.Offset
+				bo.Size = rop.Size
+			}
 
-			// As long as the block origin would span beyond the end of the
-			// big block we're currently analyzing, split it into {A, B},
-			// where A fits into the current big block, and B is the rest
-			for comp.Size+bo.Size > bigBlockSize {
-				truncatedSize := bigBlockSize - comp.Size
-
-				// truncatedSize may be 0 if `comp.Size == bigBlockSize`, ie. comp already
-				// explains all the contents of the current big block - in this case,
-				// we keep this BlockOrigin intact for the next iteration of the loop
-				// (during which comp.Size will == 0)
-				if truncatedSize > 0 {
-					// this is A
-					comp.Append(&BlockOrigin{
-						FileIndex: rop.FileIndex,
-						Offset:    bo.Offset,
-						Size:      truncatedSize,
-					})
-
-					// and bo becomes B
-					bo.Offset += truncatedSize
-					bo.Size -= truncatedSize
-				}
-
-				onComp(comp)
-
-				// after sending over the composition, we allocate a new one - same file, next block
-				// (sent comps should not be modified afterwards)
-				comp = &Composition{
-					FileIndex:  int64(fileIndex),
-					BlockIndex: comp.BlockIndex + 1,
-				}
+			if rop.FileIndex < 0 || rop.FileIndex >= int64(len(g.TargetContainer.Files)) {
+				return errors.Errorf("Malformed patch: op refers to target file %d", rop.FileIndex)
 			}
 
-			// after all the splitting, there might still be some data left over
-			// (that's smaller than bigBlockSize)
-			if bo.Size > 0 {
-				comp.Append(bo)
+			// the last block of a file may be short
+			targetSize := g.TargetContainer.Files[rop.FileIndex].Size
+			if bo.Offset+bo.Size > targetSize {
+				bo.Size = targetSize - bo.Offset
 			}
+
+			c.add(bo)
 		case pwr.SyncOp_DATA:
 			// Data SyncOps are not aligned either in target or source. Since genie
 			// works in byte offsets, this suits us just fine.
-			fo := &FreshOrigin{
+			c.add(&FreshOrigin{
 				Size: int64(len(rop.Data)),
-			}
+			})
+		case pwr.SyncOp_HEY_YOU_DID_IT:
+			return nil
+		}
+	}
+}
 
-			for comp.Size+fo.Size > bigBlockSize {
-				truncatedSize := bigBlockSize - comp.Size
+// analyzeBsdiff reads a bsdiff series, up to and including its delimiter.
+// Added bytes depend on the old file (and on the patch), copied bytes
+// only on the patch.
+func (g *Genie) analyzeBsdiff(patchWire *wire.ReadContext, c *composer) error {
+	bh := &pwr.BsdiffHeader{}
+	err := patchWire.ReadMessage(bh)
+	if err != nil {
+		return errors.WithStack(err)
+	}
 
-				// only if we can fit some of the data in this block, otherwise, clear
-				// the current comp, wait for next loop iteration where comp.Size will be 0
-				if truncatedSize > 0 {
-					comp.Append(&FreshOrigin{
-						Size: truncatedSize,
-					})
+	targetIndex := bh.TargetIndex
+	if targetIndex < 0 || targetIndex >= int64(len(g.TargetContainer.Files)) {
+		return errors.Errorf("Malformed patch: bsdiff series refers to target file %d", targetIndex)
+	}
 
-					fo.Size -= truncatedSize
-				}
+	var oldOffset int64
+	ctrl := &bsdiff.Control{}
+	for {
+		ctrl.Reset()
+		err = patchWire.ReadMessage(ctrl)
+		if err != nil {
+			return errors.WithStack(err)
+		}
 
-				onComp(comp)
+		if ctrl.Eof {
+			break
+		}
 
-				// allocate a new comp after sending, so we don't write to the previous one
-				comp = &Composition{
-					FileIndex:  int64(fileIndex),
-					BlockIndex: comp.BlockIndex + 1,
-				}
-			}
+		if len(ctrl.Add) > 0 {
+			c.add(&BsdiffOrigin{
+				FileIndex: targetIndex,
+				Offset:    oldOffset,
+				Size:      int64(len(ctrl.Add)),
+			})
+			oldOffset += int64(len(ctrl.Add))
+		}
 
-			if fo.Size > 0 {
-				comp.Append(fo)
-			}
-		case pwr.SyncOp_HEY_YOU_DID_IT:
-			if comp.Size > 0 && fileSize > 0 {
-				onComp(comp)
-			}
-			return nil
+		if len(ctrl.Copy) > 0 {
+			c.add(&FreshOrigin{
+				Size: int64(len(ctrl.Copy)),
+			})
 		}
+
+		oldOffset += ctrl.Seek
 	}
+
+	rop := &pwr.SyncOp{}
+	err = patchWire.ReadMessage(rop)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if rop.Type != pwr.SyncOp_HEY_YOU_DID_IT {
+		return errors.Errorf("Malformed patch: expected sentinel SyncOp after bsdiff series, got %s", rop.Type)
+	}
+	return nil
 }
@@ -0,0 +1,225 @@
+package genie_test
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/pwr/genie"
+	"github.com/itchio/wharf/pwr/rediff"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_GenieBsdiff(t *testing.T) {
+	dir, err := os.MkdirTemp("", "geniebsdiff")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	tp := makeTestPatches(t, dir, noCompression)
+
+	patchReader := seeksource.FromBytes(tp.optimizedPatch)
+	_, err = patchReader.Resume(nil)
+	wtest.Must(t, err)
+
+	g := &genie.Genie{
+		BlockSize: pwr.BlockSize * 4,
+	}
+	wtest.Must(t, g.ParseHeader(patchReader))
+
+	sizes := make(map[int64]int64)
+	numBsdiffOrigins := 0
+	wtest.Must(t, g.ParseContents(func(comp *genie.Composition) {
+		assert.True(t, comp.Size <= g.BlockSize)
+		assert.EqualValues(t, sizes[comp.FileIndex], comp.BlockIndex*g.BlockSize, "%s", comp)
+		sizes[comp.FileIndex] += comp.Size
+
+		for _, origin := range comp.Origins {
+			if bo, ok := origin.(*genie.BsdiffOrigin); ok {
+				numBsdiffOrigins++
+				targetFile := g.TargetContainer.Files[bo.FileIndex]
+				assert.Equal(t, "big", targetFile.Path)
+				assert.True(t, bo.Offset+bo.Size <= targetFile.Size)
+			}
+		}
+	}))
+
+	assert.True(t, numBsdiffOrigins > 0)
+	for fileIndex, f := range g.SourceContainer.Files {
+		assert.Equal(t, f.Size, sizes[int64(fileIndex)], "%s should be fully explained", f.Path)
+	}
+}
+
+func Test_GenieShortBlocks(t *testing.T) {
+	dir, err := os.MkdirTemp("", "genieshortblocks")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	// the new file is a fresh block followed by the old one, whose last
+	// block is short, and gets copied at the very end of the new file
+	rng := rand.New(rand.NewSource(0x1))
+	oldData := make([]byte, pwr.BlockSize+14)
+	rng.Read(oldData)
+	newData := make([]byte, pwr.BlockSize)
+	rng.Read(newData)
+	newData = append(newData, oldData...)
+
+	v1 := filepath.Join(dir, "v1")
+	wtest.MakeTestDir(t, v1, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "file", Data: oldData},
+		},
+	})
+
+	v2 := filepath.Join(dir, "v2")
+	wtest.MakeTestDir(t, v2, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "file", Data: newData},
+		},
+	})
+
+	oldSig := makeSignature(t, v1)
+	newSig := makeSignature(t, v2)
+
+	dctx := &pwr.DiffContext{
+		Compression: noCompression,
+		Consumer:    &state.Consumer{},
+
+		SourceContainer: newSig.Container,
+		Pool:            fspool.New(newSig.Container, v2),
+
+		TargetContainer: oldSig.Container,
+		TargetSignature: oldSig.Hashes,
+	}
+
+	patchBuffer := new(bytes.Buffer)
+	wtest.Must(t, dctx.WritePatch(context.Background(), patchBuffer, new(bytes.Buffer)))
+	assert.EqualValues(t, pwr.BlockSize+14, dctx.ReusedBytes)
+
+	patchReader := seeksource.FromBytes(patchBuffer.Bytes())
+	_, err = patchReader.Resume(nil)
+	wtest.Must(t, err)
+
+	g := &genie.Genie{
+		BlockSize: pwr.BlockSize,
+	}
+	wtest.Must(t, g.ParseHeader(patchReader))
+
+	targetSize := oldSig.Container.Files[0].Size
+	var size int64
+	wtest.Must(t, g.ParseContents(func(comp *genie.Composition) {
+		size += comp.Size
+		for _, origin := range comp.Origins {
+			if bo, ok := origin.(*genie.BlockOrigin); ok {
+				// block ranges are in (small) blocks, but origins
+				// stop at the end of the target file.
+				assert.True(t, bo.Offset+bo.Size <= targetSize, "%s", comp)
+			}
+		}
+	}))
+	assert.Equal(t, newSig.Container.Files[0].Size, size)
+}
+
+var noCompression = &pwr.CompressionSettings{
+	Algorithm: pwr.CompressionAlgorithm_NONE,
+}
+
+type testPatches struct {
+	v1, v2 string
+
+	oldSig, newSig *pwr.SignatureInfo
+
+	// patch is a regular rsync patch, optimizedPatch has a bsdiff
+	// series for "big"
+	patch          []byte
+	optimizedPatch []byte
+}
+
+func makeTestPatches(t *testing.T, dir string, compression *pwr.CompressionSettings) *testPatches {
+	v1 := filepath.Join(dir, "v1")
+	wtest.MakeTestDir(t, v1, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "big", Seed: 0x1, Size: pwr.BlockSize*12 + 14},
+			{Path: "moved-before", Seed: 0x2, Size: pwr.BlockSize * 3},
+			{Path: "empty", Data: []byte{}},
+			{Path: "subdir/small", Seed: 0x3, Size: 17},
+		},
+	})
+
+	v2 := filepath.Join(dir, "v2")
+	wtest.MakeTestDir(t, v2, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "big", Seed: 0x1, Size: pwr.BlockSize*12 + 14, Bsmods: []wtest.Bsmod{
+				{Interval: pwr.BlockSize/3 + 3, Delta: 0x4, Max: 3, Skip: 20},
+			}},
+			{Path: "moved-after", Seed: 0x2, Size: pwr.BlockSize * 3},
+			{Path: "shifted", Chunks: []wtest.TestDirChunk{
+				{Seed: 0x4, Size: 12},
+				{Seed: 0x2, Size: pwr.BlockSize * 2},
+			}},
+			{Path: "empty", Data: []byte{}},
+			{Path: "subdir/small", Seed: 0x3, Size: 17},
+			{Path: "subdir/new", Seed: 0x5, Size: pwr.BlockSize*2 + 7},
+		},
+	})
+
+	oldSig := makeSignature(t, v1)
+	newSig := makeSignature(t, v2)
+
+	dctx := &pwr.DiffContext{
+		Compression: compression,
+		Consumer:    &state.Consumer{},
+
+		SourceContainer: newSig.Container,
+		Pool:            fspool.New(newSig.Container, v2),
+
+		TargetContainer: oldSig.Container,
+		TargetSignature: oldSig.Hashes,
+	}
+
+	patchBuffer := new(bytes.Buffer)
+	wtest.Must(t, dctx.WritePatch(context.Background(), patchBuffer, new(bytes.Buffer)))
+
+	rc, err := rediff.NewContext(rediff.Params{
+		Compression: compression,
+		PatchReader: seeksource.FromBytes(patchBuffer.Bytes()),
+	})
+	wtest.Must(t, err)
+
+	optimizedBuffer := new(bytes.Buffer)
+	wtest.Must(t, rc.Optimize(rediff.OptimizeParams{
+		TargetPool:  fspool.New(rc.GetTargetContainer(), v1),
+		SourcePool:  fspool.New(rc.GetSourceContainer(), v2),
+		PatchWriter: optimizedBuffer,
+	}))
+
+	return &testPatches{
+		v1:             v1,
+		v2:             v2,
+		oldSig:         oldSig,
+		newSig:         newSig,
+		patch:          patchBuffer.Bytes(),
+		optimizedPatch: optimizedBuffer.Bytes(),
+	}
+}
+
+func makeSignature(t *testing.T, dir string) *pwr.SignatureInfo {
+	container, err := tlc.WalkAny(dir, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	hashes, err := pwr.ComputeSignature(context.Background(), container, fspool.New(container, dir), &state.Consumer{})
+	wtest.Must(t, err)
+
+	return &pwr.SignatureInfo{
+		Container: container,
+		Hashes:    hashes,
+	}
+}
@@ -0,0 +1,451 @@
+package genie
+
+import (
+	"io"
+	"math"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior"
+	"github.com/itchio/wharf/bsdiff"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/wire"
+	"github.com/pkg/errors"
+)
+
+// A Range is a span of bytes, from Start (inclusive) to End (exclusive)
+type Range struct {
+	Start int64
+	End   int64
+}
+
+// Size returns the number of bytes in the range
+func (r Range) Size() int64 {
+	return r.End - r.Start
+}
+
+// A DownloadPlan lists which parts of a patch, and of the build it applies to,
+// are needed to produce some of the files of the new build.
+type DownloadPlan struct {
+	Header          *pwr.PatchHeader
+	TargetContainer *tlc.Container
+	SourceContainer *tlc.Container
+
+	// SourceIndexWhitelist lists the source files the plan produces, and
+	// should be passed to the patcher's SetSourceIndexWhitelist
+	SourceIndexWhitelist map[int64]bool
+
+	// PatchRanges are the ranges of the patch file to fetch, sorted and merged.
+	// Compressed patches can only be decompressed from the start, so for them,
+	// it's a single range from the start of the patch file.
+	PatchRanges []Range
+
+	// TargetRanges maps the index of each target file that's read from to
+	// the ranges that are read, sorted and merged
+	TargetRanges map[int64][]Range
+
+	// where the series of whitelisted files are in the patch file
+	series map[int64]Range
+}
+
+// PlanParams describes which files of the new build a DownloadPlan is for
+type PlanParams struct {
+	// PatchReader is the whole patch
+	PatchReader savior.SeekSource
+
+	// SourceIndexWhitelist lists indices of source files to produce
+	SourceIndexWhitelist map[int64]bool
+	// SourcePaths lists paths of source files to produce, in addition
+	// to those in SourceIndexWhitelist
+	SourcePaths []string
+}
+
+// PlanDownload works out which parts of a patch, and of the build it applies
+// to, are needed to produce a subset of the source container's files.
+// It reads the whole patch, so it's meant to run wherever the patch is
+// available, with only the resulting plan sent to clients.
+func PlanDownload(params PlanParams) (*DownloadPlan, error) {
+	patchReader := params.PatchReader
+	if patchReader == nil {
+		return nil, errors.New("PlanDownload: missing PatchReader")
+	}
+
+	_, err := patchReader.Resume(nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// compositions are only used for their origins, there's no need
+	// to split them into blocks
+	g := &Genie{
+		BlockSize: math.MaxInt64,
+	}
+	err = g.ParseHeader(patchReader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	dp := &DownloadPlan{
+		Header:               g.Header,
+		TargetContainer:      g.TargetContainer,
+		SourceContainer:      g.SourceContainer,
+		SourceIndexWhitelist: make(map[int64]bool),
+		TargetRanges:         make(map[int64][]Range),
+		series:               make(map[int64]Range),
+	}
+
+	numFiles := int64(len(g.SourceContainer.Files))
+	for fileIndex, ok := range params.SourceIndexWhitelist {
+		if !ok {
+			continue
+		}
+		if fileIndex < 0 || fileIndex >= numFiles {
+			return nil, errors.Errorf("PlanDownload: source container has no file %d", fileIndex)
+		}
+		dp.SourceIndexWhitelist[fileIndex] = true
+	}
+
+	if len(params.SourcePaths) > 0 {
+		fileIndices := make(map[string]int64)
+		for fileIndex, f := range g.SourceContainer.Files {
+			fileIndices[f.Path] = int64(fileIndex)
+		}
+
+		for _, path := range params.SourcePaths {
+			fileIndex, ok := fileIndices[path]
+			if !ok {
+				return nil, errors.Errorf("PlanDownload: source container has no file '%s'", path)
+			}
+			dp.SourceIndexWhitelist[fileIndex] = true
+		}
+	}
+
+	headerEnd := g.patchOffset()
+	lastEnd := headerEnd
+
+	onComp := func(comp *Composition) {
+		if !dp.SourceIndexWhitelist[comp.FileIndex] {
+			return
+		}
+
+		for _, origin := range comp.Origins {
+			switch o := origin.(type) {
+			case *BlockOrigin:
+				dp.TargetRanges[o.FileIndex] = append(dp.TargetRanges[o.FileIndex], Range{Start: o.Offset, End: o.Offset + o.Size})
+			case *BsdiffOrigin:
+				dp.TargetRanges[o.FileIndex] = append(dp.TargetRanges[o.FileIndex], Range{Start: o.Offset, End: o.Offset + o.Size})
+			}
+		}
+	}
+
+	onSeries := func(fileIndex int64, start int64, end int64) {
+		if !dp.SourceIndexWhitelist[fileIndex] {
+			return
+		}
+
+		dp.series[fileIndex] = Range{Start: start, End: end}
+		lastEnd = end
+	}
+
+	err = g.parseContents(onComp, onSeries)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for fileIndex, ranges := range dp.TargetRanges {
+		dp.TargetRanges[fileIndex] = mergeRanges(ranges)
+	}
+
+	if dp.Header.Compression.Algorithm == pwr.CompressionAlgorithm_NONE {
+		ranges := []Range{{Start: 0, End: headerEnd}}
+		for _, r := range dp.series {
+			ranges = append(ranges, r)
+		}
+		dp.PatchRanges = mergeRanges(ranges)
+	} else {
+		dp.PatchRanges = []Range{{Start: 0, End: lastEnd}}
+	}
+
+	return dp, nil
+}
+
+// PatchSize returns the total size of PatchRanges
+func (dp *DownloadPlan) PatchSize() int64 {
+	var total int64
+	for _, r := range dp.PatchRanges {
+		total += r.Size()
+	}
+	return total
+}
+
+// WritePatch writes an uncompressed patch that only contains the series of
+// whitelisted files, the others being left empty. fetched must read like the
+// original patch, but only the contents of PatchRanges are ever read from it.
+// The result can be applied by a patcher with the plan's SourceIndexWhitelist.
+func (dp *DownloadPlan) WritePatch(fetched savior.SeekSource, patchWriter io.Writer) error {
+	_, err := fetched.Resume(nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	rawPatchWire := wire.NewReadContext(fetched)
+	err = rawPatchWire.ExpectMagic(pwr.PatchMagic)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	header := &pwr.PatchHeader{}
+	err = rawPatchWire.ReadMessage(header)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	patchWire, err := pwr.DecompressWire(rawPatchWire, header.Compression)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	targetContainer := &tlc.Container{}
+	err = patchWire.ReadMessage(targetContainer)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	sourceContainer := &tlc.Container{}
+	err = patchWire.ReadMessage(sourceContainer)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if len(sourceContainer.Files) != len(dp.SourceContainer.Files) {
+		return errors.Errorf("fetched patch has %d source files, plan has %d", len(sourceContainer.Files), len(dp.SourceContainer.Files))
+	}
+
+	wctx := wire.NewWriteContext(patchWriter)
+	err = wctx.WriteMagic(pwr.PatchMagic)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = wctx.WriteMessage(&pwr.PatchHeader{
+		Compression: &pwr.CompressionSettings{
+			Algorithm: pwr.CompressionAlgorithm_NONE,
+			Checksums: header.Compression.Checksums,
+		},
+		BlockSize: header.BlockSize,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	wctx.SetChecksums(header.Compression.Checksums)
+
+	err = wctx.WriteMessage(targetContainer)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = wctx.WriteMessage(sourceContainer)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	compressed := header.Compression.Algorithm != pwr.CompressionAlgorithm_NONE
+
+	var lastIndex int64 = -1
+	for fileIndex := range dp.series {
+		if fileIndex > lastIndex {
+			lastIndex = fileIndex
+		}
+	}
+
+	for fileIndex := range sourceContainer.Files {
+		fileIndex := int64(fileIndex)
+		r, whitelisted := dp.series[fileIndex]
+
+		if compressed {
+			// the decompressed stream is read in order, up to the last
+			// whitelisted file - other series are read and dropped
+			if fileIndex <= lastIndex {
+				var seriesWriter *wire.WriteContext
+				if whitelisted {
+					seriesWriter = wctx
+				}
+				err = copySeries(patchWire, seriesWriter, fileIndex)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				if whitelisted {
+					continue
+				}
+			}
+		} else if whitelisted {
+			section, err := fetched.Section(r.Start, r.Size())
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			_, err = section.Resume(nil)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			seriesWire := wire.NewReadContext(section)
+			seriesWire.SetChecksums(header.Compression.Checksums)
+			err = copySeries(seriesWire, wctx, fileIndex)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			continue
+		}
+
+		err = writeEmptySeries(wctx, fileIndex)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	err = wctx.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// copySeries reads a file's series from rctx, and writes it to wctx, unless
+// it's nil
+func copySeries(rctx *wire.ReadContext, wctx *wire.WriteContext, fileIndex int64) error {
+	write := func(msg proto.Message) error {
+		if wctx == nil {
+			return nil
+		}
+		return wctx.WriteMessage(msg)
+	}
+
+	sh := &pwr.SyncHeader{}
+	err := rctx.ReadMessage(sh)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if sh.FileIndex != fileIndex {
+		return errors.Errorf("corrupted patch: expected file %d, got file %d", fileIndex, sh.FileIndex)
+	}
+
+	err = write(sh)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	switch sh.Type {
+	case pwr.SyncHeader_RSYNC:
+		// the sentinel is read and copied by the loop below
+	case pwr.SyncHeader_BSDIFF:
+		bh := &pwr.BsdiffHeader{}
+		err = rctx.ReadMessage(bh)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		err = write(bh)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		ctrl := &bsdiff.Control{}
+		for !ctrl.Eof {
+			err = rctx.ReadMessage(ctrl)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			err = write(ctrl)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	default:
+		return errors.Errorf("unknown patch series kind %d", sh.Type)
+	}
+
+	op := &pwr.SyncOp{}
+	for op.Type != pwr.SyncOp_HEY_YOU_DID_IT {
+		err = rctx.ReadMessage(op)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if sh.Type == pwr.SyncHeader_BSDIFF && op.Type != pwr.SyncOp_HEY_YOU_DID_IT {
+			return errors.Errorf("corrupted patch: expected sentinel SyncOp after bsdiff series, got %s", op.Type)
+		}
+
+		err = write(op)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// writeEmptySeries writes a series that produces nothing, which the patcher
+// skips over for files that aren't whitelisted
+func writeEmptySeries(wctx *wire.WriteContext, fileIndex int64) error {
+	err := wctx.WriteMessage(&pwr.SyncHeader{
+		FileIndex: fileIndex,
+		Type:      pwr.SyncHeader_RSYNC,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = wctx.WriteMessage(&pwr.SyncOp{
+		Type: pwr.SyncOp_HEY_YOU_DID_IT,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// mergeRanges sorts ranges and merges those that overlap or touch
+func mergeRanges(ranges []Range) []Range {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Start < ranges[j].Start
+	})
+
+	var res []Range
+	for _, r := range ranges {
+		if r.Size() <= 0 {
+			continue
+		}
+
+		if len(res) > 0 && r.Start <= res[len(res)-1].End {
+			last := &res[len(res)-1]
+			if r.End > last.End {
+				last.End = r.End
+			}
+			continue
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+// WoundedPaths returns the paths of the files wounds were found in, in the
+// order they were first found, so they can be used as PlanParams.SourcePaths
+func WoundedPaths(container *tlc.Container, wounds <-chan *pwr.Wound) []string {
+	seen := make(map[int64]bool)
+	var paths []string
+	for wound := range wounds {
+		if wound.Kind != pwr.WoundKind_FILE || seen[wound.Index] {
+			continue
+		}
+
+		seen[wound.Index] = true
+		paths = append(paths, container.Files[wound.Index].Path)
+	}
+	return paths
+}
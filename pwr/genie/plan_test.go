@@ -0,0 +1,115 @@
+package genie_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/pwr/bowl"
+	"github.com/itchio/wharf/pwr/genie"
+	"github.com/itchio/wharf/pwr/patcher"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/itchio/wharf/compressors/cbrotli"
+	_ "github.com/itchio/wharf/decompressors/cbrotli"
+)
+
+func Test_PlanDownload(t *testing.T) {
+	for _, compression := range []*pwr.CompressionSettings{
+		noCompression,
+		{Algorithm: pwr.CompressionAlgorithm_BROTLI, Quality: 1},
+	} {
+		t.Run(compression.ToString(), func(t *testing.T) {
+			testPlanDownload(t, compression)
+		})
+	}
+}
+
+func testPlanDownload(t *testing.T, compression *pwr.CompressionSettings) {
+	dir, err := os.MkdirTemp("", "plandownload")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	tp := makeTestPatches(t, dir, compression)
+	patch := tp.optimizedPatch
+
+	plan, err := genie.PlanDownload(genie.PlanParams{
+		PatchReader: seeksource.FromBytes(patch),
+		SourcePaths: []string{"big", "subdir/new"},
+	})
+	wtest.Must(t, err)
+	assert.Len(t, plan.SourceIndexWhitelist, 2)
+
+	targetIndices := make(map[string]int64)
+	for i, f := range plan.TargetContainer.Files {
+		targetIndices[f.Path] = int64(i)
+	}
+
+	// "subdir/new" is all fresh data, "big" is bsdiff'd against its old version
+	bigIndex := targetIndices["big"]
+	assert.Len(t, plan.TargetRanges, 1)
+	assert.NotEmpty(t, plan.TargetRanges[bigIndex])
+
+	if compression.Algorithm == pwr.CompressionAlgorithm_NONE {
+		assert.True(t, plan.PatchSize() < int64(len(patch)))
+	} else {
+		assert.Len(t, plan.PatchRanges, 1)
+	}
+
+	// only fetch what the plan says, from both the patch and the old build
+	fetched := make([]byte, len(patch))
+	for _, r := range plan.PatchRanges {
+		copy(fetched[r.Start:r.End], patch[r.Start:r.End])
+	}
+
+	sparseV1 := filepath.Join(dir, "sparse-v1")
+	for i, f := range plan.TargetContainer.Files {
+		contents := make([]byte, f.Size)
+		if ranges, ok := plan.TargetRanges[int64(i)]; ok {
+			original, err := os.ReadFile(filepath.Join(tp.v1, f.Path))
+			wtest.Must(t, err)
+			for _, r := range ranges {
+				copy(contents[r.Start:r.End], original[r.Start:r.End])
+			}
+		}
+
+		path := filepath.Join(sparseV1, f.Path)
+		wtest.Must(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		wtest.Must(t, os.WriteFile(path, contents, 0o644))
+	}
+
+	partialPatch := new(bytes.Buffer)
+	wtest.Must(t, plan.WritePatch(seeksource.FromBytes(fetched), partialPatch))
+
+	p, err := patcher.New(seeksource.FromBytes(partialPatch.Bytes()), &state.Consumer{})
+	wtest.Must(t, err)
+	p.SetSourceIndexWhitelist(plan.SourceIndexWhitelist)
+
+	out := filepath.Join(dir, "out")
+	targetPool := fspool.New(p.GetTargetContainer(), sparseV1)
+	b, err := bowl.NewFreshBowl(bowl.FreshBowlParams{
+		SourceContainer: p.GetSourceContainer(),
+		TargetContainer: p.GetTargetContainer(),
+		TargetPool:      targetPool,
+		OutputFolder:    out,
+	})
+	wtest.Must(t, err)
+
+	wtest.Must(t, p.Resume(nil, targetPool, b))
+	wtest.Must(t, b.Commit())
+	assert.EqualValues(t, 2, p.GetTouchedFiles())
+
+	for _, path := range []string{"big", "subdir/new"} {
+		expected, err := os.ReadFile(filepath.Join(tp.v2, path))
+		wtest.Must(t, err)
+		actual, err := os.ReadFile(filepath.Join(out, path))
+		wtest.Must(t, err)
+		assert.True(t, bytes.Equal(expected, actual), "%s should be patched", path)
+	}
+}
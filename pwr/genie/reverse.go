@@ -0,0 +1,286 @@
+package genie
+
+import (
+	"context"
+	"io"
+	"sort"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake"
+	"github.com/itchio/savior"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/werrors"
+	"github.com/itchio/wharf/wire"
+	"github.com/itchio/wharf/wsync"
+	"github.com/pkg/errors"
+)
+
+// A reverseSpan is a range of a target file that the patch copies
+// unchanged into a source file
+type reverseSpan struct {
+	targetOffset    int64
+	size            int64
+	sourceFileIndex int64
+	sourceOffset    int64
+}
+
+// WriteReversePatch writes a patch that goes from a patch's source container
+// back to its target container, without diffing them. Ranges the patch copies
+// from target files are copied back from the source files they ended up in,
+// the rest of the target files is read from targetPool and stored as fresh data.
+//
+// It lives here rather than in pwr, because it relies on Genie, which itself
+// depends on pwr. targetPool isn't closed.
+func WriteReversePatch(ctx context.Context, patchReader savior.SeekSource, targetPool lake.Pool, reverseWriter io.Writer, compression *pwr.CompressionSettings, consumer *state.Consumer) error {
+	if compression == nil {
+		compression = &pwr.CompressionSettings{
+			Algorithm: pwr.CompressionAlgorithm_NONE,
+		}
+	}
+
+	g := &Genie{}
+	err := g.ParseHeader(patchReader)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// we only need to know where origins end up in source files,
+	// which any big block size tells us
+	g.BlockSize = g.smallBlockSize
+
+	targetFiles := g.TargetContainer.Files
+	spans := make([][]reverseSpan, len(targetFiles))
+	var sourceOffset int64
+	err = g.ParseContents(func(comp *Composition) {
+		sourceOffset = comp.BlockIndex * g.BlockSize
+		for _, origin := range comp.Origins {
+			if bo, ok := origin.(*BlockOrigin); ok && bo.Size > 0 {
+				spans[bo.FileIndex] = append(spans[bo.FileIndex], reverseSpan{
+					targetOffset:    bo.Offset,
+					size:            bo.Size,
+					sourceFileIndex: comp.FileIndex,
+					sourceOffset:    sourceOffset,
+				})
+			}
+			sourceOffset += origin.GetSize()
+		}
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// the reverse patch's target is the patch's source, and vice versa
+	rawWire := wire.NewWriteContext(reverseWriter)
+	err = rawWire.WriteMagic(pwr.PatchMagic)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = rawWire.WriteMessage(&pwr.PatchHeader{
+		Compression: compression,
+		BlockSize:   g.Header.BlockSize,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	wctx, err := pwr.CompressWire(rawWire, compression)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = wctx.WriteMessage(g.SourceContainer)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = wctx.WriteMessage(g.TargetContainer)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	rw := &reverseOpsWriter{
+		wctx:       wctx,
+		targetPool: targetPool,
+		op:         &pwr.SyncOp{},
+	}
+
+	sh := &pwr.SyncHeader{}
+	for fileIndex, f := range targetFiles {
+		select {
+		case <-ctx.Done():
+			return werrors.ErrCancelled
+		default:
+			// keep going!
+		}
+		consumer.ProgressLabel(f.Path)
+		consumer.Progress(float64(f.Offset) / float64(g.TargetContainer.Size))
+
+		sh.Reset()
+		sh.FileIndex = int64(fileIndex)
+		err = wctx.WriteMessage(sh)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		err = rw.writeFile(int64(fileIndex), f.Size, mergeSpans(spans[fileIndex]))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		rw.op.Reset()
+		rw.op.Type = pwr.SyncOp_HEY_YOU_DID_IT
+		err = wctx.WriteMessage(rw.op)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	err = wctx.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	consumer.Progress(1.0)
+	return nil
+}
+
+// mergeSpans sorts spans by target offset, and merges those that are
+// contiguous both in the target and the source
+func mergeSpans(spans []reverseSpan) []reverseSpan {
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].targetOffset < spans[j].targetOffset
+	})
+
+	var merged []reverseSpan
+	for _, s := range spans {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			if last.sourceFileIndex == s.sourceFileIndex &&
+				last.targetOffset+last.size == s.targetOffset &&
+				last.sourceOffset+last.size == s.sourceOffset {
+				last.size += s.size
+				continue
+			}
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+// reverseOpsWriter writes the ops that rebuild target files
+type reverseOpsWriter struct {
+	wctx       *wire.WriteContext
+	targetPool lake.Pool
+	op         *pwr.SyncOp
+	buf        []byte
+}
+
+// writeFile writes the ops for a target file, given the spans of it
+// found in source files, sorted by target offset
+func (rw *reverseOpsWriter) writeFile(fileIndex int64, fileSize int64, spans []reverseSpan) error {
+	var reader io.ReadSeeker
+	var offset int64
+
+	for _, s := range spans {
+		end := s.targetOffset + s.size
+		if end <= offset {
+			// already covered by a previous span
+			continue
+		}
+
+		if s.targetOffset > offset {
+			if reader == nil {
+				var err error
+				reader, err = rw.targetPool.GetReadSeeker(fileIndex)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+			}
+
+			err := rw.writeData(reader, offset, s.targetOffset-offset)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			offset = s.targetOffset
+		}
+
+		// spans may overlap, skip what's already been written
+		skip := offset - s.targetOffset
+		rw.op.Reset()
+		rw.op.Type = pwr.SyncOp_BYTE_RANGE
+		rw.op.FileIndex = s.sourceFileIndex
+		rw.op.Offset = s.sourceOffset + skip
+		rw.op.Size = s.size - skip
+		err := rw.wctx.WriteMessage(rw.op)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		offset = end
+	}
+
+	if fileSize == 0 {
+		// patchers expect at least one op, like wsync we
+		// send an empty DATA op for empty files
+		rw.op.Reset()
+		rw.op.Type = pwr.SyncOp_DATA
+		err := rw.wctx.WriteMessage(rw.op)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return nil
+	}
+
+	if offset < fileSize {
+		if reader == nil {
+			var err error
+			reader, err = rw.targetPool.GetReadSeeker(fileIndex)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		err := rw.writeData(reader, offset, fileSize-offset)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// writeData writes size bytes of a target file, starting at offset,
+// as DATA ops
+func (rw *reverseOpsWriter) writeData(reader io.ReadSeeker, offset int64, size int64) error {
+	_, err := reader.Seek(offset, io.SeekStart)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if rw.buf == nil {
+		rw.buf = make([]byte, wsync.MaxDataOp)
+	}
+
+	for size > 0 {
+		n := int64(len(rw.buf))
+		if n > size {
+			n = size
+		}
+
+		_, err = io.ReadFull(reader, rw.buf[:n])
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		rw.op.Reset()
+		rw.op.Type = pwr.SyncOp_DATA
+		rw.op.Data = rw.buf[:n]
+		err = rw.wctx.WriteMessage(rw.op)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		size -= n
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package genie_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/pwr/genie"
+	"github.com/itchio/wharf/pwr/patcher"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_WriteReversePatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "geniereverse")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	tp := makeTestPatches(t, dir, noCompression)
+
+	for i, patch := range [][]byte{tp.patch, tp.optimizedPatch} {
+		patchReader := seeksource.FromBytes(patch)
+		_, err = patchReader.Resume(nil)
+		wtest.Must(t, err)
+
+		var maxProgress float64
+		consumer := &state.Consumer{
+			OnProgress: func(progress float64) {
+				if progress > maxProgress {
+					maxProgress = progress
+				}
+			},
+		}
+
+		reverseBuffer := new(bytes.Buffer)
+		wtest.Must(t, genie.WriteReversePatch(context.Background(), patchReader, fspool.New(tp.oldSig.Container, tp.v1), reverseBuffer, noCompression, consumer))
+		assert.EqualValues(t, 1.0, maxProgress)
+
+		if i == 0 {
+			// most of v1 ends up in v2, and must be copied back rather than stored.
+			// bsdiff'd files are stored, since they're not copies.
+			assert.True(t, int64(reverseBuffer.Len()) < tp.oldSig.Container.Size/2, "reverse patch is %d bytes for a %d-byte build", reverseBuffer.Len(), tp.oldSig.Container.Size)
+		}
+
+		outDir := filepath.Join(dir, "reversed")
+		wtest.Must(t, os.RemoveAll(outDir))
+		wtest.Must(t, os.MkdirAll(outDir, 0755))
+		wtest.Must(t, patcher.PatchFresh(patcher.PatchFreshParams{
+			PatchReader: seeksource.FromBytes(reverseBuffer.Bytes()),
+			TargetDir:   tp.v2,
+			OutputDir:   outDir,
+			Consumer:    &state.Consumer{},
+		}))
+		wtest.Must(t, pwr.AssertValid(outDir, tp.oldSig))
+		wtest.Must(t, pwr.AssertNoGhosts(outDir, tp.oldSig))
+	}
+
+	t.Logf("Stopping when cancelled")
+	patchReader := seeksource.FromBytes(tp.patch)
+	_, err = patchReader.Resume(nil)
+	wtest.Must(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = genie.WriteReversePatch(ctx, patchReader, fspool.New(tp.oldSig.Container, tp.v1), new(bytes.Buffer), noCompression, &state.Consumer{})
+	assert.Error(t, err)
+}
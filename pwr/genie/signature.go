@@ -0,0 +1,193 @@
+package genie
+
+import (
+	"context"
+	"io"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake"
+	"github.com/itchio/savior"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/werrors"
+	"github.com/itchio/wharf/wsync"
+	"github.com/pkg/errors"
+)
+
+// UpdateSignature computes the signature of a patch's source container from
+// the signature of its target container. Blocks the patch copies unchanged
+// from an aligned target block keep their old hashes, the others (fresh data,
+// unaligned ranges, bsdiff) are read from sourcePool and hashed again.
+//
+// It lives here rather than in pwr, because it relies on Genie, which itself
+// depends on pwr. Chunk hashes of FASTCDC signatures are computed from scratch.
+// Like ComputeSignature, it closes sourcePool.
+func UpdateSignature(ctx context.Context, oldSig *pwr.SignatureInfo, patchReader savior.SeekSource, sourcePool lake.Pool, consumer *state.Consumer) (_ *pwr.SignatureInfo, err error) {
+	// ComputeChunkSignature closes the pool itself
+	closePool := true
+	defer func() {
+		if !closePool {
+			return
+		}
+		if pErr := sourcePool.Close(); pErr != nil && err == nil {
+			err = errors.WithStack(pErr)
+		}
+	}()
+
+	hashInfo, err := pwr.ComputeHashInfo(oldSig)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	g := &Genie{}
+	err = g.ParseHeader(patchReader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	blockSize := g.smallBlockSize
+	if oldSig.EffectiveBlockSize() != blockSize {
+		return nil, errors.Errorf("signature has %d-byte blocks, but patch has %d-byte blocks", oldSig.EffectiveBlockSize(), blockSize)
+	}
+
+	err = oldSig.Container.EnsureEqual(g.TargetContainer)
+	if err != nil {
+		return nil, errors.Wrap(err, "signature doesn't match patch's target container")
+	}
+	targetFiles := g.TargetContainer.Files
+
+	// genie works in "big blocks", which we want to be signature blocks
+	g.BlockSize = blockSize
+
+	sourceFiles := g.SourceContainer.Files
+	reused := make([][]*wsync.BlockHash, len(sourceFiles))
+	for fileIndex, f := range sourceFiles {
+		reused[fileIndex] = make([]*wsync.BlockHash, pwr.ComputeNumBlocksWithBlockSize(f.Size, blockSize))
+	}
+
+	var numReused int64
+	err = g.ParseContents(func(comp *Composition) {
+		if len(comp.Origins) != 1 {
+			return
+		}
+		bo, ok := comp.Origins[0].(*BlockOrigin)
+		if !ok || bo.Offset%blockSize != 0 {
+			return
+		}
+
+		blocks := reused[comp.FileIndex]
+		if comp.BlockIndex >= int64(len(blocks)) {
+			return
+		}
+
+		sourceSize := pwr.ComputeBlockSizeWithBlockSize(sourceFiles[comp.FileIndex].Size, comp.BlockIndex, blockSize)
+		targetBlockIndex := bo.Offset / blockSize
+		group := hashInfo.Groups[bo.FileIndex]
+		if targetBlockIndex >= int64(len(group)) || bo.Size != sourceSize {
+			return
+		}
+		if pwr.ComputeBlockSizeWithBlockSize(targetFiles[bo.FileIndex].Size, targetBlockIndex, blockSize) != sourceSize {
+			return
+		}
+
+		bh := group[targetBlockIndex]
+		bh.FileIndex = comp.FileIndex
+		bh.BlockIndex = comp.BlockIndex
+		blocks[comp.BlockIndex] = &bh
+		numReused++
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	consumer.Debugf("Re-using %d hashes from the old signature", numReused)
+
+	hasher, err := pwr.NewStrongHasher(oldSig.StrongHash)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	sctx := wsync.NewContextWithHasher(int(blockSize), hasher)
+
+	var hashes []wsync.BlockHash
+	buf := make([]byte, blockSize)
+
+	for fileIndex, f := range sourceFiles {
+		select {
+		case <-ctx.Done():
+			return nil, werrors.ErrCancelled
+		default:
+			// keep going!
+		}
+		consumer.ProgressLabel(f.Path)
+		consumer.Progress(float64(f.Offset) / float64(g.SourceContainer.Size))
+
+		if f.Size == 0 {
+			// empty files have a 0-length shortblock for historical reasons.
+			weakHash, strongHash := sctx.HashBlock(nil)
+			hashes = append(hashes, wsync.BlockHash{
+				FileIndex:  int64(fileIndex),
+				WeakHash:   weakHash,
+				StrongHash: strongHash,
+			})
+			continue
+		}
+
+		var reader io.ReadSeeker
+		for blockIndex, bh := range reused[fileIndex] {
+			if bh != nil {
+				hashes = append(hashes, *bh)
+				continue
+			}
+
+			if reader == nil {
+				reader, err = sourcePool.GetReadSeeker(int64(fileIndex))
+				if err != nil {
+					return nil, errors.WithStack(err)
+				}
+			}
+
+			offset := int64(blockIndex) * blockSize
+			_, err = reader.Seek(offset, io.SeekStart)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+
+			size := pwr.ComputeBlockSizeWithBlockSize(f.Size, int64(blockIndex), blockSize)
+			_, err = io.ReadFull(reader, buf[:size])
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+
+			newHash := wsync.BlockHash{
+				FileIndex:  int64(fileIndex),
+				BlockIndex: int64(blockIndex),
+			}
+			newHash.WeakHash, newHash.StrongHash = sctx.HashBlock(buf[:size])
+			if size < blockSize {
+				newHash.ShortSize = int32(size)
+			}
+			hashes = append(hashes, newHash)
+		}
+	}
+
+	sigInfo := &pwr.SignatureInfo{
+		Container:  g.SourceContainer,
+		Hashes:     hashes,
+		BlockSize:  oldSig.BlockSize,
+		StrongHash: oldSig.StrongHash,
+		Chunking:   oldSig.Chunking,
+	}
+
+	if oldSig.Chunking == pwr.ChunkingAlgorithm_FASTCDC {
+		sc := &pwr.SignContext{
+			BlockSize:  oldSig.BlockSize,
+			StrongHash: oldSig.StrongHash,
+			Consumer:   consumer,
+		}
+		closePool = false
+		sigInfo.Chunks, err = sc.ComputeChunkSignature(ctx, g.SourceContainer, sourcePool)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	return sigInfo, nil
+}
@@ -0,0 +1,106 @@
+package genie_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/pwr/genie"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_UpdateSignature(t *testing.T) {
+	dir, err := os.MkdirTemp("", "updatesig")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	tp := makeTestPatches(t, dir, noCompression)
+	oldSig, newSig, v2 := tp.oldSig, tp.newSig, tp.v2
+
+	// rsync patches reuse unchanged blocks of "big", bsdiff patches
+	// (optimized) don't, but both reuse all of "moved-after".
+	maxReads := []int64{newSig.Container.Size / 2, newSig.Container.Size - 3*pwr.BlockSize}
+
+	for i, patch := range [][]byte{tp.patch, tp.optimizedPatch} {
+		patchReader := seeksource.FromBytes(patch)
+		_, err := patchReader.Resume(nil)
+		wtest.Must(t, err)
+
+		pool := &countingPool{Pool: fspool.New(newSig.Container, v2)}
+		updated, err := genie.UpdateSignature(context.Background(), oldSig, patchReader, pool, &state.Consumer{})
+		wtest.Must(t, err)
+
+		wtest.Must(t, updated.Container.EnsureEqual(newSig.Container))
+		assert.Equal(t, newSig.Hashes, updated.Hashes)
+		assert.Equal(t, 1, pool.numCloses)
+
+		// unchanged and moved blocks must not be read and hashed again
+		t.Logf("Read %d of %d bytes", pool.numRead, newSig.Container.Size)
+		assert.True(t, pool.numRead <= maxReads[i], "unchanged blocks must be reused")
+	}
+
+	t.Logf("Updating a FASTCDC signature")
+	sc := &pwr.SignContext{Consumer: &state.Consumer{}}
+	oldChunks, err := sc.ComputeChunkSignature(context.Background(), oldSig.Container, fspool.New(oldSig.Container, tp.v1))
+	wtest.Must(t, err)
+	newChunks, err := sc.ComputeChunkSignature(context.Background(), newSig.Container, fspool.New(newSig.Container, v2))
+	wtest.Must(t, err)
+
+	fastSig := *oldSig
+	fastSig.Chunking = pwr.ChunkingAlgorithm_FASTCDC
+	fastSig.Chunks = oldChunks
+
+	patchReader := seeksource.FromBytes(tp.patch)
+	_, err = patchReader.Resume(nil)
+	wtest.Must(t, err)
+
+	pool := &countingPool{Pool: fspool.New(newSig.Container, v2)}
+	updated, err := genie.UpdateSignature(context.Background(), &fastSig, patchReader, pool, &state.Consumer{})
+	wtest.Must(t, err)
+	assert.Equal(t, newSig.Hashes, updated.Hashes)
+	assert.Equal(t, newChunks, updated.Chunks)
+	assert.Equal(t, 1, pool.numCloses)
+}
+
+// countingPool counts bytes read through it, and how many times it's closed
+type countingPool struct {
+	lake.Pool
+
+	numRead   int64
+	numCloses int
+}
+
+func (cp *countingPool) GetReader(fileIndex int64) (io.Reader, error) {
+	return cp.GetReadSeeker(fileIndex)
+}
+
+func (cp *countingPool) GetReadSeeker(fileIndex int64) (io.ReadSeeker, error) {
+	rs, err := cp.Pool.GetReadSeeker(fileIndex)
+	if err != nil {
+		return nil, err
+	}
+	return &countingReadSeeker{ReadSeeker: rs, cp: cp}, nil
+}
+
+func (cp *countingPool) Close() error {
+	cp.numCloses++
+	return cp.Pool.Close()
+}
+
+type countingReadSeeker struct {
+	io.ReadSeeker
+	cp *countingPool
+}
+
+func (crs *countingReadSeeker) Read(buf []byte) (int, error) {
+	n, err := crs.ReadSeeker.Read(buf)
+	crs.cp.numRead += int64(n)
+	return n, err
+}
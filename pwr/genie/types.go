@@ -16,6 +16,18 @@ func (bo *BlockOrigin) GetSize() int64 {
 	return bo.Size
 }
 
+// A BsdiffOrigin is a range of an old file that bsdiff add data is
+// applied to: the result depends on both the old bytes and the patch.
+type BsdiffOrigin struct {
+	FileIndex int64
+	Offset    int64
+	Size      int64
+}
+
+func (bo *BsdiffOrigin) GetSize() int64 {
+	return bo.Size
+}
+
 type FreshOrigin struct {
 	Size int64
 }
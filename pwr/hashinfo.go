@@ -9,6 +9,11 @@ import (
 type HashInfo struct {
 	Container *tlc.Container
 	Groups    HashGroups
+
+	// BlockSize is the size of the blocks hashes were computed for
+	BlockSize int64
+	// StrongHash is the algorithm strong hashes were computed with
+	StrongHash StrongHashAlgorithm
 }
 
 type HashGroups = map[int64][]wsync.BlockHash
@@ -19,8 +24,14 @@ func ComputeHashInfo(sigInfo *SignatureInfo) (*HashInfo, error) {
 		pathToFileIndex[f.Path] = int64(fileIndex)
 	}
 
+	_, err := NewStrongHasher(sigInfo.StrongHash)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
 	hashGroups := make(HashGroups)
 	hashIndex := int64(0)
+	blockSize := sigInfo.EffectiveBlockSize()
 
 	for _, f := range sigInfo.Container.Files {
 		fileIndex := pathToFileIndex[f.Path]
@@ -31,7 +42,7 @@ func ComputeHashInfo(sigInfo *SignatureInfo) (*HashInfo, error) {
 			continue
 		}
 
-		numBlocks := ComputeNumBlocks(f.Size)
+		numBlocks := ComputeNumBlocksWithBlockSize(f.Size, blockSize)
 		hashGroups[fileIndex] = sigInfo.Hashes[hashIndex : hashIndex+numBlocks]
 		hashIndex += numBlocks
 	}
@@ -42,8 +53,10 @@ func ComputeHashInfo(sigInfo *SignatureInfo) (*HashInfo, error) {
 	}
 
 	hashInfo := &HashInfo{
-		Container: sigInfo.Container,
-		Groups:    hashGroups,
+		Container:  sigInfo.Container,
+		Groups:     hashGroups,
+		BlockSize:  blockSize,
+		StrongHash: sigInfo.StrongHash,
 	}
 
 	return hashInfo, nil
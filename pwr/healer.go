@@ -1,11 +1,20 @@
 package pwr
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/itchio/headway/state"
+	"github.com/itchio/httpkit/eos"
+	"github.com/itchio/httpkit/eos/option"
 	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/werrors"
+	"github.com/pkg/errors"
 )
 
 // A LockMap is an array of channels, corresponding to file indices
@@ -33,8 +42,49 @@ type Healer interface {
 	TotalHealed() int64
 }
 
+// A SourceVerifier checks a wharf file (a manifest, a zip index) a healer is
+// about to read, and returns the source to read it from instead. It returns an
+// error if the file can't be trusted, see sealing.Verifier. The archives and
+// directories blocks are healed from aren't wharf files, and aren't checked.
+type SourceVerifier func(source savior.SeekSource) (savior.SeekSource, error)
+
+// openWharfFile opens the wharf file at an eos path, and checks it with
+// verify if it's non-nil. The returned file must be closed once the source
+// has been read.
+func openWharfFile(path string, verify SourceVerifier, consumer *state.Consumer) (savior.SeekSource, eos.File, error) {
+	file, err := eos.Open(path, option.WithConsumer(consumer))
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	var source savior.SeekSource = seeksource.FromFile(file)
+	if verify != nil {
+		source, err = verify(source)
+		if err != nil {
+			file.Close()
+			return nil, nil, errors.Wrapf(err, "while verifying %s", path)
+		}
+	}
+
+	return source, file, nil
+}
+
+// setSourceVerifier gives verify to healers that read wharf files
+func setSourceVerifier(healer Healer, verify SourceVerifier) {
+	switch h := healer.(type) {
+	case *ArchiveHealer:
+		h.VerifyIndex = verify
+	case *ManifestHealer:
+		h.VerifyManifest = verify
+	}
+}
+
 // NewHealer takes a spec of the form "type,url", and a target folder
 // and returns a healer that knows how to repair target from spec.
+// Manifest healers take a spec of the form "manifest,manifestURL,sourceURL",
+// or "manifest,manifestURL" when the source sits next to the manifest, with
+// the same name minus the ".pwm" extension (build.zip.pwm is a manifest for
+// build.zip). Dir healers take a spec of the form "dir,path".
 func NewHealer(spec string, target string) (Healer, error) {
 	tokens := strings.SplitN(spec, ",", 2)
 	if len(tokens) != 2 {
@@ -52,8 +102,326 @@ func NewHealer(spec string, target string) (Healer, error) {
 		}
 		return ah, nil
 	case "manifest":
-		return nil, fmt.Errorf("Manifest healer: stub")
+		// manifest healers need two urls: the manifest, and where to read blocks from
+		urls := strings.SplitN(healerURL, ",", 2)
+		if len(urls) == 1 {
+			sourceURL := strings.TrimSuffix(urls[0], ManifestExtension)
+			if sourceURL == urls[0] || sourceURL == "" {
+				return nil, fmt.Errorf("Invalid manifest healer spec: expected 'manifest,manifestURL,sourceURL', or a manifestURL ending in %s, but got '%s'", ManifestExtension, spec)
+			}
+			urls = append(urls, sourceURL)
+		}
+
+		mh := &ManifestHealer{
+			ManifestPath: urls[0],
+			SourcePath:   urls[1],
+			Target:       target,
+		}
+		return mh, nil
+	case "dir":
+		dh := &DirHealer{
+			SourceDir: healerURL,
+			Target:    target,
+		}
+		return dh, nil
 	}
 
 	return nil, fmt.Errorf("Unknown healer type %s", healerType)
 }
+
+// woundsTally keeps count of the wounds a healer has received
+type woundsTally struct {
+	totalCorrupted int64
+	hasWounds      bool
+}
+
+// HasWounds returns true if the healer ever received wounds
+func (wt *woundsTally) HasWounds() bool {
+	return wt.hasWounds
+}
+
+// TotalCorrupted returns the total amount of corrupted data
+// contained in the wounds this healer has received. Dirs
+// and symlink wounds have 0-size, use HasWounds to know
+// if there were any wounds at all.
+func (wt *woundsTally) TotalCorrupted() int64 {
+	return wt.totalCorrupted
+}
+
+// A woundsLoop receives wounds on behalf of a healer: dir and symlink
+// wounds are healed right away, file wounds are handed over to healFiles,
+// which runs in its own goroutine.
+type woundsLoop struct {
+	consumer  *state.Consumer
+	target    string
+	container *tlc.Container
+	tally     *woundsTally
+
+	// if set, only the first wound of each file is handed over, for
+	// healers that rewrite whole files
+	wholeFiles bool
+
+	healFiles func(ctx context.Context, fileWounds chan *Wound) error
+
+	// called for each file wound before it's handed over, may be nil
+	onFileWound func(wound *Wound)
+
+	// called with the size of files that were never wounded
+	onHealthyFile func(size int64)
+}
+
+func (wl *woundsLoop) run(parentCtx context.Context, wounds chan *Wound) error {
+	ctx, cancel := context.WithCancel(parentCtx)
+	defer cancel()
+
+	woundedFiles := make(map[int64]bool)
+	// queueing must never block, even while healFiles waits on a lock map.
+	// With wholeFiles, at most one wound per file is ever queued, otherwise
+	// there may be any number of them.
+	var fileWounds chan *Wound
+	errs := make(chan error, 1)
+
+	if wl.wholeFiles {
+		fileWounds = make(chan *Wound, len(wl.container.Files))
+		go func() {
+			errs <- wl.healFiles(ctx, fileWounds)
+		}()
+	} else {
+		fileWounds = make(chan *Wound)
+		queuedWounds := make(chan *Wound)
+		go queueWounds(ctx, fileWounds, queuedWounds)
+		go func() {
+			errs <- wl.healFiles(ctx, queuedWounds)
+		}()
+	}
+
+	processWound := func(wound *Wound) error {
+		if !wound.Healthy() {
+			wl.tally.totalCorrupted += wound.Size()
+			wl.tally.hasWounds = true
+		}
+
+		switch wound.Kind {
+		case WoundKind_DIR:
+			err := healDirWound(wl.consumer, wl.target, wl.container, wound)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+		case WoundKind_SYMLINK:
+			err := healSymlinkWound(wl.consumer, wl.target, wl.container, wound)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+		case WoundKind_FILE:
+			if wl.wholeFiles && woundedFiles[wound.Index] {
+				// already queued
+				return nil
+			}
+			woundedFiles[wound.Index] = true
+
+			if wl.onFileWound != nil {
+				wl.onFileWound(wound)
+			}
+
+			select {
+			case <-ctx.Done():
+				return werrors.ErrCancelled
+			case err := <-errs:
+				return errors.WithStack(err)
+			case fileWounds <- wound:
+				// queued for work!
+			}
+
+		case WoundKind_CLOSED_FILE:
+			if woundedFiles[wound.Index] {
+				// already healing file
+			} else {
+				fileSize := wl.container.Files[wound.Index].Size
+
+				// whole file was healthy
+				if wound.End == fileSize {
+					wl.onHealthyFile(fileSize)
+				}
+			}
+
+		default:
+			return fmt.Errorf("Unknown wound kind: %d", wound.Kind)
+		}
+
+		return nil
+	}
+
+	for wound := range wounds {
+		select {
+		case <-ctx.Done():
+			return werrors.ErrCancelled
+		default:
+			// keep going!
+		}
+
+		err := processWound(wound)
+		if err != nil {
+			return err
+		}
+	}
+
+	// queued everything
+	close(fileWounds)
+
+	err := <-errs
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// queueWounds forwards wounds from in to out, holding on to as many of them
+// as needed so that sending to in never blocks. out is closed once in is
+// closed and everything was forwarded.
+func queueWounds(ctx context.Context, in chan *Wound, out chan *Wound) {
+	defer close(out)
+
+	var pending []*Wound
+	for in != nil || len(pending) > 0 {
+		var send chan *Wound
+		var next *Wound
+		if len(pending) > 0 {
+			send = out
+			next = pending[0]
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case wound, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			pending = append(pending, wound)
+		case send <- next:
+			pending[0] = nil
+			pending = pending[1:]
+		}
+	}
+}
+
+// healDirWound makes sure the directory a wound refers to exists in target,
+// removing any file or symlink that might be in the way.
+func healDirWound(consumer *state.Consumer, target string, container *tlc.Container, wound *Wound) error {
+	dirEntry := container.Dirs[wound.Index]
+	path := filepath.Join(target, filepath.FromSlash(dirEntry.Path))
+
+	stats, err := os.Lstat(path)
+	if err == nil {
+		if stats.IsDir() {
+			consumer.Debugf("For dir wound, found existing dir (%s), all good", path)
+			return nil
+		} else {
+			consumer.Debugf("For dir wound, found file/symlink (%s), removing", path)
+			err = os.Remove(path)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	consumer.Debugf("For dir wound, doing MkdirAll (%s)", path)
+	err = os.MkdirAll(path, 0o755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// healSymlinkWound (re-)creates the symlink a wound refers to in target,
+// removing anything that might be in the way.
+func healSymlinkWound(consumer *state.Consumer, target string, container *tlc.Container, wound *Wound) error {
+	symlinkEntry := container.Symlinks[wound.Index]
+	path := filepath.Join(target, filepath.FromSlash(symlinkEntry.Path))
+
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	stats, err := os.Lstat(path)
+	if err == nil {
+		if stats.IsDir() {
+			consumer.Debugf("For symlink wound, found dir (%s), doing RemoveAll", path)
+			err = os.RemoveAll(path)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		} else {
+			consumer.Debugf("For symlink wound, found file/symlink (%s), doing Remove", path)
+			err = os.Remove(path)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	consumer.Debugf("For symlink wound, doing Symlink (%s) => (%s)", path, symlinkEntry.Dest)
+	err = os.Symlink(symlinkEntry.Dest, path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// openWoundedFile waits for a file to be unlocked (if lockMap is set), then
+// opens it for reading and writing. If prepare is true, it also makes sure it's
+// a regular file of the right size, so that wounds can be healed in place.
+func openWoundedFile(ctx context.Context, lockMap LockMap, consumer *state.Consumer, target string, container *tlc.Container, fileIndex int64, prepare bool) (*os.File, error) {
+	if lockMap != nil {
+		lock := lockMap[fileIndex]
+		select {
+		case <-lock:
+			// keep going
+		case <-ctx.Done():
+			return nil, werrors.ErrCancelled
+		}
+	}
+
+	f := container.Files[fileIndex]
+	path := filepath.Join(target, filepath.FromSlash(f.Path))
+	consumer.ProgressLabel(f.Path)
+
+	if prepare {
+		stats, err := os.Lstat(path)
+		if err == nil && !stats.Mode().IsRegular() {
+			consumer.Debugf("For file wound, found dir/symlink (%s), doing RemoveAll", path)
+			err = os.RemoveAll(path)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+
+		err = os.MkdirAll(filepath.Dir(path), 0o755)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, ModeMask)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if prepare {
+		err = file.Truncate(f.Size)
+		if err != nil {
+			file.Close()
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	return file, nil
+}
@@ -8,14 +8,19 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
 	"time"
 
 	"github.com/itchio/arkive/zip"
 	"github.com/itchio/headway/state"
+	"github.com/itchio/httpkit/eos"
+	"github.com/itchio/lake"
 	"github.com/itchio/lake/pools"
+	"github.com/itchio/lake/pools/fspool"
 	"github.com/itchio/lake/tlc"
 	"github.com/itchio/randsource"
+	"github.com/itchio/savior/seeksource"
 	"github.com/itchio/wharf/wtest"
 	"github.com/stretchr/testify/assert"
 )
@@ -32,6 +37,25 @@ func Test_NewHealer(t *testing.T) {
 
 	_, ok := healer.(*ArchiveHealer)
 	assert.True(t, ok)
+
+	_, err = NewHealer("manifest,/dev/null", "invalid")
+	assert.Error(t, err)
+
+	healer, err = NewHealer("manifest,/dev/null,/dev/null", "invalid")
+	assert.NoError(t, err)
+
+	_, ok = healer.(*ManifestHealer)
+	assert.True(t, ok)
+
+	healer, err = NewHealer("manifest,/builds/1234.zip.pwm", "invalid")
+	assert.NoError(t, err)
+	assert.Equal(t, "/builds/1234.zip", healer.(*ManifestHealer).SourcePath)
+
+	healer, err = NewHealer("dir,/dev/null", "invalid")
+	assert.NoError(t, err)
+
+	_, ok = healer.(*DirHealer)
+	assert.True(t, ok)
 }
 
 type healMethod func()
@@ -97,10 +121,18 @@ func Test_ArchiveHealer(t *testing.T) {
 		Hashes:    hashes,
 	}
 
-	healDirect := func() {
-		healer, err := NewHealer(fmt.Sprintf("archive,%s", archivePath), targetDir)
-		assert.NoError(t, err)
+	indexPath := filepath.Join(mainDir, "archive.pzi")
+	archiveFile, err := os.Open(archivePath)
+	wtest.Must(t, err)
+	stats, err := archiveFile.Stat()
+	wtest.Must(t, err)
+	indexWriter, err := os.Create(indexPath)
+	wtest.Must(t, err)
+	zic := &ZipIndexContext{}
+	wtest.Must(t, zic.WriteIndex(context.Background(), archiveFile, stats.Size(), indexWriter))
+	wtest.Must(t, archiveFile.Close())
 
+	healWith := func(healer Healer) {
 		wounds := make(chan *Wound)
 		done := make(chan bool)
 
@@ -124,6 +156,20 @@ func Test_ArchiveHealer(t *testing.T) {
 		<-done
 	}
 
+	healDirect := func() {
+		healer, err := NewHealer(fmt.Sprintf("archive,%s", archivePath), targetDir)
+		assert.NoError(t, err)
+		healWith(healer)
+	}
+
+	healIndexed := func() {
+		healWith(&ArchiveHealer{
+			ArchivePath:      archivePath,
+			ArchiveIndexPath: indexPath,
+			Target:           targetDir,
+		})
+	}
+
 	healValidate := func() {
 		vc := &ValidatorContext{
 			Consumer: consumer,
@@ -134,6 +180,7 @@ func Test_ArchiveHealer(t *testing.T) {
 
 	var healMethods = map[string]healMethod{
 		"direct":   healDirect,
+		"indexed":  healIndexed,
 		"validate": healValidate,
 	}
 
@@ -171,3 +218,333 @@ func Test_ArchiveHealer(t *testing.T) {
 		assertAllFilesHealed()
 	}
 }
+
+func Test_ManifestHealer(t *testing.T) {
+	mainDir, err := os.MkdirTemp("", "manifesthealer")
+	assert.NoError(t, err)
+	defer os.RemoveAll(mainDir)
+
+	sourceDir := filepath.Join(mainDir, "source")
+	targetDir := filepath.Join(mainDir, "target")
+
+	wtest.MakeTestDir(t, sourceDir, wtest.TestDirSettings{
+		Seed: 0x4412,
+		Entries: []wtest.TestDirEntry{
+			{Path: "subdir/file-1", Seed: 0x1},
+			{Path: "file-1", Seed: 0x2, Size: BlockSize*5 + 12},
+			{Path: "file-2", Seed: 0x3, Size: 128},
+			{Path: "empty", Size: -1},
+		},
+	})
+
+	container, err := tlc.WalkAny(sourceDir, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	manifestPath := filepath.Join(mainDir, "build.pwm")
+	manifestWriter, err := os.Create(manifestPath)
+	wtest.Must(t, err)
+	wtest.Must(t, WriteManifest(context.Background(), container, fspool.New(container, sourceDir), manifestWriter, HashAlgorithm_SHAKE128_32))
+
+	consumer := &state.Consumer{}
+	hashes, err := ComputeSignature(context.Background(), container, fspool.New(container, sourceDir), consumer)
+	wtest.Must(t, err)
+
+	sigInfo := &SignatureInfo{
+		Container: container,
+		Hashes:    hashes,
+	}
+
+	spec := fmt.Sprintf("manifest,%s,%s", manifestPath, sourceDir)
+
+	var lastHealed int64
+
+	healDirect := func() {
+		healer, err := NewHealer(spec, targetDir)
+		wtest.Must(t, err)
+
+		lockMap := NewLockMap(container)
+		healer.SetLockMap(lockMap)
+		for _, lock := range lockMap {
+			close(lock)
+		}
+
+		wounds := make(chan *Wound)
+		done := make(chan bool)
+
+		go func() {
+			err := healer.Do(context.Background(), container, wounds)
+			assert.NoError(t, err)
+			done <- true
+		}()
+
+		for _, d := range container.Dirs {
+			wtest.Must(t, os.MkdirAll(filepath.Join(targetDir, filepath.FromSlash(d.Path)), 0o755))
+		}
+
+		for i, f := range container.Files {
+			wounds <- &Wound{
+				Kind:  WoundKind_FILE,
+				Index: int64(i),
+				Start: 0,
+				End:   f.Size,
+			}
+		}
+
+		close(wounds)
+
+		<-done
+		lastHealed = healer.TotalHealed()
+	}
+
+	healValidate := func() {
+		vc := &ValidatorContext{
+			Consumer: consumer,
+			HealPath: spec,
+		}
+		wtest.Must(t, vc.Validate(context.Background(), targetDir, sigInfo))
+		lastHealed = vc.WoundsConsumer.(Healer).TotalHealed()
+	}
+
+	var healMethods = map[string]healMethod{
+		"direct":   healDirect,
+		"validate": healValidate,
+	}
+
+	targetPath := func(path string) string {
+		return filepath.Join(targetDir, filepath.FromSlash(path))
+	}
+
+	assertAllFilesHealed := func() {
+		wtest.Must(t, AssertValid(targetDir, sigInfo))
+		wtest.Must(t, AssertNoGhosts(targetDir, sigInfo))
+	}
+
+	for healMethod, doHeal := range healMethods {
+		wtest.Must(t, os.RemoveAll(targetDir))
+
+		t.Logf("...with no files present (%s)", healMethod)
+		doHeal()
+		assertAllFilesHealed()
+		assert.EqualValues(t, container.Size, lastHealed)
+
+		t.Logf("...with nothing to heal (%s)", healMethod)
+		doHeal()
+		assertAllFilesHealed()
+		assert.EqualValues(t, 0, lastHealed)
+
+		t.Logf("...with one file too long (%s)", healMethod)
+		f, err := os.OpenFile(targetPath("file-2"), os.O_APPEND|os.O_WRONLY, 0644)
+		wtest.Must(t, err)
+		_, err = f.Write(bytes.Repeat([]byte{0x3}, 1024))
+		wtest.Must(t, err)
+		wtest.Must(t, f.Close())
+		doHeal()
+		assertAllFilesHealed()
+
+		t.Logf("...with one file too short (%s)", healMethod)
+		wtest.Must(t, os.Truncate(targetPath("file-1"), BlockSize*2+4))
+		doHeal()
+		assertAllFilesHealed()
+		assert.EqualValues(t, BlockSize*3+12, lastHealed)
+
+		t.Logf("...with one block corrupted (%s)", healMethod)
+		f, err = os.OpenFile(targetPath("file-1"), os.O_WRONLY, 0644)
+		wtest.Must(t, err)
+		_, err = f.WriteAt([]byte{0x1, 0x2, 0x3}, BlockSize*2+16)
+		wtest.Must(t, err)
+		wtest.Must(t, f.Close())
+		doHeal()
+		assertAllFilesHealed()
+		assert.EqualValues(t, BlockSize, lastHealed)
+	}
+
+	t.Logf("...with many wounds while files are locked")
+	wtest.Must(t, os.RemoveAll(targetDir))
+	for _, d := range container.Dirs {
+		wtest.Must(t, os.MkdirAll(targetPath(d.Path), 0o755))
+	}
+
+	healer, err := NewHealer(spec, targetDir)
+	wtest.Must(t, err)
+	lockMap := NewLockMap(container)
+	healer.SetLockMap(lockMap)
+
+	wounds := make(chan *Wound)
+	done := make(chan error, 1)
+	go func() {
+		done <- healer.Do(context.Background(), container, wounds)
+	}()
+
+	queued := make(chan bool)
+	go func() {
+		// more wounds than any fixed-size queue would hold
+		for j := 0; j < 300; j++ {
+			for i, f := range container.Files {
+				wounds <- &Wound{
+					Kind:  WoundKind_FILE,
+					Index: int64(i),
+					Start: 0,
+					End:   f.Size,
+				}
+			}
+		}
+		close(wounds)
+		queued <- true
+	}()
+
+	select {
+	case <-queued:
+		// good, nothing waited on the locks
+	case <-time.After(10 * time.Second):
+		t.Fatal("queueing wounds blocked while files were locked")
+	}
+
+	for _, lock := range lockMap {
+		close(lock)
+	}
+	wtest.Must(t, <-done)
+	assertAllFilesHealed()
+	assert.EqualValues(t, container.Size, healer.TotalHealed())
+
+	t.Logf("...leaving the caller's source pool open")
+	wtest.Must(t, os.RemoveAll(targetDir))
+	manifestSource, err := eos.Open(manifestPath)
+	wtest.Must(t, err)
+	defer manifestSource.Close()
+	manifest, err := ReadManifest(seeksource.FromFile(manifestSource))
+	wtest.Must(t, err)
+
+	sourcePool := &closeCountingPool{Pool: fspool.New(container, sourceDir)}
+	mh := &ManifestHealer{
+		Target:     targetDir,
+		Manifest:   manifest,
+		SourcePool: sourcePool,
+		Consumer:   consumer,
+	}
+	wounds = make(chan *Wound)
+	go func() {
+		done <- mh.Do(context.Background(), container, wounds)
+	}()
+	for i, f := range container.Files {
+		wounds <- &Wound{
+			Kind:  WoundKind_FILE,
+			Index: int64(i),
+			Start: 0,
+			End:   f.Size,
+		}
+	}
+	close(wounds)
+	wtest.Must(t, <-done)
+	assert.EqualValues(t, container.Size, mh.TotalHealed())
+	assert.EqualValues(t, 0, sourcePool.closed)
+}
+
+type closeCountingPool struct {
+	lake.Pool
+	closed int
+}
+
+func (ccp *closeCountingPool) Close() error {
+	ccp.closed++
+	return ccp.Pool.Close()
+}
+
+func Test_DirHealer(t *testing.T) {
+	mainDir, err := os.MkdirTemp("", "dirhealer")
+	assert.NoError(t, err)
+	defer os.RemoveAll(mainDir)
+
+	sourceDir := filepath.Join(mainDir, "source")
+	targetDir := filepath.Join(mainDir, "target")
+
+	entries := []wtest.TestDirEntry{
+		{Path: "subdir/file-1", Seed: 0x1},
+		{Path: "file-1", Seed: 0x2, Size: BlockSize*5 + 12},
+		{Path: "file-2", Seed: 0x3, Size: 128},
+	}
+	if runtime.GOOS != "windows" {
+		entries = append(entries, wtest.TestDirEntry{Path: "link", Dest: "file-2"})
+	}
+
+	wtest.MakeTestDir(t, sourceDir, wtest.TestDirSettings{
+		Seed:    0x5531,
+		Entries: entries,
+	})
+	wtest.Must(t, os.MkdirAll(filepath.Join(sourceDir, "empty-dir"), 0755))
+
+	container, err := tlc.WalkAny(sourceDir, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	consumer := &state.Consumer{}
+	hashes, err := ComputeSignature(context.Background(), container, fspool.New(container, sourceDir), consumer)
+	wtest.Must(t, err)
+
+	sigInfo := &SignatureInfo{
+		Container: container,
+		Hashes:    hashes,
+	}
+
+	heal := func() int64 {
+		vc := &ValidatorContext{
+			Consumer: consumer,
+			HealPath: fmt.Sprintf("dir,%s", sourceDir),
+		}
+		wtest.Must(t, vc.Validate(context.Background(), targetDir, sigInfo))
+		return vc.WoundsConsumer.(Healer).TotalHealed()
+	}
+
+	targetPath := func(path string) string {
+		return filepath.Join(targetDir, filepath.FromSlash(path))
+	}
+
+	assertAllFilesHealed := func() {
+		wtest.Must(t, AssertValid(targetDir, sigInfo))
+		wtest.Must(t, AssertNoGhosts(targetDir, sigInfo))
+	}
+
+	t.Logf("...with no files present")
+	assert.EqualValues(t, container.Size, heal())
+	assertAllFilesHealed()
+
+	t.Logf("...with nothing to heal")
+	assert.EqualValues(t, 0, heal())
+	assertAllFilesHealed()
+
+	t.Logf("...with one file too long")
+	f, err := os.OpenFile(targetPath("file-2"), os.O_APPEND|os.O_WRONLY, 0644)
+	wtest.Must(t, err)
+	_, err = f.Write(bytes.Repeat([]byte{0x3}, 1024))
+	wtest.Must(t, err)
+	wtest.Must(t, f.Close())
+	heal()
+	assertAllFilesHealed()
+
+	t.Logf("...with a dir where a file should be")
+	wtest.Must(t, os.Remove(targetPath("file-2")))
+	wtest.Must(t, os.MkdirAll(targetPath("file-2"), 0755))
+	heal()
+	assertAllFilesHealed()
+
+	t.Logf("...with one block corrupted")
+	f, err = os.OpenFile(targetPath("file-1"), os.O_WRONLY, 0644)
+	wtest.Must(t, err)
+	_, err = f.WriteAt([]byte{0x1, 0x2, 0x3}, BlockSize*2+16)
+	wtest.Must(t, err)
+	wtest.Must(t, f.Close())
+	assert.EqualValues(t, BlockSize, heal())
+	assertAllFilesHealed()
+
+	t.Logf("...with a missing empty dir")
+	wtest.Must(t, os.Remove(targetPath("empty-dir")))
+	heal()
+	assertAllFilesHealed()
+
+	t.Logf("...with a corrupted source")
+	wtest.Must(t, os.Truncate(targetPath("file-1"), 0))
+	wtest.Must(t, os.Truncate(filepath.Join(sourceDir, "file-1"), 12))
+	vc := &ValidatorContext{
+		Consumer: consumer,
+		HealPath: fmt.Sprintf("dir,%s", sourceDir),
+	}
+	assert.Error(t, vc.Validate(context.Background(), targetDir, sigInfo))
+}
@@ -0,0 +1,222 @@
+package pwr
+
+import (
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior"
+	"github.com/itchio/wharf/bsdiff"
+	"github.com/itchio/wharf/wire"
+	"github.com/pkg/errors"
+)
+
+// A PatchInspection describes what a patch is made of, file by file
+type PatchInspection struct {
+	Header          *PatchHeader
+	TargetContainer *tlc.Container
+	SourceContainer *tlc.Container
+
+	// Files has an entry for each file of the source container, in order
+	Files []*FileInspection
+}
+
+// A FileInspection describes how a patch rebuilds a single file
+type FileInspection struct {
+	// FileIndex is the index of the file in the source container
+	FileIndex int64
+	Path      string
+	Size      int64
+
+	Type SyncHeader_Type
+
+	// FreshBytes is the size of DATA ops (rsync only)
+	FreshBytes int64
+	// ReusedBytes maps target file indices to how many bytes BLOCK_RANGE
+	// and BYTE_RANGE ops copy from them (rsync only)
+	ReusedBytes map[int64]int64
+	// NumOps is the number of rsync ops, or of bsdiff controls
+	NumOps int64
+
+	// BsdiffTargetIndex is the target file the bsdiff series is based on
+	BsdiffTargetIndex int64
+	// BsdiffAddBytes is the total size of bsdiff add data
+	BsdiffAddBytes int64
+	// BsdiffCopyBytes is the total size of bsdiff copy (fresh) data
+	BsdiffCopyBytes int64
+
+	// CompressedBytes is roughly how much of the patch file the file's
+	// series takes. Decompressors read ahead, so it's only accurate for
+	// files large enough compared to their buffers.
+	CompressedBytes int64
+}
+
+// TotalReusedBytes returns how many bytes are copied from all target files
+func (fi *FileInspection) TotalReusedBytes() int64 {
+	var total int64
+	for _, size := range fi.ReusedBytes {
+		total += size
+	}
+	return total
+}
+
+// InspectPatch reads a whole patch and returns statistics about each file
+// of its source container. It doesn't need access to any build.
+func InspectPatch(patchReader savior.SeekSource) (*PatchInspection, error) {
+	_, err := patchReader.Resume(nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	rawPatchWire := wire.NewReadContext(patchReader)
+	err = rawPatchWire.ExpectMagic(PatchMagic)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	header := &PatchHeader{}
+	err = rawPatchWire.ReadMessage(header)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = ValidateBlockSize(header.BlockSize)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	blockSize := EffectiveBlockSize(header.BlockSize)
+
+	patchWire, compressedSource, err := DecompressWireSection(rawPatchWire, header.Compression)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	pi := &PatchInspection{
+		Header:          header,
+		TargetContainer: &tlc.Container{},
+		SourceContainer: &tlc.Container{},
+	}
+
+	err = patchWire.ReadMessage(pi.TargetContainer)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = patchWire.ReadMessage(pi.SourceContainer)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	sh := &SyncHeader{}
+	for fileIndex, f := range pi.SourceContainer.Files {
+		startOffset := compressedSource.Tell()
+
+		sh.Reset()
+		err = patchWire.ReadMessage(sh)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		if sh.FileIndex != int64(fileIndex) {
+			return nil, errors.Errorf("corrupted patch: expected file %d, got file %d", fileIndex, sh.FileIndex)
+		}
+
+		fi := &FileInspection{
+			FileIndex:   int64(fileIndex),
+			Path:        f.Path,
+			Size:        f.Size,
+			Type:        sh.Type,
+			ReusedBytes: make(map[int64]int64),
+		}
+
+		switch sh.Type {
+		case SyncHeader_RSYNC:
+			err = pi.inspectRsync(patchWire, fi, blockSize)
+		case SyncHeader_BSDIFF:
+			err = pi.inspectBsdiff(patchWire, fi)
+		default:
+			err = errors.Errorf("unknown patch series kind %d", sh.Type)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "while inspecting %s", f.Path)
+		}
+
+		fi.CompressedBytes = compressedSource.Tell() - startOffset
+		pi.Files = append(pi.Files, fi)
+	}
+
+	return pi, nil
+}
+
+func (pi *PatchInspection) inspectRsync(patchWire *wire.ReadContext, fi *FileInspection, blockSize int64) error {
+	targetFiles := pi.TargetContainer.Files
+	op := &SyncOp{}
+
+	for {
+		op.Reset()
+		err := patchWire.ReadMessage(op)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		switch op.Type {
+		case SyncOp_BLOCK_RANGE, SyncOp_BYTE_RANGE:
+			if op.FileIndex < 0 || op.FileIndex >= int64(len(targetFiles)) {
+				return errors.Errorf("corrupted patch: op refers to target file %d", op.FileIndex)
+			}
+
+			size := op.Size
+			if op.Type == SyncOp_BLOCK_RANGE {
+				fileSize := targetFiles[op.FileIndex].Size
+				lastBlockIndex := op.BlockIndex + op.BlockSpan - 1
+				tailSize := ComputeBlockSizeWithBlockSize(fileSize, lastBlockIndex, blockSize)
+				size = blockSize*(op.BlockSpan-1) + tailSize
+			}
+			fi.ReusedBytes[op.FileIndex] += size
+
+		case SyncOp_DATA:
+			fi.FreshBytes += int64(len(op.Data))
+
+		case SyncOp_HEY_YOU_DID_IT:
+			return nil
+
+		default:
+			return errors.Errorf("unknown sync op type %s", op.Type)
+		}
+		fi.NumOps++
+	}
+}
+
+func (pi *PatchInspection) inspectBsdiff(patchWire *wire.ReadContext, fi *FileInspection) error {
+	bh := &BsdiffHeader{}
+	err := patchWire.ReadMessage(bh)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	fi.BsdiffTargetIndex = bh.TargetIndex
+
+	ctrl := &bsdiff.Control{}
+	for {
+		ctrl.Reset()
+		err = patchWire.ReadMessage(ctrl)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if ctrl.Eof {
+			break
+		}
+
+		fi.BsdiffAddBytes += int64(len(ctrl.Add))
+		fi.BsdiffCopyBytes += int64(len(ctrl.Copy))
+		fi.NumOps++
+	}
+
+	op := &SyncOp{}
+	err = patchWire.ReadMessage(op)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if op.Type != SyncOp_HEY_YOU_DID_IT {
+		return errors.Errorf("corrupted patch: expected sentinel SyncOp after bsdiff series, got %s", op.Type)
+	}
+	return nil
+}
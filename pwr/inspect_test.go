@@ -0,0 +1,75 @@
+package pwr
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_InspectPatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "inspectpatch")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	v1, v2, targetContainer, sourceContainer := makeDiffTestDirs(t, dir)
+
+	targetSignature, err := ComputeSignature(context.Background(), targetContainer, fspool.New(targetContainer, v1), &state.Consumer{})
+	wtest.Must(t, err)
+
+	dctx := &DiffContext{
+		Compression: &CompressionSettings{
+			Algorithm: CompressionAlgorithm_NONE,
+		},
+		Consumer: &state.Consumer{},
+
+		SourceContainer: sourceContainer,
+		Pool:            fspool.New(sourceContainer, v2),
+
+		TargetContainer: targetContainer,
+		TargetSignature: targetSignature,
+	}
+
+	patchBuffer := new(bytes.Buffer)
+	wtest.Must(t, dctx.WritePatch(context.Background(), patchBuffer, new(bytes.Buffer)))
+
+	pi, err := InspectPatch(seeksource.FromBytes(patchBuffer.Bytes()))
+	wtest.Must(t, err)
+	assert.Equal(t, len(sourceContainer.Files), len(pi.Files))
+
+	targetIndices := make(map[string]int64)
+	for i, f := range targetContainer.Files {
+		targetIndices[f.Path] = int64(i)
+	}
+
+	var fresh, reused, compressed int64
+	for i, fi := range pi.Files {
+		f := sourceContainer.Files[i]
+		assert.EqualValues(t, i, fi.FileIndex)
+		assert.Equal(t, f.Path, fi.Path)
+		assert.Equal(t, SyncHeader_RSYNC, fi.Type)
+		assert.Equal(t, f.Size, fi.FreshBytes+fi.TotalReusedBytes(), "%s should be fully explained", f.Path)
+
+		fresh += fi.FreshBytes
+		reused += fi.TotalReusedBytes()
+		compressed += fi.CompressedBytes
+
+		switch f.Path {
+		case "moved-after":
+			assert.Equal(t, map[int64]int64{targetIndices["moved-before"]: f.Size}, fi.ReusedBytes)
+		case "subdir/new":
+			assert.Equal(t, f.Size, fi.FreshBytes)
+		}
+	}
+
+	assert.Equal(t, dctx.FreshBytes, fresh)
+	assert.Equal(t, dctx.ReusedBytes, reused)
+	assert.True(t, compressed > fresh)
+	assert.True(t, compressed < int64(patchBuffer.Len()))
+}
@@ -0,0 +1,225 @@
+package pwr
+
+import (
+	"context"
+	"crypto/sha3"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	"github.com/itchio/lake"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior"
+	"github.com/itchio/wharf/werrors"
+	"github.com/itchio/wharf/wire"
+	"github.com/pkg/errors"
+)
+
+// ManifestExtension is the file extension of wharf manifest files
+const ManifestExtension = ".pwm"
+
+// A ManifestInfo contains the strong hashes of all blocks of all files
+// in a given container, as read from a wharf manifest file (.pwm)
+type ManifestInfo struct {
+	Container *tlc.Container
+	Algorithm HashAlgorithm
+
+	// Hashes holds one slice per file of the container (in the same order),
+	// which holds the hash of each of the file's blocks. Empty files have no blocks.
+	Hashes [][][]byte
+}
+
+// WriteManifest computes the hashes of all blocks of all files in a given container,
+// by reading them from pool, and writes them as an uncompressed wharf manifest file to writer.
+func WriteManifest(ctx context.Context, container *tlc.Container, pool lake.Pool, writer io.Writer, algorithm HashAlgorithm) error {
+	return WriteCompressedManifest(ctx, container, pool, writer, nil, algorithm)
+}
+
+// WriteCompressedManifest is like WriteManifest, but compresses hashes with
+// the given settings, or not at all if nil.
+func WriteCompressedManifest(ctx context.Context, container *tlc.Container, pool lake.Pool, writer io.Writer, compression *CompressionSettings, algorithm HashAlgorithm) (err error) {
+	defer func() {
+		if pErr := pool.Close(); pErr != nil && err == nil {
+			err = errors.WithStack(pErr)
+		}
+	}()
+
+	hasher, err := newManifestHasher(algorithm)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if compression == nil {
+		compression = &CompressionSettings{
+			Algorithm: CompressionAlgorithm_NONE,
+		}
+	}
+
+	rawWire := wire.NewWriteContext(writer)
+	err = rawWire.WriteMagic(ManifestMagic)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	header := &ManifestHeader{
+		Compression: compression,
+		Algorithm:   algorithm,
+	}
+	err = rawWire.WriteMessage(header)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	manifestWire, err := CompressWire(rawWire, header.Compression)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = manifestWire.WriteMessage(container)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	buf := make([]byte, BlockSize)
+	mbh := &ManifestBlockHash{}
+
+	for fileIndex, f := range container.Files {
+		select {
+		case <-ctx.Done():
+			return werrors.ErrCancelled
+		default:
+			// keep going!
+		}
+
+		var reader io.Reader
+		reader, err = pool.GetReader(int64(fileIndex))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		numBlocks := ComputeNumBlocks(f.Size)
+		for blockIndex := int64(0); blockIndex < numBlocks; blockIndex++ {
+			block := buf[:ComputeBlockSize(f.Size, blockIndex)]
+			_, err = io.ReadFull(reader, block)
+			if err != nil {
+				return errors.Wrapf(err, "while reading block %d of %s", blockIndex, f.Path)
+			}
+
+			mbh.Reset()
+			mbh.Hash = hasher.hashBlock(block)
+			err = manifestWire.WriteMessage(mbh)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	err = manifestWire.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// ReadManifest reads the container and all block hashes from a wharf manifest file.
+func ReadManifest(source savior.SeekSource) (*ManifestInfo, error) {
+	_, err := source.Resume(nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	rawWire := wire.NewReadContext(source)
+	err = rawWire.ExpectMagic(ManifestMagic)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	header := &ManifestHeader{}
+	err = rawWire.ReadMessage(header)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	_, err = newManifestHasher(header.Algorithm)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	manifestWire, err := DecompressWire(rawWire, header.Compression)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	container := &tlc.Container{}
+	err = manifestWire.ReadMessage(container)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	hashes := make([][][]byte, len(container.Files))
+	mbh := &ManifestBlockHash{}
+
+	for fileIndex, f := range container.Files {
+		numBlocks := ComputeNumBlocks(f.Size)
+		fileHashes := make([][]byte, numBlocks)
+
+		for blockIndex := int64(0); blockIndex < numBlocks; blockIndex++ {
+			err = manifestWire.ReadMessage(mbh)
+			if err != nil {
+				return nil, errors.Wrapf(err, "while reading hash of block %d of %s", blockIndex, f.Path)
+			}
+			fileHashes[blockIndex] = mbh.Hash
+		}
+		hashes[fileIndex] = fileHashes
+	}
+
+	manifest := &ManifestInfo{
+		Container: container,
+		Algorithm: header.Algorithm,
+		Hashes:    hashes,
+	}
+	return manifest, nil
+}
+
+// manifestHasher computes the strong hash of a block for a given HashAlgorithm
+type manifestHasher struct {
+	algorithm HashAlgorithm
+
+	shake *sha3.SHAKE
+	crc   *crc32.Table
+}
+
+func newManifestHasher(algorithm HashAlgorithm) (*manifestHasher, error) {
+	mh := &manifestHasher{
+		algorithm: algorithm,
+	}
+
+	switch algorithm {
+	case HashAlgorithm_SHAKE128_32:
+		mh.shake = sha3.NewSHAKE128()
+	case HashAlgorithm_CRC32C:
+		mh.crc = crc32.MakeTable(crc32.Castagnoli)
+	default:
+		return nil, errors.Errorf("unsupported manifest hash algorithm %s", algorithm)
+	}
+
+	return mh, nil
+}
+
+func (mh *manifestHasher) hashBlock(block []byte) []byte {
+	switch mh.algorithm {
+	case HashAlgorithm_SHAKE128_32:
+		mh.shake.Reset()
+		// writing to or reading from a SHAKE never fails
+		_, _ = mh.shake.Write(block)
+		res := make([]byte, 32)
+		_, _ = mh.shake.Read(res)
+		return res
+	case HashAlgorithm_CRC32C:
+		res := make([]byte, 4)
+		binary.BigEndian.PutUint32(res, crc32.Checksum(block, mh.crc))
+		return res
+	}
+	return nil
+}
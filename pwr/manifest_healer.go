@@ -0,0 +1,318 @@
+package pwr
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/headway/united"
+
+	"github.com/itchio/lake"
+	"github.com/itchio/lake/pools"
+	"github.com/itchio/lake/tlc"
+
+	"github.com/itchio/wharf/werrors"
+
+	"github.com/pkg/errors"
+)
+
+// A ManifestHealer repairs files block by block: it uses a manifest to
+// find out which blocks are actually corrupted, and only reads those
+// from a source build.
+type ManifestHealer struct {
+	// the directory we should heal
+	Target string
+
+	// an eos path for the manifest (.pwm), used if Manifest is nil
+	ManifestPath string
+
+	// an eos path for the source build (a directory, a .zip file, a single file),
+	// used if SourcePool is nil
+	SourcePath string
+
+	// VerifyManifest (optional) checks the manifest at ManifestPath
+	// before it's read
+	VerifyManifest SourceVerifier
+
+	// Manifest describes the build we're healing to
+	Manifest *ManifestInfo
+
+	// SourcePool is where healthy blocks are read from. It's not closed
+	// by the healer.
+	SourcePool lake.Pool
+
+	// A consumer to report progress to
+	Consumer *state.Consumer
+
+	// internal
+	woundsTally
+	progressMutex  sync.Mutex
+	totalProcessed int64
+	totalHealed    int64
+	totalHealthy   int64
+
+	container  *tlc.Container
+	hasher     *manifestHasher
+	sourcePool lake.Pool
+
+	lockMap LockMap
+}
+
+var _ Healer = (*ManifestHealer)(nil)
+
+// Do starts receiving from the wounds channel and healing
+func (mh *ManifestHealer) Do(parentCtx context.Context, container *tlc.Container, wounds chan *Wound) error {
+	mh.container = container
+
+	err := mh.openManifest()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	wl := &woundsLoop{
+		consumer:      mh.Consumer,
+		target:        mh.Target,
+		container:     container,
+		tally:         &mh.woundsTally,
+		healFiles:     mh.heal,
+		onHealthyFile: mh.onHealthyFile,
+	}
+	return wl.run(parentCtx, wounds)
+}
+
+func (mh *ManifestHealer) openManifest() error {
+	if mh.Manifest == nil {
+		source, file, err := openWharfFile(mh.ManifestPath, mh.VerifyManifest, mh.Consumer)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer file.Close()
+
+		mh.Manifest, err = ReadManifest(source)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	manifestFiles := mh.Manifest.Container.Files
+	if len(manifestFiles) != len(mh.container.Files) {
+		return errors.Errorf("manifest has %d files, but container has %d", len(manifestFiles), len(mh.container.Files))
+	}
+	for fileIndex, f := range mh.container.Files {
+		mf := manifestFiles[fileIndex]
+		if mf.Path != f.Path || mf.Size != f.Size {
+			return errors.Errorf("manifest doesn't match container: expected file %d to be %s (%d bytes), got %s (%d bytes)",
+				fileIndex, f.Path, f.Size, mf.Path, mf.Size)
+		}
+	}
+
+	var err error
+	mh.hasher, err = newManifestHasher(mh.Manifest.Algorithm)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (mh *ManifestHealer) heal(ctx context.Context, fileWounds chan *Wound) (rErr error) {
+	var currentIndex int64 = -1
+	var currentFile *os.File
+	preparedFiles := make(map[int64]bool)
+
+	closeCurrent := func() error {
+		if currentFile == nil {
+			return nil
+		}
+
+		err := currentFile.Close()
+		currentFile = nil
+		currentIndex = -1
+		return err
+	}
+
+	defer func() {
+		if err := closeCurrent(); err != nil && rErr == nil {
+			rErr = errors.WithStack(err)
+		}
+
+		if mh.sourcePool != nil {
+			// only close the pool if we opened it
+			if err := mh.sourcePool.Close(); err != nil && rErr == nil {
+				rErr = errors.WithStack(err)
+			}
+		}
+	}()
+
+	buf := make([]byte, BlockSize)
+
+	for {
+		select {
+		case <-ctx.Done():
+			// something else stopped the healing
+			return nil
+		case wound, ok := <-fileWounds:
+			if !ok {
+				// no more wounds to heal
+				return nil
+			}
+
+			if wound.Index != currentIndex {
+				err := closeCurrent()
+				if err != nil {
+					return errors.WithStack(err)
+				}
+
+				currentFile, err = openWoundedFile(ctx, mh.lockMap, mh.Consumer, mh.Target, mh.container, wound.Index, !preparedFiles[wound.Index])
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				currentIndex = wound.Index
+				preparedFiles[wound.Index] = true
+			}
+
+			err := mh.healWound(ctx, currentFile, wound, buf)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+}
+
+func (mh *ManifestHealer) healWound(ctx context.Context, file *os.File, wound *Wound, buf []byte) error {
+	f := mh.container.Files[wound.Index]
+	hashes := mh.Manifest.Hashes[wound.Index]
+
+	numBlocks := ComputeNumBlocks(f.Size)
+	if numBlocks == 0 || wound.End <= wound.Start {
+		return nil
+	}
+
+	firstBlock := wound.Start / BlockSize
+	lastBlock := (wound.End - 1) / BlockSize
+	if lastBlock >= numBlocks {
+		lastBlock = numBlocks - 1
+	}
+
+	var sourceReader io.ReadSeeker
+
+	for blockIndex := firstBlock; blockIndex <= lastBlock; blockIndex++ {
+		select {
+		case <-ctx.Done():
+			return werrors.ErrCancelled
+		default:
+			// keep going!
+		}
+
+		offset := blockIndex * BlockSize
+		blockSize := ComputeBlockSize(f.Size, blockIndex)
+		block := buf[:blockSize]
+		expectedHash := hashes[blockIndex]
+
+		n, err := file.ReadAt(block, offset)
+		if int64(n) == blockSize && bytes.Equal(mh.hasher.hashBlock(block), expectedHash) {
+			// block was fine after all
+			mh.onBlockProcessed(blockSize, 0)
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return errors.WithStack(err)
+		}
+
+		if sourceReader == nil {
+			sourceReader, err = mh.getSourceReader(wound.Index)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		_, err = sourceReader.Seek(offset, io.SeekStart)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		_, err = io.ReadFull(sourceReader, block)
+		if err != nil {
+			return errors.Wrapf(err, "while reading block %d of %s from source", blockIndex, f.Path)
+		}
+
+		if !bytes.Equal(mh.hasher.hashBlock(block), expectedHash) {
+			return errors.Errorf("source is corrupted too: block %d of %s doesn't match manifest", blockIndex, f.Path)
+		}
+
+		_, err = file.WriteAt(block, offset)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		mh.onBlockProcessed(blockSize, blockSize)
+	}
+
+	mh.Consumer.Debugf("Healed ~%s wound %s into %s",
+		united.FormatBytes(wound.Size()), united.FormatBytes(wound.Start), f.Path)
+
+	return nil
+}
+
+func (mh *ManifestHealer) getSourceReader(fileIndex int64) (io.ReadSeeker, error) {
+	if mh.SourcePool != nil {
+		return mh.SourcePool.GetReadSeeker(fileIndex)
+	}
+
+	if mh.sourcePool == nil {
+		pool, err := pools.New(mh.container, mh.SourcePath)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		mh.sourcePool = pool
+	}
+
+	return mh.sourcePool.GetReadSeeker(fileIndex)
+}
+
+func (mh *ManifestHealer) onHealthyFile(size int64) {
+	mh.progressMutex.Lock()
+	mh.totalHealthy += size
+	mh.progressMutex.Unlock()
+	mh.updateProgress()
+}
+
+func (mh *ManifestHealer) onBlockProcessed(processed int64, healed int64) {
+	mh.progressMutex.Lock()
+	mh.totalProcessed += processed
+	mh.totalHealed += healed
+	mh.progressMutex.Unlock()
+	mh.updateProgress()
+}
+
+// TotalHealed returns the total amount of data written to disk
+// to repair the wounds. Since ManifestHealer only rewrites blocks
+// that don't match the manifest, this may be less than TotalCorrupted.
+func (mh *ManifestHealer) TotalHealed() int64 {
+	mh.progressMutex.Lock()
+	defer mh.progressMutex.Unlock()
+	return mh.totalHealed
+}
+
+// SetConsumer gives this healer a consumer to report progress to
+func (mh *ManifestHealer) SetConsumer(consumer *state.Consumer) {
+	mh.Consumer = consumer
+}
+
+func (mh *ManifestHealer) updateProgress() {
+	if mh.Consumer == nil {
+		return
+	}
+
+	mh.progressMutex.Lock()
+	progress := float64(mh.totalHealthy+mh.totalProcessed) / float64(mh.container.Size)
+	mh.Consumer.Progress(progress)
+	mh.progressMutex.Unlock()
+}
+
+func (mh *ManifestHealer) SetLockMap(lockMap LockMap) {
+	mh.lockMap = lockMap
+}
@@ -0,0 +1,72 @@
+package pwr
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Manifest(t *testing.T) {
+	dir, err := os.MkdirTemp("", "manifest")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	wtest.MakeTestDir(t, dir, wtest.TestDirSettings{
+		Seed: 0x3391,
+		Entries: []wtest.TestDirEntry{
+			{Path: "subdir/file-1", Seed: 0x1},
+			{Path: "file-1", Seed: 0x2, Size: BlockSize*3 + 17},
+			{Path: "file-2", Seed: 0x3, Size: BlockSize},
+			{Path: "empty", Size: -1},
+		},
+	})
+
+	container, err := tlc.WalkAny(dir, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	for _, algorithm := range []HashAlgorithm{HashAlgorithm_SHAKE128_32, HashAlgorithm_CRC32C} {
+		t.Logf("Testing with %s", algorithm)
+
+		buf := new(bytes.Buffer)
+		compression := &CompressionSettings{
+			Algorithm: CompressionAlgorithm_NONE,
+			Checksums: true,
+		}
+		wtest.Must(t, WriteCompressedManifest(context.Background(), container, fspool.New(container, dir), buf, compression, algorithm))
+
+		manifest, err := ReadManifest(seeksource.FromBytes(buf.Bytes()))
+		wtest.Must(t, err)
+
+		assert.Equal(t, algorithm, manifest.Algorithm)
+		wtest.Must(t, container.EnsureEqual(manifest.Container))
+		assert.Equal(t, len(container.Files), len(manifest.Hashes))
+
+		hasher, err := newManifestHasher(algorithm)
+		wtest.Must(t, err)
+
+		for fileIndex, f := range container.Files {
+			fileHashes := manifest.Hashes[fileIndex]
+			assert.EqualValues(t, ComputeNumBlocks(f.Size), len(fileHashes))
+
+			data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(f.Path)))
+			wtest.Must(t, err)
+
+			for blockIndex, hash := range fileHashes {
+				start := int64(blockIndex) * BlockSize
+				block := data[start : start+ComputeBlockSize(f.Size, int64(blockIndex))]
+				assert.Equal(t, hasher.hashBlock(block), hash)
+			}
+		}
+	}
+
+	_, err = ReadManifest(seeksource.FromBytes([]byte{1, 2, 3, 4}))
+	assert.Error(t, err)
+}
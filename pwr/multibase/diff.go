@@ -0,0 +1,532 @@
+package multibase
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/itchio/headway/counter"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/multiread"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/taskgroup"
+	"github.com/itchio/wharf/wire"
+	"github.com/itchio/wharf/wsync"
+	"github.com/pkg/errors"
+)
+
+// DiffContext holds the state during a multi-base diff
+type DiffContext struct {
+	Compression *pwr.CompressionSettings
+	Consumer    *state.Consumer
+
+	SourceContainer *tlc.Container
+	Pool            lake.Pool
+
+	// Bases are the builds the patch can be applied to, in order of
+	// preference. Their signatures must all have been computed with
+	// the same block size and strong hash.
+	Bases []*pwr.SignatureInfo
+
+	ReusedBytes int64
+	FreshBytes  int64
+	// FallbackBytes counts data sent for the bases that miss some
+	// reused blocks. It's also counted in ReusedBytes.
+	FallbackBytes int64
+}
+
+// a base build, indexed for lookups
+type base struct {
+	hashInfo *pwr.HashInfo
+	// hashes of non-empty files, by weak hash, in signature order
+	lookup      map[uint32][]wsync.BlockHash
+	pathToIndex map[string]int64
+}
+
+// a ref is a run of blocks in a single base
+type ref struct {
+	baseIndex  int64
+	fileIndex  int64
+	blockIndex int64
+	blockSpan  int64
+}
+
+// a piece is a run of source data, either fresh or found in some of the bases
+type piece struct {
+	size int64
+	// one per base that has the data, in base order. empty for fresh data.
+	refs []ref
+}
+
+type differ struct {
+	dctx      *DiffContext
+	bases     []*base
+	blockSize int64
+
+	// file indices of each base start at offsets[baseIndex] in library
+	offsets []int64
+	library *wsync.BlockLibrary
+
+	diffContext *wsync.Context
+	signContext *wsync.Context
+}
+
+// WritePatch outputs a multi-base patch to patchWriter, and the source's
+// signature to signatureWriter
+func (dctx *DiffContext) WritePatch(ctx context.Context, patchWriter io.Writer, signatureWriter io.Writer) (err error) {
+	if dctx.Compression == nil {
+		return errors.New("multibase: no compression settings specified")
+	}
+
+	if len(dctx.Bases) == 0 {
+		return errors.New("multibase: at least one base is needed")
+	}
+
+	defer func() {
+		if fErr := dctx.Pool.Close(); fErr != nil && err == nil {
+			err = errors.WithStack(fErr)
+		}
+	}()
+
+	d, err := dctx.newDiffer()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	first := dctx.Bases[0]
+
+	// signature header
+	rawSigWire := wire.NewWriteContext(signatureWriter)
+	err = rawSigWire.WriteMagic(pwr.SignatureMagic)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = rawSigWire.WriteMessage(&pwr.SignatureHeader{
+		Compression: dctx.Compression,
+		BlockSize:   first.BlockSize,
+		StrongHash:  first.StrongHash,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	sigWire, err := pwr.CompressWire(rawSigWire, dctx.Compression)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = sigWire.WriteMessage(dctx.SourceContainer)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// patch header
+	rawPatchWire := wire.NewWriteContext(patchWriter)
+	err = rawPatchWire.WriteMagic(pwr.MultiBasePatchMagic)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = rawPatchWire.WriteMessage(&pwr.MultiBasePatchHeader{
+		Compression: dctx.Compression,
+		BlockSize:   first.BlockSize,
+		NumBases:    int64(len(dctx.Bases)),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	patchWire, err := pwr.CompressWire(rawPatchWire, dctx.Compression)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, b := range dctx.Bases {
+		err = patchWire.WriteMessage(b.Container)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	err = patchWire.WriteMessage(dctx.SourceContainer)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	sigWriter := func(bh wsync.BlockHash) error {
+		return sigWire.WriteMessage(&pwr.BlockHash{
+			WeakHash:   bh.WeakHash,
+			StrongHash: bh.StrongHash,
+		})
+	}
+
+	// re-used messages
+	syncHeader := &pwr.SyncHeader{}
+	syncDelimiter := &pwr.SyncOp{
+		Type: pwr.SyncOp_HEY_YOU_DID_IT,
+	}
+
+	for fileIndex, f := range dctx.SourceContainer.Files {
+		dctx.Consumer.ProgressLabel(f.Path)
+
+		syncHeader.Reset()
+		syncHeader.FileIndex = int64(fileIndex)
+		err = patchWire.WriteMessage(syncHeader)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		pieces, err := d.findPieces(ctx, int64(fileIndex), sigWriter)
+		if err != nil {
+			return errors.Wrapf(err, "while diffing %s", f.Path)
+		}
+
+		err = d.writePieces(int64(fileIndex), pieces, patchWire)
+		if err != nil {
+			return errors.Wrapf(err, "while writing %s", f.Path)
+		}
+
+		err = patchWire.WriteMessage(syncDelimiter)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	err = patchWire.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = sigWire.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (dctx *DiffContext) newDiffer() (*differ, error) {
+	first := dctx.Bases[0]
+	d := &differ{
+		dctx:      dctx,
+		blockSize: first.EffectiveBlockSize(),
+	}
+
+	var combined []wsync.BlockHash
+	var offset int64
+
+	for baseIndex, sigInfo := range dctx.Bases {
+		if sigInfo.EffectiveBlockSize() != d.blockSize {
+			return nil, errors.Errorf("multibase: base %d has %d-byte blocks, base 0 has %d-byte blocks", baseIndex, sigInfo.EffectiveBlockSize(), d.blockSize)
+		}
+		if sigInfo.StrongHash != first.StrongHash {
+			return nil, errors.Errorf("multibase: base %d uses %s strong hashes, base 0 uses %s", baseIndex, sigInfo.StrongHash, first.StrongHash)
+		}
+
+		hashInfo, err := pwr.ComputeHashInfo(sigInfo)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while reading signature of base %d", baseIndex)
+		}
+
+		b := &base{
+			hashInfo:    hashInfo,
+			lookup:      make(map[uint32][]wsync.BlockHash),
+			pathToIndex: make(map[string]int64),
+		}
+		for fileIndex, f := range sigInfo.Container.Files {
+			b.pathToIndex[f.Path] = int64(fileIndex)
+			for _, bh := range hashInfo.Groups[int64(fileIndex)] {
+				b.lookup[bh.WeakHash] = append(b.lookup[bh.WeakHash], bh)
+			}
+		}
+		d.bases = append(d.bases, b)
+
+		for _, bh := range sigInfo.Hashes {
+			bh.FileIndex += offset
+			combined = append(combined, bh)
+		}
+		d.offsets = append(d.offsets, offset)
+		offset += int64(len(sigInfo.Container.Files))
+	}
+	d.library = wsync.NewBlockLibrary(combined)
+
+	var err error
+	d.diffContext, err = mksync(first)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	d.signContext, err = mksync(first)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return d, nil
+}
+
+func mksync(sigInfo *pwr.SignatureInfo) (*wsync.Context, error) {
+	hasher, err := pwr.NewStrongHasher(sigInfo.StrongHash)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return wsync.NewContextWithHasher(int(sigInfo.EffectiveBlockSize()), hasher), nil
+}
+
+// findPieces diffs a source file against all bases, and sends its hashes to sigWriter
+func (d *differ) findPieces(ctx context.Context, fileIndex int64, sigWriter wsync.SignatureWriter) ([]*piece, error) {
+	dctx := d.dctx
+	f := dctx.SourceContainer.Files[fileIndex]
+
+	sourceReader, err := dctx.Pool.GetReader(fileIndex)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	onSourceRead := func(count int64) {
+		dctx.Consumer.Progress(float64(f.Offset+count) / float64(dctx.SourceContainer.Size))
+	}
+
+	var preferredFileIndex int64 = -1
+	if oldIndex, ok := d.bases[0].pathToIndex[f.Path]; ok {
+		preferredFileIndex = oldIndex
+	}
+
+	var pieces []*piece
+	opsWriter := func(op wsync.Operation) error {
+		switch op.Type {
+		case wsync.OpBlockRange:
+			baseIndex := d.baseIndexOf(op.FileIndex)
+			for i := int64(0); i < op.BlockSpan; i++ {
+				pieces = d.addBlock(pieces, f.Path, ref{
+					baseIndex:  baseIndex,
+					fileIndex:  op.FileIndex - d.offsets[baseIndex],
+					blockIndex: op.BlockIndex + i,
+					blockSpan:  1,
+				})
+			}
+		case wsync.OpData:
+			if len(pieces) > 0 && len(pieces[len(pieces)-1].refs) == 0 {
+				pieces[len(pieces)-1].size += int64(len(op.Data))
+			} else {
+				pieces = append(pieces, &piece{size: int64(len(op.Data))})
+			}
+		default:
+			return errors.Errorf("unexpected rsync op type: %d", op.Type)
+		}
+		return nil
+	}
+
+	mr := multiread.New(counter.NewReaderCallback(onSourceRead, sourceReader))
+	diffReader := mr.Reader()
+	signReader := mr.Reader()
+
+	err = taskgroup.Do(ctx,
+		func() error {
+			return d.signContext.CreateSignature(ctx, fileIndex, signReader, sigWriter)
+		},
+		func() error {
+			return d.diffContext.ComputeDiff(diffReader, d.library, opsWriter, preferredFileIndex)
+		},
+		func() error {
+			return mr.Do(ctx)
+		},
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return pieces, nil
+}
+
+// baseIndexOf returns which base a file index of the combined library belongs to
+func (d *differ) baseIndexOf(combinedFileIndex int64) int64 {
+	baseIndex := int64(len(d.offsets) - 1)
+	for baseIndex > 0 && d.offsets[baseIndex] > combinedFileIndex {
+		baseIndex--
+	}
+	return baseIndex
+}
+
+// addBlock adds a block found by the diff to pieces, along with the same
+// block in every other base that has it.
+func (d *differ) addBlock(pieces []*piece, path string, found ref) []*piece {
+	foundBase := d.bases[found.baseIndex]
+	bh := foundBase.hashInfo.Groups[found.fileIndex][found.blockIndex]
+	fileSize := foundBase.hashInfo.Container.Files[found.fileIndex].Size
+	size := pwr.ComputeBlockSizeWithBlockSize(fileSize, found.blockIndex, d.blockSize)
+
+	var last *piece
+	if len(pieces) > 0 && len(pieces[len(pieces)-1].refs) > 0 {
+		last = pieces[len(pieces)-1]
+	}
+
+	var refs []ref
+	for baseIndex, b := range d.bases {
+		if int64(baseIndex) == found.baseIndex {
+			refs = append(refs, found)
+			continue
+		}
+
+		var prev *ref
+		if last != nil {
+			for i := range last.refs {
+				if last.refs[i].baseIndex == int64(baseIndex) {
+					prev = &last.refs[i]
+				}
+			}
+		}
+
+		if r, ok := b.find(bh, prev, path); ok {
+			r.baseIndex = int64(baseIndex)
+			refs = append(refs, r)
+		}
+	}
+
+	if last != nil && last.continuedBy(refs) {
+		for i := range last.refs {
+			last.refs[i].blockSpan++
+		}
+		last.size += size
+		return pieces
+	}
+
+	return append(pieces, &piece{size: size, refs: refs})
+}
+
+// find looks for a block with the same contents as bh. It prefers the block
+// right after prev, then blocks from the file at path.
+func (b *base) find(bh wsync.BlockHash, prev *ref, path string) (ref, bool) {
+	if prev != nil {
+		group := b.hashInfo.Groups[prev.fileIndex]
+		next := prev.blockIndex + prev.blockSpan
+		if next < int64(len(group)) && sameBlock(group[next], bh) {
+			return ref{fileIndex: prev.fileIndex, blockIndex: next, blockSpan: 1}, true
+		}
+	}
+
+	var preferredFileIndex int64 = -1
+	if fileIndex, ok := b.pathToIndex[path]; ok {
+		preferredFileIndex = fileIndex
+	}
+
+	var match *wsync.BlockHash
+	for i, candidate := range b.lookup[bh.WeakHash] {
+		if !sameBlock(candidate, bh) {
+			continue
+		}
+		if match == nil || candidate.FileIndex == preferredFileIndex {
+			match = &b.lookup[bh.WeakHash][i]
+		}
+		if candidate.FileIndex == preferredFileIndex {
+			break
+		}
+	}
+
+	if match == nil {
+		return ref{}, false
+	}
+	return ref{fileIndex: match.FileIndex, blockIndex: match.BlockIndex, blockSpan: 1}, true
+}
+
+func sameBlock(a wsync.BlockHash, b wsync.BlockHash) bool {
+	return a.WeakHash == b.WeakHash && a.ShortSize == b.ShortSize && bytes.Equal(a.StrongHash, b.StrongHash)
+}
+
+// continuedBy returns true if refs (all single blocks) follow the piece's
+// refs in the same files of the same bases.
+func (p *piece) continuedBy(refs []ref) bool {
+	if len(refs) != len(p.refs) {
+		return false
+	}
+
+	for i, r := range refs {
+		pr := p.refs[i]
+		if r.baseIndex != pr.baseIndex || r.fileIndex != pr.fileIndex || r.blockIndex != pr.blockIndex+pr.blockSpan {
+			return false
+		}
+	}
+	return true
+}
+
+// writePieces reads the source file again, and writes the ops for each
+// piece, with fallback data for the bases that don't have it.
+func (d *differ) writePieces(fileIndex int64, pieces []*piece, patchWire *wire.WriteContext) error {
+	dctx := d.dctx
+	numBases := len(d.bases)
+
+	sourceReader, err := dctx.Pool.GetReader(fileIndex)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	wop := &pwr.SyncOp{}
+	buf := make([]byte, wsync.MaxDataOp)
+
+	writeData := func(size int64, fallback bool) error {
+		for first := true; first || size > 0; first = false {
+			n := int64(len(buf))
+			if n > size {
+				n = size
+			}
+
+			_, err := io.ReadFull(sourceReader, buf[:n])
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			wop.Reset()
+			wop.Type = pwr.SyncOp_DATA
+			wop.Data = buf[:n]
+			wop.Fallback = fallback
+			err = patchWire.WriteMessage(wop)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			size -= n
+		}
+		return nil
+	}
+
+	for _, p := range pieces {
+		if len(p.refs) == 0 {
+			err = writeData(p.size, false)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			dctx.FreshBytes += p.size
+			continue
+		}
+
+		for i, r := range p.refs {
+			wop.Reset()
+			wop.Type = pwr.SyncOp_BLOCK_RANGE
+			wop.BaseIndex = r.baseIndex
+			wop.FileIndex = r.fileIndex
+			wop.BlockIndex = r.blockIndex
+			wop.BlockSpan = r.blockSpan
+			wop.Alternative = i > 0
+			err = patchWire.WriteMessage(wop)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		dctx.ReusedBytes += p.size
+
+		if len(p.refs) < numBases {
+			err = writeData(p.size, true)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			dctx.FallbackBytes += p.size
+		} else {
+			_, err = io.CopyN(io.Discard, sourceReader, p.size)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	return nil
+}
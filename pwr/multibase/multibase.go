@@ -0,0 +1,90 @@
+// Package multibase writes and applies patches that can upgrade any one of
+// several previous builds (the bases) to a new build.
+//
+// A multi-base patch is like a regular rsync patch, except each BLOCK_RANGE
+// op says which base it reads from. When several bases have the same data,
+// it's listed once per base, and when some bases don't have it at all,
+// it's followed by fallback DATA ops. Projecting the patch for one of the
+// bases yields a regular patch, which the patcher package can apply.
+package multibase
+
+import (
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/wire"
+	"github.com/pkg/errors"
+)
+
+// Info describes a multi-base patch
+type Info struct {
+	Header *pwr.MultiBasePatchHeader
+
+	// Bases are the builds the patch applies to, in the order they
+	// were given to the diff
+	Bases []*tlc.Container
+	// Source is the build the patch produces
+	Source *tlc.Container
+}
+
+// ReadInfo reads the header and containers of a multi-base patch
+func ReadInfo(patchReader savior.SeekSource) (*Info, error) {
+	info, _, err := readInfo(patchReader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return info, nil
+}
+
+// readInfo reads the header and containers of a multi-base patch, and returns
+// a (decompressing) read context positioned right after them.
+func readInfo(patchReader savior.SeekSource) (*Info, *wire.ReadContext, error) {
+	_, err := patchReader.Resume(nil)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	rctx := wire.NewReadContext(patchReader)
+	err = rctx.ExpectMagic(pwr.MultiBasePatchMagic)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	header := &pwr.MultiBasePatchHeader{}
+	err = rctx.ReadMessage(header)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	err = pwr.ValidateBlockSize(header.BlockSize)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	if header.NumBases < 1 {
+		return nil, nil, errors.Errorf("corrupted multi-base patch: has %d bases", header.NumBases)
+	}
+
+	rctx, err = pwr.DecompressWire(rctx, header.Compression)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	info := &Info{Header: header}
+	for i := int64(0); i < header.NumBases; i++ {
+		container := &tlc.Container{}
+		err = rctx.ReadMessage(container)
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		info.Bases = append(info.Bases, container)
+	}
+
+	info.Source = &tlc.Container{}
+	err = rctx.ReadMessage(info.Source)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	return info, rctx, nil
+}
@@ -0,0 +1,151 @@
+package multibase_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/pwr/multibase"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/itchio/wharf/compressors/cbrotli"
+	_ "github.com/itchio/wharf/decompressors/cbrotli"
+)
+
+func Test_MultiBase(t *testing.T) {
+	mainDir, err := os.MkdirTemp("", "multibase")
+	wtest.Must(t, err)
+	defer os.RemoveAll(mainDir)
+
+	bases := []wtest.TestDirSettings{
+		{
+			Seed: 0x11,
+			Entries: []wtest.TestDirEntry{
+				{Path: "shared", Seed: 0x1, Size: pwr.BlockSize * 4},
+				{Path: "file", Seed: 0xa, Size: pwr.BlockSize * 2},
+				{Path: "empty", Data: []byte{}},
+			},
+		},
+		{
+			Seed: 0x22,
+			Entries: []wtest.TestDirEntry{
+				{Path: "shared", Seed: 0x1, Size: pwr.BlockSize * 4},
+				{Path: "file", Seed: 0xb, Size: pwr.BlockSize * 2},
+				{Path: "only-b", Seed: 0x5, Size: pwr.BlockSize + 7},
+			},
+		},
+		{
+			Seed: 0x33,
+			Entries: []wtest.TestDirEntry{
+				{Path: "moved/shared", Seed: 0x1, Size: pwr.BlockSize * 4},
+				{Path: "file", Seed: 0xc, Size: pwr.BlockSize * 2},
+			},
+		},
+	}
+
+	source := wtest.TestDirSettings{
+		Seed: 0x44,
+		Entries: []wtest.TestDirEntry{
+			{Path: "shared", Seed: 0x1, Size: pwr.BlockSize * 4},
+			{Path: "file", Chunks: []wtest.TestDirChunk{
+				{Seed: 0xa, Size: pwr.BlockSize * 2},
+				{Seed: 0x99, Size: pwr.BlockSize},
+				{Seed: 0xb, Size: pwr.BlockSize * 2},
+				{Seed: 0xc, Size: pwr.BlockSize * 2},
+			}},
+			{Path: "only-b", Seed: 0x5, Size: pwr.BlockSize + 7},
+			{Path: "empty", Data: []byte{}},
+		},
+	}
+
+	var baseDirs []string
+	var baseSigs []*pwr.SignatureInfo
+	for i, settings := range bases {
+		dir := filepath.Join(mainDir, "bases", string(rune('a'+i)))
+		wtest.MakeTestDir(t, dir, settings)
+		baseDirs = append(baseDirs, dir)
+		baseSigs = append(baseSigs, makeSignature(t, dir))
+	}
+
+	sourceDir := filepath.Join(mainDir, "source")
+	wtest.MakeTestDir(t, sourceDir, source)
+	sourceContainer, err := tlc.WalkAny(sourceDir, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	dctx := &multibase.DiffContext{
+		Compression: &pwr.CompressionSettings{
+			Algorithm: pwr.CompressionAlgorithm_BROTLI,
+			Quality:   1,
+		},
+		SourceContainer: sourceContainer,
+		Pool:            fspool.New(sourceContainer, sourceDir),
+		Bases:           baseSigs,
+	}
+
+	patchBuffer := new(bytes.Buffer)
+	signatureBuffer := new(bytes.Buffer)
+	wtest.Must(t, dctx.WritePatch(context.Background(), patchBuffer, signatureBuffer))
+	t.Logf("Reused %d bytes (%d with fallback), %d fresh bytes", dctx.ReusedBytes, dctx.FallbackBytes, dctx.FreshBytes)
+
+	assert.EqualValues(t, pwr.BlockSize, dctx.FreshBytes)
+	// "shared" is in every base, everything else is only in one of them
+	assert.EqualValues(t, pwr.BlockSize*7+7, dctx.FallbackBytes)
+	assert.EqualValues(t, sourceContainer.Size-dctx.FreshBytes, dctx.ReusedBytes)
+
+	info, err := multibase.ReadInfo(seeksource.FromBytes(patchBuffer.Bytes()))
+	wtest.Must(t, err)
+	assert.Len(t, info.Bases, len(bases))
+	wtest.Must(t, info.Source.EnsureEqual(sourceContainer))
+
+	sourceSig := makeSignature(t, sourceDir)
+	sigReader := seeksource.FromBytes(signatureBuffer.Bytes())
+	_, err = sigReader.Resume(nil)
+	wtest.Must(t, err)
+	writtenSig, err := pwr.ReadSignature(context.Background(), sigReader)
+	wtest.Must(t, err)
+	assert.EqualValues(t, sourceSig.Hashes, writtenSig.Hashes)
+
+	for baseIndex, baseDir := range baseDirs {
+		t.Logf("Applying to base %d", baseIndex)
+
+		outputDir := filepath.Join(mainDir, "out")
+		wtest.Must(t, os.RemoveAll(outputDir))
+		wtest.Must(t, multibase.PatchFresh(multibase.PatchFreshParams{
+			PatchReader: seeksource.FromBytes(patchBuffer.Bytes()),
+			BaseIndex:   int64(baseIndex),
+			TargetDir:   baseDir,
+			OutputDir:   outputDir,
+		}))
+
+		wtest.Must(t, pwr.AssertValid(outputDir, sourceSig))
+		wtest.Must(t, pwr.AssertNoGhosts(outputDir, sourceSig))
+	}
+
+	err = multibase.Project(multibase.ProjectParams{
+		PatchReader: seeksource.FromBytes(patchBuffer.Bytes()),
+		BaseIndex:   int64(len(bases)),
+		PatchWriter: new(bytes.Buffer),
+	})
+	assert.Error(t, err)
+}
+
+func makeSignature(t *testing.T, dir string) *pwr.SignatureInfo {
+	container, err := tlc.WalkAny(dir, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	hashes, err := pwr.ComputeSignature(context.Background(), container, fspool.New(container, dir), &state.Consumer{})
+	wtest.Must(t, err)
+
+	return &pwr.SignatureInfo{
+		Container: container,
+		Hashes:    hashes,
+	}
+}
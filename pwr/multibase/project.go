@@ -0,0 +1,279 @@
+package multibase
+
+import (
+	"bufio"
+	"io"
+	"os"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/savior"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/pwr/patcher"
+	"github.com/itchio/wharf/wire"
+	"github.com/pkg/errors"
+)
+
+// ProjectParams describes a projection
+type ProjectParams struct {
+	// PatchReader is the multi-base patch
+	PatchReader savior.SeekSource
+	// BaseIndex is the base the projected patch applies to
+	BaseIndex int64
+	// PatchWriter receives a regular patch from that base to the source
+	PatchWriter io.Writer
+
+	// optional, defaults to no compression
+	Compression *pwr.CompressionSettings
+}
+
+// Project writes a regular patch that upgrades one of the bases of a
+// multi-base patch. It reads blocks from that base when the multi-base
+// patch lists it, and uses fallback data otherwise.
+func Project(params ProjectParams) error {
+	if params.PatchReader == nil {
+		return errors.New("ProjectParams.PatchReader can't be nil")
+	}
+	if params.PatchWriter == nil {
+		return errors.New("ProjectParams.PatchWriter can't be nil")
+	}
+
+	compression := params.Compression
+	if compression == nil {
+		compression = &pwr.CompressionSettings{
+			Algorithm: pwr.CompressionAlgorithm_NONE,
+		}
+	}
+
+	info, rctx, err := readInfo(params.PatchReader)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	baseIndex := params.BaseIndex
+	if baseIndex < 0 || baseIndex >= int64(len(info.Bases)) {
+		return errors.Errorf("multibase: patch has %d bases, can't project for base %d", len(info.Bases), baseIndex)
+	}
+	baseContainer := info.Bases[baseIndex]
+
+	rawPatchWire := wire.NewWriteContext(params.PatchWriter)
+	err = rawPatchWire.WriteMagic(pwr.PatchMagic)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = rawPatchWire.WriteMessage(&pwr.PatchHeader{
+		Compression: compression,
+		BlockSize:   info.Header.BlockSize,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	patchWire, err := pwr.CompressWire(rawPatchWire, compression)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = patchWire.WriteMessage(baseContainer)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = patchWire.WriteMessage(info.Source)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	sh := &pwr.SyncHeader{}
+	for fileIndex, f := range info.Source.Files {
+		sh.Reset()
+		err = rctx.ReadMessage(sh)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if sh.FileIndex != int64(fileIndex) {
+			return errors.Errorf("corrupted multi-base patch: expected file %d, got file %d", fileIndex, sh.FileIndex)
+		}
+		if sh.Type != pwr.SyncHeader_RSYNC {
+			return errors.Errorf("corrupted multi-base patch: unsupported patch series kind %s", sh.Type)
+		}
+
+		err = patchWire.WriteMessage(sh)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		err = projectOps(rctx, patchWire, baseIndex, len(baseContainer.Files))
+		if err != nil {
+			return errors.Wrapf(err, "while projecting %s", f.Path)
+		}
+	}
+
+	err = patchWire.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// projectOps copies the ops of a single file, up to and including
+// the delimiter, keeping only what baseIndex needs.
+func projectOps(rctx *wire.ReadContext, patchWire *wire.WriteContext, baseIndex int64, numBaseFiles int) error {
+	op := &pwr.SyncOp{}
+	wop := &pwr.SyncOp{}
+
+	// state of the current group of alternatives
+	inGroup := false
+	usedRef := false
+	usedFallback := false
+
+	closeGroup := func() error {
+		if inGroup && !usedRef && !usedFallback {
+			return errors.Errorf("corrupted multi-base patch: no data for base %d", baseIndex)
+		}
+		inGroup = false
+		return nil
+	}
+
+	for {
+		op.Reset()
+		err := rctx.ReadMessage(op)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		switch op.Type {
+		case pwr.SyncOp_BLOCK_RANGE:
+			if op.Alternative {
+				if !inGroup || usedFallback {
+					return errors.New("corrupted multi-base patch: alternative block range out of place")
+				}
+			} else {
+				err = closeGroup()
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				inGroup, usedRef, usedFallback = true, false, false
+			}
+
+			if op.BaseIndex != baseIndex || usedRef {
+				continue
+			}
+
+			if op.FileIndex < 0 || op.FileIndex >= int64(numBaseFiles) {
+				return errors.Errorf("corrupted multi-base patch: block range refers to file %d", op.FileIndex)
+			}
+
+			wop.Reset()
+			wop.Type = pwr.SyncOp_BLOCK_RANGE
+			wop.FileIndex = op.FileIndex
+			wop.BlockIndex = op.BlockIndex
+			wop.BlockSpan = op.BlockSpan
+			err = patchWire.WriteMessage(wop)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			usedRef = true
+
+		case pwr.SyncOp_DATA:
+			if op.Fallback {
+				if !inGroup {
+					return errors.New("corrupted multi-base patch: fallback data out of place")
+				}
+				usedFallback = true
+				if usedRef {
+					continue
+				}
+			} else {
+				err = closeGroup()
+				if err != nil {
+					return errors.WithStack(err)
+				}
+			}
+
+			wop.Reset()
+			wop.Type = pwr.SyncOp_DATA
+			wop.Data = op.Data
+			err = patchWire.WriteMessage(wop)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+		case pwr.SyncOp_HEY_YOU_DID_IT:
+			err = closeGroup()
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			err = patchWire.WriteMessage(op)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			return nil
+
+		default:
+			return errors.Errorf("corrupted multi-base patch: unexpected sync op type %s", op.Type)
+		}
+	}
+}
+
+// PatchFreshParams describes how to apply a multi-base patch
+type PatchFreshParams struct {
+	PatchReader savior.SeekSource
+	// BaseIndex is the base installed in TargetDir, see ReadInfo
+	BaseIndex int64
+
+	TargetDir string
+	OutputDir string
+
+	Consumer *state.Consumer
+}
+
+// PatchFresh applies a multi-base patch to TargetDir, which must contain
+// the base at BaseIndex, and writes the source build to OutputDir.
+func PatchFresh(params PatchFreshParams) (err error) {
+	if params.PatchReader == nil {
+		return errors.Errorf("PatchFreshParams.PatchReader can't be nil")
+	}
+
+	projected, err := os.CreateTemp("", "wharf-multibase")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		projected.Close()
+		if rErr := os.Remove(projected.Name()); rErr != nil && err == nil {
+			err = errors.WithStack(rErr)
+		}
+	}()
+
+	bw := bufio.NewWriter(projected)
+	err = Project(ProjectParams{
+		PatchReader: params.PatchReader,
+		BaseIndex:   params.BaseIndex,
+		PatchWriter: bw,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = patcher.PatchFresh(patcher.PatchFreshParams{
+		PatchReader: seeksource.FromFile(projected),
+		TargetDir:   params.TargetDir,
+		OutputDir:   params.OutputDir,
+		Consumer:    params.Consumer,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
@@ -21,6 +21,12 @@ type savingPatcher struct {
 	rctx     *wire.ReadContext
 	consumer *state.Consumer
 
+	// set if the patch has a table of contents, which lets us jump
+	// over files that aren't whitelisted instead of reading them
+	patchReader  savior.SeekSource
+	toc          *pwr.PatchTOC
+	tocFileIndex int64
+
 	sc SaveConsumer
 
 	targetContainer *tlc.Container
@@ -46,6 +52,16 @@ func New(patchReader savior.SeekSource, consumer *state.Consumer) (Patcher, erro
 	// Downside: more network usage when resuming
 	// Upside: no need to store that on disk
 
+	// this has to happen first: sections of patchReader may share
+	// its underlying reader, and seek it.
+	toc, err := pwr.ReadPatchTOC(patchReader)
+	if err != nil {
+		if errors.Cause(err) != pwr.ErrNoPatchTOC {
+			return nil, err
+		}
+		toc = nil
+	}
+
 	startOffset, err := patchReader.Resume(nil)
 	if err != nil {
 		return nil, err
@@ -72,6 +88,11 @@ func New(patchReader savior.SeekSource, consumer *state.Consumer) (Patcher, erro
 		return nil, err
 	}
 
+	err = pwr.ValidateBlockSize(header.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+
 	rctx, err := pwr.DecompressWire(rawWire, header.Compression)
 	if err != nil {
 		return nil, err
@@ -107,10 +128,17 @@ func New(patchReader savior.SeekSource, consumer *state.Consumer) (Patcher, erro
 		}
 	}
 
+	if toc != nil && toc.Header.NumFiles != int64(len(sourceContainer.Files)) {
+		return nil, errors.Errorf("corrupted patch: table of contents has %d files, but patch has %d", toc.Header.NumFiles, len(sourceContainer.Files))
+	}
+
 	sp := &savingPatcher{
 		rctx:     rctx,
 		consumer: consumer,
 
+		patchReader: patchReader,
+		toc:         toc,
+
 		targetContainer: targetContainer,
 		sourceContainer: sourceContainer,
 		header:          header,
@@ -131,6 +159,13 @@ func (sp *savingPatcher) Resume(c *Checkpoint, targetPool lake.Pool, bwl bowl.Bo
 	consumer := sp.consumer
 
 	if c != nil {
+		if c.TOCFileIndex != 0 {
+			err := sp.seekFile(c.TOCFileIndex)
+			if err != nil {
+				return err
+			}
+		}
+
 		err := sp.rctx.Resume(c.MessageCheckpoint)
 		if err != nil {
 			return err
@@ -149,10 +184,31 @@ func (sp *savingPatcher) Resume(c *Checkpoint, targetPool lake.Pool, bwl bowl.Bo
 	var numFiles = int64(len(sp.sourceContainer.Files))
 	consumer.Debugf("↺ Resuming from file %d / %d", c.FileIndex, numFiles)
 
+	// whether the patch must be read from elsewhere for the next file
+	needsSeek := false
+
 	for c.FileIndex < numFiles {
 		f := sp.sourceContainer.Files[c.FileIndex]
 		var sh *pwr.SyncHeader
 
+		if c.SyncHeader == nil && sp.toc != nil && sp.sourceIndexWhiteList != nil {
+			if !sp.sourceIndexWhiteList[c.FileIndex] {
+				// the table of contents tells us where the next file
+				// starts, no need to read through this one.
+				needsSeek = true
+				c.FileIndex++
+				continue
+			}
+
+			if needsSeek {
+				err := sp.seekFile(c.FileIndex)
+				if err != nil {
+					return err
+				}
+				needsSeek = false
+			}
+		}
+
 		if c.SyncHeader != nil {
 			sh = c.SyncHeader
 			consumer.Debugf("...from checkpoint")
@@ -207,6 +263,23 @@ func (sp *savingPatcher) Resume(c *Checkpoint, targetPool lake.Pool, bwl bowl.Bo
 	return nil
 }
 
+// seekFile makes the patcher read the patch from the start of the given
+// file's series, as located by the table of contents
+func (sp *savingPatcher) seekFile(fileIndex int64) error {
+	if sp.toc == nil {
+		return errors.Errorf("patch has no table of contents, can't jump to file %d", fileIndex)
+	}
+
+	sp.consumer.Debugf("Jumping to file %d using table of contents", fileIndex)
+	rctx, err := sp.toc.OpenFile(sp.patchReader, fileIndex)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	sp.rctx = rctx
+	sp.tocFileIndex = fileIndex
+	return nil
+}
+
 func (sp *savingPatcher) skipFile(c *Checkpoint, sh *pwr.SyncHeader) error {
 	sp.consumer.ProgressLabel(sp.sourceContainer.Files[sh.FileIndex].Path)
 
@@ -261,7 +334,14 @@ func (sp *savingPatcher) Progress() float64 {
 		return -1
 	}
 
-	return sp.rctx.GetSource().Progress()
+	progress := sp.rctx.GetSource().Progress()
+	if sp.tocFileIndex != 0 {
+		// the source only covers the patch from the file we jumped to
+		start := float64(sp.toc.Entries[sp.tocFileIndex].RestartOffset)
+		patchSize := float64(sp.toc.Header.PatchSize)
+		progress = (start + progress*(patchSize-start)) / patchSize
+	}
+	return progress
 }
 
 func (sp *savingPatcher) SetSourceIndexWhitelist(sourceIndexWhitelist map[int64]bool) {
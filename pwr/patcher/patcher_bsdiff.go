@@ -127,6 +127,7 @@ func (sp *savingPatcher) processBsdiff(c *Checkpoint, targetPool lake.Pool, sh *
 					FileIndex:         sh.FileIndex,
 					FileKind:          FileKindBsdiff,
 					MessageCheckpoint: messageCheckpoint,
+					TOCFileIndex:      sp.tocFileIndex,
 					BowlCheckpoint:    bowlCheckpoint,
 					BsdiffCheckpoint: &BsdiffCheckpoint{
 						WriterCheckpoint: writerCheckpoint,
@@ -111,7 +111,7 @@ func (sp *savingPatcher) processRsync(c *Checkpoint, targetPool lake.Pool, sh *p
 	}
 
 	if sp.rsyncCtx == nil {
-		sp.rsyncCtx = wsync.NewContext(int(pwr.BlockSize))
+		sp.rsyncCtx = wsync.NewContext(int(pwr.EffectiveBlockSize(sp.header.BlockSize)))
 	}
 
 	if op == nil {
@@ -160,6 +160,7 @@ func (sp *savingPatcher) processRsync(c *Checkpoint, targetPool lake.Pool, sh *p
 					FileIndex:         sh.FileIndex,
 					FileKind:          FileKindRsync,
 					MessageCheckpoint: messageCheckpoint,
+					TOCFileIndex:      sp.tocFileIndex,
 					BowlCheckpoint:    bowlCheckpoint,
 					RsyncCheckpoint: &RsyncCheckpoint{
 						WriterCheckpoint: writerCheckpoint,
@@ -219,6 +220,13 @@ func makeWop(op *pwr.SyncOp) (wsync.Operation, error) {
 			BlockIndex: op.BlockIndex,
 			BlockSpan:  op.BlockSpan,
 		}, nil
+	case pwr.SyncOp_BYTE_RANGE:
+		return wsync.Operation{
+			Type:      wsync.OpByteRange,
+			FileIndex: op.FileIndex,
+			Offset:    op.Offset,
+			Size:      op.Size,
+		}, nil
 	case pwr.SyncOp_DATA:
 		return wsync.Operation{
 			Type: wsync.OpData,
@@ -230,13 +238,8 @@ func makeWop(op *pwr.SyncOp) (wsync.Operation, error) {
 }
 
 func (sp *savingPatcher) isFullFileOp(sh *pwr.SyncHeader, op *pwr.SyncOp) bool {
-	// only block range ops can be full-file ops
-	if op.Type != pwr.SyncOp_BLOCK_RANGE {
-		return false
-	}
-
-	// and it's gotta start at 0
-	if op.BlockIndex != 0 {
+	// only block range and byte range ops can be full-file ops
+	if op.Type != pwr.SyncOp_BLOCK_RANGE && op.Type != pwr.SyncOp_BYTE_RANGE {
 		return false
 	}
 
@@ -248,7 +251,17 @@ func (sp *savingPatcher) isFullFileOp(sh *pwr.SyncHeader, op *pwr.SyncOp) bool {
 		return false
 	}
 
-	numOutputBlocks := pwr.ComputeNumBlocks(outputFile.Size)
+	if op.Type == pwr.SyncOp_BYTE_RANGE {
+		// byte ranges are easy: it's gotta be all of it
+		return op.Offset == 0 && op.Size == outputFile.Size
+	}
+
+	// and it's gotta start at 0
+	if op.BlockIndex != 0 {
+		return false
+	}
+
+	numOutputBlocks := pwr.ComputeNumBlocksWithBlockSize(outputFile.Size, pwr.EffectiveBlockSize(sp.header.BlockSize))
 
 	// and it's gotta, well, span the full file
 	spansFullFile := op.BlockSpan == numOutputBlocks
@@ -350,3 +350,418 @@ func (ep *explodingPool) GetReadSeeker(fileIndex int64) (io.ReadSeeker, error) {
 func (ep *explodingPool) Close() error {
 	return nil
 }
+
+func Test_CustomBlockSize(t *testing.T) {
+	dir, err := os.MkdirTemp("", "patcher-blocksize")
+	wtest.Must(t, err)
+	defer screw.RemoveAll(dir)
+
+	const blockSize = 8 * 1024
+
+	v1 := filepath.Join(dir, "v1")
+	wtest.MakeTestDir(t, v1, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "subdir/file-1", Seed: 0x1, Size: blockSize*40 + 14},
+			{Path: "file-1", Seed: 0x2, Size: blockSize * 3},
+		},
+	})
+
+	v2 := filepath.Join(dir, "v2")
+	wtest.MakeTestDir(t, v2, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "subdir/file-1", Seed: 0x1, Size: blockSize*40 + 14, Swaperoos: []wtest.Swaperoo{
+				{OldStart: 0, NewStart: blockSize * 30, Size: blockSize * 4},
+			}},
+			{Path: "file-1", Chunks: []wtest.TestDirChunk{
+				{Seed: 0x2, Size: blockSize * 2},
+				{Seed: 0x5, Size: 17},
+			}},
+		},
+	})
+
+	consumer := &state.Consumer{}
+
+	targetContainer, err := tlc.WalkAny(v1, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	sourceContainer, err := tlc.WalkAny(v2, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	sc := &pwr.SignContext{
+		BlockSize: blockSize,
+		Consumer:  consumer,
+	}
+	targetSignature, err := sc.ComputeSignature(context.Background(), targetContainer, fspool.New(targetContainer, v1))
+	wtest.Must(t, err)
+	assert.EqualValues(t, 40+1+3, len(targetSignature))
+
+	dctx := &pwr.DiffContext{
+		Compression: &pwr.CompressionSettings{
+			Algorithm: pwr.CompressionAlgorithm_BROTLI,
+			Quality:   1,
+		},
+		Consumer: consumer,
+
+		SourceContainer: sourceContainer,
+		Pool:            fspool.New(sourceContainer, v2),
+
+		TargetContainer: targetContainer,
+		TargetSignature: targetSignature,
+
+		BlockSize: blockSize,
+	}
+
+	patchBuffer := new(bytes.Buffer)
+	signatureBuffer := new(bytes.Buffer)
+	wtest.Must(t, dctx.WritePatch(context.Background(), patchBuffer, signatureBuffer))
+	assert.True(t, dctx.ReusedBytes > blockSize*30, "most of the old build should be reused")
+
+	sigReader := seeksource.FromBytes(signatureBuffer.Bytes())
+	_, err = sigReader.Resume(nil)
+	wtest.Must(t, err)
+
+	sigInfo, err := pwr.ReadSignature(context.Background(), sigReader)
+	wtest.Must(t, err)
+	assert.EqualValues(t, blockSize, sigInfo.BlockSize)
+	assert.EqualValues(t, 41+3, len(sigInfo.Hashes))
+
+	out := filepath.Join(dir, "out")
+	wtest.Must(t, patcher.PatchFresh(patcher.PatchFreshParams{
+		PatchReader: seeksource.FromBytes(patchBuffer.Bytes()),
+		TargetDir:   v1,
+		OutputDir:   out,
+		Consumer:    consumer,
+	}))
+	wtest.Must(t, pwr.AssertValid(out, sigInfo))
+
+	t.Logf("Validating against a signature with the wrong block size")
+	sigInfo.BlockSize = 0
+	assert.Error(t, pwr.AssertValid(out, sigInfo))
+}
+
+func Test_PatchTOC(t *testing.T) {
+	dir, err := os.MkdirTemp("", "patcher-toc")
+	wtest.Must(t, err)
+	defer screw.RemoveAll(dir)
+
+	v1 := filepath.Join(dir, "v1")
+	wtest.MakeTestDir(t, v1, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "file-1", Seed: 0x1, Size: wtest.BlockSize*8 + 14},
+			{Path: "file-2", Seed: 0x2, Size: wtest.BlockSize * 3},
+			{Path: "file-3", Seed: 0x3, Size: wtest.BlockSize*40 + 3},
+		},
+	})
+
+	v2 := filepath.Join(dir, "v2")
+	wtest.MakeTestDir(t, v2, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "file-1", Seed: 0x1, Size: wtest.BlockSize*8 + 14, Bsmods: []wtest.Bsmod{
+				{Interval: wtest.BlockSize/2 + 3, Delta: 0x4},
+			}},
+			{Path: "file-2", Seed: 0x5, Size: wtest.BlockSize * 3},
+			{Path: "file-3", Seed: 0x3, Size: wtest.BlockSize*40 + 3, Bsmods: []wtest.Bsmod{
+				{Interval: wtest.BlockSize*3 + 7, Delta: 0x18},
+			}},
+		},
+	})
+
+	consumer := &state.Consumer{}
+
+	targetContainer, err := tlc.WalkAny(v1, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	sourceContainer, err := tlc.WalkAny(v2, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	targetSignature, err := pwr.ComputeSignature(context.Background(), targetContainer, fspool.New(targetContainer, v1), consumer)
+	wtest.Must(t, err)
+
+	dctx := &pwr.DiffContext{
+		Compression: &pwr.CompressionSettings{
+			Algorithm: pwr.CompressionAlgorithm_NONE,
+		},
+		Consumer: consumer,
+
+		SourceContainer: sourceContainer,
+		Pool:            fspool.New(sourceContainer, v2),
+
+		TargetContainer: targetContainer,
+		TargetSignature: targetSignature,
+	}
+
+	patchBuffer := new(bytes.Buffer)
+	wtest.Must(t, dctx.WritePatch(context.Background(), patchBuffer, io.Discard))
+	patchSize := patchBuffer.Len()
+	wtest.Must(t, pwr.WritePatchTOC(seeksource.FromBytes(patchBuffer.Bytes()), patchBuffer))
+	patch := patchBuffer.Bytes()
+
+	toc, err := pwr.ReadPatchTOC(seeksource.FromBytes(patch))
+	wtest.Must(t, err)
+
+	// garble the series of all files but the last one: the patcher can
+	// only get through if it jumps straight to the last one.
+	lastIndex := int64(len(sourceContainer.Files)) - 1
+	for i := toc.Entries[0].RestartOffset; i < toc.Entries[lastIndex].RestartOffset; i++ {
+		patch[i] ^= 0xff
+	}
+
+	patchLast := func(patchBytes []byte) error {
+		out := filepath.Join(dir, "out")
+		defer screw.RemoveAll(out)
+
+		p, err := patcher.New(seeksource.FromBytes(patchBytes), consumer)
+		if err != nil {
+			return err
+		}
+		p.SetSourceIndexWhitelist(map[int64]bool{lastIndex: true})
+
+		var checkpoint *patcher.Checkpoint
+		p.SetSaveConsumer(&patcherSaveConsumer{
+			shouldSave: func() bool {
+				return true
+			},
+			save: func(c *patcher.Checkpoint) (patcher.AfterSaveAction, error) {
+				checkpoint = c
+				return patcher.AfterSaveStop, nil
+			},
+		})
+
+		targetPool := fspool.New(p.GetTargetContainer(), v1)
+		b, err := bowl.NewFreshBowl(bowl.FreshBowlParams{
+			SourceContainer: p.GetSourceContainer(),
+			TargetContainer: p.GetTargetContainer(),
+			TargetPool:      targetPool,
+			OutputFolder:    out,
+		})
+		if err != nil {
+			return err
+		}
+
+		numCheckpoints := 0
+		for {
+			c := checkpoint
+			checkpoint = nil
+			err = p.Resume(c, targetPool, b)
+			if errors.Cause(err) != patcher.ErrStop {
+				break
+			}
+			numCheckpoints++
+			assert.EqualValues(t, lastIndex, checkpoint.TOCFileIndex)
+
+			checkpointBuf := new(bytes.Buffer)
+			wtest.Must(t, gob.NewEncoder(checkpointBuf).Encode(checkpoint))
+			checkpoint = &patcher.Checkpoint{}
+			wtest.Must(t, gob.NewDecoder(checkpointBuf).Decode(checkpoint))
+		}
+		if err != nil {
+			return err
+		}
+		assert.True(t, numCheckpoints > 0, "had at least one checkpoint")
+		assert.EqualValues(t, 1, p.GetTouchedFiles())
+
+		lastPath := sourceContainer.Files[lastIndex].Path
+		expected, err := os.ReadFile(filepath.Join(v2, lastPath))
+		wtest.Must(t, err)
+		actual, err := os.ReadFile(filepath.Join(out, lastPath))
+		wtest.Must(t, err)
+		assert.True(t, bytes.Equal(expected, actual), "last file was patched")
+		return nil
+	}
+
+	wtest.Must(t, patchLast(patch))
+
+	t.Logf("Reading through skipped files without a table of contents")
+	assert.Error(t, patchLast(patch[:patchSize]))
+}
+
+func Test_StrongHash(t *testing.T) {
+	dir, err := os.MkdirTemp("", "patcher-stronghash")
+	wtest.Must(t, err)
+	defer screw.RemoveAll(dir)
+
+	v1 := filepath.Join(dir, "v1")
+	wtest.MakeTestDir(t, v1, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "subdir/file-1", Seed: 0x1, Size: pwr.BlockSize*5 + 14},
+			{Path: "file-1", Seed: 0x2, Size: pwr.BlockSize * 3},
+		},
+	})
+
+	v2 := filepath.Join(dir, "v2")
+	wtest.MakeTestDir(t, v2, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "subdir/file-1", Seed: 0x1, Size: pwr.BlockSize*5 + 14, Swaperoos: []wtest.Swaperoo{
+				{OldStart: 0, NewStart: pwr.BlockSize * 3, Size: pwr.BlockSize},
+			}},
+			{Path: "file-1", Chunks: []wtest.TestDirChunk{
+				{Seed: 0x2, Size: pwr.BlockSize * 2},
+				{Seed: 0x5, Size: 17},
+			}},
+		},
+	})
+
+	consumer := &state.Consumer{}
+
+	targetContainer, err := tlc.WalkAny(v1, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	sourceContainer, err := tlc.WalkAny(v2, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	hashSizes := map[pwr.StrongHashAlgorithm]int{
+		pwr.StrongHashAlgorithm_MD5:        16,
+		pwr.StrongHashAlgorithm_SHA256:     32,
+		pwr.StrongHashAlgorithm_BLAKE3_256: 32,
+		pwr.StrongHashAlgorithm_XXH3_128:   16,
+	}
+
+	for algorithm, hashSize := range hashSizes {
+		t.Logf("Using strong hash %s", algorithm)
+
+		sc := &pwr.SignContext{
+			StrongHash: algorithm,
+			Consumer:   consumer,
+		}
+		targetSignature, err := sc.ComputeSignature(context.Background(), targetContainer, fspool.New(targetContainer, v1))
+		wtest.Must(t, err)
+
+		dctx := &pwr.DiffContext{
+			Compression: &pwr.CompressionSettings{
+				Algorithm: pwr.CompressionAlgorithm_BROTLI,
+				Quality:   1,
+			},
+			Consumer: consumer,
+
+			SourceContainer: sourceContainer,
+			Pool:            fspool.New(sourceContainer, v2),
+
+			TargetContainer: targetContainer,
+			TargetSignature: targetSignature,
+
+			StrongHash: algorithm,
+		}
+
+		patchBuffer := new(bytes.Buffer)
+		signatureBuffer := new(bytes.Buffer)
+		wtest.Must(t, dctx.WritePatch(context.Background(), patchBuffer, signatureBuffer))
+		assert.True(t, dctx.ReusedBytes > pwr.BlockSize*5, "most of the old build should be reused")
+
+		sigReader := seeksource.FromBytes(signatureBuffer.Bytes())
+		_, err = sigReader.Resume(nil)
+		wtest.Must(t, err)
+
+		sigInfo, err := pwr.ReadSignature(context.Background(), sigReader)
+		wtest.Must(t, err)
+		assert.Equal(t, algorithm, sigInfo.StrongHash)
+		for _, bh := range sigInfo.Hashes {
+			assert.Len(t, bh.StrongHash, hashSize)
+		}
+
+		out := filepath.Join(dir, "out-"+algorithm.String())
+		wtest.Must(t, patcher.PatchFresh(patcher.PatchFreshParams{
+			PatchReader: seeksource.FromBytes(patchBuffer.Bytes()),
+			TargetDir:   v1,
+			OutputDir:   out,
+			Consumer:    consumer,
+		}))
+		wtest.Must(t, pwr.AssertValid(out, sigInfo))
+
+		t.Logf("Validating against a signature with the wrong strong hash")
+		wrongInfo := *sigInfo
+		wrongInfo.StrongHash = (algorithm + 1) % pwr.StrongHashAlgorithm(len(hashSizes))
+		assert.Error(t, pwr.AssertValid(out, &wrongInfo))
+	}
+
+	t.Logf("Signing with an unknown strong hash")
+	sc := &pwr.SignContext{
+		StrongHash: pwr.StrongHashAlgorithm(42),
+		Consumer:   consumer,
+	}
+	_, err = sc.ComputeSignature(context.Background(), targetContainer, fspool.New(targetContainer, v1))
+	assert.Error(t, err)
+}
+
+func Test_ChunkedDiff(t *testing.T) {
+	dir, err := os.MkdirTemp("", "patcher-chunked")
+	wtest.Must(t, err)
+	defer screw.RemoveAll(dir)
+
+	v1 := filepath.Join(dir, "v1")
+	wtest.MakeTestDir(t, v1, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "data.pak", Seed: 0x1, Size: pwr.BlockSize*20 + 14},
+			{Path: "renamed-before", Seed: 0x2, Size: pwr.BlockSize*2 + 3},
+			{Path: "empty", Data: []byte{}},
+		},
+	})
+
+	v2 := filepath.Join(dir, "v2")
+	wtest.MakeTestDir(t, v2, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			// one byte inserted at the start shifts everything after it
+			{Path: "data.pak", Chunks: []wtest.TestDirChunk{
+				{Seed: 0x9, Size: 1},
+				{Seed: 0x1, Size: pwr.BlockSize*20 + 14},
+			}},
+			{Path: "renamed-after", Seed: 0x2, Size: pwr.BlockSize*2 + 3},
+			{Path: "empty", Data: []byte{}},
+			{Path: "new-file", Seed: 0x3, Size: 1234},
+		},
+	})
+
+	consumer := &state.Consumer{}
+
+	targetContainer, err := tlc.WalkAny(v1, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	sourceContainer, err := tlc.WalkAny(v2, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	sc := &pwr.SignContext{Consumer: consumer}
+	targetChunks, err := sc.ComputeChunkSignature(context.Background(), targetContainer, fspool.New(targetContainer, v1))
+	wtest.Must(t, err)
+
+	dctx := &pwr.DiffContext{
+		Compression: &pwr.CompressionSettings{
+			Algorithm: pwr.CompressionAlgorithm_BROTLI,
+			Quality:   1,
+		},
+		Consumer: consumer,
+
+		SourceContainer: sourceContainer,
+		Pool:            fspool.New(sourceContainer, v2),
+
+		TargetContainer: targetContainer,
+
+		Chunking:     pwr.ChunkingAlgorithm_FASTCDC,
+		TargetChunks: targetChunks,
+	}
+
+	patchBuffer := new(bytes.Buffer)
+	signatureBuffer := new(bytes.Buffer)
+	wtest.Must(t, dctx.WritePatch(context.Background(), patchBuffer, signatureBuffer))
+	assert.True(t, dctx.FreshBytes < pwr.BlockSize*8, "most of the old build should be reused")
+
+	sigReader := seeksource.FromBytes(signatureBuffer.Bytes())
+	_, err = sigReader.Resume(nil)
+	wtest.Must(t, err)
+
+	sigInfo, err := pwr.ReadSignature(context.Background(), sigReader)
+	wtest.Must(t, err)
+	assert.Equal(t, pwr.ChunkingAlgorithm_FASTCDC, sigInfo.Chunking)
+
+	sourceChunks, err := sc.ComputeChunkSignature(context.Background(), sourceContainer, fspool.New(sourceContainer, v2))
+	wtest.Must(t, err)
+	assert.EqualValues(t, sourceChunks, sigInfo.Chunks)
+
+	out := filepath.Join(dir, "out")
+	wtest.Must(t, patcher.PatchFresh(patcher.PatchFreshParams{
+		PatchReader: seeksource.FromBytes(patchBuffer.Bytes()),
+		TargetDir:   v1,
+		OutputDir:   out,
+		Consumer:    consumer,
+	}))
+	wtest.Must(t, pwr.AssertValid(out, sigInfo))
+	wtest.Must(t, pwr.AssertNoGhosts(out, sigInfo))
+}
@@ -3,6 +3,7 @@ package patcher_test
 import (
 	"bytes"
 	"context"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
@@ -892,7 +893,7 @@ func runSinglePatchingScenario(t *testing.T, scenario patchScenario, direction S
 					wtest.Must(t, pwr.AssertNoGhosts(outDir, v2Sig))
 				}()
 
-				applyInPlace := func(beforePatch func()) error {
+				applyInPlace := func(beforePatch func(), reversePatchWriter io.Writer) error {
 					wtest.WipeAndCpDir(t, v1, outDir)
 					beforePatch()
 
@@ -915,6 +916,10 @@ func runSinglePatchingScenario(t *testing.T, scenario patchScenario, direction S
 						StageFolder:     stageDir,
 						OutputFolder:    outDir,
 
+						ReversePatchWriter: reversePatchWriter,
+						ReverseCompression: compression,
+						PatchReader:        patchReader,
+
 						Consumer: consumer,
 					})
 					if err != nil {
@@ -944,7 +949,7 @@ func runSinglePatchingScenario(t *testing.T, scenario patchScenario, direction S
 						log("Applying %s in-place (v1 + corruptions) -> (v2)", patch.Name)
 						err := applyInPlace(func() {
 							applyCorruptions(t, outDir, *scenario.corruptions)
-						})
+						}, nil)
 						if err != nil {
 							log("As expected, got an error: %v", err)
 						}
@@ -960,15 +965,28 @@ func runSinglePatchingScenario(t *testing.T, scenario patchScenario, direction S
 						log("Applying %s in-place (v1 + intermediate) -> (v2)", patch.Name)
 						err := applyInPlace(func() {
 							wtest.MakeTestDir(t, outDir, *scenario.intermediate)
-						})
+						}, nil)
 						wtest.Must(t, err)
 					}()
 				}
 
 				func() {
 					log("Applying %s in-place (v1) -> (v2)", patch.Name)
-					wtest.Must(t, applyInPlace(func() {}))
+					reversePatchBuffer := new(bytes.Buffer)
+					wtest.Must(t, applyInPlace(func() {}, reversePatchBuffer))
 					wtest.Must(t, pwr.AssertNoGhosts(outDir, v2Sig))
+
+					log("Applying reverse of %s fresh (v2) -> (v1)", patch.Name)
+					reverseDir := filepath.Join(mainDir, "reverse")
+					wtest.WipeAndMkdir(t, reverseDir)
+					wtest.Must(t, patcher.PatchFresh(patcher.PatchFreshParams{
+						PatchReader: seeksource.FromBytes(reversePatchBuffer.Bytes()),
+						TargetDir:   outDir,
+						OutputDir:   reverseDir,
+						Consumer:    consumer,
+					}))
+					wtest.Must(t, assertValid(reverseDir, v1Sig))
+					wtest.Must(t, pwr.AssertNoGhosts(reverseDir, v1Sig))
 				}()
 			}
 
@@ -19,6 +19,12 @@ type Checkpoint struct {
 	FileIndex int64
 	FileKind  FileKind
 
+	// TOCFileIndex is non-zero when the patcher jumped to that file using
+	// the patch's table of contents, skipping the files before it: then
+	// MessageCheckpoint is relative to that file's entry, not to the start
+	// of the patch.
+	TOCFileIndex int64
+
 	BowlCheckpoint   *bowl.BowlCheckpoint
 	SyncHeader       *pwr.SyncHeader
 	RsyncCheckpoint  *RsyncCheckpoint
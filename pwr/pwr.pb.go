@@ -21,6 +21,108 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+// How files are split for diffing
+type ChunkingAlgorithm int32
+
+const (
+	ChunkingAlgorithm_FIXED_BLOCKS ChunkingAlgorithm = 0
+	// chunk boundaries depend on content, averaging blockSize
+	ChunkingAlgorithm_FASTCDC ChunkingAlgorithm = 1
+)
+
+// Enum value maps for ChunkingAlgorithm.
+var (
+	ChunkingAlgorithm_name = map[int32]string{
+		0: "FIXED_BLOCKS",
+		1: "FASTCDC",
+	}
+	ChunkingAlgorithm_value = map[string]int32{
+		"FIXED_BLOCKS": 0,
+		"FASTCDC":      1,
+	}
+)
+
+func (x ChunkingAlgorithm) Enum() *ChunkingAlgorithm {
+	p := new(ChunkingAlgorithm)
+	*p = x
+	return p
+}
+
+func (x ChunkingAlgorithm) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ChunkingAlgorithm) Descriptor() protoreflect.EnumDescriptor {
+	return file_pwr_pwr_proto_enumTypes[0].Descriptor()
+}
+
+func (ChunkingAlgorithm) Type() protoreflect.EnumType {
+	return &file_pwr_pwr_proto_enumTypes[0]
+}
+
+func (x ChunkingAlgorithm) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ChunkingAlgorithm.Descriptor instead.
+func (ChunkingAlgorithm) EnumDescriptor() ([]byte, []int) {
+	return file_pwr_pwr_proto_rawDescGZIP(), []int{0}
+}
+
+// Strong hashes used to confirm weak hash matches in signatures
+type StrongHashAlgorithm int32
+
+const (
+	// the only strong hash before it was recorded
+	StrongHashAlgorithm_MD5        StrongHashAlgorithm = 0
+	StrongHashAlgorithm_SHA256     StrongHashAlgorithm = 1
+	StrongHashAlgorithm_BLAKE3_256 StrongHashAlgorithm = 2
+	StrongHashAlgorithm_XXH3_128   StrongHashAlgorithm = 3
+)
+
+// Enum value maps for StrongHashAlgorithm.
+var (
+	StrongHashAlgorithm_name = map[int32]string{
+		0: "MD5",
+		1: "SHA256",
+		2: "BLAKE3_256",
+		3: "XXH3_128",
+	}
+	StrongHashAlgorithm_value = map[string]int32{
+		"MD5":        0,
+		"SHA256":     1,
+		"BLAKE3_256": 2,
+		"XXH3_128":   3,
+	}
+)
+
+func (x StrongHashAlgorithm) Enum() *StrongHashAlgorithm {
+	p := new(StrongHashAlgorithm)
+	*p = x
+	return p
+}
+
+func (x StrongHashAlgorithm) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (StrongHashAlgorithm) Descriptor() protoreflect.EnumDescriptor {
+	return file_pwr_pwr_proto_enumTypes[1].Descriptor()
+}
+
+func (StrongHashAlgorithm) Type() protoreflect.EnumType {
+	return &file_pwr_pwr_proto_enumTypes[1]
+}
+
+func (x StrongHashAlgorithm) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use StrongHashAlgorithm.Descriptor instead.
+func (StrongHashAlgorithm) EnumDescriptor() ([]byte, []int) {
+	return file_pwr_pwr_proto_rawDescGZIP(), []int{1}
+}
+
 type CompressionAlgorithm int32
 
 const (
@@ -57,11 +159,11 @@ func (x CompressionAlgorithm) String() string {
 }
 
 func (CompressionAlgorithm) Descriptor() protoreflect.EnumDescriptor {
-	return file_pwr_pwr_proto_enumTypes[0].Descriptor()
+	return file_pwr_pwr_proto_enumTypes[2].Descriptor()
 }
 
 func (CompressionAlgorithm) Type() protoreflect.EnumType {
-	return &file_pwr_pwr_proto_enumTypes[0]
+	return &file_pwr_pwr_proto_enumTypes[2]
 }
 
 func (x CompressionAlgorithm) Number() protoreflect.EnumNumber {
@@ -70,7 +172,50 @@ func (x CompressionAlgorithm) Number() protoreflect.EnumNumber {
 
 // Deprecated: Use CompressionAlgorithm.Descriptor instead.
 func (CompressionAlgorithm) EnumDescriptor() ([]byte, []int) {
-	return file_pwr_pwr_proto_rawDescGZIP(), []int{0}
+	return file_pwr_pwr_proto_rawDescGZIP(), []int{2}
+}
+
+type EncryptionAlgorithm int32
+
+const (
+	EncryptionAlgorithm_AES_256_GCM EncryptionAlgorithm = 0
+)
+
+// Enum value maps for EncryptionAlgorithm.
+var (
+	EncryptionAlgorithm_name = map[int32]string{
+		0: "AES_256_GCM",
+	}
+	EncryptionAlgorithm_value = map[string]int32{
+		"AES_256_GCM": 0,
+	}
+)
+
+func (x EncryptionAlgorithm) Enum() *EncryptionAlgorithm {
+	p := new(EncryptionAlgorithm)
+	*p = x
+	return p
+}
+
+func (x EncryptionAlgorithm) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (EncryptionAlgorithm) Descriptor() protoreflect.EnumDescriptor {
+	return file_pwr_pwr_proto_enumTypes[3].Descriptor()
+}
+
+func (EncryptionAlgorithm) Type() protoreflect.EnumType {
+	return &file_pwr_pwr_proto_enumTypes[3]
+}
+
+func (x EncryptionAlgorithm) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use EncryptionAlgorithm.Descriptor instead.
+func (EncryptionAlgorithm) EnumDescriptor() ([]byte, []int) {
+	return file_pwr_pwr_proto_rawDescGZIP(), []int{3}
 }
 
 type HashAlgorithm int32
@@ -103,11 +248,11 @@ func (x HashAlgorithm) String() string {
 }
 
 func (HashAlgorithm) Descriptor() protoreflect.EnumDescriptor {
-	return file_pwr_pwr_proto_enumTypes[1].Descriptor()
+	return file_pwr_pwr_proto_enumTypes[4].Descriptor()
 }
 
 func (HashAlgorithm) Type() protoreflect.EnumType {
-	return &file_pwr_pwr_proto_enumTypes[1]
+	return &file_pwr_pwr_proto_enumTypes[4]
 }
 
 func (x HashAlgorithm) Number() protoreflect.EnumNumber {
@@ -116,7 +261,7 @@ func (x HashAlgorithm) Number() protoreflect.EnumNumber {
 
 // Deprecated: Use HashAlgorithm.Descriptor instead.
 func (HashAlgorithm) EnumDescriptor() ([]byte, []int) {
-	return file_pwr_pwr_proto_rawDescGZIP(), []int{1}
+	return file_pwr_pwr_proto_rawDescGZIP(), []int{4}
 }
 
 type WoundKind int32
@@ -156,11 +301,11 @@ func (x WoundKind) String() string {
 }
 
 func (WoundKind) Descriptor() protoreflect.EnumDescriptor {
-	return file_pwr_pwr_proto_enumTypes[2].Descriptor()
+	return file_pwr_pwr_proto_enumTypes[5].Descriptor()
 }
 
 func (WoundKind) Type() protoreflect.EnumType {
-	return &file_pwr_pwr_proto_enumTypes[2]
+	return &file_pwr_pwr_proto_enumTypes[5]
 }
 
 func (x WoundKind) Number() protoreflect.EnumNumber {
@@ -169,7 +314,7 @@ func (x WoundKind) Number() protoreflect.EnumNumber {
 
 // Deprecated: Use WoundKind.Descriptor instead.
 func (WoundKind) EnumDescriptor() ([]byte, []int) {
-	return file_pwr_pwr_proto_rawDescGZIP(), []int{2}
+	return file_pwr_pwr_proto_rawDescGZIP(), []int{5}
 }
 
 type SyncHeader_Type int32
@@ -203,11 +348,11 @@ func (x SyncHeader_Type) String() string {
 }
 
 func (SyncHeader_Type) Descriptor() protoreflect.EnumDescriptor {
-	return file_pwr_pwr_proto_enumTypes[3].Descriptor()
+	return file_pwr_pwr_proto_enumTypes[6].Descriptor()
 }
 
 func (SyncHeader_Type) Type() protoreflect.EnumType {
-	return &file_pwr_pwr_proto_enumTypes[3]
+	return &file_pwr_pwr_proto_enumTypes[6]
 }
 
 func (x SyncHeader_Type) Number() protoreflect.EnumNumber {
@@ -222,8 +367,10 @@ func (SyncHeader_Type) EnumDescriptor() ([]byte, []int) {
 type SyncOp_Type int32
 
 const (
-	SyncOp_BLOCK_RANGE    SyncOp_Type = 0
-	SyncOp_DATA           SyncOp_Type = 1
+	SyncOp_BLOCK_RANGE SyncOp_Type = 0
+	SyncOp_DATA        SyncOp_Type = 1
+	// when set, offset and size are in bytes (see FASTCDC)
+	SyncOp_BYTE_RANGE     SyncOp_Type = 2
 	SyncOp_HEY_YOU_DID_IT SyncOp_Type = 2049 // <3 @GranPC & @tomasduda
 )
 
@@ -232,11 +379,13 @@ var (
 	SyncOp_Type_name = map[int32]string{
 		0:    "BLOCK_RANGE",
 		1:    "DATA",
+		2:    "BYTE_RANGE",
 		2049: "HEY_YOU_DID_IT",
 	}
 	SyncOp_Type_value = map[string]int32{
 		"BLOCK_RANGE":    0,
 		"DATA":           1,
+		"BYTE_RANGE":     2,
 		"HEY_YOU_DID_IT": 2049,
 	}
 )
@@ -252,11 +401,11 @@ func (x SyncOp_Type) String() string {
 }
 
 func (SyncOp_Type) Descriptor() protoreflect.EnumDescriptor {
-	return file_pwr_pwr_proto_enumTypes[4].Descriptor()
+	return file_pwr_pwr_proto_enumTypes[7].Descriptor()
 }
 
 func (SyncOp_Type) Type() protoreflect.EnumType {
-	return &file_pwr_pwr_proto_enumTypes[4]
+	return &file_pwr_pwr_proto_enumTypes[7]
 }
 
 func (x SyncOp_Type) Number() protoreflect.EnumNumber {
@@ -269,8 +418,10 @@ func (SyncOp_Type) EnumDescriptor() ([]byte, []int) {
 }
 
 type PatchHeader struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Compression   *CompressionSettings   `protobuf:"bytes,1,opt,name=compression,proto3" json:"compression,omitempty"`
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	Compression *CompressionSettings   `protobuf:"bytes,1,opt,name=compression,proto3" json:"compression,omitempty"`
+	// in bytes, 0 means 64KiB (the only block size before it was recorded)
+	BlockSize     int64 `protobuf:"varint,2,opt,name=blockSize,proto3" json:"blockSize,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -312,6 +463,13 @@ func (x *PatchHeader) GetCompression() *CompressionSettings {
 	return nil
 }
 
+func (x *PatchHeader) GetBlockSize() int64 {
+	if x != nil {
+		return x.BlockSize
+	}
+	return 0
+}
+
 type SyncHeader struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Type          SyncHeader_Type        `protobuf:"varint,1,opt,name=type,proto3,enum=io.itch.wharf.pwr.SyncHeader_Type" json:"type,omitempty"`
@@ -409,12 +567,22 @@ func (x *BsdiffHeader) GetTargetIndex() int64 {
 }
 
 type SyncOp struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Type          SyncOp_Type            `protobuf:"varint,1,opt,name=type,proto3,enum=io.itch.wharf.pwr.SyncOp_Type" json:"type,omitempty"`
-	FileIndex     int64                  `protobuf:"varint,2,opt,name=fileIndex,proto3" json:"fileIndex,omitempty"`
-	BlockIndex    int64                  `protobuf:"varint,3,opt,name=blockIndex,proto3" json:"blockIndex,omitempty"`
-	BlockSpan     int64                  `protobuf:"varint,4,opt,name=blockSpan,proto3" json:"blockSpan,omitempty"`
-	Data          []byte                 `protobuf:"bytes,5,opt,name=data,proto3" json:"data,omitempty"`
+	state      protoimpl.MessageState `protogen:"open.v1"`
+	Type       SyncOp_Type            `protobuf:"varint,1,opt,name=type,proto3,enum=io.itch.wharf.pwr.SyncOp_Type" json:"type,omitempty"`
+	FileIndex  int64                  `protobuf:"varint,2,opt,name=fileIndex,proto3" json:"fileIndex,omitempty"`
+	BlockIndex int64                  `protobuf:"varint,3,opt,name=blockIndex,proto3" json:"blockIndex,omitempty"`
+	BlockSpan  int64                  `protobuf:"varint,4,opt,name=blockSpan,proto3" json:"blockSpan,omitempty"`
+	Data       []byte                 `protobuf:"bytes,5,opt,name=data,proto3" json:"data,omitempty"`
+	Offset     int64                  `protobuf:"varint,6,opt,name=offset,proto3" json:"offset,omitempty"`
+	Size       int64                  `protobuf:"varint,7,opt,name=size,proto3" json:"size,omitempty"`
+	// multi-base patches only: which base a BLOCK_RANGE refers to
+	BaseIndex int64 `protobuf:"varint,8,opt,name=baseIndex,proto3" json:"baseIndex,omitempty"`
+	// multi-base patches only: this BLOCK_RANGE is the same data as
+	// the previous one, but in another base
+	Alternative bool `protobuf:"varint,9,opt,name=alternative,proto3" json:"alternative,omitempty"`
+	// multi-base patches only: this DATA is the same data as the
+	// previous BLOCK_RANGEs, for bases that have none of them
+	Fallback      bool `protobuf:"varint,10,opt,name=fallback,proto3" json:"fallback,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -484,27 +652,66 @@ func (x *SyncOp) GetData() []byte {
 	return nil
 }
 
-type SignatureHeader struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Compression   *CompressionSettings   `protobuf:"bytes,1,opt,name=compression,proto3" json:"compression,omitempty"`
+func (x *SyncOp) GetOffset() int64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *SyncOp) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *SyncOp) GetBaseIndex() int64 {
+	if x != nil {
+		return x.BaseIndex
+	}
+	return 0
+}
+
+func (x *SyncOp) GetAlternative() bool {
+	if x != nil {
+		return x.Alternative
+	}
+	return false
+}
+
+func (x *SyncOp) GetFallback() bool {
+	if x != nil {
+		return x.Fallback
+	}
+	return false
+}
+
+type PatchTOCHeader struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// size of the patch, without the table of contents
+	PatchSize int64 `protobuf:"varint,1,opt,name=patchSize,proto3" json:"patchSize,omitempty"`
+	NumFiles  int64 `protobuf:"varint,2,opt,name=numFiles,proto3" json:"numFiles,omitempty"`
+	// same as the patch's
+	Compression   *CompressionSettings `protobuf:"bytes,3,opt,name=compression,proto3" json:"compression,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *SignatureHeader) Reset() {
-	*x = SignatureHeader{}
+func (x *PatchTOCHeader) Reset() {
+	*x = PatchTOCHeader{}
 	mi := &file_pwr_pwr_proto_msgTypes[4]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *SignatureHeader) String() string {
+func (x *PatchTOCHeader) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*SignatureHeader) ProtoMessage() {}
+func (*PatchTOCHeader) ProtoMessage() {}
 
-func (x *SignatureHeader) ProtoReflect() protoreflect.Message {
+func (x *PatchTOCHeader) ProtoReflect() protoreflect.Message {
 	mi := &file_pwr_pwr_proto_msgTypes[4]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -516,40 +723,58 @@ func (x *SignatureHeader) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use SignatureHeader.ProtoReflect.Descriptor instead.
-func (*SignatureHeader) Descriptor() ([]byte, []int) {
+// Deprecated: Use PatchTOCHeader.ProtoReflect.Descriptor instead.
+func (*PatchTOCHeader) Descriptor() ([]byte, []int) {
 	return file_pwr_pwr_proto_rawDescGZIP(), []int{4}
 }
 
-func (x *SignatureHeader) GetCompression() *CompressionSettings {
+func (x *PatchTOCHeader) GetPatchSize() int64 {
+	if x != nil {
+		return x.PatchSize
+	}
+	return 0
+}
+
+func (x *PatchTOCHeader) GetNumFiles() int64 {
+	if x != nil {
+		return x.NumFiles
+	}
+	return 0
+}
+
+func (x *PatchTOCHeader) GetCompression() *CompressionSettings {
 	if x != nil {
 		return x.Compression
 	}
 	return nil
 }
 
-type BlockHash struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	WeakHash      uint32                 `protobuf:"varint,1,opt,name=weakHash,proto3" json:"weakHash,omitempty"`
-	StrongHash    []byte                 `protobuf:"bytes,2,opt,name=strongHash,proto3" json:"strongHash,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+type PatchTOCEntry struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// offset in the patch file where decompression can start over
+	RestartOffset int64 `protobuf:"varint,1,opt,name=restartOffset,proto3" json:"restartOffset,omitempty"`
+	// offset in the decompressed stream that restartOffset corresponds to
+	RestartDecompressedOffset int64 `protobuf:"varint,2,opt,name=restartDecompressedOffset,proto3" json:"restartDecompressedOffset,omitempty"`
+	// offset in the decompressed stream of the file's SyncHeader
+	DecompressedOffset int64 `protobuf:"varint,3,opt,name=decompressedOffset,proto3" json:"decompressedOffset,omitempty"`
+	unknownFields      protoimpl.UnknownFields
+	sizeCache          protoimpl.SizeCache
 }
 
-func (x *BlockHash) Reset() {
-	*x = BlockHash{}
+func (x *PatchTOCEntry) Reset() {
+	*x = PatchTOCEntry{}
 	mi := &file_pwr_pwr_proto_msgTypes[5]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *BlockHash) String() string {
+func (x *PatchTOCEntry) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*BlockHash) ProtoMessage() {}
+func (*PatchTOCEntry) ProtoMessage() {}
 
-func (x *BlockHash) ProtoReflect() protoreflect.Message {
+func (x *PatchTOCEntry) ProtoReflect() protoreflect.Message {
 	mi := &file_pwr_pwr_proto_msgTypes[5]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -561,47 +786,55 @@ func (x *BlockHash) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use BlockHash.ProtoReflect.Descriptor instead.
-func (*BlockHash) Descriptor() ([]byte, []int) {
+// Deprecated: Use PatchTOCEntry.ProtoReflect.Descriptor instead.
+func (*PatchTOCEntry) Descriptor() ([]byte, []int) {
 	return file_pwr_pwr_proto_rawDescGZIP(), []int{5}
 }
 
-func (x *BlockHash) GetWeakHash() uint32 {
+func (x *PatchTOCEntry) GetRestartOffset() int64 {
 	if x != nil {
-		return x.WeakHash
+		return x.RestartOffset
 	}
 	return 0
 }
 
-func (x *BlockHash) GetStrongHash() []byte {
+func (x *PatchTOCEntry) GetRestartDecompressedOffset() int64 {
 	if x != nil {
-		return x.StrongHash
+		return x.RestartDecompressedOffset
 	}
-	return nil
+	return 0
 }
 
-type CompressionSettings struct {
+func (x *PatchTOCEntry) GetDecompressedOffset() int64 {
+	if x != nil {
+		return x.DecompressedOffset
+	}
+	return 0
+}
+
+type MultiBasePatchHeader struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
-	Algorithm     CompressionAlgorithm   `protobuf:"varint,1,opt,name=algorithm,proto3,enum=io.itch.wharf.pwr.CompressionAlgorithm" json:"algorithm,omitempty"`
-	Quality       int32                  `protobuf:"varint,2,opt,name=quality,proto3" json:"quality,omitempty"`
+	Compression   *CompressionSettings   `protobuf:"bytes,1,opt,name=compression,proto3" json:"compression,omitempty"`
+	BlockSize     int64                  `protobuf:"varint,2,opt,name=blockSize,proto3" json:"blockSize,omitempty"`
+	NumBases      int64                  `protobuf:"varint,3,opt,name=numBases,proto3" json:"numBases,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *CompressionSettings) Reset() {
-	*x = CompressionSettings{}
+func (x *MultiBasePatchHeader) Reset() {
+	*x = MultiBasePatchHeader{}
 	mi := &file_pwr_pwr_proto_msgTypes[6]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *CompressionSettings) String() string {
+func (x *MultiBasePatchHeader) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*CompressionSettings) ProtoMessage() {}
+func (*MultiBasePatchHeader) ProtoMessage() {}
 
-func (x *CompressionSettings) ProtoReflect() protoreflect.Message {
+func (x *MultiBasePatchHeader) ProtoReflect() protoreflect.Message {
 	mi := &file_pwr_pwr_proto_msgTypes[6]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -613,47 +846,59 @@ func (x *CompressionSettings) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use CompressionSettings.ProtoReflect.Descriptor instead.
-func (*CompressionSettings) Descriptor() ([]byte, []int) {
+// Deprecated: Use MultiBasePatchHeader.ProtoReflect.Descriptor instead.
+func (*MultiBasePatchHeader) Descriptor() ([]byte, []int) {
 	return file_pwr_pwr_proto_rawDescGZIP(), []int{6}
 }
 
-func (x *CompressionSettings) GetAlgorithm() CompressionAlgorithm {
+func (x *MultiBasePatchHeader) GetCompression() *CompressionSettings {
 	if x != nil {
-		return x.Algorithm
+		return x.Compression
 	}
-	return CompressionAlgorithm_NONE
+	return nil
 }
 
-func (x *CompressionSettings) GetQuality() int32 {
+func (x *MultiBasePatchHeader) GetBlockSize() int64 {
 	if x != nil {
-		return x.Quality
+		return x.BlockSize
 	}
 	return 0
 }
 
-type ManifestHeader struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Compression   *CompressionSettings   `protobuf:"bytes,1,opt,name=compression,proto3" json:"compression,omitempty"`
-	Algorithm     HashAlgorithm          `protobuf:"varint,2,opt,name=algorithm,proto3,enum=io.itch.wharf.pwr.HashAlgorithm" json:"algorithm,omitempty"`
+func (x *MultiBasePatchHeader) GetNumBases() int64 {
+	if x != nil {
+		return x.NumBases
+	}
+	return 0
+}
+
+type SignatureHeader struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	Compression *CompressionSettings   `protobuf:"bytes,1,opt,name=compression,proto3" json:"compression,omitempty"`
+	// in bytes, 0 means 64KiB (the only block size before it was recorded)
+	BlockSize  int64               `protobuf:"varint,2,opt,name=blockSize,proto3" json:"blockSize,omitempty"`
+	StrongHash StrongHashAlgorithm `protobuf:"varint,3,opt,name=strongHash,proto3,enum=io.itch.wharf.pwr.StrongHashAlgorithm" json:"strongHash,omitempty"`
+	// when FASTCDC, the block hashes are followed by a ChunkHash
+	// for every content-defined chunk of every file
+	Chunking      ChunkingAlgorithm `protobuf:"varint,4,opt,name=chunking,proto3,enum=io.itch.wharf.pwr.ChunkingAlgorithm" json:"chunking,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *ManifestHeader) Reset() {
-	*x = ManifestHeader{}
+func (x *SignatureHeader) Reset() {
+	*x = SignatureHeader{}
 	mi := &file_pwr_pwr_proto_msgTypes[7]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *ManifestHeader) String() string {
+func (x *SignatureHeader) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*ManifestHeader) ProtoMessage() {}
+func (*SignatureHeader) ProtoMessage() {}
 
-func (x *ManifestHeader) ProtoReflect() protoreflect.Message {
+func (x *SignatureHeader) ProtoReflect() protoreflect.Message {
 	mi := &file_pwr_pwr_proto_msgTypes[7]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -665,46 +910,61 @@ func (x *ManifestHeader) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use ManifestHeader.ProtoReflect.Descriptor instead.
-func (*ManifestHeader) Descriptor() ([]byte, []int) {
+// Deprecated: Use SignatureHeader.ProtoReflect.Descriptor instead.
+func (*SignatureHeader) Descriptor() ([]byte, []int) {
 	return file_pwr_pwr_proto_rawDescGZIP(), []int{7}
 }
 
-func (x *ManifestHeader) GetCompression() *CompressionSettings {
+func (x *SignatureHeader) GetCompression() *CompressionSettings {
 	if x != nil {
 		return x.Compression
 	}
 	return nil
 }
 
-func (x *ManifestHeader) GetAlgorithm() HashAlgorithm {
+func (x *SignatureHeader) GetBlockSize() int64 {
 	if x != nil {
-		return x.Algorithm
+		return x.BlockSize
 	}
-	return HashAlgorithm_SHAKE128_32
+	return 0
 }
 
-type ManifestBlockHash struct {
+func (x *SignatureHeader) GetStrongHash() StrongHashAlgorithm {
+	if x != nil {
+		return x.StrongHash
+	}
+	return StrongHashAlgorithm_MD5
+}
+
+func (x *SignatureHeader) GetChunking() ChunkingAlgorithm {
+	if x != nil {
+		return x.Chunking
+	}
+	return ChunkingAlgorithm_FIXED_BLOCKS
+}
+
+type BlockHash struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
-	Hash          []byte                 `protobuf:"bytes,1,opt,name=hash,proto3" json:"hash,omitempty"`
+	WeakHash      uint32                 `protobuf:"varint,1,opt,name=weakHash,proto3" json:"weakHash,omitempty"`
+	StrongHash    []byte                 `protobuf:"bytes,2,opt,name=strongHash,proto3" json:"strongHash,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *ManifestBlockHash) Reset() {
-	*x = ManifestBlockHash{}
+func (x *BlockHash) Reset() {
+	*x = BlockHash{}
 	mi := &file_pwr_pwr_proto_msgTypes[8]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *ManifestBlockHash) String() string {
+func (x *BlockHash) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*ManifestBlockHash) ProtoMessage() {}
+func (*BlockHash) ProtoMessage() {}
 
-func (x *ManifestBlockHash) ProtoReflect() protoreflect.Message {
+func (x *BlockHash) ProtoReflect() protoreflect.Message {
 	mi := &file_pwr_pwr_proto_msgTypes[8]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -716,12 +976,301 @@ func (x *ManifestBlockHash) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use ManifestBlockHash.ProtoReflect.Descriptor instead.
-func (*ManifestBlockHash) Descriptor() ([]byte, []int) {
+// Deprecated: Use BlockHash.ProtoReflect.Descriptor instead.
+func (*BlockHash) Descriptor() ([]byte, []int) {
 	return file_pwr_pwr_proto_rawDescGZIP(), []int{8}
 }
 
-func (x *ManifestBlockHash) GetHash() []byte {
+func (x *BlockHash) GetWeakHash() uint32 {
+	if x != nil {
+		return x.WeakHash
+	}
+	return 0
+}
+
+func (x *BlockHash) GetStrongHash() []byte {
+	if x != nil {
+		return x.StrongHash
+	}
+	return nil
+}
+
+// chunks of a file are consecutive, so their offsets are implied
+type ChunkHash struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Size          int64                  `protobuf:"varint,1,opt,name=size,proto3" json:"size,omitempty"`
+	StrongHash    []byte                 `protobuf:"bytes,2,opt,name=strongHash,proto3" json:"strongHash,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ChunkHash) Reset() {
+	*x = ChunkHash{}
+	mi := &file_pwr_pwr_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ChunkHash) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ChunkHash) ProtoMessage() {}
+
+func (x *ChunkHash) ProtoReflect() protoreflect.Message {
+	mi := &file_pwr_pwr_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ChunkHash.ProtoReflect.Descriptor instead.
+func (*ChunkHash) Descriptor() ([]byte, []int) {
+	return file_pwr_pwr_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *ChunkHash) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *ChunkHash) GetStrongHash() []byte {
+	if x != nil {
+		return x.StrongHash
+	}
+	return nil
+}
+
+type CompressionSettings struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	Algorithm CompressionAlgorithm   `protobuf:"varint,1,opt,name=algorithm,proto3,enum=io.itch.wharf.pwr.CompressionAlgorithm" json:"algorithm,omitempty"`
+	Quality   int32                  `protobuf:"varint,2,opt,name=quality,proto3" json:"quality,omitempty"`
+	// if set, every message after the header is followed by a CRC32C
+	// of its length prefix and contents
+	Checksums     bool `protobuf:"varint,3,opt,name=checksums,proto3" json:"checksums,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CompressionSettings) Reset() {
+	*x = CompressionSettings{}
+	mi := &file_pwr_pwr_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CompressionSettings) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CompressionSettings) ProtoMessage() {}
+
+func (x *CompressionSettings) ProtoReflect() protoreflect.Message {
+	mi := &file_pwr_pwr_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CompressionSettings.ProtoReflect.Descriptor instead.
+func (*CompressionSettings) Descriptor() ([]byte, []int) {
+	return file_pwr_pwr_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *CompressionSettings) GetAlgorithm() CompressionAlgorithm {
+	if x != nil {
+		return x.Algorithm
+	}
+	return CompressionAlgorithm_NONE
+}
+
+func (x *CompressionSettings) GetQuality() int32 {
+	if x != nil {
+		return x.Quality
+	}
+	return 0
+}
+
+func (x *CompressionSettings) GetChecksums() bool {
+	if x != nil {
+		return x.Checksums
+	}
+	return false
+}
+
+type EncryptionHeader struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	Algorithm EncryptionAlgorithm    `protobuf:"varint,1,opt,name=algorithm,proto3,enum=io.itch.wharf.pwr.EncryptionAlgorithm" json:"algorithm,omitempty"`
+	// size of decrypted chunks, all but the last one are full
+	ChunkSize int64 `protobuf:"varint,2,opt,name=chunkSize,proto3" json:"chunkSize,omitempty"`
+	// random, 7 bytes
+	Nonce []byte `protobuf:"bytes,3,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	// random, 32 bytes
+	Salt          []byte `protobuf:"bytes,4,opt,name=salt,proto3" json:"salt,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *EncryptionHeader) Reset() {
+	*x = EncryptionHeader{}
+	mi := &file_pwr_pwr_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EncryptionHeader) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EncryptionHeader) ProtoMessage() {}
+
+func (x *EncryptionHeader) ProtoReflect() protoreflect.Message {
+	mi := &file_pwr_pwr_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EncryptionHeader.ProtoReflect.Descriptor instead.
+func (*EncryptionHeader) Descriptor() ([]byte, []int) {
+	return file_pwr_pwr_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *EncryptionHeader) GetAlgorithm() EncryptionAlgorithm {
+	if x != nil {
+		return x.Algorithm
+	}
+	return EncryptionAlgorithm_AES_256_GCM
+}
+
+func (x *EncryptionHeader) GetChunkSize() int64 {
+	if x != nil {
+		return x.ChunkSize
+	}
+	return 0
+}
+
+func (x *EncryptionHeader) GetNonce() []byte {
+	if x != nil {
+		return x.Nonce
+	}
+	return nil
+}
+
+func (x *EncryptionHeader) GetSalt() []byte {
+	if x != nil {
+		return x.Salt
+	}
+	return nil
+}
+
+type ManifestHeader struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Compression   *CompressionSettings   `protobuf:"bytes,1,opt,name=compression,proto3" json:"compression,omitempty"`
+	Algorithm     HashAlgorithm          `protobuf:"varint,2,opt,name=algorithm,proto3,enum=io.itch.wharf.pwr.HashAlgorithm" json:"algorithm,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ManifestHeader) Reset() {
+	*x = ManifestHeader{}
+	mi := &file_pwr_pwr_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ManifestHeader) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ManifestHeader) ProtoMessage() {}
+
+func (x *ManifestHeader) ProtoReflect() protoreflect.Message {
+	mi := &file_pwr_pwr_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ManifestHeader.ProtoReflect.Descriptor instead.
+func (*ManifestHeader) Descriptor() ([]byte, []int) {
+	return file_pwr_pwr_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *ManifestHeader) GetCompression() *CompressionSettings {
+	if x != nil {
+		return x.Compression
+	}
+	return nil
+}
+
+func (x *ManifestHeader) GetAlgorithm() HashAlgorithm {
+	if x != nil {
+		return x.Algorithm
+	}
+	return HashAlgorithm_SHAKE128_32
+}
+
+type ManifestBlockHash struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Hash          []byte                 `protobuf:"bytes,1,opt,name=hash,proto3" json:"hash,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ManifestBlockHash) Reset() {
+	*x = ManifestBlockHash{}
+	mi := &file_pwr_pwr_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ManifestBlockHash) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ManifestBlockHash) ProtoMessage() {}
+
+func (x *ManifestBlockHash) ProtoReflect() protoreflect.Message {
+	mi := &file_pwr_pwr_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ManifestBlockHash.ProtoReflect.Descriptor instead.
+func (*ManifestBlockHash) Descriptor() ([]byte, []int) {
+	return file_pwr_pwr_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *ManifestBlockHash) GetHash() []byte {
 	if x != nil {
 		return x.Hash
 	}
@@ -738,7 +1287,7 @@ type WoundsHeader struct {
 
 func (x *WoundsHeader) Reset() {
 	*x = WoundsHeader{}
-	mi := &file_pwr_pwr_proto_msgTypes[9]
+	mi := &file_pwr_pwr_proto_msgTypes[14]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -750,7 +1299,7 @@ func (x *WoundsHeader) String() string {
 func (*WoundsHeader) ProtoMessage() {}
 
 func (x *WoundsHeader) ProtoReflect() protoreflect.Message {
-	mi := &file_pwr_pwr_proto_msgTypes[9]
+	mi := &file_pwr_pwr_proto_msgTypes[14]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -763,7 +1312,7 @@ func (x *WoundsHeader) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use WoundsHeader.ProtoReflect.Descriptor instead.
 func (*WoundsHeader) Descriptor() ([]byte, []int) {
-	return file_pwr_pwr_proto_rawDescGZIP(), []int{9}
+	return file_pwr_pwr_proto_rawDescGZIP(), []int{14}
 }
 
 // Describe a corrupted portion of a file, in [start,end)
@@ -779,7 +1328,7 @@ type Wound struct {
 
 func (x *Wound) Reset() {
 	*x = Wound{}
-	mi := &file_pwr_pwr_proto_msgTypes[10]
+	mi := &file_pwr_pwr_proto_msgTypes[15]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -791,7 +1340,7 @@ func (x *Wound) String() string {
 func (*Wound) ProtoMessage() {}
 
 func (x *Wound) ProtoReflect() protoreflect.Message {
-	mi := &file_pwr_pwr_proto_msgTypes[10]
+	mi := &file_pwr_pwr_proto_msgTypes[15]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -804,7 +1353,7 @@ func (x *Wound) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Wound.ProtoReflect.Descriptor instead.
 func (*Wound) Descriptor() ([]byte, []int) {
-	return file_pwr_pwr_proto_rawDescGZIP(), []int{10}
+	return file_pwr_pwr_proto_rawDescGZIP(), []int{15}
 }
 
 func (x *Wound) GetIndex() int64 {
@@ -835,13 +1384,290 @@ func (x *Wound) GetKind() WoundKind {
 	return WoundKind_FILE
 }
 
+type ZipIndexHeader struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	Compression *CompressionSettings   `protobuf:"bytes,1,opt,name=compression,proto3" json:"compression,omitempty"`
+	// size of the indexed archive, to detect mismatches
+	ArchiveSize   int64 `protobuf:"varint,2,opt,name=archiveSize,proto3" json:"archiveSize,omitempty"`
+	NumEntries    int64 `protobuf:"varint,3,opt,name=numEntries,proto3" json:"numEntries,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ZipIndexHeader) Reset() {
+	*x = ZipIndexHeader{}
+	mi := &file_pwr_pwr_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ZipIndexHeader) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ZipIndexHeader) ProtoMessage() {}
+
+func (x *ZipIndexHeader) ProtoReflect() protoreflect.Message {
+	mi := &file_pwr_pwr_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ZipIndexHeader.ProtoReflect.Descriptor instead.
+func (*ZipIndexHeader) Descriptor() ([]byte, []int) {
+	return file_pwr_pwr_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *ZipIndexHeader) GetCompression() *CompressionSettings {
+	if x != nil {
+		return x.Compression
+	}
+	return nil
+}
+
+func (x *ZipIndexHeader) GetArchiveSize() int64 {
+	if x != nil {
+		return x.ArchiveSize
+	}
+	return 0
+}
+
+func (x *ZipIndexHeader) GetNumEntries() int64 {
+	if x != nil {
+		return x.NumEntries
+	}
+	return 0
+}
+
+type ZipIndexEntry struct {
+	state             protoimpl.MessageState `protogen:"open.v1"`
+	Path              string                 `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"`
+	Mode              uint32                 `protobuf:"varint,2,opt,name=mode,proto3" json:"mode,omitempty"`
+	LocalHeaderOffset int64                  `protobuf:"varint,3,opt,name=localHeaderOffset,proto3" json:"localHeaderOffset,omitempty"`
+	// offset of the entry's (compressed) data in the archive
+	DataOffset       int64  `protobuf:"varint,4,opt,name=dataOffset,proto3" json:"dataOffset,omitempty"`
+	CompressedSize   int64  `protobuf:"varint,5,opt,name=compressedSize,proto3" json:"compressedSize,omitempty"`
+	UncompressedSize int64  `protobuf:"varint,6,opt,name=uncompressedSize,proto3" json:"uncompressedSize,omitempty"`
+	Method           uint32 `protobuf:"varint,7,opt,name=method,proto3" json:"method,omitempty"`
+	Crc32            uint32 `protobuf:"varint,8,opt,name=crc32,proto3" json:"crc32,omitempty"`
+	NumRestartPoints int64  `protobuf:"varint,9,opt,name=numRestartPoints,proto3" json:"numRestartPoints,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *ZipIndexEntry) Reset() {
+	*x = ZipIndexEntry{}
+	mi := &file_pwr_pwr_proto_msgTypes[17]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ZipIndexEntry) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ZipIndexEntry) ProtoMessage() {}
+
+func (x *ZipIndexEntry) ProtoReflect() protoreflect.Message {
+	mi := &file_pwr_pwr_proto_msgTypes[17]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ZipIndexEntry.ProtoReflect.Descriptor instead.
+func (*ZipIndexEntry) Descriptor() ([]byte, []int) {
+	return file_pwr_pwr_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *ZipIndexEntry) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+func (x *ZipIndexEntry) GetMode() uint32 {
+	if x != nil {
+		return x.Mode
+	}
+	return 0
+}
+
+func (x *ZipIndexEntry) GetLocalHeaderOffset() int64 {
+	if x != nil {
+		return x.LocalHeaderOffset
+	}
+	return 0
+}
+
+func (x *ZipIndexEntry) GetDataOffset() int64 {
+	if x != nil {
+		return x.DataOffset
+	}
+	return 0
+}
+
+func (x *ZipIndexEntry) GetCompressedSize() int64 {
+	if x != nil {
+		return x.CompressedSize
+	}
+	return 0
+}
+
+func (x *ZipIndexEntry) GetUncompressedSize() int64 {
+	if x != nil {
+		return x.UncompressedSize
+	}
+	return 0
+}
+
+func (x *ZipIndexEntry) GetMethod() uint32 {
+	if x != nil {
+		return x.Method
+	}
+	return 0
+}
+
+func (x *ZipIndexEntry) GetCrc32() uint32 {
+	if x != nil {
+		return x.Crc32
+	}
+	return 0
+}
+
+func (x *ZipIndexEntry) GetNumRestartPoints() int64 {
+	if x != nil {
+		return x.NumRestartPoints
+	}
+	return 0
+}
+
+// A point inside a deflate stream from which decompression can be
+// restarted, without inflating the entry from the start
+type ZipIndexRestartPoint struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// offset into the entry's uncompressed data
+	UncompressedOffset int64 `protobuf:"varint,1,opt,name=uncompressedOffset,proto3" json:"uncompressedOffset,omitempty"`
+	// offset into the entry's compressed data, relative to dataOffset
+	CompressedOffset int64 `protobuf:"varint,2,opt,name=compressedOffset,proto3" json:"compressedOffset,omitempty"`
+	// bits already read from the compressed data
+	Bits    uint32 `protobuf:"varint,3,opt,name=bits,proto3" json:"bits,omitempty"`
+	NumBits uint32 `protobuf:"varint,4,opt,name=numBits,proto3" json:"numBits,omitempty"`
+	// the decompressor's sliding window
+	Window         []byte `protobuf:"bytes,5,opt,name=window,proto3" json:"window,omitempty"`
+	WindowReadPos  int64  `protobuf:"varint,6,opt,name=windowReadPos,proto3" json:"windowReadPos,omitempty"`
+	WindowWritePos int64  `protobuf:"varint,7,opt,name=windowWritePos,proto3" json:"windowWritePos,omitempty"`
+	WindowFull     bool   `protobuf:"varint,8,opt,name=windowFull,proto3" json:"windowFull,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *ZipIndexRestartPoint) Reset() {
+	*x = ZipIndexRestartPoint{}
+	mi := &file_pwr_pwr_proto_msgTypes[18]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ZipIndexRestartPoint) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ZipIndexRestartPoint) ProtoMessage() {}
+
+func (x *ZipIndexRestartPoint) ProtoReflect() protoreflect.Message {
+	mi := &file_pwr_pwr_proto_msgTypes[18]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ZipIndexRestartPoint.ProtoReflect.Descriptor instead.
+func (*ZipIndexRestartPoint) Descriptor() ([]byte, []int) {
+	return file_pwr_pwr_proto_rawDescGZIP(), []int{18}
+}
+
+func (x *ZipIndexRestartPoint) GetUncompressedOffset() int64 {
+	if x != nil {
+		return x.UncompressedOffset
+	}
+	return 0
+}
+
+func (x *ZipIndexRestartPoint) GetCompressedOffset() int64 {
+	if x != nil {
+		return x.CompressedOffset
+	}
+	return 0
+}
+
+func (x *ZipIndexRestartPoint) GetBits() uint32 {
+	if x != nil {
+		return x.Bits
+	}
+	return 0
+}
+
+func (x *ZipIndexRestartPoint) GetNumBits() uint32 {
+	if x != nil {
+		return x.NumBits
+	}
+	return 0
+}
+
+func (x *ZipIndexRestartPoint) GetWindow() []byte {
+	if x != nil {
+		return x.Window
+	}
+	return nil
+}
+
+func (x *ZipIndexRestartPoint) GetWindowReadPos() int64 {
+	if x != nil {
+		return x.WindowReadPos
+	}
+	return 0
+}
+
+func (x *ZipIndexRestartPoint) GetWindowWritePos() int64 {
+	if x != nil {
+		return x.WindowWritePos
+	}
+	return 0
+}
+
+func (x *ZipIndexRestartPoint) GetWindowFull() bool {
+	if x != nil {
+		return x.WindowFull
+	}
+	return false
+}
+
 var File_pwr_pwr_proto protoreflect.FileDescriptor
 
 const file_pwr_pwr_proto_rawDesc = "" +
 	"\n" +
-	"\rpwr/pwr.proto\x12\x11io.itch.wharf.pwr\"W\n" +
+	"\rpwr/pwr.proto\x12\x11io.itch.wharf.pwr\"u\n" +
 	"\vPatchHeader\x12H\n" +
-	"\vcompression\x18\x01 \x01(\v2&.io.itch.wharf.pwr.CompressionSettingsR\vcompression\"\x81\x01\n" +
+	"\vcompression\x18\x01 \x01(\v2&.io.itch.wharf.pwr.CompressionSettingsR\vcompression\x12\x1c\n" +
+	"\tblockSize\x18\x02 \x01(\x03R\tblockSize\"\x81\x01\n" +
 	"\n" +
 	"SyncHeader\x126\n" +
 	"\x04type\x18\x01 \x01(\x0e2\".io.itch.wharf.pwr.SyncHeader.TypeR\x04type\x12\x1c\n" +
@@ -851,7 +1677,7 @@ const file_pwr_pwr_proto_rawDesc = "" +
 	"\n" +
 	"\x06BSDIFF\x10\x01\"0\n" +
 	"\fBsdiffHeader\x12 \n" +
-	"\vtargetIndex\x18\x01 \x01(\x03R\vtargetIndex\"\xe4\x01\n" +
+	"\vtargetIndex\x18\x01 \x01(\x03R\vtargetIndex\"\xfc\x02\n" +
 	"\x06SyncOp\x122\n" +
 	"\x04type\x18\x01 \x01(\x0e2\x1e.io.itch.wharf.pwr.SyncOp.TypeR\x04type\x12\x1c\n" +
 	"\tfileIndex\x18\x02 \x01(\x03R\tfileIndex\x12\x1e\n" +
@@ -859,21 +1685,57 @@ const file_pwr_pwr_proto_rawDesc = "" +
 	"blockIndex\x18\x03 \x01(\x03R\n" +
 	"blockIndex\x12\x1c\n" +
 	"\tblockSpan\x18\x04 \x01(\x03R\tblockSpan\x12\x12\n" +
-	"\x04data\x18\x05 \x01(\fR\x04data\"6\n" +
+	"\x04data\x18\x05 \x01(\fR\x04data\x12\x16\n" +
+	"\x06offset\x18\x06 \x01(\x03R\x06offset\x12\x12\n" +
+	"\x04size\x18\a \x01(\x03R\x04size\x12\x1c\n" +
+	"\tbaseIndex\x18\b \x01(\x03R\tbaseIndex\x12 \n" +
+	"\valternative\x18\t \x01(\bR\valternative\x12\x1a\n" +
+	"\bfallback\x18\n" +
+	" \x01(\bR\bfallback\"F\n" +
 	"\x04Type\x12\x0f\n" +
 	"\vBLOCK_RANGE\x10\x00\x12\b\n" +
-	"\x04DATA\x10\x01\x12\x13\n" +
-	"\x0eHEY_YOU_DID_IT\x10\x81\x10\"[\n" +
+	"\x04DATA\x10\x01\x12\x0e\n" +
+	"\n" +
+	"BYTE_RANGE\x10\x02\x12\x13\n" +
+	"\x0eHEY_YOU_DID_IT\x10\x81\x10\"\x94\x01\n" +
+	"\x0ePatchTOCHeader\x12\x1c\n" +
+	"\tpatchSize\x18\x01 \x01(\x03R\tpatchSize\x12\x1a\n" +
+	"\bnumFiles\x18\x02 \x01(\x03R\bnumFiles\x12H\n" +
+	"\vcompression\x18\x03 \x01(\v2&.io.itch.wharf.pwr.CompressionSettingsR\vcompression\"\xa3\x01\n" +
+	"\rPatchTOCEntry\x12$\n" +
+	"\rrestartOffset\x18\x01 \x01(\x03R\rrestartOffset\x12<\n" +
+	"\x19restartDecompressedOffset\x18\x02 \x01(\x03R\x19restartDecompressedOffset\x12.\n" +
+	"\x12decompressedOffset\x18\x03 \x01(\x03R\x12decompressedOffset\"\x9a\x01\n" +
+	"\x14MultiBasePatchHeader\x12H\n" +
+	"\vcompression\x18\x01 \x01(\v2&.io.itch.wharf.pwr.CompressionSettingsR\vcompression\x12\x1c\n" +
+	"\tblockSize\x18\x02 \x01(\x03R\tblockSize\x12\x1a\n" +
+	"\bnumBases\x18\x03 \x01(\x03R\bnumBases\"\x83\x02\n" +
 	"\x0fSignatureHeader\x12H\n" +
-	"\vcompression\x18\x01 \x01(\v2&.io.itch.wharf.pwr.CompressionSettingsR\vcompression\"G\n" +
+	"\vcompression\x18\x01 \x01(\v2&.io.itch.wharf.pwr.CompressionSettingsR\vcompression\x12\x1c\n" +
+	"\tblockSize\x18\x02 \x01(\x03R\tblockSize\x12F\n" +
+	"\n" +
+	"strongHash\x18\x03 \x01(\x0e2&.io.itch.wharf.pwr.StrongHashAlgorithmR\n" +
+	"strongHash\x12@\n" +
+	"\bchunking\x18\x04 \x01(\x0e2$.io.itch.wharf.pwr.ChunkingAlgorithmR\bchunking\"G\n" +
 	"\tBlockHash\x12\x1a\n" +
 	"\bweakHash\x18\x01 \x01(\rR\bweakHash\x12\x1e\n" +
 	"\n" +
 	"strongHash\x18\x02 \x01(\fR\n" +
-	"strongHash\"v\n" +
+	"strongHash\"?\n" +
+	"\tChunkHash\x12\x12\n" +
+	"\x04size\x18\x01 \x01(\x03R\x04size\x12\x1e\n" +
+	"\n" +
+	"strongHash\x18\x02 \x01(\fR\n" +
+	"strongHash\"\x94\x01\n" +
 	"\x13CompressionSettings\x12E\n" +
 	"\talgorithm\x18\x01 \x01(\x0e2'.io.itch.wharf.pwr.CompressionAlgorithmR\talgorithm\x12\x18\n" +
-	"\aquality\x18\x02 \x01(\x05R\aquality\"\x9a\x01\n" +
+	"\aquality\x18\x02 \x01(\x05R\aquality\x12\x1c\n" +
+	"\tchecksums\x18\x03 \x01(\bR\tchecksums\"\xa0\x01\n" +
+	"\x10EncryptionHeader\x12D\n" +
+	"\talgorithm\x18\x01 \x01(\x0e2&.io.itch.wharf.pwr.EncryptionAlgorithmR\talgorithm\x12\x1c\n" +
+	"\tchunkSize\x18\x02 \x01(\x03R\tchunkSize\x12\x14\n" +
+	"\x05nonce\x18\x03 \x01(\fR\x05nonce\x12\x12\n" +
+	"\x04salt\x18\x04 \x01(\fR\x04salt\"\x9a\x01\n" +
 	"\x0eManifestHeader\x12H\n" +
 	"\vcompression\x18\x01 \x01(\v2&.io.itch.wharf.pwr.CompressionSettingsR\vcompression\x12>\n" +
 	"\talgorithm\x18\x02 \x01(\x0e2 .io.itch.wharf.pwr.HashAlgorithmR\talgorithm\"'\n" +
@@ -884,13 +1746,54 @@ const file_pwr_pwr_proto_rawDesc = "" +
 	"\x05index\x18\x01 \x01(\x03R\x05index\x12\x14\n" +
 	"\x05start\x18\x02 \x01(\x03R\x05start\x12\x10\n" +
 	"\x03end\x18\x03 \x01(\x03R\x03end\x120\n" +
-	"\x04kind\x18\x04 \x01(\x0e2\x1c.io.itch.wharf.pwr.WoundKindR\x04kind*@\n" +
+	"\x04kind\x18\x04 \x01(\x0e2\x1c.io.itch.wharf.pwr.WoundKindR\x04kind\"\x9c\x01\n" +
+	"\x0eZipIndexHeader\x12H\n" +
+	"\vcompression\x18\x01 \x01(\v2&.io.itch.wharf.pwr.CompressionSettingsR\vcompression\x12 \n" +
+	"\varchiveSize\x18\x02 \x01(\x03R\varchiveSize\x12\x1e\n" +
+	"\n" +
+	"numEntries\x18\x03 \x01(\x03R\n" +
+	"numEntries\"\xb3\x02\n" +
+	"\rZipIndexEntry\x12\x12\n" +
+	"\x04path\x18\x01 \x01(\tR\x04path\x12\x12\n" +
+	"\x04mode\x18\x02 \x01(\rR\x04mode\x12,\n" +
+	"\x11localHeaderOffset\x18\x03 \x01(\x03R\x11localHeaderOffset\x12\x1e\n" +
+	"\n" +
+	"dataOffset\x18\x04 \x01(\x03R\n" +
+	"dataOffset\x12&\n" +
+	"\x0ecompressedSize\x18\x05 \x01(\x03R\x0ecompressedSize\x12*\n" +
+	"\x10uncompressedSize\x18\x06 \x01(\x03R\x10uncompressedSize\x12\x16\n" +
+	"\x06method\x18\a \x01(\rR\x06method\x12\x14\n" +
+	"\x05crc32\x18\b \x01(\rR\x05crc32\x12*\n" +
+	"\x10numRestartPoints\x18\t \x01(\x03R\x10numRestartPoints\"\xa6\x02\n" +
+	"\x14ZipIndexRestartPoint\x12.\n" +
+	"\x12uncompressedOffset\x18\x01 \x01(\x03R\x12uncompressedOffset\x12*\n" +
+	"\x10compressedOffset\x18\x02 \x01(\x03R\x10compressedOffset\x12\x12\n" +
+	"\x04bits\x18\x03 \x01(\rR\x04bits\x12\x18\n" +
+	"\anumBits\x18\x04 \x01(\rR\anumBits\x12\x16\n" +
+	"\x06window\x18\x05 \x01(\fR\x06window\x12$\n" +
+	"\rwindowReadPos\x18\x06 \x01(\x03R\rwindowReadPos\x12&\n" +
+	"\x0ewindowWritePos\x18\a \x01(\x03R\x0ewindowWritePos\x12\x1e\n" +
+	"\n" +
+	"windowFull\x18\b \x01(\bR\n" +
+	"windowFull*2\n" +
+	"\x11ChunkingAlgorithm\x12\x10\n" +
+	"\fFIXED_BLOCKS\x10\x00\x12\v\n" +
+	"\aFASTCDC\x10\x01*H\n" +
+	"\x13StrongHashAlgorithm\x12\a\n" +
+	"\x03MD5\x10\x00\x12\n" +
+	"\n" +
+	"\x06SHA256\x10\x01\x12\x0e\n" +
+	"\n" +
+	"BLAKE3_256\x10\x02\x12\f\n" +
+	"\bXXH3_128\x10\x03*@\n" +
 	"\x14CompressionAlgorithm\x12\b\n" +
 	"\x04NONE\x10\x00\x12\n" +
 	"\n" +
 	"\x06BROTLI\x10\x01\x12\b\n" +
 	"\x04GZIP\x10\x02\x12\b\n" +
-	"\x04ZSTD\x10\x03*,\n" +
+	"\x04ZSTD\x10\x03*&\n" +
+	"\x13EncryptionAlgorithm\x12\x0f\n" +
+	"\vAES_256_GCM\x10\x00*,\n" +
 	"\rHashAlgorithm\x12\x0f\n" +
 	"\vSHAKE128_32\x10\x00\x12\n" +
 	"\n" +
@@ -913,40 +1816,57 @@ func file_pwr_pwr_proto_rawDescGZIP() []byte {
 	return file_pwr_pwr_proto_rawDescData
 }
 
-var file_pwr_pwr_proto_enumTypes = make([]protoimpl.EnumInfo, 5)
-var file_pwr_pwr_proto_msgTypes = make([]protoimpl.MessageInfo, 11)
+var file_pwr_pwr_proto_enumTypes = make([]protoimpl.EnumInfo, 8)
+var file_pwr_pwr_proto_msgTypes = make([]protoimpl.MessageInfo, 19)
 var file_pwr_pwr_proto_goTypes = []any{
-	(CompressionAlgorithm)(0),   // 0: io.itch.wharf.pwr.CompressionAlgorithm
-	(HashAlgorithm)(0),          // 1: io.itch.wharf.pwr.HashAlgorithm
-	(WoundKind)(0),              // 2: io.itch.wharf.pwr.WoundKind
-	(SyncHeader_Type)(0),        // 3: io.itch.wharf.pwr.SyncHeader.Type
-	(SyncOp_Type)(0),            // 4: io.itch.wharf.pwr.SyncOp.Type
-	(*PatchHeader)(nil),         // 5: io.itch.wharf.pwr.PatchHeader
-	(*SyncHeader)(nil),          // 6: io.itch.wharf.pwr.SyncHeader
-	(*BsdiffHeader)(nil),        // 7: io.itch.wharf.pwr.BsdiffHeader
-	(*SyncOp)(nil),              // 8: io.itch.wharf.pwr.SyncOp
-	(*SignatureHeader)(nil),     // 9: io.itch.wharf.pwr.SignatureHeader
-	(*BlockHash)(nil),           // 10: io.itch.wharf.pwr.BlockHash
-	(*CompressionSettings)(nil), // 11: io.itch.wharf.pwr.CompressionSettings
-	(*ManifestHeader)(nil),      // 12: io.itch.wharf.pwr.ManifestHeader
-	(*ManifestBlockHash)(nil),   // 13: io.itch.wharf.pwr.ManifestBlockHash
-	(*WoundsHeader)(nil),        // 14: io.itch.wharf.pwr.WoundsHeader
-	(*Wound)(nil),               // 15: io.itch.wharf.pwr.Wound
+	(ChunkingAlgorithm)(0),       // 0: io.itch.wharf.pwr.ChunkingAlgorithm
+	(StrongHashAlgorithm)(0),     // 1: io.itch.wharf.pwr.StrongHashAlgorithm
+	(CompressionAlgorithm)(0),    // 2: io.itch.wharf.pwr.CompressionAlgorithm
+	(EncryptionAlgorithm)(0),     // 3: io.itch.wharf.pwr.EncryptionAlgorithm
+	(HashAlgorithm)(0),           // 4: io.itch.wharf.pwr.HashAlgorithm
+	(WoundKind)(0),               // 5: io.itch.wharf.pwr.WoundKind
+	(SyncHeader_Type)(0),         // 6: io.itch.wharf.pwr.SyncHeader.Type
+	(SyncOp_Type)(0),             // 7: io.itch.wharf.pwr.SyncOp.Type
+	(*PatchHeader)(nil),          // 8: io.itch.wharf.pwr.PatchHeader
+	(*SyncHeader)(nil),           // 9: io.itch.wharf.pwr.SyncHeader
+	(*BsdiffHeader)(nil),         // 10: io.itch.wharf.pwr.BsdiffHeader
+	(*SyncOp)(nil),               // 11: io.itch.wharf.pwr.SyncOp
+	(*PatchTOCHeader)(nil),       // 12: io.itch.wharf.pwr.PatchTOCHeader
+	(*PatchTOCEntry)(nil),        // 13: io.itch.wharf.pwr.PatchTOCEntry
+	(*MultiBasePatchHeader)(nil), // 14: io.itch.wharf.pwr.MultiBasePatchHeader
+	(*SignatureHeader)(nil),      // 15: io.itch.wharf.pwr.SignatureHeader
+	(*BlockHash)(nil),            // 16: io.itch.wharf.pwr.BlockHash
+	(*ChunkHash)(nil),            // 17: io.itch.wharf.pwr.ChunkHash
+	(*CompressionSettings)(nil),  // 18: io.itch.wharf.pwr.CompressionSettings
+	(*EncryptionHeader)(nil),     // 19: io.itch.wharf.pwr.EncryptionHeader
+	(*ManifestHeader)(nil),       // 20: io.itch.wharf.pwr.ManifestHeader
+	(*ManifestBlockHash)(nil),    // 21: io.itch.wharf.pwr.ManifestBlockHash
+	(*WoundsHeader)(nil),         // 22: io.itch.wharf.pwr.WoundsHeader
+	(*Wound)(nil),                // 23: io.itch.wharf.pwr.Wound
+	(*ZipIndexHeader)(nil),       // 24: io.itch.wharf.pwr.ZipIndexHeader
+	(*ZipIndexEntry)(nil),        // 25: io.itch.wharf.pwr.ZipIndexEntry
+	(*ZipIndexRestartPoint)(nil), // 26: io.itch.wharf.pwr.ZipIndexRestartPoint
 }
 var file_pwr_pwr_proto_depIdxs = []int32{
-	11, // 0: io.itch.wharf.pwr.PatchHeader.compression:type_name -> io.itch.wharf.pwr.CompressionSettings
-	3,  // 1: io.itch.wharf.pwr.SyncHeader.type:type_name -> io.itch.wharf.pwr.SyncHeader.Type
-	4,  // 2: io.itch.wharf.pwr.SyncOp.type:type_name -> io.itch.wharf.pwr.SyncOp.Type
-	11, // 3: io.itch.wharf.pwr.SignatureHeader.compression:type_name -> io.itch.wharf.pwr.CompressionSettings
-	0,  // 4: io.itch.wharf.pwr.CompressionSettings.algorithm:type_name -> io.itch.wharf.pwr.CompressionAlgorithm
-	11, // 5: io.itch.wharf.pwr.ManifestHeader.compression:type_name -> io.itch.wharf.pwr.CompressionSettings
-	1,  // 6: io.itch.wharf.pwr.ManifestHeader.algorithm:type_name -> io.itch.wharf.pwr.HashAlgorithm
-	2,  // 7: io.itch.wharf.pwr.Wound.kind:type_name -> io.itch.wharf.pwr.WoundKind
-	8,  // [8:8] is the sub-list for method output_type
-	8,  // [8:8] is the sub-list for method input_type
-	8,  // [8:8] is the sub-list for extension type_name
-	8,  // [8:8] is the sub-list for extension extendee
-	0,  // [0:8] is the sub-list for field type_name
+	18, // 0: io.itch.wharf.pwr.PatchHeader.compression:type_name -> io.itch.wharf.pwr.CompressionSettings
+	6,  // 1: io.itch.wharf.pwr.SyncHeader.type:type_name -> io.itch.wharf.pwr.SyncHeader.Type
+	7,  // 2: io.itch.wharf.pwr.SyncOp.type:type_name -> io.itch.wharf.pwr.SyncOp.Type
+	18, // 3: io.itch.wharf.pwr.PatchTOCHeader.compression:type_name -> io.itch.wharf.pwr.CompressionSettings
+	18, // 4: io.itch.wharf.pwr.MultiBasePatchHeader.compression:type_name -> io.itch.wharf.pwr.CompressionSettings
+	18, // 5: io.itch.wharf.pwr.SignatureHeader.compression:type_name -> io.itch.wharf.pwr.CompressionSettings
+	1,  // 6: io.itch.wharf.pwr.SignatureHeader.strongHash:type_name -> io.itch.wharf.pwr.StrongHashAlgorithm
+	0,  // 7: io.itch.wharf.pwr.SignatureHeader.chunking:type_name -> io.itch.wharf.pwr.ChunkingAlgorithm
+	2,  // 8: io.itch.wharf.pwr.CompressionSettings.algorithm:type_name -> io.itch.wharf.pwr.CompressionAlgorithm
+	3,  // 9: io.itch.wharf.pwr.EncryptionHeader.algorithm:type_name -> io.itch.wharf.pwr.EncryptionAlgorithm
+	18, // 10: io.itch.wharf.pwr.ManifestHeader.compression:type_name -> io.itch.wharf.pwr.CompressionSettings
+	4,  // 11: io.itch.wharf.pwr.ManifestHeader.algorithm:type_name -> io.itch.wharf.pwr.HashAlgorithm
+	5,  // 12: io.itch.wharf.pwr.Wound.kind:type_name -> io.itch.wharf.pwr.WoundKind
+	18, // 13: io.itch.wharf.pwr.ZipIndexHeader.compression:type_name -> io.itch.wharf.pwr.CompressionSettings
+	14, // [14:14] is the sub-list for method output_type
+	14, // [14:14] is the sub-list for method input_type
+	14, // [14:14] is the sub-list for extension type_name
+	14, // [14:14] is the sub-list for extension extendee
+	0,  // [0:14] is the sub-list for field type_name
 }
 
 func init() { file_pwr_pwr_proto_init() }
@@ -959,8 +1879,8 @@ func file_pwr_pwr_proto_init() {
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_pwr_pwr_proto_rawDesc), len(file_pwr_pwr_proto_rawDesc)),
-			NumEnums:      5,
-			NumMessages:   11,
+			NumEnums:      8,
+			NumMessages:   19,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
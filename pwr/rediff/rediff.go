@@ -150,6 +150,12 @@ func (cx *context) analyzePatch() error {
 		return err
 	}
 
+	err = pwr.ValidateBlockSize(ph.BlockSize)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	blockSize := pwr.EffectiveBlockSize(ph.BlockSize)
+
 	rctx, err = pwr.DecompressWire(rctx, ph.Compression)
 	if err != nil {
 		return errors.WithStack(err)
@@ -214,11 +220,15 @@ func (cx *context) analyzePatch() error {
 				alreadyReused := bytesReusedPerFileIndex[rop.FileIndex]
 				lastBlockIndex := rop.BlockIndex + rop.BlockSpan
 				targetFile := targetContainer.Files[rop.FileIndex]
-				lastBlockSize := pwr.ComputeBlockSize(targetFile.Size, lastBlockIndex)
-				otherBlocksSize := pwr.BlockSize*rop.BlockSpan - 1
+				lastBlockSize := pwr.ComputeBlockSizeWithBlockSize(targetFile.Size, lastBlockIndex, blockSize)
+				otherBlocksSize := blockSize*rop.BlockSpan - 1
 
 				bytesReusedPerFileIndex[rop.FileIndex] = alreadyReused + otherBlocksSize + lastBlockSize
 
+			case pwr.SyncOp_BYTE_RANGE:
+				numBlockRange++
+				bytesReusedPerFileIndex[rop.FileIndex] += rop.Size
+
 			case pwr.SyncOp_DATA:
 				numData++
 
@@ -335,6 +345,8 @@ func (cx *context) Optimize(params OptimizeParams) error {
 
 	wph := &pwr.PatchHeader{
 		Compression: compression,
+		// rsync operations are copied as-is, so they keep their block size
+		BlockSize: ph.BlockSize,
 	}
 	err = wctx.WriteMessage(wph)
 	if err != nil {
@@ -26,6 +26,9 @@ type safeKeeper struct {
 	bufLock sync.Mutex
 	buf     []byte
 
+	// only known once the signature has been read
+	blockSize int64
+
 	validBlocks map[int64]fileBlocks
 }
 
@@ -49,8 +52,6 @@ func NewSafeKeeper(params SafeKeeperParams) (lake.Pool, error) {
 		open:  params.Open,
 
 		validBlocks: make(map[int64]fileBlocks),
-
-		buf: make([]byte, BlockSize),
 	}
 	return sk, nil
 }
@@ -118,6 +119,8 @@ func (sk *safeKeeper) getBlockValidator() (BlockValidator, error) {
 		return nil, err
 	}
 
+	sk.blockSize = hashInfo.BlockSize
+	sk.buf = make([]byte, hashInfo.BlockSize)
 	sk.blockValidator = NewBlockValidator(hashInfo)
 	return sk.blockValidator, nil
 }
@@ -132,18 +135,18 @@ func (sk *safeKeeper) validateBlock(skr *safeKeeperReader) error {
 	}
 	blocks := sk.validBlocks[skr.fileIndex]
 
-	blockIndex := skr.offset / BlockSize
-	if _, checked := blocks[int(blockIndex)]; !checked {
-		bv, err := sk.getBlockValidator()
-		if err != nil {
-			return err
-		}
+	bv, err := sk.getBlockValidator()
+	if err != nil {
+		return err
+	}
 
+	blockIndex := skr.offset / sk.blockSize
+	if _, checked := blocks[int(blockIndex)]; !checked {
 		blockSize := bv.BlockSize(skr.fileIndex, blockIndex)
 		buf := sk.buf[:blockSize]
 
 		savedOffset := skr.offset
-		blockOffset := blockIndex * BlockSize
+		blockOffset := blockIndex * sk.blockSize
 		_, err = skr.rs.Seek(blockOffset, io.SeekStart)
 		if err != nil {
 			// restore offset
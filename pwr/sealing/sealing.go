@@ -0,0 +1,218 @@
+// Package sealing proves that wharf files (patches, signatures, manifests...)
+// were produced by whoever holds a given ed25519 private key.
+//
+// A seal is an ed25519 signature of a whole file, followed by SealMagic. It
+// can either be appended to the file it covers, or kept next to it, as a
+// detached .sig file. Files are hashed with SHA-512 before signing (Ed25519ph),
+// so they never need to be held in memory.
+//
+// Files opened by the caller are checked with NewVerifyingSource. Healers
+// (and the validator, when healing) open the manifests and zip indexes they
+// read themselves, and check them with a pwr.SourceVerifier, see Verifier.
+package sealing
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"io"
+
+	"github.com/itchio/savior"
+	"github.com/itchio/wharf/pwr"
+	"github.com/pkg/errors"
+)
+
+// SealSize is the size of a seal, in bytes
+const SealSize = ed25519.SignatureSize + 4
+
+// ErrNotSealed is returned when a file doesn't end with a seal
+var ErrNotSealed = errors.New("sealing: file isn't sealed")
+
+// ErrBadSeal is returned when a seal wasn't made for the given file with
+// the private key matching the given public key
+var ErrBadSeal = errors.New("sealing: seal doesn't match file")
+
+// keeps seals from being valid signatures of anything but wharf files
+const sealContext = "wharf seal"
+
+// Sign reads r until EOF, and returns a detached seal for its contents
+func Sign(r io.Reader, key ed25519.PrivateKey) ([]byte, error) {
+	digest, err := hash(r, -1)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	sig, err := key.Sign(nil, digest, signOptions())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	seal := make([]byte, 0, SealSize)
+	seal = append(seal, sig...)
+	seal = pwr.Endianness.AppendUint32(seal, uint32(pwr.SealMagic))
+	return seal, nil
+}
+
+// Seal reads r until EOF, and writes a seal for its contents to w, which
+// is expected to append to the same file
+func Seal(r io.Reader, w io.Writer, key ed25519.PrivateKey) error {
+	seal, err := Sign(r, key)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = w.Write(seal)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// Verify reads r until EOF, and returns nil if seal was made for its
+// contents with the private key matching key
+func Verify(r io.Reader, seal []byte, key ed25519.PublicKey) error {
+	sig, err := parseSeal(seal)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	digest, err := hash(r, -1)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return verifyDigest(digest, sig, key)
+}
+
+// NewVerifyingSource checks the seal appended to source, and returns
+// a source with everything but the seal, to be read by the patcher,
+// ReadSignature, ReadManifest, etc. It returns an error wrapping ErrNotSealed
+// or ErrBadSeal if the seal is missing or doesn't match.
+//
+// The whole file is read before returning, so tampered files are rejected
+// before anything acts on them. That only holds if source can't change
+// afterwards, so remote files should be downloaded first.
+func NewVerifyingSource(source savior.SeekSource, key ed25519.PublicKey) (savior.SeekSource, error) {
+	size := source.Size()
+	if size < SealSize {
+		return nil, errors.WithStack(ErrNotSealed)
+	}
+	contentsSize := size - SealSize
+
+	sealSource, err := source.Section(contentsSize, SealSize)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	_, err = sealSource.Resume(nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	seal := make([]byte, SealSize)
+	_, err = io.ReadFull(sealSource, seal)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	contents, err := source.Section(0, contentsSize)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = verifySource(contents, seal, key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return contents, nil
+}
+
+// Verifier returns a pwr.SourceVerifier that checks the seal appended to
+// wharf files read by healers with NewVerifyingSource. Like NewVerifyingSource,
+// it only protects files that can't change once checked, so remote files
+// should be downloaded first.
+func Verifier(key ed25519.PublicKey) pwr.SourceVerifier {
+	return func(source savior.SeekSource) (savior.SeekSource, error) {
+		return NewVerifyingSource(source, key)
+	}
+}
+
+// NewDetachedVerifyingSource checks a detached seal for source, and returns
+// source if it matches. See NewVerifyingSource.
+func NewDetachedVerifyingSource(source savior.SeekSource, seal []byte, key ed25519.PublicKey) (savior.SeekSource, error) {
+	err := verifySource(source, seal, key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return source, nil
+}
+
+func verifySource(source savior.SeekSource, seal []byte, key ed25519.PublicKey) error {
+	sig, err := parseSeal(seal)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = source.Resume(nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	digest, err := hash(source, source.Size())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return verifyDigest(digest, sig, key)
+}
+
+// hash returns the SHA-512 of size bytes of r, or of all of it if size is negative
+func hash(r io.Reader, size int64) ([]byte, error) {
+	h := sha512.New()
+
+	var err error
+	if size < 0 {
+		_, err = io.Copy(h, r)
+	} else {
+		_, err = io.CopyN(h, r, size)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return h.Sum(nil), nil
+}
+
+func parseSeal(seal []byte) ([]byte, error) {
+	if len(seal) != SealSize {
+		return nil, errors.WithStack(ErrNotSealed)
+	}
+
+	magic := int32(pwr.Endianness.Uint32(seal[ed25519.SignatureSize:]))
+	if magic != pwr.SealMagic {
+		return nil, errors.WithStack(ErrNotSealed)
+	}
+
+	return seal[:ed25519.SignatureSize], nil
+}
+
+func verifyDigest(digest []byte, sig []byte, key ed25519.PublicKey) error {
+	if len(key) != ed25519.PublicKeySize {
+		return errors.Errorf("sealing: invalid public key size %d", len(key))
+	}
+
+	err := ed25519.VerifyWithOptions(key, digest, sig, signOptions())
+	if err != nil {
+		return errors.WithStack(ErrBadSeal)
+	}
+	return nil
+}
+
+func signOptions() *ed25519.Options {
+	return &ed25519.Options{
+		Hash:    crypto.SHA512,
+		Context: sealContext,
+	}
+}
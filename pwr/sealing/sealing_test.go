@@ -0,0 +1,206 @@
+package sealing_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/pwr/patcher"
+	"github.com/itchio/wharf/pwr/sealing"
+	"github.com/itchio/wharf/wtest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Sealing(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sealing")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	v1 := filepath.Join(dir, "v1")
+	wtest.MakeTestDir(t, v1, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "file", Seed: 0x1, Size: pwr.BlockSize*3 + 5},
+		},
+	})
+
+	v2 := filepath.Join(dir, "v2")
+	wtest.MakeTestDir(t, v2, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "file", Seed: 0x1, Size: pwr.BlockSize*3 + 5, Bsmods: []wtest.Bsmod{
+				{Interval: pwr.BlockSize / 2, Delta: 0x3},
+			}},
+			{Path: "new", Seed: 0x2, Size: 123},
+		},
+	})
+
+	targetContainer, err := tlc.WalkAny(v1, tlc.WalkOpts{})
+	wtest.Must(t, err)
+	sourceContainer, err := tlc.WalkAny(v2, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	targetSignature, err := pwr.ComputeSignature(context.Background(), targetContainer, fspool.New(targetContainer, v1), &state.Consumer{})
+	wtest.Must(t, err)
+
+	dctx := &pwr.DiffContext{
+		Compression: &pwr.CompressionSettings{
+			Algorithm: pwr.CompressionAlgorithm_NONE,
+		},
+		Consumer: &state.Consumer{},
+
+		SourceContainer: sourceContainer,
+		Pool:            fspool.New(sourceContainer, v2),
+
+		TargetContainer: targetContainer,
+		TargetSignature: targetSignature,
+	}
+
+	patchBuffer := new(bytes.Buffer)
+	signatureBuffer := new(bytes.Buffer)
+	wtest.Must(t, dctx.WritePatch(context.Background(), patchBuffer, signatureBuffer))
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	wtest.Must(t, err)
+	otherKey, _, err := ed25519.GenerateKey(nil)
+	wtest.Must(t, err)
+
+	// appended seal
+	unsealedPatch := append([]byte(nil), patchBuffer.Bytes()...)
+	wtest.Must(t, sealing.Seal(bytes.NewReader(unsealedPatch), patchBuffer, privateKey))
+	sealedPatch := patchBuffer.Bytes()
+	assert.Len(t, sealedPatch, len(unsealedPatch)+sealing.SealSize)
+
+	patchSource, err := sealing.NewVerifyingSource(seeksource.FromBytes(sealedPatch), publicKey)
+	wtest.Must(t, err)
+	p, err := patcher.New(patchSource, &state.Consumer{})
+	wtest.Must(t, err)
+	assert.Len(t, p.GetSourceContainer().Files, 2)
+
+	_, err = sealing.NewVerifyingSource(seeksource.FromBytes(sealedPatch), otherKey)
+	assert.True(t, errors.Cause(err) == sealing.ErrBadSeal)
+
+	_, err = sealing.NewVerifyingSource(seeksource.FromBytes(unsealedPatch), publicKey)
+	assert.True(t, errors.Cause(err) == sealing.ErrNotSealed)
+
+	tampered := append([]byte(nil), sealedPatch...)
+	tampered[len(tampered)/2] ^= 0x1
+	_, err = sealing.NewVerifyingSource(seeksource.FromBytes(tampered), publicKey)
+	assert.True(t, errors.Cause(err) == sealing.ErrBadSeal)
+
+	// detached seal
+	signature := signatureBuffer.Bytes()
+	seal, err := sealing.Sign(bytes.NewReader(signature), privateKey)
+	wtest.Must(t, err)
+	wtest.Must(t, sealing.Verify(bytes.NewReader(signature), seal, publicKey))
+
+	sigSource, err := sealing.NewDetachedVerifyingSource(seeksource.FromBytes(signature), seal, publicKey)
+	wtest.Must(t, err)
+	_, err = sigSource.Resume(nil)
+	wtest.Must(t, err)
+	sigInfo, err := pwr.ReadSignature(context.Background(), sigSource)
+	wtest.Must(t, err)
+	assert.Len(t, sigInfo.Container.Files, 2)
+
+	tampered = append([]byte(nil), signature...)
+	tampered[len(tampered)-1] ^= 0x1
+	err = sealing.Verify(bytes.NewReader(tampered), seal, publicKey)
+	assert.True(t, errors.Cause(err) == sealing.ErrBadSeal)
+
+	// table of contents, then seal
+	tocBuffer := bytes.NewBuffer(append([]byte(nil), unsealedPatch...))
+	wtest.Must(t, pwr.WritePatchTOC(seeksource.FromBytes(unsealedPatch), tocBuffer))
+	tocPatch := append([]byte(nil), tocBuffer.Bytes()...)
+	wtest.Must(t, sealing.Seal(bytes.NewReader(tocPatch), tocBuffer, privateKey))
+	sealedTOCPatch := tocBuffer.Bytes()
+
+	err = pwr.WritePatchTOC(seeksource.FromBytes(sealedTOCPatch), new(bytes.Buffer))
+	assert.Error(t, err, "tables of contents must be written before the seal")
+
+	patchSource, err = sealing.NewVerifyingSource(seeksource.FromBytes(sealedTOCPatch), publicKey)
+	wtest.Must(t, err)
+	toc, err := pwr.ReadPatchTOC(patchSource)
+	wtest.Must(t, err)
+	assert.EqualValues(t, len(unsealedPatch), toc.Header.PatchSize)
+	assert.Len(t, toc.Entries, 2)
+
+	out := filepath.Join(dir, "out")
+	wtest.Must(t, patcher.PatchFresh(patcher.PatchFreshParams{
+		PatchReader: patchSource,
+		TargetDir:   v1,
+		OutputDir:   out,
+		Consumer:    &state.Consumer{},
+	}))
+	wtest.Must(t, pwr.AssertValid(out, sigInfo))
+
+	tampered = append([]byte(nil), sealedTOCPatch...)
+	tampered[len(unsealedPatch)+1] ^= 0x1
+	_, err = sealing.NewVerifyingSource(seeksource.FromBytes(tampered), publicKey)
+	assert.True(t, errors.Cause(err) == sealing.ErrBadSeal, "the seal covers the table of contents")
+}
+
+func Test_SealedManifestHeal(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sealedmanifest")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	sourceDir := filepath.Join(dir, "source")
+	wtest.MakeTestDir(t, sourceDir, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "file", Seed: 0x1, Size: pwr.BlockSize*3 + 5},
+			{Path: "subdir/small", Seed: 0x2, Size: 17},
+		},
+	})
+
+	container, err := tlc.WalkAny(sourceDir, tlc.WalkOpts{})
+	wtest.Must(t, err)
+	hashes, err := pwr.ComputeSignature(context.Background(), container, fspool.New(container, sourceDir), &state.Consumer{})
+	wtest.Must(t, err)
+	sigInfo := &pwr.SignatureInfo{
+		Container: container,
+		Hashes:    hashes,
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	wtest.Must(t, err)
+	otherKey, _, err := ed25519.GenerateKey(nil)
+	wtest.Must(t, err)
+
+	manifestBuffer := new(bytes.Buffer)
+	wtest.Must(t, pwr.WriteManifest(context.Background(), container, fspool.New(container, sourceDir), manifestBuffer, pwr.HashAlgorithm_SHAKE128_32))
+	unsealedManifest := append([]byte(nil), manifestBuffer.Bytes()...)
+	wtest.Must(t, sealing.Seal(bytes.NewReader(unsealedManifest), manifestBuffer, privateKey))
+
+	manifestPath := filepath.Join(dir, "build.pwm")
+	heal := func(manifest []byte, key ed25519.PublicKey) error {
+		wtest.Must(t, os.WriteFile(manifestPath, manifest, 0644))
+
+		targetDir := filepath.Join(dir, "target")
+		wtest.Must(t, os.RemoveAll(targetDir))
+
+		vctx := &pwr.ValidatorContext{
+			HealPath:     "manifest," + manifestPath + "," + sourceDir,
+			HealVerifier: sealing.Verifier(key),
+		}
+		err := vctx.Validate(context.Background(), targetDir, sigInfo)
+		if err != nil {
+			return err
+		}
+		return pwr.AssertValid(targetDir, sigInfo)
+	}
+
+	wtest.Must(t, heal(manifestBuffer.Bytes(), publicKey))
+
+	err = heal(manifestBuffer.Bytes(), otherKey)
+	assert.True(t, errors.Cause(err) == sealing.ErrBadSeal)
+
+	err = heal(unsealedManifest, publicKey)
+	assert.True(t, errors.Cause(err) == sealing.ErrNotSealed)
+}
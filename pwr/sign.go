@@ -19,15 +19,58 @@ import (
 type SignatureInfo struct {
 	Container *tlc.Container
 	Hashes    []wsync.BlockHash
+
+	// BlockSize is the size of the blocks Hashes were computed for,
+	// 0 means BlockSize
+	BlockSize int64
+	// StrongHash is the algorithm Hashes' strong hashes were computed with
+	StrongHash StrongHashAlgorithm
+
+	// Chunks are only set for FASTCDC signatures, in addition to Hashes
+	Chunking ChunkingAlgorithm
+	Chunks   []wsync.ChunkHash
+}
+
+// EffectiveBlockSize returns the block size the signature was computed with
+func (si *SignatureInfo) EffectiveBlockSize() int64 {
+	return EffectiveBlockSize(si.BlockSize)
+}
+
+// SignContext holds the settings used to compute signatures
+type SignContext struct {
+	// BlockSize (optional) defaults to BlockSize
+	BlockSize int64
+	// StrongHash (optional) defaults to MD5
+	StrongHash StrongHashAlgorithm
+	Consumer   *state.Consumer
+
+	// Concurrency (optional) specifies the number of workers to hash blocks with.
+	// A 0 value (default) hashes them sequentially. A negative value is added
+	// to the number of cores. Hashes are written in the same order either way.
+	Concurrency int
 }
 
 // ComputeSignature compute the signature of all blocks of all files in a given container,
 // by reading them from disk, relative to `basePath`, and notifying `consumer` of its
 // progress
 func ComputeSignature(ctx context.Context, container *tlc.Container, pool lake.Pool, consumer *state.Consumer) ([]wsync.BlockHash, error) {
+	sc := &SignContext{Consumer: consumer}
+	return sc.ComputeSignature(ctx, container, pool)
+}
+
+// ComputeSignatureToWriter is a variant of ComputeSignature that writes hashes
+// to a callback
+func ComputeSignatureToWriter(ctx context.Context, container *tlc.Container, pool lake.Pool, consumer *state.Consumer, sigWriter wsync.SignatureWriter) error {
+	sc := &SignContext{Consumer: consumer}
+	return sc.ComputeSignatureToWriter(ctx, container, pool, sigWriter)
+}
+
+// ComputeSignature computes the signature of all blocks of all files in a given container,
+// using the context's block size
+func (sc *SignContext) ComputeSignature(ctx context.Context, container *tlc.Container, pool lake.Pool) ([]wsync.BlockHash, error) {
 	var signature []wsync.BlockHash
 
-	err := ComputeSignatureToWriter(ctx, container, pool, consumer, func(bl wsync.BlockHash) error {
+	err := sc.ComputeSignatureToWriter(ctx, container, pool, func(bl wsync.BlockHash) error {
 		signature = append(signature, bl)
 		return nil
 	})
@@ -40,8 +83,9 @@ func ComputeSignature(ctx context.Context, container *tlc.Container, pool lake.P
 
 // ComputeSignatureToWriter is a variant of ComputeSignature that writes hashes
 // to a callback
-func ComputeSignatureToWriter(ctx context.Context, container *tlc.Container, pool lake.Pool, consumer *state.Consumer, sigWriter wsync.SignatureWriter) error {
+func (sc *SignContext) ComputeSignatureToWriter(ctx context.Context, container *tlc.Container, pool lake.Pool, sigWriter wsync.SignatureWriter) error {
 	var err error
+	consumer := sc.Consumer
 
 	defer func() {
 		if pErr := pool.Close(); pErr != nil && err == nil {
@@ -49,7 +93,23 @@ func ComputeSignatureToWriter(ctx context.Context, container *tlc.Container, poo
 		}
 	}()
 
-	sctx := mksync()
+	err = ValidateBlockSize(sc.BlockSize)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if sc.Concurrency != 0 {
+		err = sc.computeSignatureParallel(ctx, container, pool, sigWriter)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return nil
+	}
+
+	sctx, err := mksync(sc.BlockSize, sc.StrongHash)
+	if err != nil {
+		return errors.WithStack(err)
+	}
 
 	totalBytes := container.Size
 	fileOffset := int64(0)
@@ -88,9 +148,130 @@ func ComputeSignatureToWriter(ctx context.Context, container *tlc.Container, poo
 	return nil
 }
 
+// ComputeChunkSignature computes the content-defined chunk hashes of all files
+// in a given container, for use with FASTCDC diffs. Chunks average the
+// context's block size.
+func (sc *SignContext) ComputeChunkSignature(ctx context.Context, container *tlc.Container, pool lake.Pool) (chunks []wsync.ChunkHash, err error) {
+	defer func() {
+		if pErr := pool.Close(); pErr != nil && err == nil {
+			err = errors.WithStack(pErr)
+		}
+	}()
+
+	err = ValidateBlockSize(sc.BlockSize)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	sctx, err := mksync(sc.BlockSize, sc.StrongHash)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	totalBytes := container.Size
+	fileOffset := int64(0)
+
+	onRead := func(count int64) {
+		sc.Consumer.Progress(float64(fileOffset+count) / float64(totalBytes))
+	}
+
+	for fileIndex, f := range container.Files {
+		select {
+		case <-ctx.Done():
+			return nil, werrors.ErrCancelled
+		default:
+			// keep going!
+		}
+
+		sc.Consumer.ProgressLabel(f.Path)
+		fileOffset = f.Offset
+
+		var reader io.Reader
+		reader, err = pool.GetReader(int64(fileIndex))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		cr := counter.NewReaderCallback(onRead, reader)
+		err = sctx.CreateChunkSignature(ctx, int64(fileIndex), cr, func(ch wsync.ChunkHash) error {
+			chunks = append(chunks, ch)
+			return nil
+		})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	return chunks, nil
+}
+
 // ReadSignature reads the hashes from all files of a given container, from a
 // wharf signature file.
 func ReadSignature(ctx context.Context, signatureReader savior.SeekSource) (*SignatureInfo, error) {
+	var hashes []wsync.BlockHash
+	signature, err := readSignature(ctx, signatureReader, func(bh wsync.BlockHash) error {
+		hashes = append(hashes, bh)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	signature.Hashes = hashes
+	return signature, nil
+}
+
+// readSignature reads a wharf signature file, relaying block hashes to
+// onHash instead of keeping them. The returned SignatureInfo has no Hashes.
+func readSignature(ctx context.Context, signatureReader savior.SeekSource, onHash wsync.SignatureWriter) (*SignatureInfo, error) {
+	sr, err := NewSignatureReader(ctx, signatureReader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for {
+		_, hashes, err := sr.NextFile()
+		if err != nil {
+			if errors.Cause(err) == io.EOF {
+				break
+			}
+			return nil, errors.WithStack(err)
+		}
+
+		for _, bh := range hashes {
+			err = onHash(bh)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+	}
+
+	return sr.Info, nil
+}
+
+// A SignatureReader reads a wharf signature file one file at a time, so
+// that only a single file's hashes are held in memory.
+type SignatureReader struct {
+	// Info has everything but Hashes. For FASTCDC signatures, Chunks are
+	// only set once NextFile has returned io.EOF.
+	Info *SignatureInfo
+
+	ctx       context.Context
+	sigWire   *wire.ReadContext
+	blockSize int64
+	hash      *BlockHash
+
+	// index of the next file NextFile returns
+	fileIndex int64
+	// set once the signature is truncated or fully read
+	done bool
+	// set once what follows block hashes has been read
+	finished bool
+}
+
+// NewSignatureReader reads the header and container of a wharf signature
+// file, leaving the hashes for NextFile or FileHashes.
+func NewSignatureReader(ctx context.Context, signatureReader savior.SeekSource) (*SignatureReader, error) {
 	rawSigWire := wire.NewReadContext(signatureReader)
 	err := rawSigWire.ExpectMagic(SignatureMagic)
 	if err != nil {
@@ -103,6 +284,23 @@ func ReadSignature(ctx context.Context, signatureReader savior.SeekSource) (*Sig
 		return nil, errors.WithStack(err)
 	}
 
+	err = ValidateBlockSize(header.BlockSize)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	_, err = NewStrongHasher(header.StrongHash)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	switch header.Chunking {
+	case ChunkingAlgorithm_FIXED_BLOCKS, ChunkingAlgorithm_FASTCDC:
+		// good
+	default:
+		return nil, errors.Errorf("unsupported chunking algorithm %s", header.Chunking)
+	}
+
 	sigWire, err := DecompressWire(rawSigWire, header.Compression)
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -118,75 +316,174 @@ func ReadSignature(ctx context.Context, signatureReader savior.SeekSource) (*Sig
 		}
 	}
 
-	var hashes []wsync.BlockHash
-	hash := &BlockHash{}
+	sr := &SignatureReader{
+		Info: &SignatureInfo{
+			Container:  container,
+			BlockSize:  header.BlockSize,
+			StrongHash: header.StrongHash,
+			Chunking:   header.Chunking,
+		},
+
+		ctx:       ctx,
+		sigWire:   sigWire,
+		blockSize: EffectiveBlockSize(header.BlockSize),
+		hash:      &BlockHash{},
+	}
+	return sr, nil
+}
 
-	for fileIndex, f := range container.Files {
-		select {
-		case <-ctx.Done():
-			return nil, werrors.ErrCancelled
-		default:
-			// keep going!
+// NextFile returns the index and block hashes of the next file, in container
+// order. Like ReadSignature, it returns partial hashes for truncated signatures.
+// It returns io.EOF once there are no files left.
+func (sr *SignatureReader) NextFile() (int64, []wsync.BlockHash, error) {
+	if sr.fileIndex >= int64(len(sr.Info.Container.Files)) {
+		err := sr.finish()
+		if err != nil {
+			return 0, nil, errors.WithStack(err)
 		}
+		return 0, nil, io.EOF
+	}
+
+	select {
+	case <-sr.ctx.Done():
+		return 0, nil, werrors.ErrCancelled
+	default:
+		// keep going!
+	}
 
-		numBlocks := ComputeNumBlocks(f.Size)
-		if numBlocks == 0 {
-			hash.Reset()
-			err = sigWire.ReadMessage(hash)
+	fileIndex := sr.fileIndex
+	sr.fileIndex++
 
-			if err != nil {
-				if errors.Cause(err) == io.EOF {
-					break
-				}
-				return nil, errors.WithStack(err)
+	if sr.done {
+		// truncated signature
+		return fileIndex, nil, nil
+	}
+
+	f := sr.Info.Container.Files[fileIndex]
+	blockSize := sr.blockSize
+	hash := sr.hash
+
+	numBlocks := ComputeNumBlocksWithBlockSize(f.Size, blockSize)
+	if numBlocks == 0 {
+		hash.Reset()
+		err := sr.sigWire.ReadMessage(hash)
+		if err != nil {
+			if errors.Cause(err) == io.EOF {
+				sr.done = true
+				return fileIndex, nil, nil
 			}
+			return 0, nil, errors.WithStack(err)
+		}
 
-			// empty files have a 0-length shortblock for historical reasons.
-			blockHash := wsync.BlockHash{
-				FileIndex:  int64(fileIndex),
-				BlockIndex: 0,
+		// empty files have a 0-length shortblock for historical reasons.
+		blockHash := wsync.BlockHash{
+			FileIndex:  fileIndex,
+			BlockIndex: 0,
 
-				WeakHash:   hash.WeakHash,
-				StrongHash: hash.StrongHash,
+			WeakHash:   hash.WeakHash,
+			StrongHash: hash.StrongHash,
 
-				ShortSize: 0,
+			ShortSize: 0,
+		}
+		return fileIndex, []wsync.BlockHash{blockHash}, nil
+	}
+
+	hashes := make([]wsync.BlockHash, 0, numBlocks)
+	for blockIndex := int64(0); blockIndex < numBlocks; blockIndex++ {
+		hash.Reset()
+		err := sr.sigWire.ReadMessage(hash)
+		if err != nil {
+			if errors.Cause(err) == io.EOF {
+				sr.done = true
+				break
 			}
-			hashes = append(hashes, blockHash)
+			return 0, nil, errors.WithStack(err)
+		}
+
+		// full blocks have a shortSize of 0, for more compact storage
+		shortSize := int32(0)
+		if (blockIndex+1)*blockSize > f.Size {
+			shortSize = int32(f.Size % blockSize)
+		}
+
+		hashes = append(hashes, wsync.BlockHash{
+			FileIndex:  fileIndex,
+			BlockIndex: blockIndex,
+
+			WeakHash:   hash.WeakHash,
+			StrongHash: hash.StrongHash,
+
+			ShortSize: shortSize,
+		})
+	}
+
+	return fileIndex, hashes, nil
+}
+
+// FileHashes skips to the given file and returns its block hashes.
+// Files must be asked for in increasing order.
+func (sr *SignatureReader) FileHashes(fileIndex int64) ([]wsync.BlockHash, error) {
+	if fileIndex < sr.fileIndex {
+		return nil, errors.Errorf("signature reader: asked for file %d, but already past file %d", fileIndex, sr.fileIndex-1)
+	}
+
+	for {
+		index, hashes, err := sr.NextFile()
+		if err != nil {
+			return nil, errors.WithStack(err)
 		}
 
-		for blockIndex := int64(0); blockIndex < numBlocks; blockIndex++ {
-			hash.Reset()
-			err = sigWire.ReadMessage(hash)
+		if index == fileIndex {
+			return hashes, nil
+		}
+	}
+}
 
+// finish reads whatever follows the block hashes, once
+func (sr *SignatureReader) finish() error {
+	if sr.finished {
+		return nil
+	}
+	sr.finished = true
+
+	if sr.Info.Chunking == ChunkingAlgorithm_FASTCDC {
+		chunks, err := readChunks(sr.sigWire, sr.Info.Container)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		sr.Info.Chunks = chunks
+	}
+	return nil
+}
+
+// readChunks reads the chunk hashes that follow the block hashes
+// in FASTCDC signatures
+func readChunks(sigWire *wire.ReadContext, container *tlc.Container) ([]wsync.ChunkHash, error) {
+	var chunks []wsync.ChunkHash
+	chunkHash := &ChunkHash{}
+
+	for fileIndex, f := range container.Files {
+		offset := int64(0)
+		for offset < f.Size {
+			chunkHash.Reset()
+			err := sigWire.ReadMessage(chunkHash)
 			if err != nil {
-				if errors.Cause(err) == io.EOF {
-					break
-				}
 				return nil, errors.WithStack(err)
 			}
 
-			// full blocks have a shortSize of 0, for more compact storage
-			shortSize := int32(0)
-			if (blockIndex+1)*BlockSize > f.Size {
-				shortSize = int32(f.Size % BlockSize)
+			if chunkHash.Size <= 0 || offset+chunkHash.Size > f.Size {
+				return nil, errors.Errorf("invalid %d-byte chunk at %d in %s (%d bytes)", chunkHash.Size, offset, f.Path, f.Size)
 			}
 
-			blockHash := wsync.BlockHash{
+			chunks = append(chunks, wsync.ChunkHash{
 				FileIndex:  int64(fileIndex),
-				BlockIndex: blockIndex,
-
-				WeakHash:   hash.WeakHash,
-				StrongHash: hash.StrongHash,
-
-				ShortSize: shortSize,
-			}
-			hashes = append(hashes, blockHash)
+				Offset:     offset,
+				Size:       chunkHash.Size,
+				StrongHash: chunkHash.StrongHash,
+			})
+			offset += chunkHash.Size
 		}
 	}
 
-	signature := &SignatureInfo{
-		Container: container,
-		Hashes:    hashes,
-	}
-	return signature, nil
+	return chunks, nil
 }
@@ -0,0 +1,212 @@
+package pwr
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/itchio/headway/counter"
+	"github.com/itchio/lake"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/werrors"
+	"github.com/itchio/wharf/wsync"
+	"github.com/pkg/errors"
+)
+
+type signJob struct {
+	hash wsync.BlockHash
+	data []byte
+	// closed once hash is complete
+	done chan struct{}
+}
+
+// computeSignatureParallel reads blocks in order from a single goroutine,
+// hashes them on a pool of workers, and writes their hashes in the
+// same order as ComputeSignatureToWriter would.
+func (sc *SignContext) computeSignatureParallel(parentCtx context.Context, container *tlc.Container, pool lake.Pool, sigWriter wsync.SignatureWriter) error {
+	numWorkers := sc.Concurrency
+	if numWorkers < 1 {
+		numWorkers += runtime.NumCPU()
+	}
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+
+	blockSize := EffectiveBlockSize(sc.BlockSize)
+
+	// every worker gets its own hasher
+	var contexts []*wsync.Context
+	for i := 0; i < numWorkers; i++ {
+		sctx, err := mksync(sc.BlockSize, sc.StrongHash)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		contexts = append(contexts, sctx)
+	}
+
+	// stop everyone as soon as one task fails
+	ctx, cancel := context.WithCancel(parentCtx)
+	defer cancel()
+
+	cancelled := func() error {
+		if parentCtx.Err() != nil {
+			return werrors.ErrCancelled
+		}
+		return errors.WithStack(ctx.Err())
+	}
+
+	// buffers bound the number of blocks in flight
+	numBuffers := numWorkers * 4
+	buffers := make(chan []byte, numBuffers)
+	for i := 0; i < numBuffers; i++ {
+		buffers <- make([]byte, blockSize)
+	}
+
+	jobs := make(chan *signJob, numBuffers)
+	ordered := make(chan *signJob, numBuffers)
+
+	consumer := sc.Consumer
+	totalBytes := container.Size
+	fileOffset := int64(0)
+
+	onRead := func(count int64) {
+		consumer.Progress(float64(fileOffset+count) / float64(totalBytes))
+	}
+
+	read := func() error {
+		defer close(jobs)
+		defer close(ordered)
+
+		for fileIndex, f := range container.Files {
+			consumer.ProgressLabel(f.Path)
+			fileOffset = f.Offset
+
+			reader, err := pool.GetReader(int64(fileIndex))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			cr := counter.NewReaderCallback(onRead, reader)
+
+			for blockIndex := int64(0); ; blockIndex++ {
+				var buf []byte
+				select {
+				case buf = <-buffers:
+				case <-ctx.Done():
+					return cancelled()
+				}
+
+				last := false
+				n, err := io.ReadFull(cr, buf)
+				if err != nil {
+					if errors.Cause(err) != io.EOF && errors.Cause(err) != io.ErrUnexpectedEOF {
+						return errors.WithStack(err)
+					}
+					last = true
+				}
+
+				if n == 0 && blockIndex > 0 {
+					// the previous block was the last one
+					buffers <- buf
+					break
+				}
+
+				// empty files have a 0-length shortblock, like
+				// in CreateSignature
+				job := &signJob{
+					hash: wsync.BlockHash{
+						FileIndex:  int64(fileIndex),
+						BlockIndex: blockIndex,
+					},
+					data: buf[:n],
+					done: make(chan struct{}),
+				}
+
+				select {
+				case jobs <- job:
+				case <-ctx.Done():
+					return cancelled()
+				}
+
+				select {
+				case ordered <- job:
+				case <-ctx.Done():
+					return cancelled()
+				}
+
+				if last {
+					break
+				}
+			}
+		}
+
+		return nil
+	}
+
+	work := func(sctx *wsync.Context) error {
+		for job := range jobs {
+			job.hash.WeakHash, job.hash.StrongHash = sctx.HashBlock(job.data)
+			if int64(len(job.data)) < blockSize {
+				job.hash.ShortSize = int32(len(job.data))
+			}
+
+			buffers <- job.data[:blockSize]
+			close(job.done)
+		}
+		return nil
+	}
+
+	write := func() error {
+		for job := range ordered {
+			select {
+			case <-job.done:
+			case <-ctx.Done():
+				return cancelled()
+			}
+
+			err := sigWriter(job.hash)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		return nil
+	}
+
+	// unlike taskgroup.Do, wait for every task to return, even after one
+	// of them failed: the caller closes pool as soon as we return.
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+
+	run := func(task func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := task()
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+
+	run(read)
+	run(write)
+	for _, sctx := range contexts {
+		sctx := sctx
+		run(func() error {
+			return work(sctx)
+		})
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return errors.WithStack(firstErr)
+	}
+	if parentCtx.Err() != nil {
+		return werrors.ErrCancelled
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package pwr
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/werrors"
+	"github.com/itchio/wharf/wsync"
+	"github.com/itchio/wharf/wtest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParallelSignature(t *testing.T) {
+	dir, err := os.MkdirTemp("", "parallelsig")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	wtest.MakeTestDir(t, dir, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "big", Seed: 0x1, Size: BlockSize*40 + 14},
+			{Path: "aligned", Seed: 0x2, Size: BlockSize * 3},
+			{Path: "empty", Data: []byte{}},
+			{Path: "small", Seed: 0x3, Size: 17},
+			{Path: "subdir/other", Seed: 0x4, Size: BlockSize*2 + 1},
+		},
+	})
+
+	container, err := tlc.WalkAny(dir, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	sign := func(sc *SignContext) []wsync.BlockHash {
+		hashes, err := sc.ComputeSignature(context.Background(), container, fspool.New(container, dir))
+		wtest.Must(t, err)
+		return hashes
+	}
+
+	for _, blockSize := range []int64{0, 8 * 1024} {
+		reference := sign(&SignContext{BlockSize: blockSize, Consumer: &state.Consumer{}})
+
+		for _, concurrency := range []int{1, 3, 16, -1} {
+			t.Logf("Signing with block size %d, concurrency %d", blockSize, concurrency)
+			hashes := sign(&SignContext{
+				BlockSize:   blockSize,
+				Consumer:    &state.Consumer{},
+				Concurrency: concurrency,
+			})
+			assert.Equal(t, reference, hashes)
+		}
+	}
+
+	t.Logf("Stopping on writer errors")
+	sc := &SignContext{Consumer: &state.Consumer{}, Concurrency: 4}
+	numWritten := 0
+	err = sc.ComputeSignatureToWriter(context.Background(), container, fspool.New(container, dir), func(bh wsync.BlockHash) error {
+		numWritten++
+		if numWritten == 5 {
+			return errors.New("writer failed")
+		}
+		return nil
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 5, numWritten)
+
+	t.Logf("Stopping when cancelled")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = sc.ComputeSignature(ctx, container, fspool.New(container, dir))
+	assert.Equal(t, werrors.ErrCancelled, errors.Cause(err))
+	_, err = sc.ComputeChunkSignature(ctx, container, fspool.New(container, dir))
+	assert.Equal(t, werrors.ErrCancelled, errors.Cause(err))
+}
+
+func Test_SignatureReader(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sigreader")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	v1, _, container, _ := makeDiffTestDirs(t, dir)
+
+	// diffing against an empty container gives us v1's signature file
+	sigBuffer := new(bytes.Buffer)
+	sigDctx := &DiffContext{
+		Compression: &CompressionSettings{
+			Algorithm: CompressionAlgorithm_NONE,
+		},
+		Consumer: &state.Consumer{},
+
+		SourceContainer: container,
+		Pool:            fspool.New(container, v1),
+
+		TargetContainer: &tlc.Container{},
+	}
+	wtest.Must(t, sigDctx.WritePatch(context.Background(), new(bytes.Buffer), sigBuffer))
+
+	openReader := func() *SignatureReader {
+		source := seeksource.FromBytes(sigBuffer.Bytes())
+		_, err := source.Resume(nil)
+		wtest.Must(t, err)
+		sr, err := NewSignatureReader(context.Background(), source)
+		wtest.Must(t, err)
+		return sr
+	}
+
+	expected, err := ComputeSignature(context.Background(), container, fspool.New(container, v1), &state.Consumer{})
+	wtest.Must(t, err)
+
+	sr := openReader()
+	assert.Equal(t, len(container.Files), len(sr.Info.Container.Files))
+	var hashes []wsync.BlockHash
+	for expectedIndex := int64(0); ; expectedIndex++ {
+		fileIndex, fileHashes, err := sr.NextFile()
+		if errors.Cause(err) == io.EOF {
+			assert.EqualValues(t, len(container.Files), expectedIndex)
+			break
+		}
+		wtest.Must(t, err)
+		assert.Equal(t, expectedIndex, fileIndex)
+		hashes = append(hashes, fileHashes...)
+	}
+	assert.Equal(t, expected, hashes)
+
+	t.Logf("Skipping to files")
+	sr = openReader()
+	last := int64(len(container.Files) - 1)
+	lastHashes, err := sr.FileHashes(last)
+	wtest.Must(t, err)
+	assert.NotEmpty(t, lastHashes)
+	for _, bh := range lastHashes {
+		assert.Equal(t, last, bh.FileIndex)
+	}
+	_, err = sr.FileHashes(0)
+	assert.Error(t, err)
+
+	t.Logf("Validating while streaming")
+	vctx := &ValidatorContext{FailFast: true, Consumer: &state.Consumer{}}
+	wtest.Must(t, vctx.ValidateStream(context.Background(), v1, openReader()))
+
+	// corrupt a block in the middle of the build
+	f, err := os.OpenFile(filepath.Join(v1, "big"), os.O_WRONLY, 0)
+	wtest.Must(t, err)
+	_, err = f.WriteAt([]byte{0x42, 0x42}, BlockSize*5+3)
+	wtest.Must(t, err)
+	wtest.Must(t, f.Close())
+
+	vctx = &ValidatorContext{FailFast: true, Consumer: &state.Consumer{}}
+	assert.Error(t, vctx.ValidateStream(context.Background(), v1, openReader()))
+}
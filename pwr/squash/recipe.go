@@ -0,0 +1,135 @@
+package squash
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+type segmentKind int
+
+const (
+	// fresh data, kept in the store
+	segmentFresh segmentKind = iota
+	// bytes copied as-is from a file of the old build
+	segmentRef
+	// bytes from a file of the old build, with bsdiff add data
+	// (kept in the store) added to them
+	segmentAdd
+)
+
+// A segment is a contiguous part of a file, and where it comes from
+type segment struct {
+	kind segmentKind
+	size int64
+
+	// file of the old build and offset into it, for ref and add segments
+	fileIndex int64
+	offset    int64
+
+	// offset into the store, for fresh and add segments
+	storeOffset int64
+}
+
+// trim returns the [start, start+size) part of a segment
+func (s segment) trim(start int64, size int64) segment {
+	res := s
+	res.size = size
+	if s.kind == segmentRef || s.kind == segmentAdd {
+		res.offset += start
+	}
+	if s.kind == segmentFresh || s.kind == segmentAdd {
+		res.storeOffset += start
+	}
+	return res
+}
+
+// follows returns true if s picks up exactly where prev left off,
+// in which case both can be merged into a single segment
+func (s segment) follows(prev segment) bool {
+	if s.kind != prev.kind {
+		return false
+	}
+
+	if s.kind == segmentRef || s.kind == segmentAdd {
+		if s.fileIndex != prev.fileIndex || s.offset != prev.offset+prev.size {
+			return false
+		}
+	}
+
+	if s.kind == segmentFresh || s.kind == segmentAdd {
+		if s.storeOffset != prev.storeOffset+prev.size {
+			return false
+		}
+	}
+
+	return true
+}
+
+// A recipe describes how to build a file of a new build, as a list
+// of segments referring to an old build.
+type recipe struct {
+	segments []segment
+	// starts holds the offset at which each segment starts in the new file
+	starts []int64
+	size   int64
+}
+
+func (r *recipe) append(s segment) {
+	if s.size == 0 {
+		return
+	}
+
+	if n := len(r.segments); n > 0 && s.follows(r.segments[n-1]) {
+		r.segments[n-1].size += s.size
+		r.size += s.size
+		return
+	}
+
+	r.segments = append(r.segments, s)
+	r.starts = append(r.starts, r.size)
+	r.size += s.size
+}
+
+// slice calls onSegment with the segments that make up
+// the [offset, offset+size) part of the file, in order.
+func (r *recipe) slice(offset int64, size int64, onSegment func(s segment) error) error {
+	if offset < 0 || size < 0 || offset+size > r.size {
+		return errors.Errorf("corrupted patch: reading [%d, %d) from a %d-byte file", offset, offset+size, r.size)
+	}
+
+	// find the last segment that starts at or before offset
+	i := sort.Search(len(r.starts), func(i int) bool {
+		return r.starts[i] > offset
+	}) - 1
+
+	end := offset + size
+	for ; size > 0 && offset < end; i++ {
+		s := r.segments[i]
+		start := offset - r.starts[i]
+		pieceSize := s.size - start
+		if pieceSize > end-offset {
+			pieceSize = end - offset
+		}
+
+		err := onSegment(s.trim(start, pieceSize))
+		if err != nil {
+			return err
+		}
+		offset += pieceSize
+	}
+
+	return nil
+}
+
+// bytesPerFile returns how many bytes of the recipe come
+// from each file of the old build.
+func (r *recipe) bytesPerFile() map[int64]int64 {
+	res := make(map[int64]int64)
+	for _, s := range r.segments {
+		if s.kind == segmentRef || s.kind == segmentAdd {
+			res[s.fileIndex] += s.size
+		}
+	}
+	return res
+}
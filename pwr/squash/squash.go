@@ -0,0 +1,856 @@
+// Package squash combines consecutive wharf patches (A to B, B to C, etc.)
+// into a single patch (A to C) that only refers to the oldest build.
+package squash
+
+import (
+	"fmt"
+	"io"
+
+	validation "github.com/go-ozzo/ozzo-validation"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior"
+	"github.com/itchio/wharf/bsdiff"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/wire"
+	"github.com/itchio/wharf/wsync"
+	"github.com/pkg/errors"
+)
+
+// ErrNeedTargetPool is returned when a file of the squashed patch can't
+// be expressed in terms of the oldest build's blocks alone, and no
+// TargetPool was given to read the missing data from.
+var ErrNeedTargetPool = errors.New("squash: some files need data from the oldest build, but no TargetPool was given")
+
+// the largest chunk of data we hold in memory at once
+const maxChunkSize = 1024 * 1024 // 1MiB
+
+// Params describes a squash operation
+type Params struct {
+	// Patches must be consecutive: the first one goes from build A to build B,
+	// the second one from build B to build C, and so on. At least two are needed.
+	Patches []savior.SeekSource
+
+	// PatchWriter receives the squashed patch, which goes from the first
+	// patch's old build to the last patch's new build.
+	PatchWriter io.Writer
+
+	// TargetPool (optional) gives access to the oldest build. Files that are
+	// made of unaligned parts of several old files can't be expressed with
+	// rsync operations or a single bsdiff series, so their data is read from it.
+	// If it's needed but missing, Do returns ErrNeedTargetPool.
+	TargetPool lake.Pool
+
+	// optional, defaults to the last patch's compression settings
+	Compression *pwr.CompressionSettings
+	// optional
+	Consumer *state.Consumer
+}
+
+type squasher struct {
+	params Params
+	store  *store
+
+	// the oldest build
+	targetContainer *tlc.Container
+
+	// block size of the squashed patch's rsync operations
+	blockSize int64
+}
+
+// A parsedPatch holds the recipes for all files of a patch's new build
+type parsedPatch struct {
+	header          *pwr.PatchHeader
+	targetContainer *tlc.Container
+	sourceContainer *tlc.Container
+	recipes         []*recipe
+}
+
+// Do squashes all patches and writes the result to params.PatchWriter
+func Do(params Params) (err error) {
+	err = validation.ValidateStruct(&params,
+		validation.Field(&params.Patches, validation.Required, validation.Length(2, 0)),
+		validation.Field(&params.PatchWriter, validation.Required),
+	)
+	if err != nil {
+		return err
+	}
+
+	if params.TargetPool != nil {
+		defer func() {
+			if cErr := params.TargetPool.Close(); cErr != nil && err == nil {
+				err = errors.WithStack(cErr)
+			}
+		}()
+	}
+
+	st, err := newStore()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if cErr := st.close(); cErr != nil && err == nil {
+			err = errors.WithStack(cErr)
+		}
+	}()
+
+	sq := &squasher{
+		params: params,
+		store:  st,
+	}
+	return sq.do()
+}
+
+func (sq *squasher) do() error {
+	consumer := sq.params.Consumer
+
+	var squashed *parsedPatch
+	for i, patchReader := range sq.params.Patches {
+		consumer.Infof("Reading patch %d/%d", i+1, len(sq.params.Patches))
+
+		patch, err := sq.readPatch(patchReader)
+		if err != nil {
+			return errors.Wrapf(err, "while reading patch %d", i+1)
+		}
+
+		if squashed == nil {
+			squashed = patch
+			sq.targetContainer = patch.targetContainer
+			continue
+		}
+
+		err = squashed.sourceContainer.EnsureEqual(patch.targetContainer)
+		if err != nil {
+			return errors.Wrapf(err, "patch %d doesn't apply to the output of patch %d", i+1, i)
+		}
+
+		for fileIndex, r := range patch.recipes {
+			consumer.ProgressLabel(patch.sourceContainer.Files[fileIndex].Path)
+
+			patch.recipes[fileIndex], err = sq.compose(squashed.recipes, r)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		squashed = &parsedPatch{
+			header:          patch.header,
+			targetContainer: squashed.targetContainer,
+			sourceContainer: patch.sourceContainer,
+			recipes:         patch.recipes,
+		}
+	}
+
+	return sq.writePatch(squashed)
+}
+
+// readPatch turns every file of a patch into a recipe
+func (sq *squasher) readPatch(patchReader savior.SeekSource) (*parsedPatch, error) {
+	_, err := patchReader.Resume(nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	rctx := wire.NewReadContext(patchReader)
+	err = rctx.ExpectMagic(pwr.PatchMagic)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	header := &pwr.PatchHeader{}
+	err = rctx.ReadMessage(header)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = pwr.ValidateBlockSize(header.BlockSize)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	rctx, err = pwr.DecompressWire(rctx, header.Compression)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	targetContainer := &tlc.Container{}
+	err = rctx.ReadMessage(targetContainer)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	sourceContainer := &tlc.Container{}
+	err = rctx.ReadMessage(sourceContainer)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	patch := &parsedPatch{
+		header:          header,
+		targetContainer: targetContainer,
+		sourceContainer: sourceContainer,
+	}
+
+	sh := &pwr.SyncHeader{}
+	for fileIndex, f := range sourceContainer.Files {
+		sh.Reset()
+		err = rctx.ReadMessage(sh)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		if sh.FileIndex != int64(fileIndex) {
+			return nil, errors.Errorf("corrupted patch: expected file %d, got file %d", fileIndex, sh.FileIndex)
+		}
+
+		var r *recipe
+		switch sh.Type {
+		case pwr.SyncHeader_RSYNC:
+			r, err = sq.readRsync(rctx, targetContainer, pwr.EffectiveBlockSize(header.BlockSize))
+		case pwr.SyncHeader_BSDIFF:
+			r, err = sq.readBsdiff(rctx, targetContainer)
+		default:
+			err = errors.Errorf("unknown patch series kind %d", sh.Type)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "while reading %s", f.Path)
+		}
+
+		if r.size != f.Size {
+			return nil, errors.Errorf("corrupted patch: %s should be %d bytes, but patch produces %d bytes", f.Path, f.Size, r.size)
+		}
+		patch.recipes = append(patch.recipes, r)
+	}
+
+	return patch, nil
+}
+
+func (sq *squasher) readRsync(rctx *wire.ReadContext, targetContainer *tlc.Container, blockSize int64) (*recipe, error) {
+	r := &recipe{}
+	op := &pwr.SyncOp{}
+
+	for {
+		op.Reset()
+		err := rctx.ReadMessage(op)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		switch op.Type {
+		case pwr.SyncOp_BLOCK_RANGE:
+			if op.FileIndex < 0 || op.FileIndex >= int64(len(targetContainer.Files)) {
+				return nil, errors.Errorf("corrupted patch: block range refers to file %d", op.FileIndex)
+			}
+
+			fileSize := targetContainer.Files[op.FileIndex].Size
+			start := op.BlockIndex * blockSize
+			end := (op.BlockIndex + op.BlockSpan) * blockSize
+			if end > fileSize {
+				end = fileSize
+			}
+			if start < 0 || start >= end {
+				return nil, errors.Errorf("corrupted patch: invalid block range %d+%d for a %d-byte file", op.BlockIndex, op.BlockSpan, fileSize)
+			}
+
+			r.append(segment{
+				kind:      segmentRef,
+				size:      end - start,
+				fileIndex: op.FileIndex,
+				offset:    start,
+			})
+
+		case pwr.SyncOp_BYTE_RANGE:
+			if op.FileIndex < 0 || op.FileIndex >= int64(len(targetContainer.Files)) {
+				return nil, errors.Errorf("corrupted patch: byte range refers to file %d", op.FileIndex)
+			}
+
+			fileSize := targetContainer.Files[op.FileIndex].Size
+			if op.Offset < 0 || op.Size <= 0 || op.Offset+op.Size > fileSize {
+				return nil, errors.Errorf("corrupted patch: invalid byte range %d+%d for a %d-byte file", op.Offset, op.Size, fileSize)
+			}
+
+			r.append(segment{
+				kind:      segmentRef,
+				size:      op.Size,
+				fileIndex: op.FileIndex,
+				offset:    op.Offset,
+			})
+
+		case pwr.SyncOp_DATA:
+			storeOffset, err := sq.store.append(op.Data)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+
+			r.append(segment{
+				kind:        segmentFresh,
+				size:        int64(len(op.Data)),
+				storeOffset: storeOffset,
+			})
+
+		case pwr.SyncOp_HEY_YOU_DID_IT:
+			return r, nil
+
+		default:
+			return nil, errors.Errorf("unknown sync op type %s", op.Type)
+		}
+	}
+}
+
+func (sq *squasher) readBsdiff(rctx *wire.ReadContext, targetContainer *tlc.Container) (*recipe, error) {
+	r := &recipe{}
+
+	bh := &pwr.BsdiffHeader{}
+	err := rctx.ReadMessage(bh)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	targetIndex := bh.TargetIndex
+	if targetIndex < 0 || targetIndex >= int64(len(targetContainer.Files)) {
+		return nil, errors.Errorf("corrupted patch: bsdiff series refers to file %d", targetIndex)
+	}
+	targetSize := targetContainer.Files[targetIndex].Size
+
+	var oldOffset int64
+	ctrl := &bsdiff.Control{}
+
+	for {
+		ctrl.Reset()
+		err = rctx.ReadMessage(ctrl)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		if ctrl.Eof {
+			break
+		}
+
+		if len(ctrl.Add) > 0 {
+			addSize := int64(len(ctrl.Add))
+			if oldOffset < 0 || oldOffset+addSize > targetSize {
+				return nil, errors.Errorf("corrupted patch: bsdiff add reads [%d, %d) from a %d-byte file", oldOffset, oldOffset+addSize, targetSize)
+			}
+
+			s := segment{
+				kind:      segmentRef,
+				size:      addSize,
+				fileIndex: targetIndex,
+				offset:    oldOffset,
+			}
+
+			if !isZero(ctrl.Add) {
+				s.kind = segmentAdd
+				s.storeOffset, err = sq.store.append(ctrl.Add)
+				if err != nil {
+					return nil, errors.WithStack(err)
+				}
+			}
+
+			r.append(s)
+			oldOffset += addSize
+		}
+
+		if len(ctrl.Copy) > 0 {
+			storeOffset, err := sq.store.append(ctrl.Copy)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+
+			r.append(segment{
+				kind:        segmentFresh,
+				size:        int64(len(ctrl.Copy)),
+				storeOffset: storeOffset,
+			})
+		}
+
+		oldOffset += ctrl.Seek
+	}
+
+	op := &pwr.SyncOp{}
+	err = rctx.ReadMessage(op)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if op.Type != pwr.SyncOp_HEY_YOU_DID_IT {
+		return nil, errors.Errorf("corrupted patch: expected sentinel SyncOp after bsdiff series, got %s", op.Type)
+	}
+
+	return r, nil
+}
+
+// compose takes a recipe that refers to a middle build, and the recipes for
+// all files of the middle build, and returns a recipe that refers to the
+// old build instead.
+func (sq *squasher) compose(middle []*recipe, r *recipe) (*recipe, error) {
+	res := &recipe{}
+
+	for _, s := range r.segments {
+		switch s.kind {
+		case segmentFresh:
+			res.append(s)
+
+		case segmentRef:
+			if s.fileIndex >= int64(len(middle)) {
+				return nil, errors.Errorf("corrupted patch: refers to file %d", s.fileIndex)
+			}
+
+			err := middle[s.fileIndex].slice(s.offset, s.size, func(piece segment) error {
+				res.append(piece)
+				return nil
+			})
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+
+		case segmentAdd:
+			if s.fileIndex >= int64(len(middle)) {
+				return nil, errors.Errorf("corrupted patch: refers to file %d", s.fileIndex)
+			}
+
+			// where we are in s's add data
+			addOffset := s.storeOffset
+
+			err := middle[s.fileIndex].slice(s.offset, s.size, func(piece segment) error {
+				defer func() {
+					addOffset += piece.size
+				}()
+
+				switch piece.kind {
+				case segmentRef:
+					// the old data doesn't change, so the add data can be reused as-is
+					res.append(segment{
+						kind:        segmentAdd,
+						size:        piece.size,
+						fileIndex:   piece.fileIndex,
+						offset:      piece.offset,
+						storeOffset: addOffset,
+					})
+					return nil
+
+				case segmentFresh:
+					// adding to fresh data gives fresh data
+					storeOffset, _, err := sq.addData(piece.storeOffset, addOffset, piece.size)
+					if err != nil {
+						return err
+					}
+
+					res.append(segment{
+						kind:        segmentFresh,
+						size:        piece.size,
+						storeOffset: storeOffset,
+					})
+					return nil
+
+				case segmentAdd:
+					// adding twice to old data is the same as adding the sum once
+					storeOffset, zero, err := sq.addData(piece.storeOffset, addOffset, piece.size)
+					if err != nil {
+						return err
+					}
+
+					kind := segmentAdd
+					if zero {
+						kind = segmentRef
+					}
+
+					res.append(segment{
+						kind:        kind,
+						size:        piece.size,
+						fileIndex:   piece.fileIndex,
+						offset:      piece.offset,
+						storeOffset: storeOffset,
+					})
+					return nil
+				}
+
+				return errors.Errorf("unknown segment kind %d", piece.kind)
+			})
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// addData adds two regions of the store bytewise, appends the result
+// to the store, and returns its offset, along with whether it's all zeroes.
+func (sq *squasher) addData(offsetA int64, offsetB int64, size int64) (int64, bool, error) {
+	bufA := make([]byte, chunkSize(size))
+	bufB := make([]byte, chunkSize(size))
+
+	var resOffset int64 = -1
+	zero := true
+
+	for done := int64(0); done < size; {
+		n := chunkSize(size - done)
+		a := bufA[:n]
+		b := bufB[:n]
+
+		err := sq.store.read(offsetA+done, a)
+		if err != nil {
+			return 0, false, err
+		}
+
+		err = sq.store.read(offsetB+done, b)
+		if err != nil {
+			return 0, false, err
+		}
+
+		for i := range a {
+			a[i] += b[i]
+		}
+		zero = zero && isZero(a)
+
+		// appends are contiguous, so the result is a single region
+		offset, err := sq.store.append(a)
+		if err != nil {
+			return 0, false, err
+		}
+		if resOffset == -1 {
+			resOffset = offset
+		}
+
+		done += n
+	}
+
+	return resOffset, zero, nil
+}
+
+func (sq *squasher) writePatch(squashed *parsedPatch) (err error) {
+	consumer := sq.params.Consumer
+
+	compression := sq.params.Compression
+	if compression == nil {
+		compression = squashed.header.Compression
+	}
+
+	// patches are read in terms of bytes, so any block size works for the
+	// output. use the same as the newest patch, like for compression.
+	sq.blockSize = pwr.EffectiveBlockSize(squashed.header.BlockSize)
+
+	rawWire := wire.NewWriteContext(sq.params.PatchWriter)
+	err = rawWire.WriteMagic(pwr.PatchMagic)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = rawWire.WriteMessage(&pwr.PatchHeader{
+		Compression: compression,
+		BlockSize:   squashed.header.BlockSize,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	wctx, err := pwr.CompressWire(rawWire, compression)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = wctx.WriteMessage(squashed.targetContainer)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = wctx.WriteMessage(squashed.sourceContainer)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var doneSize int64
+	totalSize := squashed.sourceContainer.Size
+
+	for fileIndex, r := range squashed.recipes {
+		f := squashed.sourceContainer.Files[fileIndex]
+		consumer.ProgressLabel(f.Path)
+
+		err = sq.writeFile(wctx, int64(fileIndex), r)
+		if err != nil {
+			return errors.Wrapf(err, "while writing %s", f.Path)
+		}
+
+		doneSize += f.Size
+		if totalSize > 0 {
+			consumer.Progress(float64(doneSize) / float64(totalSize))
+		}
+	}
+
+	err = wctx.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (sq *squasher) writeFile(wctx *wire.WriteContext, fileIndex int64, r *recipe) error {
+	if sq.isRsyncable(r) {
+		return sq.writeRsync(wctx, fileIndex, r)
+	}
+
+	// bsdiff series are applied against a single old file, pick the one
+	// we use the most
+	bytesPerFile := r.bytesPerFile()
+
+	var targetIndex int64 = -1
+	var targetBytes int64
+	for index, numBytes := range bytesPerFile {
+		if numBytes > targetBytes || (numBytes == targetBytes && index < targetIndex) {
+			targetIndex = index
+			targetBytes = numBytes
+		}
+	}
+
+	// data from other old files has to be read from the oldest build
+	if len(bytesPerFile) > 1 && sq.params.TargetPool == nil {
+		return errors.WithStack(ErrNeedTargetPool)
+	}
+
+	return sq.writeBsdiff(wctx, fileIndex, targetIndex, r)
+}
+
+// isRsyncable returns true if a recipe only uses fresh data and whole
+// blocks of the old build, ie. if it can be expressed as rsync operations
+func (sq *squasher) isRsyncable(r *recipe) bool {
+	for _, s := range r.segments {
+		switch s.kind {
+		case segmentFresh:
+			// fine
+		case segmentRef:
+			if s.offset%sq.blockSize != 0 {
+				return false
+			}
+
+			fileSize := sq.targetContainer.Files[s.fileIndex].Size
+			if s.size%sq.blockSize != 0 && s.offset+s.size != fileSize {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (sq *squasher) writeRsync(wctx *wire.WriteContext, fileIndex int64, r *recipe) error {
+	err := wctx.WriteMessage(&pwr.SyncHeader{
+		Type:      pwr.SyncHeader_RSYNC,
+		FileIndex: fileIndex,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	op := &pwr.SyncOp{}
+
+	if len(r.segments) == 0 {
+		// the patcher expects at least one op before the end marker
+		op.Type = pwr.SyncOp_DATA
+		err = wctx.WriteMessage(op)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	for _, s := range r.segments {
+		switch s.kind {
+		case segmentRef:
+			op.Reset()
+			op.Type = pwr.SyncOp_BLOCK_RANGE
+			op.FileIndex = s.fileIndex
+			op.BlockIndex = s.offset / sq.blockSize
+			op.BlockSpan = (s.size + sq.blockSize - 1) / sq.blockSize
+			err = wctx.WriteMessage(op)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+		case segmentFresh:
+			for done := int64(0); done < s.size; {
+				data := make([]byte, min(s.size-done, wsync.MaxDataOp))
+				err = sq.store.read(s.storeOffset+done, data)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+
+				op.Reset()
+				op.Type = pwr.SyncOp_DATA
+				op.Data = data
+				err = wctx.WriteMessage(op)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				done += int64(len(data))
+			}
+		}
+	}
+
+	op.Reset()
+	op.Type = pwr.SyncOp_HEY_YOU_DID_IT
+	err = wctx.WriteMessage(op)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (sq *squasher) writeBsdiff(wctx *wire.WriteContext, fileIndex int64, targetIndex int64, r *recipe) error {
+	err := wctx.WriteMessage(&pwr.SyncHeader{
+		Type:      pwr.SyncHeader_BSDIFF,
+		FileIndex: fileIndex,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = wctx.WriteMessage(&pwr.BsdiffHeader{
+		TargetIndex: targetIndex,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// controls are only written once we know they won't need a seek
+	var pending *bsdiff.Control
+	emit := func(ctrl *bsdiff.Control) error {
+		if pending != nil {
+			err := wctx.WriteMessage(pending)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		pending = ctrl
+		return nil
+	}
+
+	var oldOffset int64
+
+	for _, s := range r.segments {
+		if s.kind != segmentFresh && s.fileIndex == targetIndex {
+			if oldOffset != s.offset {
+				seek := s.offset - oldOffset
+				if pending != nil {
+					pending.Seek += seek
+				} else {
+					err = emit(&bsdiff.Control{Seek: seek})
+					if err != nil {
+						return err
+					}
+				}
+				oldOffset = s.offset
+			}
+
+			for done := int64(0); done < s.size; {
+				add := make([]byte, chunkSize(s.size-done))
+				if s.kind == segmentAdd {
+					err = sq.store.read(s.storeOffset+done, add)
+					if err != nil {
+						return errors.WithStack(err)
+					}
+				}
+
+				err = emit(&bsdiff.Control{Add: add})
+				if err != nil {
+					return err
+				}
+				done += int64(len(add))
+				oldOffset += int64(len(add))
+			}
+			continue
+		}
+
+		for done := int64(0); done < s.size; {
+			data := make([]byte, chunkSize(s.size-done))
+			err = sq.readSegment(s.trim(done, int64(len(data))), data)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			err = emit(&bsdiff.Control{Copy: data})
+			if err != nil {
+				return err
+			}
+			done += int64(len(data))
+		}
+	}
+
+	err = emit(&bsdiff.Control{Eof: true})
+	if err != nil {
+		return err
+	}
+
+	// write the eof control
+	err = emit(nil)
+	if err != nil {
+		return err
+	}
+
+	err = wctx.WriteMessage(&pwr.SyncOp{
+		Type: pwr.SyncOp_HEY_YOU_DID_IT,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// readSegment reads the actual contents of a segment into buf, which must
+// be the segment's size. Ref and add segments are read from the TargetPool.
+func (sq *squasher) readSegment(s segment, buf []byte) error {
+	if s.kind == segmentFresh {
+		return sq.store.read(s.storeOffset, buf)
+	}
+
+	if sq.params.TargetPool == nil {
+		return errors.WithStack(ErrNeedTargetPool)
+	}
+
+	reader, err := sq.params.TargetPool.GetReadSeeker(s.fileIndex)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = reader.Seek(s.offset, io.SeekStart)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = io.ReadFull(reader, buf)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("while reading %s from oldest build", sq.targetContainer.Files[s.fileIndex].Path))
+	}
+
+	if s.kind == segmentAdd {
+		add := make([]byte, len(buf))
+		err = sq.store.read(s.storeOffset, add)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		for i := range buf {
+			buf[i] += add[i]
+		}
+	}
+
+	return nil
+}
+
+func chunkSize(remaining int64) int64 {
+	return min(remaining, maxChunkSize)
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,218 @@
+package squash_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/pwr/patcher"
+	"github.com/itchio/wharf/pwr/rediff"
+	"github.com/itchio/wharf/pwr/squash"
+	"github.com/itchio/wharf/wtest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/itchio/wharf/compressors/cbrotli"
+	_ "github.com/itchio/wharf/decompressors/cbrotli"
+)
+
+func Test_Squash(t *testing.T) {
+	mainDir, err := os.MkdirTemp("", "squash")
+	wtest.Must(t, err)
+	defer os.RemoveAll(mainDir)
+
+	bsmods := func(delta byte) []wtest.Bsmod {
+		return []wtest.Bsmod{
+			{Interval: pwr.BlockSize/7 + 3, Delta: delta, Max: 4, Skip: 20},
+			{Interval: pwr.BlockSize/13 + 7, Delta: delta * 3, Max: 6, Skip: 20},
+		}
+	}
+
+	builds := []wtest.TestDirSettings{
+		{
+			Seed: 0x11,
+			Entries: []wtest.TestDirEntry{
+				{Path: "subdir/file-1", Seed: 0x1, Size: pwr.BlockSize*6 + 19},
+				{Path: "file-1", Seed: 0x2, Size: pwr.BlockSize * 3},
+				{Path: "dir2/file-2", Seed: 0x3, Size: 1024},
+				{Path: "going-away", Seed: 0x4},
+				{Path: "empty", Data: []byte{}},
+			},
+		},
+		{
+			Seed: 0x22,
+			Entries: []wtest.TestDirEntry{
+				{Path: "subdir/file-1", Seed: 0x1, Size: pwr.BlockSize*6 + 19, Bsmods: bsmods(0x4)},
+				{Path: "file-1", Chunks: []wtest.TestDirChunk{
+					{Size: pwr.BlockSize*2 + 3, Seed: 0x99},
+					{Size: pwr.BlockSize*1 + 12, Seed: 0x2},
+				}},
+				{Path: "dir2/file-2", Seed: 0x3, Size: 1024},
+				{Path: "empty", Data: []byte{}},
+				{Path: "new-file", Seed: 0x5, Size: pwr.BlockSize + 5},
+			},
+		},
+		{
+			Seed: 0x33,
+			Entries: []wtest.TestDirEntry{
+				{Path: "subdir/file-1", Seed: 0x1, Size: pwr.BlockSize*6 + 19, Bsmods: bsmods(0x7)},
+				{Path: "file-1", Seed: 0x2, Size: pwr.BlockSize*3 + 128, Swaperoos: []wtest.Swaperoo{
+					{OldStart: 0, NewStart: pwr.BlockSize * 2, Size: pwr.BlockSize},
+				}},
+				{Path: "dir2/file-2", Seed: 0x6, Size: 2048},
+				{Path: "empty", Data: []byte{}},
+				{Path: "new-file", Seed: 0x5, Size: pwr.BlockSize + 5},
+			},
+		},
+		{
+			Seed: 0x44,
+			Entries: []wtest.TestDirEntry{
+				{Path: "subdir/file-1", Seed: 0x1, Size: pwr.BlockSize*6 + 19, Bsmods: bsmods(0x9)},
+				{Path: "file-1", Seed: 0x2, Size: pwr.BlockSize * 3},
+				{Path: "dir2/file-2", Seed: 0x6, Size: 2048},
+				{Path: "empty", Data: []byte{}},
+				{Path: "newer-file", Seed: 0x5, Size: pwr.BlockSize + 5},
+			},
+		},
+	}
+
+	var dirs []string
+	for i, settings := range builds {
+		dir := filepath.Join(mainDir, "builds", string(rune('a'+i)))
+		wtest.MakeTestDir(t, dir, settings)
+		dirs = append(dirs, dir)
+	}
+
+	compression := &pwr.CompressionSettings{
+		Algorithm: pwr.CompressionAlgorithm_BROTLI,
+		Quality:   1,
+	}
+
+	consumer := &state.Consumer{}
+	var patches [][]byte
+	for i := 0; i < len(dirs)-1; i++ {
+		// alternate between rsync-only and bsdiff-optimized patches
+		patches = append(patches, makePatch(t, dirs[i], dirs[i+1], compression, i%2 == 1))
+	}
+
+	for _, withPool := range []bool{false, true} {
+		for first := 0; first < len(patches); first++ {
+			for last := first + 1; last < len(patches); last++ {
+				t.Logf("Squashing patches %d to %d (with pool: %v)", first, last, withPool)
+
+				var sources []savior.SeekSource
+				for _, patch := range patches[first : last+1] {
+					sources = append(sources, seeksource.FromBytes(patch))
+				}
+
+				targetDir := dirs[first]
+				squashed := new(bytes.Buffer)
+				params := squash.Params{
+					Patches:     sources,
+					PatchWriter: squashed,
+					Consumer:    consumer,
+				}
+				if withPool {
+					container, err := tlc.WalkAny(targetDir, tlc.WalkOpts{})
+					wtest.Must(t, err)
+					params.TargetPool = fspool.New(container, targetDir)
+				}
+
+				err := squash.Do(params)
+				if !withPool && errors.Cause(err) == squash.ErrNeedTargetPool {
+					t.Logf("Needs a target pool, skipping")
+					continue
+				}
+				wtest.Must(t, err)
+
+				outputDir := filepath.Join(mainDir, "out")
+				wtest.Must(t, os.RemoveAll(outputDir))
+				wtest.Must(t, patcher.PatchFresh(patcher.PatchFreshParams{
+					PatchReader: seeksource.FromBytes(squashed.Bytes()),
+					TargetDir:   targetDir,
+					OutputDir:   outputDir,
+				}))
+
+				expectedDir := dirs[last+1]
+				wtest.Must(t, pwr.AssertValid(outputDir, makeSignature(t, expectedDir)))
+				wtest.Must(t, pwr.AssertNoGhosts(outputDir, makeSignature(t, expectedDir)))
+			}
+		}
+	}
+
+	t.Logf("Squashing non-consecutive patches")
+	err = squash.Do(squash.Params{
+		Patches: []savior.SeekSource{
+			seeksource.FromBytes(patches[0]),
+			seeksource.FromBytes(patches[2]),
+		},
+		PatchWriter: new(bytes.Buffer),
+	})
+	assert.Error(t, err)
+
+	t.Logf("Squashing a single patch")
+	err = squash.Do(squash.Params{
+		Patches:     []savior.SeekSource{seeksource.FromBytes(patches[0])},
+		PatchWriter: new(bytes.Buffer),
+	})
+	assert.Error(t, err)
+}
+
+func makeSignature(t *testing.T, dir string) *pwr.SignatureInfo {
+	container, err := tlc.WalkAny(dir, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	hashes, err := pwr.ComputeSignature(context.Background(), container, fspool.New(container, dir), &state.Consumer{})
+	wtest.Must(t, err)
+
+	return &pwr.SignatureInfo{
+		Container: container,
+		Hashes:    hashes,
+	}
+}
+
+func makePatch(t *testing.T, oldDir string, newDir string, compression *pwr.CompressionSettings, optimize bool) []byte {
+	targetSignature := makeSignature(t, oldDir)
+
+	sourceContainer, err := tlc.WalkAny(newDir, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	dctx := &pwr.DiffContext{
+		Compression: compression,
+
+		SourceContainer: sourceContainer,
+		Pool:            fspool.New(sourceContainer, newDir),
+
+		TargetContainer: targetSignature.Container,
+		TargetSignature: targetSignature.Hashes,
+	}
+
+	patchBuffer := new(bytes.Buffer)
+	wtest.Must(t, dctx.WritePatch(context.Background(), patchBuffer, new(bytes.Buffer)))
+
+	if !optimize {
+		return patchBuffer.Bytes()
+	}
+
+	rc, err := rediff.NewContext(rediff.Params{
+		Compression: compression,
+		PatchReader: seeksource.FromBytes(patchBuffer.Bytes()),
+	})
+	wtest.Must(t, err)
+
+	optimizedBuffer := new(bytes.Buffer)
+	wtest.Must(t, rc.Optimize(rediff.OptimizeParams{
+		TargetPool:  fspool.New(rc.GetTargetContainer(), oldDir),
+		SourcePool:  fspool.New(rc.GetSourceContainer(), newDir),
+		PatchWriter: optimizedBuffer,
+	}))
+	return optimizedBuffer.Bytes()
+}
@@ -0,0 +1,65 @@
+package squash
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// A store holds fresh data and bsdiff add data on disk, so
+// that squashing doesn't need to keep whole patches in memory.
+// It is append-only, and not safe for concurrent use.
+type store struct {
+	file *os.File
+	size int64
+}
+
+func newStore() (*store, error) {
+	file, err := os.CreateTemp("", "squash-store")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &store{file: file}, nil
+}
+
+// append writes data at the end of the store and returns its offset.
+// Successive calls return contiguous offsets.
+func (s *store) append(data []byte) (int64, error) {
+	offset := s.size
+	_, err := s.file.WriteAt(data, offset)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	s.size += int64(len(data))
+	return offset, nil
+}
+
+// read fills buf with data from the store, starting at offset
+func (s *store) read(offset int64, buf []byte) error {
+	_, err := s.file.ReadAt(buf, offset)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (s *store) close() error {
+	path := s.file.Name()
+
+	err := s.file.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package pwr
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"hash"
+
+	"github.com/itchio/wharf/wsync"
+	"github.com/pkg/errors"
+	"github.com/zeebo/blake3"
+	"github.com/zeebo/xxh3"
+)
+
+// NewStrongHasher returns a hash.Hash that computes the strong hash
+// of blocks for a given algorithm.
+func NewStrongHasher(algorithm StrongHashAlgorithm) (hash.Hash, error) {
+	switch algorithm {
+	case StrongHashAlgorithm_MD5:
+		return md5.New(), nil
+	case StrongHashAlgorithm_SHA256:
+		return sha256.New(), nil
+	case StrongHashAlgorithm_BLAKE3_256:
+		return blake3.New(), nil
+	case StrongHashAlgorithm_XXH3_128:
+		return &xxh3Hasher128{xxh3.New()}, nil
+	}
+	return nil, errors.Errorf("unsupported strong hash algorithm %s", algorithm)
+}
+
+// xxh3.Hasher sums to 64 bits, this gives us the 128-bit variant
+type xxh3Hasher128 struct {
+	*xxh3.Hasher
+}
+
+func (xh *xxh3Hasher128) Size() int {
+	return 16
+}
+
+func (xh *xxh3Hasher128) Sum(b []byte) []byte {
+	sum := xh.Sum128().Bytes()
+	return append(b, sum[:]...)
+}
+
+func mksync(blockSize int64, strongHash StrongHashAlgorithm) (*wsync.Context, error) {
+	hasher, err := NewStrongHasher(strongHash)
+	if err != nil {
+		return nil, err
+	}
+	return wsync.NewContextWithHasher(int(EffectiveBlockSize(blockSize)), hasher), nil
+}
@@ -0,0 +1,330 @@
+package pwr
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior"
+	"github.com/itchio/wharf/bsdiff"
+	"github.com/itchio/wharf/wire"
+	"github.com/pkg/errors"
+)
+
+// ErrNoPatchTOC is returned by ReadPatchTOC for patches without a table of contents
+var ErrNoPatchTOC = errors.New("patch has no table of contents")
+
+// the footer is the offset of the table of contents, then its magic
+const patchTOCFooterSize = 8 + 4
+
+// A PatchTOC is a table of contents for a patch: it locates the series
+// of each file, so they can be read without reading the rest of the patch.
+type PatchTOC struct {
+	Header *PatchTOCHeader
+	// Entries has one entry per file of the source container, in order
+	Entries []*PatchTOCEntry
+}
+
+// WritePatchTOC reads a whole patch and writes a table of contents for it,
+// which must be appended to the patch. Readers that don't know about tables
+// of contents ignore it. writer isn't closed.
+//
+// Decompression can only start over for streams made of independent parts
+// (uncompressed patches, or zstd ones): for other algorithms, entries point
+// to the start of the compressed stream, and only save parsing messages.
+//
+// Sealed patches are refused: the table of contents must be written before
+// the seal, so that the seal covers it.
+func WritePatchTOC(patchReader savior.SeekSource, writer io.Writer) error {
+	sealed, err := endsWithSeal(patchReader)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if sealed {
+		return errors.New("patch is sealed, its table of contents must be written before sealing it")
+	}
+
+	_, err = ReadPatchTOC(patchReader)
+	if err == nil {
+		return errors.New("patch already has a table of contents")
+	}
+	if errors.Cause(err) != ErrNoPatchTOC {
+		return errors.WithStack(err)
+	}
+
+	_, err = patchReader.Resume(nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	rawPatchWire := wire.NewReadContext(patchReader)
+	err = rawPatchWire.ExpectMagic(PatchMagic)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	header := &PatchHeader{}
+	err = rawPatchWire.ReadMessage(header)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	sectionOffset := patchReader.Tell()
+	patchWire, _, err := DecompressWireSection(rawPatchWire, header.Compression)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = patchWire.ReadMessage(&tlc.Container{})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	sourceContainer := &tlc.Container{}
+	err = patchWire.ReadMessage(sourceContainer)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	restartable, _ := patchWire.GetSource().(RestartableSource)
+
+	var entries []*PatchTOCEntry
+	for fileIndex := range sourceContainer.Files {
+		entry := &PatchTOCEntry{
+			RestartOffset:      sectionOffset,
+			DecompressedOffset: patchWire.Offset(),
+		}
+
+		if header.Compression.Algorithm == CompressionAlgorithm_NONE {
+			entry.RestartOffset = sectionOffset + entry.DecompressedOffset
+			entry.RestartDecompressedOffset = entry.DecompressedOffset
+		} else if restartable != nil {
+			compressedOffset, decompressedOffset := restartable.RestartPoint()
+			entry.RestartOffset = sectionOffset + compressedOffset
+			entry.RestartDecompressedOffset = decompressedOffset
+		}
+		entries = append(entries, entry)
+
+		err = skipSeries(patchWire, int64(fileIndex))
+		if err != nil {
+			return errors.Wrapf(err, "while reading %s", sourceContainer.Files[fileIndex].Path)
+		}
+	}
+
+	patchSize := patchReader.Size()
+
+	wctx := wire.NewWriteContext(writer)
+	err = wctx.WriteMagic(PatchTOCMagic)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = wctx.WriteMessage(&PatchTOCHeader{
+		PatchSize:   patchSize,
+		NumFiles:    int64(len(entries)),
+		Compression: header.Compression,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, entry := range entries {
+		err = wctx.WriteMessage(entry)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	err = binary.Write(writer, Endianness, patchSize)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = binary.Write(writer, Endianness, PatchTOCMagic)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// endsWithSeal returns true if the last bytes of source are SealMagic
+func endsWithSeal(source savior.SeekSource) (bool, error) {
+	size := source.Size()
+	if size < 4 {
+		return false, nil
+	}
+
+	magicSource, err := source.Section(size-4, 4)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	_, err = magicSource.Resume(nil)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	var magic int32
+	err = binary.Read(magicSource, Endianness, &magic)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	return magic == SealMagic, nil
+}
+
+// ReadPatchTOC reads the table of contents at the end of a patch. It
+// returns ErrNoPatchTOC if there's none.
+func ReadPatchTOC(patchReader savior.SeekSource) (*PatchTOC, error) {
+	size := patchReader.Size()
+	if size < patchTOCFooterSize {
+		return nil, errors.WithStack(ErrNoPatchTOC)
+	}
+
+	footerSource, err := patchReader.Section(size-patchTOCFooterSize, patchTOCFooterSize)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	_, err = footerSource.Resume(nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var tocOffset int64
+	var magic int32
+	err = binary.Read(footerSource, Endianness, &tocOffset)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = binary.Read(footerSource, Endianness, &magic)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if magic != PatchTOCMagic {
+		return nil, errors.WithStack(ErrNoPatchTOC)
+	}
+
+	if tocOffset <= 0 || tocOffset > size-patchTOCFooterSize {
+		return nil, errors.Errorf("corrupted patch: table of contents at %d in %d-byte file", tocOffset, size)
+	}
+
+	tocSource, err := patchReader.Section(tocOffset, size-patchTOCFooterSize-tocOffset)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	_, err = tocSource.Resume(nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	rctx := wire.NewReadContext(tocSource)
+	err = rctx.ExpectMagic(PatchTOCMagic)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	toc := &PatchTOC{
+		Header: &PatchTOCHeader{},
+	}
+	err = rctx.ReadMessage(toc.Header)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if toc.Header.PatchSize != tocOffset {
+		return nil, errors.Errorf("corrupted patch: table of contents is for a %d-byte patch, but is at %d", toc.Header.PatchSize, tocOffset)
+	}
+
+	if toc.Header.Compression == nil {
+		return nil, errors.New("corrupted patch: table of contents has no compression settings")
+	}
+
+	for i := int64(0); i < toc.Header.NumFiles; i++ {
+		entry := &PatchTOCEntry{}
+		err = rctx.ReadMessage(entry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while reading table of contents entry %d", i)
+		}
+
+		if entry.RestartOffset < 0 || entry.RestartOffset > tocOffset || entry.RestartDecompressedOffset > entry.DecompressedOffset {
+			return nil, errors.Errorf("corrupted patch: invalid table of contents entry %d", i)
+		}
+		toc.Entries = append(toc.Entries, entry)
+	}
+
+	return toc, nil
+}
+
+// OpenFile returns a ReadContext from which the series of the given file
+// of the source container can be read, starting with its SyncHeader.
+func (toc *PatchTOC) OpenFile(patchReader savior.SeekSource, fileIndex int64) (*wire.ReadContext, error) {
+	if fileIndex < 0 || fileIndex >= int64(len(toc.Entries)) {
+		return nil, errors.Errorf("table of contents has no file %d", fileIndex)
+	}
+	entry := toc.Entries[fileIndex]
+
+	section, err := patchReader.Section(entry.RestartOffset, toc.Header.PatchSize-entry.RestartOffset)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	source, err := decompressSource(section, toc.Header.Compression)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = savior.DiscardByRead(source, entry.DecompressedOffset-entry.RestartDecompressedOffset)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	rctx := wire.NewReadContext(source)
+	rctx.SetChecksums(toc.Header.Compression.Checksums)
+	return rctx, nil
+}
+
+// skipSeries reads a file's series, up to and including its sentinel
+func skipSeries(rctx *wire.ReadContext, fileIndex int64) error {
+	sh := &SyncHeader{}
+	err := rctx.ReadMessage(sh)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if sh.FileIndex != fileIndex {
+		return errors.Errorf("corrupted patch: expected file %d, got file %d", fileIndex, sh.FileIndex)
+	}
+
+	switch sh.Type {
+	case SyncHeader_RSYNC:
+		// only sync ops, handled below
+	case SyncHeader_BSDIFF:
+		err = rctx.ReadMessage(&BsdiffHeader{})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		ctrl := &bsdiff.Control{}
+		for !ctrl.Eof {
+			err = rctx.ReadMessage(ctrl)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	default:
+		return errors.Errorf("unknown patch series kind %d", sh.Type)
+	}
+
+	op := &SyncOp{}
+	for op.Type != SyncOp_HEY_YOU_DID_IT {
+		err = rctx.ReadMessage(op)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
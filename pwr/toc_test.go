@@ -0,0 +1,88 @@
+package pwr
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/wtest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PatchTOC(t *testing.T) {
+	dir, err := os.MkdirTemp("", "patchtoc")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	v1, v2, targetContainer, sourceContainer := makeDiffTestDirs(t, dir)
+
+	targetSignature, err := ComputeSignature(context.Background(), targetContainer, fspool.New(targetContainer, v1), &state.Consumer{})
+	wtest.Must(t, err)
+
+	dctx := &DiffContext{
+		Compression: &CompressionSettings{
+			Algorithm: CompressionAlgorithm_NONE,
+		},
+		Consumer: &state.Consumer{},
+
+		SourceContainer: sourceContainer,
+		Pool:            fspool.New(sourceContainer, v2),
+
+		TargetContainer: targetContainer,
+		TargetSignature: targetSignature,
+	}
+
+	patchBuffer := new(bytes.Buffer)
+	wtest.Must(t, dctx.WritePatch(context.Background(), patchBuffer, new(bytes.Buffer)))
+	patchSize := int64(patchBuffer.Len())
+
+	_, err = ReadPatchTOC(seeksource.FromBytes(patchBuffer.Bytes()))
+	assert.True(t, errors.Cause(err) == ErrNoPatchTOC)
+
+	wtest.Must(t, WritePatchTOC(seeksource.FromBytes(patchBuffer.Bytes()), patchBuffer))
+	patch := patchBuffer.Bytes()
+
+	err = WritePatchTOC(seeksource.FromBytes(patch), new(bytes.Buffer))
+	assert.Error(t, err, "patches can only have one table of contents")
+
+	toc, err := ReadPatchTOC(seeksource.FromBytes(patch))
+	wtest.Must(t, err)
+	assert.Equal(t, patchSize, toc.Header.PatchSize)
+	assert.Len(t, toc.Entries, len(sourceContainer.Files))
+
+	// the table of contents doesn't get in the way of regular readers
+	pi, err := InspectPatch(seeksource.FromBytes(patch))
+	wtest.Must(t, err)
+
+	// read files in reverse order, to make sure they're independent
+	for fileIndex := int64(len(toc.Entries)) - 1; fileIndex >= 0; fileIndex-- {
+		entry := toc.Entries[fileIndex]
+		assert.Equal(t, entry.DecompressedOffset, entry.RestartDecompressedOffset, "uncompressed patches restart right at files")
+
+		rctx, err := toc.OpenFile(seeksource.FromBytes(patch), fileIndex)
+		wtest.Must(t, err)
+
+		sh := &SyncHeader{}
+		wtest.Must(t, rctx.ReadMessage(sh))
+		assert.Equal(t, fileIndex, sh.FileIndex)
+
+		var numOps int64
+		op := &SyncOp{}
+		for {
+			wtest.Must(t, rctx.ReadMessage(op))
+			if op.Type == SyncOp_HEY_YOU_DID_IT {
+				break
+			}
+			numOps++
+		}
+		assert.Equal(t, pi.Files[fileIndex].NumOps, numOps)
+	}
+
+	_, err = toc.OpenFile(seeksource.FromBytes(patch), int64(len(toc.Entries)))
+	assert.Error(t, err)
+}
@@ -24,6 +24,10 @@ type ValidatingPool struct {
 	// Container must match Pool - may have different file indices than Signature.Container
 	Container *tlc.Container
 	Signature *SignatureInfo
+	// SignatureReader (optional) is used instead of Signature's hashes when
+	// set, so only one file's hashes are in memory at once. Files must then
+	// be written in increasing index order. Signature can be its Info.
+	SignatureReader *SignatureReader
 
 	Wounds       chan *Wound
 	WoundsFilter WoundsFilterFunc
@@ -79,13 +83,28 @@ func (vp *ValidatingPool) GetWriter(fileIndex int64) (io.WriteCloser, error) {
 		}()
 	}
 
+	if vp.SignatureReader != nil {
+		hashInfo, err := vp.fileHashInfo(fileIndex)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		vp.hashInfo = hashInfo
+	}
+
 	if vp.hashInfo == nil {
 		var err error
 		vp.hashInfo, err = ComputeHashInfo(vp.Signature)
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
-		vp.sctx = wsync.NewContext(int(BlockSize))
+	}
+
+	if vp.sctx == nil {
+		var err error
+		vp.sctx, err = mksync(vp.hashInfo.BlockSize, vp.hashInfo.StrongHash)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
 	}
 
 	w, err := vp.Pool.GetWriter(fileIndex)
@@ -126,13 +145,36 @@ func (vp *ValidatingPool) GetWriter(fileIndex int64) (io.WriteCloser, error) {
 
 	dw := &drip.Writer{
 		Writer:   ocw,
-		Buffer:   make([]byte, BlockSize),
+		Buffer:   make([]byte, EffectiveBlockSize(vp.hashInfo.BlockSize)),
 		Validate: validate,
 	}
 
 	return dw, nil
 }
 
+// fileHashInfo reads the hashes of a single file from SignatureReader
+func (vp *ValidatingPool) fileHashInfo(fileIndex int64) (*HashInfo, error) {
+	sigInfo := vp.SignatureReader.Info
+
+	hashes, err := vp.SignatureReader.FileHashes(fileIndex)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	groups := make(HashGroups)
+	// like ComputeHashInfo, empty files have no group
+	if sigInfo.Container.Files[fileIndex].Size > 0 {
+		groups[fileIndex] = hashes
+	}
+
+	return &HashInfo{
+		Container:  sigInfo.Container,
+		Groups:     groups,
+		BlockSize:  sigInfo.EffectiveBlockSize(),
+		StrongHash: sigInfo.StrongHash,
+	}, nil
+}
+
 // Close closes the underlying pool (and its reader, if any)
 func (vp *ValidatingPool) Close() error {
 	return vp.Pool.Close()
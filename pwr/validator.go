@@ -33,6 +33,9 @@ const MaxWoundSize int64 = 4 * 1024 * 1024 // 4MB
 type ValidatorContext struct {
 	WoundsPath string
 	HealPath   string
+	// HealVerifier (optional) checks the wharf files read by the
+	// healer created from HealPath, see SourceVerifier
+	HealVerifier SourceVerifier
 
 	Consumer *state.Consumer
 
@@ -54,6 +57,17 @@ const floatIntFactor = 10000.0
 // contained in signature. FailFast mode returns an error on the first corruption
 // seen, other modes write wounds to a file or for a wounds consumer, like a healer.
 func (vctx *ValidatorContext) Validate(ctx context.Context, target string, signature *SignatureInfo) error {
+	return vctx.doValidate(ctx, target, signature, nil)
+}
+
+// ValidateStream is like Validate, but reads hashes from sigReader as files
+// are checked, so memory use is bounded by the largest file instead of the
+// whole build. sigReader must not have been read from yet.
+func (vctx *ValidatorContext) ValidateStream(ctx context.Context, target string, sigReader *SignatureReader) error {
+	return vctx.doValidate(ctx, target, sigReader.Info, sigReader)
+}
+
+func (vctx *ValidatorContext) doValidate(ctx context.Context, target string, signature *SignatureInfo, sigReader *SignatureReader) error {
 	if vctx.Consumer == nil {
 		vctx.Consumer = &state.Consumer{}
 	}
@@ -128,6 +142,7 @@ func (vctx *ValidatorContext) Validate(ctx context.Context, target string, signa
 		if err != nil {
 			return err
 		}
+		setSourceVerifier(healer, vctx.HealVerifier)
 
 		woundsStateConsumer = &state.Consumer{
 			OnProgress: func(progress float64) {
@@ -242,7 +257,7 @@ func (vctx *ValidatorContext) Validate(ctx context.Context, target string, signa
 
 	fileIndices := make(chan int64)
 
-	go vctx.validate(target, signature, fileIndices, workerErrs, onProgress, cancelled)
+	go vctx.validate(target, signature, sigReader, fileIndices, workerErrs, onProgress, cancelled)
 
 	var retErr error
 	sending := true
@@ -295,7 +310,7 @@ func (vctx *ValidatorContext) Validate(ctx context.Context, target string, signa
 
 type onProgressFunc func(delta int64)
 
-func (vctx *ValidatorContext) validate(target string, signature *SignatureInfo, fileIndices chan int64,
+func (vctx *ValidatorContext) validate(target string, signature *SignatureInfo, sigReader *SignatureReader, fileIndices chan int64,
 	errs chan error, onProgress onProgressFunc, cancelled chan struct{}) {
 
 	var retErr error
@@ -321,6 +336,8 @@ func (vctx *ValidatorContext) validate(target string, signature *SignatureInfo,
 		Container: signature.Container,
 		Signature: signature,
 
+		SignatureReader: sigReader,
+
 		Wounds: vctx.Wounds,
 		WoundsFilter: func(wounds chan *Wound) chan *Wound {
 			return AggregateWounds(wounds, MaxWoundSize)
@@ -3,11 +3,13 @@ package pwr
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/itchio/headway/state"
 	"github.com/itchio/headway/united"
 	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior"
 	"github.com/itchio/wharf/wire"
 	"github.com/pkg/errors"
 )
@@ -193,6 +195,95 @@ func (ww *WoundsWriter) HasWounds() bool {
 	return ww.hasWounds
 }
 
+///////////////////////////////
+// Reader
+///////////////////////////////
+
+// ReadWounds reads a .pww (wharf wounds file format) file, as written by WoundsWriter.
+// It returns the container the wounds refer to, and a closed channel holding all
+// the wounds in the file, which can be piped into any WoundsConsumer (like a Healer).
+// All wounds are read before it returns, so that any read error is returned here
+// rather than halfway through healing.
+func ReadWounds(source savior.SeekSource) (*tlc.Container, <-chan *Wound, error) {
+	_, err := source.Resume(nil)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	rc := wire.NewReadContext(source)
+	err = rc.ExpectMagic(WoundsMagic)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	err = rc.ReadMessage(&WoundsHeader{})
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	container := &tlc.Container{}
+	err = rc.ReadMessage(container)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	var woundList []*Wound
+	for woundIndex := 0; ; woundIndex++ {
+		wound := &Wound{}
+		err = rc.ReadMessage(wound)
+		if err != nil {
+			if errors.Cause(err) == io.EOF {
+				// reached end of file
+				break
+			}
+			return nil, nil, errors.Wrapf(err, "while reading wound %d", woundIndex)
+		}
+
+		err = checkWound(container, wound)
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		woundList = append(woundList, wound)
+	}
+
+	wounds := make(chan *Wound, len(woundList))
+	for _, wound := range woundList {
+		wounds <- wound
+	}
+	close(wounds)
+
+	return container, wounds, nil
+}
+
+// checkWound makes sure a wound read from disk refers to an existing
+// entry of the container, so that consumers can trust it.
+func checkWound(container *tlc.Container, wound *Wound) error {
+	var numEntries int
+	switch wound.Kind {
+	case WoundKind_FILE, WoundKind_CLOSED_FILE:
+		numEntries = len(container.Files)
+	case WoundKind_DIR:
+		numEntries = len(container.Dirs)
+	case WoundKind_SYMLINK:
+		numEntries = len(container.Symlinks)
+	default:
+		return errors.Errorf("unknown wound kind: %d", wound.Kind)
+	}
+
+	if wound.Index < 0 || wound.Index >= int64(numEntries) {
+		return errors.Errorf("invalid %s wound: index %d out of range", wound.Kind, wound.Index)
+	}
+
+	if wound.Kind == WoundKind_FILE || wound.Kind == WoundKind_CLOSED_FILE {
+		file := container.Files[wound.Index]
+		if wound.Start < 0 || wound.Start > wound.End || wound.End > file.Size {
+			return errors.Errorf("invalid file wound: [%d,%d) out of bounds for %s (%d bytes)", wound.Start, wound.End, file.Path, file.Size)
+		}
+	}
+
+	return nil
+}
+
 ///////////////////////////////
 // Writer
 ///////////////////////////////
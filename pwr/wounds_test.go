@@ -0,0 +1,104 @@
+package pwr
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ReadWounds(t *testing.T) {
+	mainDir, err := os.MkdirTemp("", "readwounds")
+	wtest.Must(t, err)
+	defer os.RemoveAll(mainDir)
+
+	sourceDir := filepath.Join(mainDir, "source")
+	targetDir := filepath.Join(mainDir, "target")
+	woundsPath := filepath.Join(mainDir, "wounds.pww")
+
+	settings := wtest.TestDirSettings{
+		Seed: 0x1294,
+		Entries: []wtest.TestDirEntry{
+			{Path: "subdir/file-1", Seed: 0x1},
+			{Path: "file-1", Seed: 0x2, Size: BlockSize*3 + 12},
+			{Path: "file-2", Seed: 0x3, Size: 128},
+		},
+	}
+	wtest.MakeTestDir(t, sourceDir, settings)
+	wtest.MakeTestDir(t, targetDir, settings)
+
+	container, err := tlc.WalkAny(sourceDir, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	consumer := &state.Consumer{}
+	hashes, err := ComputeSignature(context.Background(), container, fspool.New(container, sourceDir), consumer)
+	wtest.Must(t, err)
+
+	sigInfo := &SignatureInfo{
+		Container: container,
+		Hashes:    hashes,
+	}
+
+	f, err := os.OpenFile(filepath.Join(targetDir, "file-1"), os.O_WRONLY, 0644)
+	wtest.Must(t, err)
+	_, err = f.WriteAt([]byte{0x1, 0x2, 0x3}, BlockSize+16)
+	wtest.Must(t, err)
+	wtest.Must(t, f.Close())
+	wtest.Must(t, os.Remove(filepath.Join(targetDir, "file-2")))
+
+	vc := &ValidatorContext{
+		Consumer:   consumer,
+		WoundsPath: woundsPath,
+	}
+	wtest.Must(t, vc.Validate(context.Background(), targetDir, sigInfo))
+	assert.True(t, vc.WoundsConsumer.HasWounds())
+
+	woundsBytes, err := os.ReadFile(woundsPath)
+	wtest.Must(t, err)
+
+	woundsContainer, wounds, err := ReadWounds(seeksource.FromBytes(woundsBytes))
+	wtest.Must(t, err)
+	wtest.Must(t, container.EnsureEqual(woundsContainer))
+
+	var totalCorrupted int64
+	var replayed []*Wound
+	for wound := range wounds {
+		totalCorrupted += wound.Size()
+		replayed = append(replayed, wound)
+	}
+	assert.EqualValues(t, vc.WoundsConsumer.TotalCorrupted(), totalCorrupted)
+	assert.EqualValues(t, BlockSize+128, totalCorrupted)
+
+	t.Logf("Healing from replayed wounds")
+	_, wounds, err = ReadWounds(seeksource.FromBytes(woundsBytes))
+	wtest.Must(t, err)
+
+	healer, err := NewHealer(fmt.Sprintf("dir,%s", sourceDir), targetDir)
+	wtest.Must(t, err)
+
+	healerWounds := make(chan *Wound)
+	go func() {
+		for wound := range wounds {
+			healerWounds <- wound
+		}
+		close(healerWounds)
+	}()
+	wtest.Must(t, healer.Do(context.Background(), woundsContainer, healerWounds))
+	assert.EqualValues(t, BlockSize+128, healer.TotalHealed())
+	wtest.Must(t, AssertValid(targetDir, sigInfo))
+
+	t.Logf("Reading truncated wounds files")
+	_, _, err = ReadWounds(seeksource.FromBytes(woundsBytes[:len(woundsBytes)-1]))
+	assert.Error(t, err)
+
+	_, _, err = ReadWounds(seeksource.FromBytes([]byte{1, 2, 3, 4}))
+	assert.Error(t, err)
+}
@@ -0,0 +1,642 @@
+package pwr
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/itchio/arkive/zip"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/kompress/flate"
+	"github.com/itchio/lake"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior"
+	"github.com/itchio/wharf/werrors"
+	"github.com/itchio/wharf/wire"
+	"github.com/pkg/errors"
+)
+
+// DefaultZipIndexRestartInterval is the default distance, in uncompressed
+// bytes, between two restart points of a deflate entry.
+const DefaultZipIndexRestartInterval int64 = 1024 * 1024 // 1MiB
+
+// the deflate sliding window is 32KiB
+const zipIndexWindowSize = 32 * 1024
+
+const (
+	zipMethodStore   = 0
+	zipMethodDeflate = 8
+
+	zipFileHeaderSignature = 0x04034b50
+	zipFileHeaderLen       = 30
+)
+
+// ZipIndexContext holds the settings used when writing a zip index
+type ZipIndexContext struct {
+	// Compression used for the index itself. Restart points contain
+	// deflate windows, so compressing the index is recommended. Defaults to none.
+	Compression *CompressionSettings
+
+	// RestartInterval is the minimum amount of uncompressed data between
+	// two restart points. Defaults to DefaultZipIndexRestartInterval.
+	RestartInterval int64
+
+	Consumer *state.Consumer
+}
+
+// WriteIndex reads the zip archive in file (of the given size) and writes a
+// wharf zip index file (.pzi) to writer. All deflate entries are fully
+// inflated to find restart points and check their integrity.
+func (zic *ZipIndexContext) WriteIndex(ctx context.Context, file io.ReaderAt, size int64, writer io.Writer) error {
+	compression := zic.Compression
+	if compression == nil {
+		compression = &CompressionSettings{
+			Algorithm: CompressionAlgorithm_NONE,
+		}
+	}
+
+	restartInterval := zic.RestartInterval
+	if restartInterval <= 0 {
+		restartInterval = DefaultZipIndexRestartInterval
+	}
+
+	zr, err := zip.NewReader(file, size)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	rawWire := wire.NewWriteContext(writer)
+	err = rawWire.WriteMagic(ZipIndexMagic)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = rawWire.WriteMessage(&ZipIndexHeader{
+		Compression: compression,
+		ArchiveSize: size,
+		NumEntries:  int64(len(zr.File)),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	indexWire, err := CompressWire(rawWire, compression)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var totalCompressed int64
+	for _, f := range zr.File {
+		totalCompressed += int64(f.CompressedSize64)
+	}
+
+	var doneCompressed int64
+	for _, f := range zr.File {
+		select {
+		case <-ctx.Done():
+			return werrors.ErrCancelled
+		default:
+			// keep going!
+		}
+
+		zic.Consumer.ProgressLabel(f.Name)
+
+		dataOffset, err := f.DataOffset()
+		if err != nil {
+			return errors.Wrapf(err, "while finding data of %s", f.Name)
+		}
+
+		localHeaderOffset, err := findLocalHeaderOffset(file, dataOffset, f.Name)
+		if err != nil {
+			return errors.Wrapf(err, "while finding local header of %s", f.Name)
+		}
+
+		entry := &ZipIndexEntry{
+			Path:              filepath.ToSlash(filepath.Clean(f.Name)),
+			Mode:              uint32(f.Mode()),
+			LocalHeaderOffset: localHeaderOffset,
+			DataOffset:        dataOffset,
+			CompressedSize:    int64(f.CompressedSize64),
+			UncompressedSize:  int64(f.UncompressedSize64),
+			Method:            uint32(f.Method),
+			Crc32:             f.CRC32,
+		}
+
+		var restartPoints []*ZipIndexRestartPoint
+		if entry.Method == zipMethodDeflate {
+			restartPoints, err = findRestartPoints(ctx, file, entry, restartInterval)
+			if err != nil {
+				return errors.Wrapf(err, "while indexing %s", f.Name)
+			}
+		}
+
+		entry.NumRestartPoints = int64(len(restartPoints))
+		err = indexWire.WriteMessage(entry)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		for _, rp := range restartPoints {
+			err = indexWire.WriteMessage(rp)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		doneCompressed += entry.CompressedSize
+		if totalCompressed > 0 {
+			zic.Consumer.Progress(float64(doneCompressed) / float64(totalCompressed))
+		}
+	}
+
+	err = indexWire.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// findLocalHeaderOffset looks backwards from an entry's data for its local
+// file header. The central directory doesn't tell us how long the local
+// extra field is, so we look for a signature with consistent lengths.
+func findLocalHeaderOffset(file io.ReaderAt, dataOffset int64, name string) (int64, error) {
+	guesses := []int64{
+		// most entries have short local extra fields
+		int64(zipFileHeaderLen + len(name) + 1024),
+		// the name and extra field are at most 64KiB each
+		zipFileHeaderLen + 2*0xffff,
+	}
+
+	for _, windowLen := range guesses {
+		if windowLen > dataOffset {
+			windowLen = dataOffset
+		}
+
+		window := make([]byte, windowLen)
+		_, err := file.ReadAt(window, dataOffset-windowLen)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+
+		for distance := int64(zipFileHeaderLen); distance <= windowLen; distance++ {
+			header := window[windowLen-distance:]
+			if binary.LittleEndian.Uint32(header) != zipFileHeaderSignature {
+				continue
+			}
+
+			nameLen := int64(binary.LittleEndian.Uint16(header[26:]))
+			extraLen := int64(binary.LittleEndian.Uint16(header[28:]))
+			if zipFileHeaderLen+nameLen+extraLen == distance {
+				return dataOffset - distance, nil
+			}
+		}
+
+		if windowLen == dataOffset {
+			break
+		}
+	}
+
+	return 0, errors.New("local file header not found")
+}
+
+// findRestartPoints inflates a deflate entry, saving the decompressor's
+// state on block boundaries at least restartInterval bytes apart.
+func findRestartPoints(ctx context.Context, file io.ReaderAt, entry *ZipIndexEntry, restartInterval int64) ([]*ZipIndexRestartPoint, error) {
+	var restartPoints []*ZipIndexRestartPoint
+
+	sr := flate.NewSaverReader(io.NewSectionReader(file, entry.DataOffset, entry.CompressedSize))
+	defer sr.Close()
+
+	checksum := crc32.NewIEEE()
+	buf := make([]byte, 32*1024)
+	var offset int64
+	nextRestart := restartInterval
+
+	for {
+		n, err := sr.Read(buf)
+		if n > 0 {
+			// writing to a hash never fails
+			_, _ = checksum.Write(buf[:n])
+			offset += int64(n)
+		}
+
+		if err == flate.ReadyToSaveError {
+			select {
+			case <-ctx.Done():
+				return nil, werrors.ErrCancelled
+			default:
+				// keep going!
+			}
+
+			cp, err := sr.Save()
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+
+			window := cp.DictDecoderHist
+			if !cp.DictDecoderFull {
+				window = window[:cp.DictDecoderWrPos]
+			}
+
+			restartPoints = append(restartPoints, &ZipIndexRestartPoint{
+				UncompressedOffset: cp.Woffset,
+				CompressedOffset:   cp.Roffset,
+				Bits:               cp.B,
+				NumBits:            uint32(cp.Nb),
+				Window:             window,
+				WindowReadPos:      int64(cp.DictDecoderRdPos),
+				WindowWritePos:     int64(cp.DictDecoderWrPos),
+				WindowFull:         cp.DictDecoderFull,
+			})
+			nextRestart = cp.Woffset + restartInterval
+			continue
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		if offset >= nextRestart {
+			sr.WantSave()
+		}
+	}
+
+	if offset != entry.UncompressedSize {
+		return nil, errors.Errorf("inflated to %d bytes, expected %d", offset, entry.UncompressedSize)
+	}
+
+	if checksum.Sum32() != entry.Crc32 {
+		return nil, errors.Errorf("checksum mismatch: got %x, expected %x", checksum.Sum32(), entry.Crc32)
+	}
+
+	return restartPoints, nil
+}
+
+// A ZipIndex describes where the entries of a zip archive are, and how
+// to start decompressing them from the middle, as read from a wharf
+// zip index file (.pzi)
+type ZipIndex struct {
+	// ArchiveSize is the size of the archive this index was made for
+	ArchiveSize int64
+
+	Entries []*ZipIndexEntry
+
+	// RestartPoints holds one slice per entry (in the same order),
+	// sorted by uncompressed offset.
+	RestartPoints [][]*ZipIndexRestartPoint
+
+	entryIndices map[string]int64
+}
+
+// ReadZipIndex reads all entries and restart points from a wharf zip index file.
+func ReadZipIndex(source savior.SeekSource) (*ZipIndex, error) {
+	_, err := source.Resume(nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	rawWire := wire.NewReadContext(source)
+	err = rawWire.ExpectMagic(ZipIndexMagic)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	header := &ZipIndexHeader{}
+	err = rawWire.ReadMessage(header)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	indexWire, err := DecompressWire(rawWire, header.Compression)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	zi := &ZipIndex{
+		ArchiveSize:  header.ArchiveSize,
+		entryIndices: make(map[string]int64),
+	}
+
+	for entryIndex := int64(0); entryIndex < header.NumEntries; entryIndex++ {
+		entry := &ZipIndexEntry{}
+		err = indexWire.ReadMessage(entry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while reading entry %d", entryIndex)
+		}
+
+		restartPoints := make([]*ZipIndexRestartPoint, entry.NumRestartPoints)
+		for i := range restartPoints {
+			rp := &ZipIndexRestartPoint{}
+			err = indexWire.ReadMessage(rp)
+			if err != nil {
+				return nil, errors.Wrapf(err, "while reading restart point %d of %s", i, entry.Path)
+			}
+			restartPoints[i] = rp
+		}
+
+		zi.Entries = append(zi.Entries, entry)
+		zi.RestartPoints = append(zi.RestartPoints, restartPoints)
+		zi.entryIndices[entry.Path] = entryIndex
+	}
+
+	return zi, nil
+}
+
+// EntryIndex returns the index of the entry with the given slashed path, if any.
+func (zi *ZipIndex) EntryIndex(path string) (int64, bool) {
+	entryIndex, ok := zi.entryIndices[path]
+	return entryIndex, ok
+}
+
+// NewEntryReader returns a reader for the uncompressed contents of an entry.
+// file must be the archive the index was made for: seeking only involves
+// range reads into it, starting from the nearest restart point.
+func (zi *ZipIndex) NewEntryReader(file io.ReaderAt, entryIndex int64) *ZipEntryReader {
+	return &ZipEntryReader{
+		index:      zi,
+		file:       file,
+		entryIndex: entryIndex,
+		entry:      zi.Entries[entryIndex],
+	}
+}
+
+// A ZipEntryReader reads and seeks into a single entry of an indexed zip archive
+type ZipEntryReader struct {
+	index      *ZipIndex
+	file       io.ReaderAt
+	entryIndex int64
+	entry      *ZipIndexEntry
+
+	offset int64
+
+	reader       io.Reader
+	closer       io.Closer
+	readerOffset int64
+}
+
+var _ io.ReadSeeker = (*ZipEntryReader)(nil)
+
+// Read reads uncompressed data from the current offset
+func (zer *ZipEntryReader) Read(buf []byte) (int, error) {
+	if zer.offset >= zer.entry.UncompressedSize {
+		return 0, io.EOF
+	}
+
+	if zer.reader == nil || zer.readerOffset != zer.offset {
+		err := zer.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := zer.reader.Read(buf)
+	zer.offset += int64(n)
+	zer.readerOffset += int64(n)
+	return n, err
+}
+
+// Seek sets the uncompressed offset for the next Read. It's cheap:
+// decompression only restarts when reading.
+func (zer *ZipEntryReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		// muffin
+	case io.SeekCurrent:
+		offset += zer.offset
+	case io.SeekEnd:
+		offset += zer.entry.UncompressedSize
+	default:
+		return zer.offset, errors.Errorf("invalid whence %d", whence)
+	}
+
+	if offset < 0 {
+		return zer.offset, errors.Errorf("invalid seek to negative offset %d", offset)
+	}
+
+	zer.offset = offset
+	return offset, nil
+}
+
+// Close releases the current decompressor, if any
+func (zer *ZipEntryReader) Close() error {
+	zer.reader = nil
+	if zer.closer != nil {
+		err := zer.closer.Close()
+		zer.closer = nil
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// open positions the reader at the current offset, starting from the
+// nearest restart point, unless reading on from the current reader is closer.
+func (zer *ZipEntryReader) open() error {
+	entry := zer.entry
+
+	switch entry.Method {
+	case zipMethodStore:
+		err := zer.Close()
+		if err != nil {
+			return err
+		}
+
+		zer.reader = io.NewSectionReader(zer.file, entry.DataOffset+zer.offset, entry.UncompressedSize-zer.offset)
+		zer.readerOffset = zer.offset
+		return nil
+
+	case zipMethodDeflate:
+		restartPoints := zer.index.RestartPoints[zer.entryIndex]
+		i := sort.Search(len(restartPoints), func(i int) bool {
+			return restartPoints[i].UncompressedOffset > zer.offset
+		})
+
+		var rp *ZipIndexRestartPoint
+		var restartOffset int64
+		if i > 0 {
+			rp = restartPoints[i-1]
+			restartOffset = rp.UncompressedOffset
+		}
+
+		if zer.reader != nil && zer.readerOffset <= zer.offset && restartOffset <= zer.readerOffset {
+			// reading on is cheaper than restarting
+		} else {
+			err := zer.Close()
+			if err != nil {
+				return err
+			}
+
+			var fr io.ReadCloser
+			if rp == nil {
+				fr = flate.NewReader(io.NewSectionReader(zer.file, entry.DataOffset, entry.CompressedSize))
+			} else {
+				hist := make([]byte, zipIndexWindowSize)
+				copy(hist, rp.Window)
+
+				cp := &flate.Checkpoint{
+					Woffset: rp.UncompressedOffset,
+					Roffset: rp.CompressedOffset,
+					B:       rp.Bits,
+					Nb:      uint(rp.NumBits),
+
+					DictDecoderHist:  hist,
+					DictDecoderRdPos: int(rp.WindowReadPos),
+					DictDecoderWrPos: int(rp.WindowWritePos),
+					DictDecoderFull:  rp.WindowFull,
+				}
+
+				compressedReader := io.NewSectionReader(zer.file, entry.DataOffset+rp.CompressedOffset, entry.CompressedSize-rp.CompressedOffset)
+				sr, err := cp.Resume(compressedReader)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				fr = sr
+			}
+
+			zer.reader = fr
+			zer.closer = fr
+			zer.readerOffset = restartOffset
+		}
+
+		if zer.readerOffset < zer.offset {
+			_, err := io.CopyN(io.Discard, zer.reader, zer.offset-zer.readerOffset)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			zer.readerOffset = zer.offset
+		}
+		return nil
+	}
+
+	return errors.Errorf("%s: unsupported zip method %d", entry.Path, entry.Method)
+}
+
+// ZipIndexPool implements lake.Pool for a zip archive, using a zip index
+// instead of its central directory. Seeking into a file only involves
+// range reads into the archive.
+type ZipIndexPool struct {
+	container *tlc.Container
+	index     *ZipIndex
+	file      io.ReaderAt
+
+	fileIndex int64
+	reader    *ZipEntryReader
+
+	seekFileIndex int64
+	readSeeker    *ZipEntryReader
+}
+
+var _ lake.Pool = (*ZipIndexPool)(nil)
+
+// NewZipIndexPool returns a pool that reads the files of container
+// from an indexed zip archive.
+func NewZipIndexPool(container *tlc.Container, index *ZipIndex, file io.ReaderAt) *ZipIndexPool {
+	return &ZipIndexPool{
+		container: container,
+		index:     index,
+		file:      file,
+
+		fileIndex:     -1,
+		seekFileIndex: -1,
+	}
+}
+
+// GetSize returns the size of the file at index fileIndex
+func (zp *ZipIndexPool) GetSize(fileIndex int64) int64 {
+	return zp.container.Files[fileIndex].Size
+}
+
+// GetReader returns an io.Reader for the file at index fileIndex.
+// The last returned reader is reused if fileIndex is the same.
+func (zp *ZipIndexPool) GetReader(fileIndex int64) (io.Reader, error) {
+	if zp.fileIndex != fileIndex {
+		if zp.reader != nil {
+			err := zp.reader.Close()
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			zp.reader = nil
+			zp.fileIndex = -1
+		}
+
+		reader, err := zp.open(fileIndex)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		zp.reader = reader
+		zp.fileIndex = fileIndex
+	}
+
+	return zp.reader, nil
+}
+
+// GetReadSeeker is like GetReader but the returned object allows seeking
+func (zp *ZipIndexPool) GetReadSeeker(fileIndex int64) (io.ReadSeeker, error) {
+	if zp.seekFileIndex != fileIndex {
+		if zp.readSeeker != nil {
+			err := zp.readSeeker.Close()
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			zp.readSeeker = nil
+			zp.seekFileIndex = -1
+		}
+
+		readSeeker, err := zp.open(fileIndex)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		zp.readSeeker = readSeeker
+		zp.seekFileIndex = fileIndex
+	}
+
+	return zp.readSeeker, nil
+}
+
+func (zp *ZipIndexPool) open(fileIndex int64) (*ZipEntryReader, error) {
+	path := zp.container.Files[fileIndex].Path
+	entryIndex, ok := zp.index.EntryIndex(path)
+	if !ok {
+		return nil, errors.Errorf("file not found in zip index: %s", path)
+	}
+
+	if !os.FileMode(zp.index.Entries[entryIndex].Mode).IsRegular() {
+		return nil, errors.Errorf("not a regular file in zip index: %s", path)
+	}
+
+	return zp.index.NewEntryReader(zp.file, entryIndex), nil
+}
+
+// Close closes all readers belonging to this pool
+func (zp *ZipIndexPool) Close() error {
+	if zp.reader != nil {
+		err := zp.reader.Close()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		zp.reader = nil
+		zp.fileIndex = -1
+	}
+
+	if zp.readSeeker != nil {
+		err := zp.readSeeker.Close()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		zp.readSeeker = nil
+		zp.seekFileIndex = -1
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package pwr
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/itchio/arkive/zip"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ZipIndex(t *testing.T) {
+	rng := rand.New(rand.NewSource(0x8812))
+
+	// somewhat compressible data, so deflate emits many blocks
+	makeData := func(size int) []byte {
+		data := make([]byte, 0, size)
+		chunk := make([]byte, 1024)
+		for len(data) < size {
+			if rng.Intn(4) == 0 {
+				rng.Read(chunk)
+			}
+			data = append(data, chunk[:rng.Intn(len(chunk))]...)
+		}
+		return data[:size]
+	}
+
+	files := []struct {
+		name   string
+		method uint16
+		extra  []byte
+		data   []byte
+	}{
+		{name: "big", method: zip.Deflate, data: makeData(3*1024*1024 + 17)},
+		{name: "dir/stored", method: zip.Store, data: makeData(200 * 1024)},
+		{name: "dir/extra", method: zip.Deflate, extra: []byte{0xfe, 0xca, 4, 0, 1, 2, 3, 4}, data: makeData(1024)},
+		{name: "empty", method: zip.Deflate, data: []byte{}},
+	}
+
+	archive := new(bytes.Buffer)
+	zw := zip.NewWriter(archive)
+	for _, f := range files {
+		writer, err := zw.CreateHeader(&zip.FileHeader{
+			Name:   f.name,
+			Method: f.method,
+			Extra:  f.extra,
+		})
+		wtest.Must(t, err)
+		_, err = writer.Write(f.data)
+		wtest.Must(t, err)
+	}
+	wtest.Must(t, zw.Close())
+
+	archiveReader := bytes.NewReader(archive.Bytes())
+
+	indexBuf := new(bytes.Buffer)
+	zic := &ZipIndexContext{
+		RestartInterval: 128 * 1024,
+	}
+	wtest.Must(t, zic.WriteIndex(context.Background(), archiveReader, archiveReader.Size(), indexBuf))
+
+	index, err := ReadZipIndex(seeksource.FromBytes(indexBuf.Bytes()))
+	wtest.Must(t, err)
+
+	assert.EqualValues(t, archive.Len(), index.ArchiveSize)
+	assert.Equal(t, len(files), len(index.Entries))
+
+	zr, err := zip.NewReader(archiveReader, archiveReader.Size())
+	wtest.Must(t, err)
+
+	for i, f := range files {
+		entryIndex, ok := index.EntryIndex(f.name)
+		assert.True(t, ok)
+		assert.EqualValues(t, i, entryIndex)
+
+		entry := index.Entries[entryIndex]
+		assert.EqualValues(t, len(f.data), entry.UncompressedSize)
+		assert.EqualValues(t, f.method, entry.Method)
+
+		dataOffset, err := zr.File[i].DataOffset()
+		wtest.Must(t, err)
+		assert.EqualValues(t, dataOffset, entry.DataOffset)
+		assert.EqualValues(t, zipFileHeaderSignature, Endianness.Uint32(archive.Bytes()[entry.LocalHeaderOffset:]))
+
+		reader := index.NewEntryReader(archiveReader, entryIndex)
+		data, err := io.ReadAll(reader)
+		wtest.Must(t, err)
+		assert.Equal(t, f.data, data)
+	}
+
+	bigIndex, _ := index.EntryIndex("big")
+	assert.True(t, len(index.RestartPoints[bigIndex]) > 4, "big entry should have several restart points")
+
+	t.Logf("Reading random blocks")
+	for _, name := range []string{"big", "dir/stored"} {
+		var data []byte
+		for _, f := range files {
+			if f.name == name {
+				data = f.data
+			}
+		}
+
+		entryIndex, _ := index.EntryIndex(name)
+		reader := index.NewEntryReader(archiveReader, entryIndex)
+
+		for i := 0; i < 32; i++ {
+			offset := rng.Int63n(int64(len(data)))
+			size := BlockSize
+			if offset+size > int64(len(data)) {
+				size = int64(len(data)) - offset
+			}
+
+			_, err := reader.Seek(offset, io.SeekStart)
+			wtest.Must(t, err)
+
+			block := make([]byte, size)
+			_, err = io.ReadFull(reader, block)
+			wtest.Must(t, err)
+			assert.Equal(t, data[offset:offset+size], block)
+		}
+		wtest.Must(t, reader.Close())
+	}
+
+	t.Logf("Using the index as a pool")
+	container, err := tlc.WalkZip(zr, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	pool := NewZipIndexPool(container, index, archiveReader)
+	for fileIndex, file := range container.Files {
+		var expected []byte
+		for _, f := range files {
+			if f.name == file.Path {
+				expected = f.data
+			}
+		}
+
+		reader, err := pool.GetReader(int64(fileIndex))
+		wtest.Must(t, err)
+		data, err := io.ReadAll(reader)
+		wtest.Must(t, err)
+		assert.Equal(t, expected, data)
+	}
+	wtest.Must(t, pool.Close())
+
+	_, err = ReadZipIndex(seeksource.FromBytes([]byte{1, 2, 3, 4}))
+	assert.Error(t, err)
+}
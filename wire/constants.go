@@ -1,9 +1,15 @@
 package wire
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
 
 // Endianness is the byte order of everything in wharf's wire format
 var Endianness = binary.LittleEndian
 
 // DebugWire controls debug printouts of wharf's wire format
 const DebugWire = false
+
+// checksums are CRC32C of a message's length prefix and contents
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
@@ -3,6 +3,7 @@ package wire
 import (
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"reflect"
 
@@ -16,6 +17,22 @@ var (
 	ErrFormat = fmt.Errorf("wrong magic (invalid input file)")
 )
 
+// ErrCorruptedMessage is returned by ReadMessage when a message doesn't
+// match its checksum
+type ErrCorruptedMessage struct {
+	// Offset is where the message starts, in bytes read by the ReadContext
+	Offset int64
+
+	Expected uint32
+	Actual   uint32
+}
+
+var _ error = (*ErrCorruptedMessage)(nil)
+
+func (e *ErrCorruptedMessage) Error() string {
+	return fmt.Sprintf("corrupted message at offset %d: expected checksum %08x, got %08x", e.Offset, e.Expected, e.Actual)
+}
+
 // ReadContext holds state of a wharf wire format reader
 type ReadContext struct {
 	source savior.Source
@@ -24,6 +41,8 @@ type ReadContext struct {
 	offset         int64
 
 	protoBuffer *proto.Buffer
+	checksums   bool
+	varintBuf   []byte
 
 	saveState               saveState
 	sourceCheckpoint        *savior.SourceCheckpoint
@@ -48,6 +67,7 @@ func NewReadContext(source savior.Source) *ReadContext {
 		offset: 0,
 
 		protoBuffer: proto.NewBuffer(make([]byte, 32*1024)),
+		varintBuf:   make([]byte, binary.MaxVarintLen64),
 	}
 	r.countingReader = &countingReader{r}
 
@@ -71,6 +91,17 @@ func (r *ReadContext) GetSource() savior.Source {
 	return r.source
 }
 
+// SetChecksums controls whether messages read from now on are expected to
+// be followed by a checksum, as written by a WriteContext with checksums on
+func (r *ReadContext) SetChecksums(checksums bool) {
+	r.checksums = checksums
+}
+
+// Offset returns how many bytes have been read from the source so far
+func (r *ReadContext) Offset() int64 {
+	return r.offset
+}
+
 func (r *ReadContext) Resume(checkpoint *MessageReaderCheckpoint) error {
 	r.saveState = saveStateIdle
 	r.sourceCheckpoint = nil
@@ -161,6 +192,7 @@ func (r *ReadContext) ExpectMagic(magic int32) error {
 // ReadMessage deserializes a protobuf message from the underlying reader
 func (r *ReadContext) ReadMessage(msg proto.Message) error {
 	savior.Debugf("wire.ReadContext: Reading message at %d", r.offset)
+	startOffset := r.offset
 
 	length, err := binary.ReadUvarint(r.countingReader)
 	if err != nil {
@@ -178,6 +210,24 @@ func (r *ReadContext) ReadMessage(msg proto.Message) error {
 	}
 	r.protoBuffer.SetBuf(msgBuf[:length])
 
+	if r.checksums {
+		var expected uint32
+		err = binary.Read(r.countingReader, Endianness, &expected)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		vibuflen := binary.PutUvarint(r.varintBuf, length)
+		actual := crc32.Update(crc32.Checksum(r.varintBuf[:vibuflen], castagnoliTable), castagnoliTable, msgBuf[:length])
+		if actual != expected {
+			return errors.WithStack(&ErrCorruptedMessage{
+				Offset:   startOffset,
+				Expected: expected,
+				Actual:   actual,
+			})
+		}
+	}
+
 	msg.Reset()
 
 	err = r.protoBuffer.Unmarshal(msg)
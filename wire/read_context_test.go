@@ -14,6 +14,7 @@ import (
 	"github.com/itchio/savior/seeksource"
 
 	"github.com/itchio/wharf/wire"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -135,3 +136,58 @@ func must(t *testing.T, err error) {
 		t.FailNow()
 	}
 }
+
+func Test_Checksums(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := wire.NewWriteContext(buf)
+	must(t, w.WriteMagic(magic))
+	w.SetChecksums(true)
+
+	var offsets []int64
+	for i := 0; i < 4; i++ {
+		offsets = append(offsets, int64(buf.Len()))
+		must(t, w.WriteMessage(&wire.Sample{
+			Data:   bytes.Repeat([]byte{byte(i)}, 128),
+			Number: int64(i),
+		}))
+	}
+
+	read := func(data []byte) ([]*wire.Sample, error) {
+		source := seeksource.FromBytes(data)
+		_, err := source.Resume(nil)
+		must(t, err)
+
+		r := wire.NewReadContext(source)
+		must(t, r.ExpectMagic(magic))
+		r.SetChecksums(true)
+
+		var samples []*wire.Sample
+		for i := 0; i < 4; i++ {
+			sample := &wire.Sample{}
+			err := r.ReadMessage(sample)
+			if err != nil {
+				return samples, err
+			}
+			samples = append(samples, sample)
+		}
+		return samples, nil
+	}
+
+	samples, err := read(buf.Bytes())
+	must(t, err)
+	assert.Len(t, samples, 4)
+	assert.EqualValues(t, 3, samples[3].Number)
+
+	// flip a bit in the third message
+	corrupted := append([]byte(nil), buf.Bytes()...)
+	corrupted[offsets[2]+10] ^= 0x4
+
+	samples, err = read(corrupted)
+	assert.Len(t, samples, 2)
+	cErr, ok := errors.Cause(err).(*wire.ErrCorruptedMessage)
+	assert.True(t, ok, "should be a corruption error, got %+v", err)
+	if ok {
+		// offsets are counted from where the ReadContext starts, magic included
+		assert.Equal(t, offsets[2], cErr.Offset)
+	}
+}
@@ -3,6 +3,7 @@ package wire
 import (
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"reflect"
 
@@ -15,11 +16,21 @@ type WriteContext struct {
 	writer io.Writer
 
 	varintBuffer []byte
+	checksums    bool
 }
 
 // NewWriteContext builds a new WriteContext that writes to a given writer
 func NewWriteContext(writer io.Writer) *WriteContext {
-	return &WriteContext{writer, make([]byte, 8)}
+	return &WriteContext{
+		writer:       writer,
+		varintBuffer: make([]byte, binary.MaxVarintLen64),
+	}
+}
+
+// SetChecksums controls whether messages written from now on are followed
+// by a checksum. Readers must know to expect them, see ReadContext.SetChecksums
+func (w *WriteContext) SetChecksums(checksums bool) {
+	w.checksums = checksums
 }
 
 // Writer returns writer a WriteContext writes to
@@ -69,5 +80,13 @@ func (w *WriteContext) WriteMessage(msg proto.Message) error {
 		return errors.WithStack(err)
 	}
 
+	if w.checksums {
+		crc := crc32.Update(crc32.Checksum(w.varintBuffer[:vibuflen], castagnoliTable), castagnoliTable, buf)
+		err = binary.Write(w.writer, Endianness, crc)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
 	return nil
 }
@@ -19,6 +19,7 @@ package wsync
 
 import (
 	"crypto/md5"
+	"hash"
 	"io"
 	"os"
 
@@ -34,9 +35,15 @@ const MaxDataOp = (4 * 1024 * 1024)
 // It uses MD5 as a 'strong hash' (in the sense of an RSync paper,
 // and compared to the very weak rolling hash)
 func NewContext(BlockSize int) *Context {
+	return NewContextWithHasher(BlockSize, md5.New())
+}
+
+// NewContextWithHasher creates a new Context that uses the given 'strong hash'
+// instead of MD5. Signatures must be created and looked up with the same one.
+func NewContextWithHasher(BlockSize int, hasher hash.Hash) *Context {
 	return &Context{
 		blockSize:    BlockSize,
-		uniqueHasher: md5.New(),
+		uniqueHasher: hasher,
 	}
 }
 
@@ -120,6 +127,38 @@ func (ctx *Context) ApplySingleFull(output io.Writer, pool lake.Pool, op Operati
 			io.CopyBuffer(output, io.LimitReader(&devNullReader{}, remaining), buffer)
 			return nil
 		}
+	case OpByteRange:
+		target, err := pool.GetReadSeeker(op.FileIndex)
+		if err != nil {
+			if failFast {
+				return errors.WithStack(err)
+			}
+			io.CopyBuffer(output, io.LimitReader(&devNullReader{}, op.Size), buffer)
+			return nil
+		}
+
+		_, err = target.Seek(op.Offset, io.SeekStart)
+		if err != nil {
+			if failFast {
+				return errors.WithStack(err)
+			}
+			io.CopyBuffer(output, io.LimitReader(&devNullReader{}, op.Size), buffer)
+			return nil
+		}
+
+		copied, err := io.CopyBuffer(output, io.LimitReader(target, op.Size), buffer)
+		if err == nil && copied < op.Size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			if failFast {
+				return errors.Wrapf(err, "While copying %d bytes", op.Size)
+			}
+
+			remaining := op.Size - copied
+			io.CopyBuffer(output, io.LimitReader(&devNullReader{}, remaining), buffer)
+			return nil
+		}
 	case OpData:
 		_, err := output.Write(op.Data)
 		if err != nil {
@@ -281,7 +320,7 @@ func (ctx *Context) ComputeDiff(source io.Reader, library *BlockLibrary, ops Ope
 
 		if !skip {
 			// Determine if there is a hash match.
-			if hh, ok := library.hashLookup[β]; ok {
+			if hh := library.lookup(β); len(hh) > 0 {
 				blockHash = ctx.findUniqueHash(hh, buffer[sum.tail:sum.head], shortSize, preferredFileIndex)
 			}
 		}
@@ -0,0 +1,345 @@
+package wsync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// A block index is an on-disk BlockLibrary: block hashes sorted by weak hash,
+// so they can be looked up without loading them all in memory.
+//
+// Layout (little-endian):
+//
+//	header: magic uint32, version uint32, strongHashSize uint32,
+//	        strongHash uint32, blockSize uint64, numRecords uint64
+//	records: numRecords times weakHash uint32, shortSize int32,
+//	         fileIndex int64, blockIndex int64, strongHash [strongHashSize]byte
+//	fanout: 65537 times uint64, the index of the first record whose
+//	        weak hash's top 16 bits are >= i
+//
+// Records with the same weak hash are in signature order, so lookups
+// return the same buckets as NewBlockLibrary's map.
+
+const (
+	blockIndexMagic   uint32 = 0x49425357 // "WSBI"
+	blockIndexVersion uint32 = 2
+
+	blockIndexHeaderSize    = 32
+	blockIndexRecordPrefix  = 24
+	blockIndexFanoutEntries = 1<<16 + 1
+	blockIndexFanoutSize    = blockIndexFanoutEntries * 8
+)
+
+var blockIndexEndianness = binary.LittleEndian
+
+// A BlockIndexWriter writes block hashes to an index file, which can
+// later be opened with OpenBlockLibrary. Hashes must be written in
+// signature order, and all strong hashes must have the same size.
+type BlockIndexWriter struct {
+	// BlockSize and StrongHash are what the hashes were computed with,
+	// and are recorded in the index so users can check they're diffing
+	// with the same settings. StrongHash is opaque to wsync. Both must
+	// be set before calling Close.
+	BlockSize  int64
+	StrongHash int32
+
+	file *os.File
+	bw   *bufio.Writer
+
+	strongHashSize int
+	numRecords     int64
+	record         []byte
+}
+
+// NewBlockIndexWriter creates (or truncates) an index file at path
+func NewBlockIndexWriter(path string) (*BlockIndexWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	biw := &BlockIndexWriter{
+		file:           file,
+		bw:             bufio.NewWriter(file),
+		strongHashSize: -1,
+	}
+
+	// the real header is written on Close
+	_, err = biw.bw.Write(make([]byte, blockIndexHeaderSize))
+	if err != nil {
+		file.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	return biw, nil
+}
+
+// Write adds a block hash to the index. It can be used as a SignatureWriter.
+func (biw *BlockIndexWriter) Write(bh BlockHash) error {
+	if biw.strongHashSize == -1 {
+		biw.strongHashSize = len(bh.StrongHash)
+		biw.record = make([]byte, blockIndexRecordPrefix+biw.strongHashSize)
+	}
+
+	if len(bh.StrongHash) != biw.strongHashSize {
+		return errors.Errorf("block index: strong hash of block %d of file %d is %d bytes, expected %d",
+			bh.BlockIndex, bh.FileIndex, len(bh.StrongHash), biw.strongHashSize)
+	}
+
+	r := biw.record
+	blockIndexEndianness.PutUint32(r[0:], bh.WeakHash)
+	blockIndexEndianness.PutUint32(r[4:], uint32(bh.ShortSize))
+	blockIndexEndianness.PutUint64(r[8:], uint64(bh.FileIndex))
+	blockIndexEndianness.PutUint64(r[16:], uint64(bh.BlockIndex))
+	copy(r[blockIndexRecordPrefix:], bh.StrongHash)
+
+	_, err := biw.bw.Write(r)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	biw.numRecords++
+	return nil
+}
+
+// Close sorts the index and finishes writing it. The writer
+// can't be used afterwards.
+func (biw *BlockIndexWriter) Close() (err error) {
+	defer func() {
+		cErr := biw.file.Close()
+		if cErr != nil && err == nil {
+			err = errors.WithStack(cErr)
+		}
+	}()
+
+	err = biw.bw.Flush()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if biw.strongHashSize == -1 {
+		biw.strongHashSize = 0
+	}
+	recordSize := blockIndexRecordPrefix + biw.strongHashSize
+	recordsEnd := blockIndexHeaderSize + int(biw.numRecords)*recordSize
+
+	data, unmap, err := mapFile(biw.file, recordsEnd, true)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	sorter := &recordSorter{
+		records:    data[blockIndexHeaderSize:recordsEnd],
+		recordSize: recordSize,
+		tmp:        make([]byte, recordSize),
+	}
+	sort.Sort(sorter)
+
+	fanout := make([]byte, blockIndexFanoutSize)
+	var recordIndex int64
+	for bucket := 0; bucket < blockIndexFanoutEntries; bucket++ {
+		for recordIndex < biw.numRecords && int(sorter.weakHash(int(recordIndex))>>16) < bucket {
+			recordIndex++
+		}
+		blockIndexEndianness.PutUint64(fanout[bucket*8:], uint64(recordIndex))
+	}
+
+	err = unmap()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	header := make([]byte, blockIndexHeaderSize)
+	blockIndexEndianness.PutUint32(header[0:], blockIndexMagic)
+	blockIndexEndianness.PutUint32(header[4:], blockIndexVersion)
+	blockIndexEndianness.PutUint32(header[8:], uint32(biw.strongHashSize))
+	blockIndexEndianness.PutUint32(header[12:], uint32(biw.StrongHash))
+	blockIndexEndianness.PutUint64(header[16:], uint64(biw.BlockSize))
+	blockIndexEndianness.PutUint64(header[24:], uint64(biw.numRecords))
+
+	_, err = biw.file.WriteAt(header, 0)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = biw.file.WriteAt(fanout, int64(recordsEnd))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// recordSorter sorts index records by weak hash, then by file index and
+// block index, which is signature order.
+type recordSorter struct {
+	records    []byte
+	recordSize int
+	tmp        []byte
+}
+
+func (rs *recordSorter) Len() int {
+	return len(rs.records) / rs.recordSize
+}
+
+func (rs *recordSorter) record(i int) []byte {
+	return rs.records[i*rs.recordSize : (i+1)*rs.recordSize]
+}
+
+func (rs *recordSorter) weakHash(i int) uint32 {
+	return blockIndexEndianness.Uint32(rs.record(i))
+}
+
+func (rs *recordSorter) Less(i, j int) bool {
+	a, b := rs.record(i), rs.record(j)
+
+	aw, bw := blockIndexEndianness.Uint32(a[0:]), blockIndexEndianness.Uint32(b[0:])
+	if aw != bw {
+		return aw < bw
+	}
+
+	af, bf := int64(blockIndexEndianness.Uint64(a[8:])), int64(blockIndexEndianness.Uint64(b[8:]))
+	if af != bf {
+		return af < bf
+	}
+
+	return int64(blockIndexEndianness.Uint64(a[16:])) < int64(blockIndexEndianness.Uint64(b[16:]))
+}
+
+func (rs *recordSorter) Swap(i, j int) {
+	a, b := rs.record(i), rs.record(j)
+	copy(rs.tmp, a)
+	copy(a, b)
+	copy(b, rs.tmp)
+}
+
+// blockIndex gives read access to an index file
+type blockIndex struct {
+	file  *os.File
+	unmap func() error
+
+	strongHashSize int
+	strongHash     int32
+	blockSize      int64
+	recordSize     int
+	numRecords     int64
+
+	records []byte
+	fanout  []byte
+}
+
+// OpenBlockLibrary returns a BlockLibrary backed by an index file written
+// by a BlockIndexWriter. The index is memory-mapped where possible, instead of
+// being loaded in memory. The library must be closed when no longer needed.
+func OpenBlockLibrary(path string) (*BlockLibrary, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	bi, err := openBlockIndex(file)
+	if err != nil {
+		file.Close()
+		return nil, errors.WithMessagef(err, "while opening block index %s", path)
+	}
+
+	return &BlockLibrary{index: bi}, nil
+}
+
+func openBlockIndex(file *os.File) (*blockIndex, error) {
+	stats, err := file.Stat()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	header := make([]byte, blockIndexHeaderSize)
+	_, err = file.ReadAt(header, 0)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if blockIndexEndianness.Uint32(header[0:]) != blockIndexMagic {
+		return nil, errors.New("not a block index (wrong magic)")
+	}
+	if version := blockIndexEndianness.Uint32(header[4:]); version != blockIndexVersion {
+		return nil, errors.Errorf("unsupported block index version %d", version)
+	}
+
+	bi := &blockIndex{
+		file:           file,
+		strongHashSize: int(blockIndexEndianness.Uint32(header[8:])),
+		strongHash:     int32(blockIndexEndianness.Uint32(header[12:])),
+		blockSize:      int64(blockIndexEndianness.Uint64(header[16:])),
+		numRecords:     int64(blockIndexEndianness.Uint64(header[24:])),
+	}
+	bi.recordSize = blockIndexRecordPrefix + bi.strongHashSize
+
+	recordsEnd := int64(blockIndexHeaderSize) + bi.numRecords*int64(bi.recordSize)
+	expectedSize := recordsEnd + blockIndexFanoutSize
+	if stats.Size() != expectedSize {
+		return nil, errors.Errorf("block index should be %d bytes, but it's %d", expectedSize, stats.Size())
+	}
+
+	data, unmap, err := mapFile(file, int(expectedSize), false)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	bi.unmap = unmap
+	bi.records = data[blockIndexHeaderSize:recordsEnd]
+	bi.fanout = data[recordsEnd:]
+
+	if bi.fanoutAt(blockIndexFanoutEntries-1) != bi.numRecords {
+		bi.close()
+		return nil, errors.New("corrupted block index (invalid fanout)")
+	}
+
+	return bi, nil
+}
+
+func (bi *blockIndex) fanoutAt(bucket int) int64 {
+	return int64(blockIndexEndianness.Uint64(bi.fanout[bucket*8:]))
+}
+
+func (bi *blockIndex) weakHash(i int64) uint32 {
+	return blockIndexEndianness.Uint32(bi.records[i*int64(bi.recordSize):])
+}
+
+// lookup returns all block hashes with the given weak hash, in signature order
+func (bi *blockIndex) lookup(weakHash uint32) []BlockHash {
+	lo := bi.fanoutAt(int(weakHash >> 16))
+	hi := bi.fanoutAt(int(weakHash>>16) + 1)
+
+	i := lo + int64(sort.Search(int(hi-lo), func(k int) bool {
+		return bi.weakHash(lo+int64(k)) >= weakHash
+	}))
+
+	var hh []BlockHash
+	for ; i < hi && bi.weakHash(i) == weakHash; i++ {
+		r := bi.records[i*int64(bi.recordSize) : (i+1)*int64(bi.recordSize)]
+		hh = append(hh, BlockHash{
+			WeakHash:   weakHash,
+			ShortSize:  int32(blockIndexEndianness.Uint32(r[4:])),
+			FileIndex:  int64(blockIndexEndianness.Uint64(r[8:])),
+			BlockIndex: int64(blockIndexEndianness.Uint64(r[16:])),
+			StrongHash: bytes.Clone(r[blockIndexRecordPrefix:]),
+		})
+	}
+	return hh
+}
+
+func (bi *blockIndex) close() error {
+	err := bi.unmap()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = bi.file.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
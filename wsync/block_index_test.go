@@ -0,0 +1,108 @@
+package wsync
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_BlockIndex(t *testing.T) {
+	dir, err := os.MkdirTemp("", "blockindex")
+	must(t, err)
+	defer os.RemoveAll(dir)
+
+	const blockSize = 4 * 1024
+	rs := NewContext(blockSize)
+
+	// a few files, some of them sharing blocks so buckets have several entries
+	var files [][]byte
+	for _, c := range []content{
+		{Len: 64*blockSize + 89, Seed: 42},
+		{Len: 32*blockSize + 19, Seed: 42, Alter: 5},
+		{Len: 0, Seed: 1},
+		{Len: 12, Seed: 7},
+		{Len: 64 * blockSize, Seed: 9824},
+	} {
+		(&c).Fill(t)
+		files = append(files, c.Data)
+	}
+
+	indexPath := filepath.Join(dir, "sig.idx")
+	biw, err := NewBlockIndexWriter(indexPath)
+	must(t, err)
+	biw.BlockSize = blockSize
+	biw.StrongHash = 3
+
+	var sig []BlockHash
+	for fileIndex, data := range files {
+		err := rs.CreateSignature(context.Background(), int64(fileIndex), bytes.NewReader(data), func(bh BlockHash) error {
+			sig = append(sig, bh)
+			return biw.Write(bh)
+		})
+		must(t, err)
+	}
+	must(t, biw.Close())
+
+	memLib := NewBlockLibrary(sig)
+	diskLib, err := OpenBlockLibrary(indexPath)
+	must(t, err)
+	defer diskLib.Close()
+
+	if diskLib.BlockSize() != blockSize || diskLib.StrongHash() != 3 {
+		t.Errorf("index should record block size %d and strong hash 3, got %d and %d", blockSize, diskLib.BlockSize(), diskLib.StrongHash())
+	}
+
+	for weakHash, hh := range memLib.hashLookup {
+		if !reflect.DeepEqual(hh, diskLib.lookup(weakHash)) {
+			t.Fatalf("lookup(%x) differs between in-memory and on-disk libraries", weakHash)
+		}
+	}
+	for _, weakHash := range []uint32{0, 1, 0xffffffff, 0x12345678} {
+		if _, ok := memLib.hashLookup[weakHash]; !ok && len(diskLib.lookup(weakHash)) != 0 {
+			t.Errorf("lookup(%x) should be empty", weakHash)
+		}
+	}
+
+	// diffs must be identical
+	source := append(append([]byte{}, files[1][:5000]...), files[4]...)
+	diff := func(lib *BlockLibrary) []Operation {
+		var ops []Operation
+		err := NewContext(blockSize).ComputeDiff(bytes.NewReader(source), lib, func(op Operation) error {
+			op.Data = append([]byte{}, op.Data...)
+			ops = append(ops, op)
+			return nil
+		}, 4)
+		must(t, err)
+		return ops
+	}
+	if !reflect.DeepEqual(diff(memLib), diff(diskLib)) {
+		t.Errorf("diffs differ between in-memory and on-disk libraries")
+	}
+
+	// empty indexes work too
+	emptyPath := filepath.Join(dir, "empty.idx")
+	biw, err = NewBlockIndexWriter(emptyPath)
+	must(t, err)
+	must(t, biw.Close())
+
+	emptyLib, err := OpenBlockLibrary(emptyPath)
+	must(t, err)
+	if len(emptyLib.lookup(sig[0].WeakHash)) != 0 {
+		t.Errorf("empty library should have no hashes")
+	}
+	must(t, emptyLib.Close())
+
+	// truncated ones don't
+	data, err := os.ReadFile(indexPath)
+	must(t, err)
+	badPath := filepath.Join(dir, "bad.idx")
+	must(t, os.WriteFile(badPath, data[:len(data)-1], 0644))
+	_, err = OpenBlockLibrary(badPath)
+	if err == nil {
+		t.Errorf("opening a truncated index should fail")
+	}
+
+}
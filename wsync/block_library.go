@@ -15,5 +15,41 @@ func NewBlockLibrary(hashes []BlockHash) *BlockLibrary {
 		}
 	}
 
-	return &BlockLibrary{hashLookup}
+	return &BlockLibrary{hashLookup: hashLookup}
+}
+
+// lookup returns all block hashes with the given weak hash,
+// in the order they were added.
+func (bl *BlockLibrary) lookup(weakHash uint32) []BlockHash {
+	if bl.index != nil {
+		return bl.index.lookup(weakHash)
+	}
+	return bl.hashLookup[weakHash]
+}
+
+// BlockSize returns the block size recorded in the index of a library
+// returned by OpenBlockLibrary, or 0 for in-memory libraries.
+func (bl *BlockLibrary) BlockSize() int64 {
+	if bl.index != nil {
+		return bl.index.blockSize
+	}
+	return 0
+}
+
+// StrongHash returns the strong hash identifier recorded in the index of
+// a library returned by OpenBlockLibrary, or 0 for in-memory libraries.
+func (bl *BlockLibrary) StrongHash() int32 {
+	if bl.index != nil {
+		return bl.index.strongHash
+	}
+	return 0
+}
+
+// Close releases the resources held by libraries returned by
+// OpenBlockLibrary. It does nothing for in-memory libraries.
+func (bl *BlockLibrary) Close() error {
+	if bl.index != nil {
+		return bl.index.close()
+	}
+	return nil
 }
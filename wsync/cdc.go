@@ -0,0 +1,310 @@
+package wsync
+
+import (
+	"context"
+	"io"
+	"math/bits"
+
+	"github.com/itchio/wharf/werrors"
+	"github.com/pkg/errors"
+)
+
+// Content-defined chunking, after "FastCDC: a Fast and Efficient
+// Content-Defined Chunking Approach for Data Deduplication" (Xia et al.)
+//
+// Unlike fixed blocks, chunk boundaries only depend on the bytes right
+// before them, so inserting or removing data only changes the chunks
+// around the edit, instead of shifting every block after it.
+
+// ChunkHash is a signature hash item for a content-defined chunk of target.
+type ChunkHash struct {
+	FileIndex int64
+	Offset    int64
+	Size      int64
+
+	StrongHash []byte
+}
+
+// A ChunkSignatureWriter consumes chunk hashes and does whatever it wants with them
+type ChunkSignatureWriter func(hash ChunkHash) error
+
+type chunkKey struct {
+	size       int64
+	strongHash string
+}
+
+// A ChunkLibrary contains a collection of chunk hashes, indexed by
+// size and strong hash for fast lookup.
+type ChunkLibrary struct {
+	hashLookup map[chunkKey][]ChunkHash
+}
+
+// NewChunkLibrary returns a new chunk library containing
+// all the given hashes, for fast lookup later.
+func NewChunkLibrary(hashes []ChunkHash) *ChunkLibrary {
+	hashLookup := make(map[chunkKey][]ChunkHash)
+
+	for _, hash := range hashes {
+		key := chunkKey{hash.Size, string(hash.StrongHash)}
+		hashLookup[key] = append(hashLookup[key], hash)
+	}
+
+	return &ChunkLibrary{hashLookup}
+}
+
+// find returns a chunk with the given size and strong hash, preferably
+// from preferredFileIndex, or nil if there's none.
+func (cl *ChunkLibrary) find(size int64, strongHash []byte, preferredFileIndex int64) *ChunkHash {
+	hh := cl.hashLookup[chunkKey{size, string(strongHash)}]
+	if len(hh) == 0 {
+		return nil
+	}
+
+	for i := range hh {
+		if hh[i].FileIndex == preferredFileIndex {
+			return &hh[i]
+		}
+	}
+	return &hh[0]
+}
+
+// gear maps bytes to random-looking values for the rolling fingerprint.
+// It's part of the signature format: changing it changes chunk boundaries.
+var gear = makeGearTable()
+
+func makeGearTable() [256]uint64 {
+	var table [256]uint64
+
+	// splitmix64, with a fixed seed
+	state := uint64(0x7768617266636463) // "wharfcdc"
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}
+
+type chunker struct {
+	minSize int
+	avgSize int
+	maxSize int
+
+	// maskS is used before avgSize (harder to match), maskL after (easier)
+	maskS uint64
+	maskL uint64
+}
+
+func newChunker(avgSize int) *chunker {
+	numBits := bits.Len(uint(avgSize)) - 1
+	if numBits < 3 {
+		numBits = 3
+	}
+
+	// the fingerprint's high bits depend on the most bytes
+	topBits := func(n int) uint64 {
+		return ^uint64(0) << (64 - n)
+	}
+
+	return &chunker{
+		minSize: avgSize / 4,
+		avgSize: avgSize,
+		maxSize: avgSize * 4,
+		maskS:   topBits(numBits + 2),
+		maskL:   topBits(numBits - 2),
+	}
+}
+
+// cut returns the size of the first chunk of data. data must
+// be at least maxSize long unless it's the end of the file.
+func (c *chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.minSize {
+		return n
+	}
+	if n > c.maxSize {
+		n = c.maxSize
+	}
+
+	normalSize := c.avgSize
+	if normalSize > n {
+		normalSize = n
+	}
+
+	var fp uint64
+	i := c.minSize
+	for ; i < normalSize; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// splitChunks reads source until EOF, and calls onChunk for each of its
+// content-defined chunks. The chunk's data is only valid during the call.
+func (ctx *Context) splitChunks(cctx context.Context, source io.Reader, onChunk func(chunk []byte) error) error {
+	c := newChunker(ctx.blockSize)
+
+	minBufferSize := c.maxSize * 2
+	if len(ctx.buffer) < minBufferSize {
+		ctx.buffer = make([]byte, minBufferSize)
+	}
+	buffer := ctx.buffer
+
+	var head, validTo int
+	eof := false
+	cancelCounter := 0
+
+	for {
+		if !eof && validTo-head < c.maxSize {
+			// make room for a full chunk
+			if validTo+c.maxSize > len(buffer) {
+				copy(buffer, buffer[head:validTo])
+				validTo -= head
+				head = 0
+			}
+
+			n, err := io.ReadFull(source, buffer[validTo:validTo+c.maxSize])
+			validTo += n
+			if err != nil {
+				if errors.Cause(err) != io.EOF && errors.Cause(err) != io.ErrUnexpectedEOF {
+					return errors.WithStack(err)
+				}
+				eof = true
+			}
+			continue
+		}
+
+		if head == validTo {
+			return nil
+		}
+
+		size := c.cut(buffer[head:validTo])
+		err := onChunk(buffer[head : head+size])
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		head += size
+
+		cancelCounter++
+		if cancelCounter > 128 {
+			cancelCounter = 0
+			select {
+			case <-cctx.Done():
+				return werrors.ErrCancelled
+			default:
+				// keep going
+			}
+		}
+	}
+}
+
+// CreateChunkSignature calculates the content-defined chunk signature of target.
+// Chunks average the context's block size. Empty files have no chunks.
+func (ctx *Context) CreateChunkSignature(cctx context.Context, fileIndex int64, fileReader io.Reader, writeHash ChunkSignatureWriter) error {
+	offset := int64(0)
+
+	return ctx.splitChunks(cctx, fileReader, func(chunk []byte) error {
+		err := writeHash(ChunkHash{
+			FileIndex:  fileIndex,
+			Offset:     offset,
+			Size:       int64(len(chunk)),
+			StrongHash: ctx.uniqueHash(chunk),
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		offset += int64(len(chunk))
+		return nil
+	})
+}
+
+// ComputeChunkDiff is a variant of ComputeDiff that splits source into
+// content-defined chunks and looks them up in a chunk library. Re-used
+// chunks are sent as OpByteRange operations.
+func (ctx *Context) ComputeChunkDiff(cctx context.Context, source io.Reader, library *ChunkLibrary, ops OperationWriter, preferredFileIndex int64) (err error) {
+	sendCount := 0
+	send := func(op Operation) error {
+		sendCount++
+		return ops(op)
+	}
+
+	// Store the previous byte range for combining.
+	var prevOp *Operation
+
+	flush := func() error {
+		if prevOp != nil {
+			err := send(*prevOp)
+			prevOp = nil
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		return nil
+	}
+
+	err = ctx.splitChunks(cctx, source, func(chunk []byte) error {
+		ch := library.find(int64(len(chunk)), ctx.uniqueHash(chunk), preferredFileIndex)
+
+		if ch != nil {
+			if prevOp != nil && prevOp.FileIndex == ch.FileIndex && prevOp.Offset+prevOp.Size == ch.Offset {
+				// combine [prevOp][chunk] into [ prevOp ]
+				prevOp.Size += ch.Size
+				return nil
+			}
+
+			err := flush()
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			prevOp = &Operation{Type: OpByteRange, FileIndex: ch.FileIndex, Offset: ch.Offset, Size: ch.Size}
+			return nil
+		}
+
+		err := flush()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		for len(chunk) > 0 {
+			data := chunk
+			if len(data) > MaxDataOp {
+				data = data[:MaxDataOp]
+			}
+			err = send(Operation{Type: OpData, Data: data})
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			chunk = chunk[len(data):]
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = flush()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if sendCount == 0 {
+		// like ComputeDiff, empty files get a single empty data op
+		err = send(Operation{Type: OpData})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
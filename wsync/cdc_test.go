@@ -0,0 +1,84 @@
+package wsync
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func Test_ChunkDiff(t *testing.T) {
+	const blockSize = 8 * 1024
+
+	target := content{Len: 64*blockSize + 89, Seed: 42}
+	(&target).Fill(t)
+
+	// insert a single byte early on, and change a few bytes later
+	source := append([]byte{}, target.Data[:1000]...)
+	source = append(source, 0x42)
+	source = append(source, target.Data[1000:]...)
+	source[40*blockSize] ^= 0xff
+
+	rs := NewContext(blockSize)
+
+	var sig []ChunkHash
+	var offset int64
+	err := rs.CreateChunkSignature(context.Background(), 0, bytes.NewReader(target.Data), func(ch ChunkHash) error {
+		if ch.Offset != offset {
+			t.Errorf("expected chunk at %d, got %d", offset, ch.Offset)
+		}
+		if ch.Size > 4*blockSize {
+			t.Errorf("chunk too large: %d", ch.Size)
+		}
+		offset += ch.Size
+		sig = append(sig, ch)
+		return nil
+	})
+	must(t, err)
+	if offset != int64(len(target.Data)) {
+		t.Fatalf("chunks cover %d bytes, expected %d", offset, len(target.Data))
+	}
+	lib := NewChunkLibrary(sig)
+
+	var ops []Operation
+	var reused, fresh int64
+	err = rs.ComputeChunkDiff(context.Background(), bytes.NewReader(source), lib, func(op Operation) error {
+		switch op.Type {
+		case OpByteRange:
+			reused += op.Size
+		case OpData:
+			op.Data = append([]byte{}, op.Data...)
+			fresh += int64(len(op.Data))
+		default:
+			t.Errorf("unexpected op type %d", op.Type)
+		}
+		ops = append(ops, op)
+		return nil
+	}, 0)
+	must(t, err)
+	t.Logf("Reused %d bytes, %d fresh bytes, %d ops", reused, fresh, len(ops))
+
+	if fresh > 8*4*blockSize {
+		t.Errorf("expected edits to only affect a few chunks, got %d fresh bytes", fresh)
+	}
+
+	result := new(bytes.Buffer)
+	pool := &SinglePool{reader: bytes.NewReader(target.Data), size: int64(len(target.Data))}
+	for _, op := range ops {
+		must(t, rs.ApplySingle(result, pool, op))
+	}
+
+	if !bytes.Equal(result.Bytes(), source) {
+		t.Errorf("Result is different from the source")
+	}
+
+	// empty files have no chunks, and a single empty data op
+	ops = nil
+	err = rs.ComputeChunkDiff(context.Background(), bytes.NewReader(nil), lib, func(op Operation) error {
+		ops = append(ops, op)
+		return nil
+	}, -1)
+	must(t, err)
+	if len(ops) != 1 || ops[0].Type != OpData || len(ops[0].Data) != 0 {
+		t.Errorf("expected a single empty data op, got %v", ops)
+	}
+}
@@ -0,0 +1,29 @@
+//go:build !unix
+
+package wsync
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// mapFile reads the first size bytes of file in memory, since we don't
+// mmap on this platform. Changes to writable mappings are written back
+// to the file once unmap is called.
+func mapFile(file *os.File, size int, writable bool) (data []byte, unmap func() error, err error) {
+	data = make([]byte, size)
+	_, err = file.ReadAt(data, 0)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	unmap = func() error {
+		if !writable {
+			return nil
+		}
+		_, err := file.WriteAt(data, 0)
+		return errors.WithStack(err)
+	}
+	return data, unmap, nil
+}
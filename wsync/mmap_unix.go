@@ -0,0 +1,33 @@
+//go:build unix
+
+package wsync
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// mapFile maps the first size bytes of file in memory. Changes to
+// writable mappings end up in the file once unmap is called.
+func mapFile(file *os.File, size int, writable bool) (data []byte, unmap func() error, err error) {
+	if size == 0 {
+		return nil, func() error { return nil }, nil
+	}
+
+	prot := syscall.PROT_READ
+	if writable {
+		prot |= syscall.PROT_WRITE
+	}
+
+	data, err = syscall.Mmap(int(file.Fd()), 0, size, prot, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	unmap = func() error {
+		return errors.WithStack(syscall.Munmap(data))
+	}
+	return data, unmap, nil
+}
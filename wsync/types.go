@@ -19,6 +19,10 @@ const (
 	// the file we're reconstructing, because we weren't able to re-use
 	// data from the old files set
 	OpData
+
+	// OpByteRange is like OpBlockRange, but addresses the old file in bytes
+	// instead of blocks. It's used for content-defined chunks.
+	OpByteRange
 )
 
 // Operation describes a step required to mutate target to align to source.
@@ -28,6 +32,10 @@ type Operation struct {
 	BlockIndex int64
 	BlockSpan  int64
 	Data       []byte
+
+	// Offset and Size are only used by OpByteRange
+	Offset int64
+	Size   int64
 }
 
 // An OperationWriter consumes sync operations and does whatever it wants with them
@@ -59,4 +67,7 @@ type Context struct {
 // by their weak-hashes for fast lookup.
 type BlockLibrary struct {
 	hashLookup map[uint32][]BlockHash
+
+	// set instead of hashLookup for on-disk libraries
+	index *blockIndex
 }